@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+)
+
+const AudioClipTypeID = 83
+
+// FMOD_SOUND_TYPE of the clip data, used before unity 5.0. Only the types unity can import are listed.
+type AudioType int32
+
+const (
+	AudioTypeUnknown   AudioType = 0
+	AudioTypeAIFF      AudioType = 2
+	AudioTypeIT        AudioType = 10
+	AudioTypeMOD       AudioType = 12
+	AudioTypeMPEG      AudioType = 13
+	AudioTypeOGGVorbis AudioType = 14
+	AudioTypeS3M       AudioType = 17
+	AudioTypeWAV       AudioType = 20
+	AudioTypeXM        AudioType = 21
+)
+
+var audioTypeExtensions = map[AudioType]string{
+	AudioTypeAIFF:      ".aif",
+	AudioTypeIT:        ".it",
+	AudioTypeMOD:       ".mod",
+	AudioTypeMPEG:      ".mp3",
+	AudioTypeOGGVorbis: ".ogg",
+	AudioTypeS3M:       ".s3m",
+	AudioTypeWAV:       ".wav",
+	AudioTypeXM:        ".xm",
+}
+
+func AudioTypeByExtension(ext string) (AudioType, bool) {
+	ext = strings.ToLower(ext)
+	for typ, e := range audioTypeExtensions {
+		if e == ext {
+			return typ, true
+		}
+	}
+	return AudioTypeUnknown, false
+}
+
+// Load types(m_Stream before 5.0, m_LoadType after).
+const (
+	AudioDecompressOnLoad   = 0
+	AudioCompressedInMemory = 1
+	AudioStreaming          = 2
+)
+
+// Codec of the FSB5 data since unity 5.0.
+type AudioCompressionFormat int32
+
+const (
+	AudioFormatPCM     AudioCompressionFormat = 0
+	AudioFormatVorbis  AudioCompressionFormat = 1
+	AudioFormatADPCM   AudioCompressionFormat = 2
+	AudioFormatMP3     AudioCompressionFormat = 3
+	AudioFormatVAG     AudioCompressionFormat = 4
+	AudioFormatHEVAG   AudioCompressionFormat = 5
+	AudioFormatXMA     AudioCompressionFormat = 6
+	AudioFormatAAC     AudioCompressionFormat = 7
+	AudioFormatGCADPCM AudioCompressionFormat = 8
+	AudioFormatATRAC9  AudioCompressionFormat = 9
+)
+
+var fsbCodecFormats = map[FSBCodec]AudioCompressionFormat{
+	FSBCodecPCM8:     AudioFormatPCM,
+	FSBCodecPCM16:    AudioFormatPCM,
+	FSBCodecPCM24:    AudioFormatPCM,
+	FSBCodecPCM32:    AudioFormatPCM,
+	FSBCodecPCMFloat: AudioFormatPCM,
+	FSBCodecVorbis:   AudioFormatVorbis,
+	FSBCodecIMAADPCM: AudioFormatADPCM,
+	FSBCodecFADPCM:   AudioFormatADPCM,
+	FSBCodecMPEG:     AudioFormatMP3,
+	FSBCodecVAG:      AudioFormatVAG,
+	FSBCodecHEVAG:    AudioFormatHEVAG,
+	FSBCodecXMA:      AudioFormatXMA,
+	FSBCodecGCADPCM:  AudioFormatGCADPCM,
+	FSBCodecAT9:      AudioFormatATRAC9,
+}
+
+// Layout of unity 3.2-4.x clips.
+// Streamed clips don't follow their type tree: data size is followed by the offset in .resS instead of the data,
+// so the layout is handled manually.
+type legacyAudioClip struct {
+	Name string
+	// FMOD_SOUND_FORMAT of the decoded sound, 2(PCM16) for all the shadowrun music
+	Format      int32
+	Type        AudioType
+	Is3D        bool
+	UseHardware bool
+	Padding     [2]uint8
+	// See load types above
+	Stream int32
+	Size   uint32
+}
+
+// Fields of AudioClip for both the legacy and 5.0+ layouts.
+type AudioClip struct {
+	Name string
+
+	// Unity 3.2-4.x
+	Format      int32     `json:",omitempty"`
+	Type        AudioType `json:",omitempty"`
+	Is3D        bool      `json:",omitempty"`
+	UseHardware bool      `json:",omitempty"`
+
+	// m_Stream before 5.0
+	LoadType int32
+
+	// Unity 5.0+, data is always FSB5 container
+	Channels          int32                  `json:",omitempty"`
+	Frequency         int32                  `json:",omitempty"`
+	BitsPerSample     int32                  `json:",omitempty"`
+	Length            float32                `json:",omitempty"`
+	CompressionFormat AudioCompressionFormat `json:",omitempty"`
+
+	// Empty if the data is streamed
+	Data     []byte `json:"-"`
+	Resource StreamInfo
+
+	// Decoded type tree value, nil for the legacy layout
+	value *Struct
+}
+
+// Default flags of the legacy clips, the same for all the shadowrun music.
+var defaultLegacyAudioClip = AudioClip{
+	Format:   2,
+	Type:     AudioTypeOGGVorbis,
+	LoadType: AudioStreaming,
+}
+
+func DecodeAudioClip(assets *AssetsReader, desc Object, r io.ReadSeeker) (AudioClip, error) {
+	info, err := assets.TypeTree(desc)
+	if err == nil && hasChild(info, "m_Resource") {
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			return AudioClip{}, errors.Wrapf(err, "audio clip %v", desc.ID)
+		}
+		clip, err := parseAudioClip(val)
+		return clip, errors.Wrapf(err, "audio clip %v", desc.ID)
+	}
+
+	// Files of unity 5.0+ always have m_Resource in the type tree if it is present at all
+	if err != nil && assets.Header.Version >= 14 {
+		return AudioClip{}, errors.Wrapf(err, "audio clip %v", desc.ID)
+	}
+
+	clip, err := readLegacyAudioClip(r, assets.Order, legacyStreamFile(assets))
+	return clip, errors.Wrapf(err, "audio clip %v", desc.ID)
+}
+
+func hasChild(info TypeInfo, name string) bool {
+	for _, child := range info.Children {
+		if child.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Legacy clips are streamed from the .resS file named after the assets file.
+func legacyStreamFile(assets *AssetsReader) string {
+	if assets.Path == "" {
+		return ""
+	}
+	return path.Base(assets.Path) + ".resS"
+}
+
+func readLegacyAudioClip(r io.ReadSeeker, order binary.ByteOrder, streamFile string) (AudioClip, error) {
+	var legacy legacyAudioClip
+	err := read(r, &legacy, order, false)
+	if err != nil {
+		return AudioClip{}, err
+	}
+
+	ret := AudioClip{
+		Name:        legacy.Name,
+		Format:      legacy.Format,
+		Type:        legacy.Type,
+		Is3D:        legacy.Is3D,
+		UseHardware: legacy.UseHardware,
+		LoadType:    legacy.Stream,
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ret, err
+	}
+
+	// Streamed clips have the offset in the stream file instead of the data
+	if len(rest) == 4 && (legacy.Stream == AudioStreaming || legacy.Size > 4) {
+		ret.Resource = StreamInfo{
+			Path:   streamFile,
+			Offset: uint64(order.Uint32(rest)),
+			Size:   uint64(legacy.Size),
+		}
+		return ret, nil
+	}
+
+	if len(rest) != int(align(legacy.Size, 4)) {
+		return ret, errors.Errorf("unexpected data left:\n%v", hex.Dump(rest))
+	}
+	ret.Data = rest[:legacy.Size]
+	return ret, nil
+}
+
+func parseAudioClip(val interface{}) (AudioClip, error) {
+	var ret AudioClip
+
+	st, ok := val.(*Struct)
+	if !ok {
+		return ret, errors.Errorf("structure expected, got %T", val)
+	}
+	ret.value = st
+
+	name, err := fieldValue(val, "m_Name")
+	if err != nil {
+		return ret, err
+	}
+	ret.Name, _ = name.(string)
+
+	for _, field := range []struct {
+		name string
+		dst  *int32
+	}{
+		{"m_LoadType", &ret.LoadType},
+		{"m_Channels", &ret.Channels},
+		{"m_Frequency", &ret.Frequency},
+		{"m_BitsPerSample", &ret.BitsPerSample},
+		{"m_CompressionFormat", (*int32)(&ret.CompressionFormat)},
+	} {
+		v, err := fieldValue(val, field.name)
+		if err != nil {
+			return ret, err
+		}
+		i, err := intValue(v)
+		if err != nil {
+			return ret, errors.Wrap(err, field.name)
+		}
+		*field.dst = int32(i)
+	}
+
+	length, err := fieldValue(val, "m_Length")
+	if err != nil {
+		return ret, err
+	}
+	l, err := floatValue(length)
+	if err != nil {
+		return ret, errors.Wrap(err, "m_Length")
+	}
+	ret.Length = float32(l)
+
+	resource, err := fieldValue(val, "m_Resource")
+	if err != nil {
+		return ret, err
+	}
+	ret.Resource, err = ParseStreamInfo(resource)
+	return ret, err
+}
+
+// Whether the clip has the layout of unity 3.2-4.x.
+func (c AudioClip) Legacy() bool {
+	return c.value == nil
+}
+
+// Returns a copy which can be modified and encoded independently, e.g. to create a new clip.
+func (c AudioClip) Clone() AudioClip {
+	if c.value != nil {
+		c.value = c.value.Clone()
+	}
+	return c
+}
+
+// Extension of the clip data file, FSB5 containers are reported as is.
+func (c AudioClip) Extension() string {
+	if !c.Legacy() {
+		return ".fsb"
+	}
+	if ext, ok := audioTypeExtensions[c.Type]; ok {
+		return ext
+	}
+	return ".bin"
+}
+
+func (c AudioClip) Reader(assets *AssetsReader) (io.Reader, error) {
+	if c.Resource.Size == 0 {
+		return bytes.NewReader(c.Data), nil
+	}
+	return assets.StreamData(c.Resource)
+}
+
+// Updates the format fields of 5.0+ clip from the FSB5 container.
+func (c *AudioClip) SetFSB(fsb *FSB5) error {
+	if len(fsb.Samples) == 0 {
+		return errors.New("FSB5 container has no samples")
+	}
+	sample := fsb.Samples[0]
+
+	format, ok := fsbCodecFormats[fsb.Codec]
+	if !ok {
+		return errors.Errorf("unsupported FSB5 codec %v", fsb.Codec)
+	}
+
+	c.CompressionFormat = format
+	c.Channels = int32(sample.Channels)
+	c.Frequency = int32(sample.Frequency)
+	c.BitsPerSample = 16
+	switch fsb.Codec {
+	case FSBCodecPCM8:
+		c.BitsPerSample = 8
+	case FSBCodecPCM24:
+		c.BitsPerSample = 24
+	case FSBCodecPCM32, FSBCodecPCMFloat:
+		c.BitsPerSample = 32
+	}
+	if sample.Frequency > 0 {
+		c.Length = float32(float64(sample.Frames) / float64(sample.Frequency))
+	}
+	return nil
+}
+
+// Encodes the clip, desc defines the type of 5.0+ clips(the one it was decoded from or a template).
+func (c AudioClip) Encode(assets *AssetsReader, desc Object) ([]byte, error) {
+	if c.Legacy() {
+		return c.encodeLegacy(assets.Order)
+	}
+
+	for _, field := range []struct {
+		name string
+		val  interface{}
+	}{
+		{"m_Name", c.Name},
+		{"m_LoadType", c.LoadType},
+		{"m_Channels", c.Channels},
+		{"m_Frequency", c.Frequency},
+		{"m_BitsPerSample", c.BitsPerSample},
+		{"m_Length", c.Length},
+		{"m_CompressionFormat", int32(c.CompressionFormat)},
+	} {
+		if !c.value.Set(field.name, field.val) {
+			return nil, errors.Errorf("field %v is missing", field.name)
+		}
+	}
+
+	resource, _ := c.value.Get("m_Resource")
+	err := c.Resource.Store(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return assets.EncodeObject(desc, c.value)
+}
+
+func (c AudioClip) encodeLegacy(order binary.ByteOrder) ([]byte, error) {
+	legacy := legacyAudioClip{
+		Name:        c.Name,
+		Format:      c.Format,
+		Type:        c.Type,
+		Is3D:        c.Is3D,
+		UseHardware: c.UseHardware,
+		Stream:      c.LoadType,
+		Size:        uint32(len(c.Data)),
+	}
+	if c.Resource.Size > 0 {
+		// Legacy clips can't refer past 4GB of the stream file
+		if c.Resource.Size > math.MaxUint32 || c.Resource.Offset > math.MaxUint32 {
+			return nil, errors.Errorf("clip %v: stream range %v+%v doesn't fit into 32 bits",
+				c.Name, c.Resource.Offset, c.Resource.Size)
+		}
+		legacy.Size = uint32(c.Resource.Size)
+	}
+
+	var buf bytes.Buffer
+	err := write(&buf, legacy, order, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Resource.Size > 0 {
+		err = write(&buf, uint32(c.Resource.Offset), order, false)
+	} else {
+		_, err = buf.Write(c.Data)
+		if err == nil {
+			err = writeAlign(&buf, len(c.Data), 4)
+		}
+	}
+	return buf.Bytes(), err
+}
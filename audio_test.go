@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEncodeLegacyRange(t *testing.T) {
+	clip := defaultLegacyAudioClip
+	clip.Name = "music"
+	clip.Resource = StreamInfo{Path: "resources.assets.resS", Offset: 1<<32 - 10, Size: 10}
+	_, err := clip.encodeLegacy(le)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []StreamInfo{{Offset: 1 << 32, Size: 10}, {Offset: 0, Size: 1 << 32}} {
+		clip.Resource = r
+		_, err = clip.encodeLegacy(le)
+		if err == nil {
+			t.Errorf("%+v: error expected", r)
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz/lzma"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Unity asset bundles, containers for the serialized files and their resources.
+See https://github.com/HearthSim/UnityPack/wiki/Format-Documentation and UnityPy sources.
+
+UnityFS(unity 5.3+):
+	header, blocks info(possibly compressed), data blocks(compressed independently)
+	Files are stored as ranges of the concatenated blocks data.
+
+UnityWeb/UnityRaw(before 5.3):
+	header, data(LZMA stream for UnityWeb, as is for UnityRaw)
+	Data starts with the files directory, offsets are relative to the data start.
+
+All the numbers are big endian.
+*/
+
+const (
+	BundleFS  = "UnityFS"
+	BundleWeb = "UnityWeb"
+	BundleRaw = "UnityRaw"
+)
+
+// Compression types, lower bits of UnityFS flags
+const (
+	CompressionNone  = 0
+	CompressionLZMA  = 1
+	CompressionLZ4   = 2
+	CompressionLZ4HC = 3
+
+	compressionMask = 0x3f
+)
+
+// UnityFS flags
+const (
+	bundleInfoCombined     = 0x40
+	bundleInfoAtEnd        = 0x80
+	bundleInfoPaddingStart = 0x200
+)
+
+// Size of data blocks in bundles created by the writer, same as unity uses for LZ4 bundles.
+const bundleBlockSize = 128 * 1024
+
+type Bundle struct {
+	Signature     string
+	FormatVersion uint32
+	UnityVersion  string
+	UnityRevision string
+	// UnityFS only
+	Flags uint32
+	// Compression of data blocks
+	Compression uint32
+	Files       []BundleFile
+
+	fd *os.File
+}
+
+type BundleFile struct {
+	Name string
+	// UnityFS only, 4 for serialized files
+	Flags uint32
+	Size  int64
+
+	data readSeekerAt
+}
+
+// Returns a new reader of the file data.
+func (f BundleFile) Reader() readSeekerAt {
+	return io.NewSectionReader(f.data, 0, f.Size)
+}
+
+// Returns location of the file extracted to dir.
+// Names are taken from the bundle as is, so absolute ones and ones leading out of dir are rejected.
+func (f BundleFile) Path(dir string) (string, error) {
+	name := path.Clean(strings.Replace(f.Name, "\\", "/", -1))
+	if name == "." || name == ".." || path.IsAbs(name) || strings.HasPrefix(name, "../") {
+		return "", errors.Errorf("invalid file name %q in the bundle", f.Name)
+	}
+	return path.Join(dir, name), nil
+}
+
+type bundleBlock struct {
+	UncompressedSize uint32
+	CompressedSize   uint32
+	Flags            uint16
+}
+
+type bundleNode struct {
+	Offset uint64
+	Size   uint64
+	Flags  uint32
+	Path   string
+}
+
+type fsHeader struct {
+	Size                 uint64
+	CompressedInfoSize   uint32
+	UncompressedInfoSize uint32
+	Flags                uint32
+}
+
+type webLevel struct {
+	CompressedSize   uint32
+	UncompressedSize uint32
+}
+
+// Checks the file signature.
+func IsBundle(file string) bool {
+	fd, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	var signature string
+	err = read(fd, &signature, binary.BigEndian, true)
+	return err == nil && (signature == BundleFS || signature == BundleWeb || signature == BundleRaw)
+}
+
+func OpenBundle(file string) (*Bundle, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	success := false
+	defer func() {
+		if !success {
+			fd.Close()
+		}
+	}()
+
+	ret := Bundle{fd: fd}
+	err = readAll(fd, binary.BigEndian, &ret.Signature, &ret.FormatVersion, &ret.UnityVersion, &ret.UnityRevision)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ret.Signature {
+	case BundleFS:
+		err = ret.readFS()
+	case BundleWeb, BundleRaw:
+		err = ret.readWeb()
+	default:
+		err = errors.Errorf("unknown bundle signature %q", ret.Signature)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	success = true
+	return &ret, nil
+}
+
+func (b *Bundle) Close() error {
+	return b.fd.Close()
+}
+
+func (b *Bundle) File(name string) (BundleFile, bool) {
+	for _, f := range b.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return BundleFile{}, false
+}
+
+// Opens the serialized file from the bundle.
+// Returned reader remains valid until the bundle is closed.
+func (b *Bundle) Open(name string) (*AssetsReader, error) {
+	f, ok := b.File(name)
+	if !ok {
+		return nil, errors.Errorf("%v not found in the bundle", name)
+	}
+
+	ret, err := NewAssetsReaderFrom(f.Reader())
+	if err != nil {
+		return nil, errors.Wrap(err, name)
+	}
+	ret.bundle = b
+	return ret, nil
+}
+
+func (b *Bundle) readFS() error {
+	var header fsHeader
+	err := read(b.fd, &header, binary.BigEndian, true)
+	if err != nil {
+		return err
+	}
+	b.Flags = header.Flags
+
+	if b.FormatVersion >= 7 {
+		err = readAlign(b.fd, 16)
+		if err != nil {
+			return err
+		}
+	}
+
+	dataOffset, err := b.fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	infoOffset := dataOffset
+	if header.Flags&bundleInfoAtEnd != 0 {
+		end, err := b.fd.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		infoOffset = end - int64(header.CompressedInfoSize)
+	} else {
+		dataOffset += int64(header.CompressedInfoSize)
+	}
+
+	packed := make([]byte, header.CompressedInfoSize)
+	_, err = b.fd.ReadAt(packed, infoOffset)
+	if err != nil {
+		return err
+	}
+
+	info, err := decompress(packed, int(header.UncompressedInfoSize), header.Flags&compressionMask)
+	if err != nil {
+		return errors.Wrap(err, "blocks info")
+	}
+
+	if header.Flags&bundleInfoPaddingStart != 0 {
+		dataOffset = int64(align64(uint64(dataOffset), 16))
+	}
+
+	r := bytes.NewReader(info)
+	var hash [16]byte
+	var blocks []bundleBlock
+	var nodes []bundleNode
+	err = readAll(r, binary.BigEndian, &hash, &blocks, &nodes)
+	if err != nil {
+		return errors.Wrap(err, "blocks info")
+	}
+
+	var data readSeekerAt
+	var size int64
+	for _, block := range blocks {
+		size += int64(block.UncompressedSize)
+		if block.Flags&compressionMask != CompressionNone {
+			b.Compression = uint32(block.Flags & compressionMask)
+		}
+	}
+
+	if b.Compression == CompressionNone {
+		data = io.NewSectionReader(b.fd, dataOffset, size)
+	} else {
+		// Everything is unpacked in memory, bundles are rarely large enough to make it a problem
+		buf := make([]byte, 0, size)
+		offset := dataOffset
+		for i, block := range blocks {
+			packed := make([]byte, block.CompressedSize)
+			_, err = b.fd.ReadAt(packed, offset)
+			if err != nil {
+				return err
+			}
+			offset += int64(block.CompressedSize)
+
+			unpacked, err := decompress(packed, int(block.UncompressedSize), uint32(block.Flags&compressionMask))
+			if err != nil {
+				return errors.Wrapf(err, "block #%v", i)
+			}
+			buf = append(buf, unpacked...)
+		}
+		data = bytes.NewReader(buf)
+	}
+
+	for _, node := range nodes {
+		if int64(node.Offset+node.Size) > size {
+			return errors.Errorf("%v is out of data range", node.Path)
+		}
+		b.Files = append(b.Files, BundleFile{
+			Name:  node.Path,
+			Flags: node.Flags,
+			Size:  int64(node.Size),
+			data:  io.NewSectionReader(data, int64(node.Offset), int64(node.Size)),
+		})
+	}
+
+	return nil
+}
+
+func (b *Bundle) readWeb() error {
+	if b.FormatVersion >= 4 {
+		var hash [16]byte
+		var crc uint32
+		err := readAll(b.fd, binary.BigEndian, &hash, &crc)
+		if err != nil {
+			return err
+		}
+	}
+
+	var header struct {
+		MinimumStreamedBytes uint32
+		HeaderSize           uint32
+		LevelsToDownload     uint32
+	}
+	var levels []webLevel
+	err := readAll(b.fd, binary.BigEndian, &header, &levels)
+	if err != nil {
+		return err
+	}
+	if len(levels) == 0 {
+		return errors.New("no levels found")
+	}
+	last := levels[len(levels)-1]
+
+	var data readSeekerAt
+	if b.Signature == BundleWeb {
+		b.Compression = CompressionLZMA
+		r, err := lzma.NewReader(io.NewSectionReader(b.fd, int64(header.HeaderSize), int64(last.CompressedSize)))
+		if err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		data = bytes.NewReader(buf)
+	} else {
+		data = io.NewSectionReader(b.fd, int64(header.HeaderSize), int64(last.UncompressedSize))
+	}
+
+	var count uint32
+	err = read(data, &count, binary.BigEndian, true)
+	if err != nil {
+		return err
+	}
+
+	for i := uint32(0); i < count; i++ {
+		var entry struct {
+			Name   string
+			Offset uint32
+			Size   uint32
+		}
+		err = read(data, &entry, binary.BigEndian, true)
+		if err != nil {
+			return err
+		}
+
+		b.Files = append(b.Files, BundleFile{
+			Name: entry.Name,
+			Size: int64(entry.Size),
+			data: io.NewSectionReader(data, int64(entry.Offset), int64(entry.Size)),
+		})
+	}
+
+	return nil
+}
+
+func decompress(data []byte, size int, compression uint32) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+
+	case CompressionLZMA:
+		// Unity omits the size from the classic lzma header, it's known from the block info anyway
+		if len(data) < 5 {
+			return nil, errors.New("lzma: invalid header")
+		}
+		header := make([]byte, 13)
+		copy(header, data[:5])
+		binary.LittleEndian.PutUint64(header[5:], uint64(size))
+
+		r, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), bytes.NewReader(data[5:])))
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]byte, size)
+		_, err = io.ReadFull(r, ret)
+		return ret, err
+
+	case CompressionLZ4, CompressionLZ4HC:
+		return lz4Decompress(data, size)
+
+	default:
+		return nil, errors.Errorf("unsupported compression type %v", compression)
+	}
+}
+
+func compress(data []byte, compression uint32) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+
+	case CompressionLZMA:
+		var buf bytes.Buffer
+		w, err := lzma.WriterConfig{
+			DictCap:      1 << 19,
+			SizeInHeader: true,
+			Size:         int64(len(data)),
+		}.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Strip the size from the classic header
+		packed := buf.Bytes()
+		return append(packed[:5:5], packed[13:]...), nil
+
+	case CompressionLZ4, CompressionLZ4HC:
+		return lz4Compress(data), nil
+
+	default:
+		return nil, errors.Errorf("unsupported compression type %v", compression)
+	}
+}
+
+// Creates a bundle with the same header and list of files as src.
+// Files found in replace are written with the new data.
+func CreateModifiedBundle(path string, src *Bundle, replace map[string][]byte) error {
+	var files []io.Reader
+	var sizes []int64
+	for _, f := range src.Files {
+		if data, ok := replace[f.Name]; ok {
+			files = append(files, bytes.NewReader(data))
+			sizes = append(sizes, int64(len(data)))
+		} else {
+			files = append(files, f.Reader())
+			sizes = append(sizes, f.Size)
+		}
+	}
+
+	fd, err := CreateOutput(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if src.Signature == BundleFS {
+		err = src.writeFS(fd.File, io.MultiReader(files...), sizes)
+	} else {
+		err = src.writeWeb(fd.File, io.MultiReader(files...), sizes)
+	}
+	if err != nil {
+		return err
+	}
+
+	return fd.Commit()
+}
+
+// Blocks info is always written uncompressed right after the header,
+// so its size is known before the data blocks are compressed.
+func (b *Bundle) writeFS(fd *os.File, data io.Reader, sizes []int64) error {
+	var total int64
+	var nodes []bundleNode
+	for i, f := range b.Files {
+		nodes = append(nodes, bundleNode{
+			Offset: uint64(total),
+			Size:   uint64(sizes[i]),
+			Flags:  f.Flags,
+			Path:   f.Name,
+		})
+		total += sizes[i]
+	}
+
+	blocks := make([]bundleBlock, (total+bundleBlockSize-1)/bundleBlockSize)
+
+	header := fsHeader{
+		Flags: b.Flags&^(compressionMask|bundleInfoAtEnd) | bundleInfoCombined,
+	}
+
+	writeHeader := func() error {
+		_, err := fd.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		w := &alignWriter{w: fd}
+		err = writeAll(w, binary.BigEndian, b.Signature, b.FormatVersion, b.UnityVersion, b.UnityRevision, header)
+		if err != nil {
+			return err
+		}
+		if b.FormatVersion >= 7 {
+			err = w.align(16)
+			if err != nil {
+				return err
+			}
+		}
+
+		var info bytes.Buffer
+		var hash [16]byte
+		err = writeAll(&info, binary.BigEndian, hash, blocks, nodes)
+		if err != nil {
+			return err
+		}
+		header.CompressedInfoSize = uint32(info.Len())
+		header.UncompressedInfoSize = uint32(info.Len())
+
+		_, err = w.Write(info.Bytes())
+		if err != nil {
+			return err
+		}
+		if b.Flags&bundleInfoPaddingStart != 0 {
+			return w.align(16)
+		}
+		return nil
+	}
+
+	// Just to reserve enough space, sizes of everything are fixed
+	err := writeHeader()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, bundleBlockSize)
+	for i := range blocks {
+		n, err := io.ReadFull(data, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		packed, err := compress(buf[:n], b.Compression)
+		if err != nil {
+			return err
+		}
+		blocks[i] = bundleBlock{
+			UncompressedSize: uint32(n),
+			CompressedSize:   uint32(len(packed)),
+			Flags:            uint16(b.Compression),
+		}
+
+		_, err = fd.Write(packed)
+		if err != nil {
+			return err
+		}
+	}
+
+	size, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	header.Size = uint64(size)
+
+	// This time with real values
+	return writeHeader()
+}
+
+// Writes UnityWeb(LZMA) or UnityRaw bundle with a single level.
+// Hash and crc of the version 4 are left empty.
+func (b *Bundle) writeWeb(fd *os.File, data io.Reader, sizes []int64) error {
+	var dir bytes.Buffer
+	dirSize := 4
+	for _, f := range b.Files {
+		dirSize += len(f.Name) + 1 + 8
+	}
+
+	offset := align(uint32(dirSize), 4)
+	err := write(&dir, uint32(len(b.Files)), binary.BigEndian, true)
+	if err != nil {
+		return err
+	}
+	for i, f := range b.Files {
+		err = writeAll(&dir, binary.BigEndian, f.Name, offset, uint32(sizes[i]))
+		if err != nil {
+			return err
+		}
+		offset += align(uint32(sizes[i]), 4)
+	}
+
+	var raw bytes.Buffer
+	raw.Write(dir.Bytes())
+	err = writeAlign(&raw, raw.Len(), 4)
+	if err != nil {
+		return err
+	}
+	for i := range b.Files {
+		n, err := io.CopyN(&raw, data, sizes[i])
+		if err != nil {
+			return err
+		}
+		err = writeAlign(&raw, int(n), 4)
+		if err != nil {
+			return err
+		}
+	}
+
+	packed := raw.Bytes()
+	if b.Signature == BundleWeb {
+		var buf bytes.Buffer
+		w, err := lzma.WriterConfig{SizeInHeader: true, Size: int64(raw.Len())}.NewWriter(&buf)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw.Bytes())
+		if err != nil {
+			return err
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+		packed = buf.Bytes()
+	}
+
+	var header bytes.Buffer
+	err = writeAll(&header, binary.BigEndian, b.Signature, b.FormatVersion, b.UnityVersion, b.UnityRevision)
+	if err != nil {
+		return err
+	}
+	if b.FormatVersion >= 4 {
+		err = writeAll(&header, binary.BigEndian, [16]byte{}, uint32(0))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Size of the remaining header fields
+	headerSize := header.Len() + 4*3 + 4 + 8
+	if b.FormatVersion >= 2 {
+		headerSize += 4
+	}
+	if b.FormatVersion >= 3 {
+		headerSize += 4
+	}
+	headerSize = int(align(uint32(headerSize), 4))
+
+	err = writeAll(&header, binary.BigEndian,
+		uint32(len(packed)), uint32(headerSize), uint32(1),
+		[]webLevel{{CompressedSize: uint32(len(packed)), UncompressedSize: uint32(raw.Len())}},
+	)
+	if err != nil {
+		return err
+	}
+	if b.FormatVersion >= 2 {
+		err = write(&header, uint32(headerSize+len(packed)), binary.BigEndian, true)
+		if err != nil {
+			return err
+		}
+	}
+	if b.FormatVersion >= 3 {
+		err = write(&header, uint32(dir.Len()), binary.BigEndian, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeAlign(&header, header.Len(), 4)
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(header.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(packed)
+	return err
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+// Data of different compressibility, lengths cover the saturated token parts of LZ4.
+func compressionSamples() map[string][]byte {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 300000; i++ {
+		text.WriteString("m_Name: track-")
+		text.WriteByte(byte('a' + i%26))
+		text.WriteString(", m_Offset: 16\n")
+	}
+
+	return map[string][]byte{
+		"empty":    {},
+		"short":    []byte("abc"),
+		"limit":    []byte("0123456789abcdef"),
+		"zeros":    make([]byte, 70000),
+		"random":   random,
+		"text":     text.Bytes(),
+		"mixed":    append(append(append([]byte{}, random[:20]...), make([]byte, 300)...), random[:1000]...),
+		"overlaps": bytes.Repeat([]byte("ab"), 40000),
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for name, data := range compressionSamples() {
+		t.Run(name, func(t *testing.T) {
+			packed := lz4Compress(data)
+			unpacked, err := lz4Decompress(packed, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(unpacked, data) {
+				t.Error("data mismatch")
+			}
+		})
+	}
+}
+
+func TestLZ4DecompressErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		size int
+	}{
+		{"literals out of range", []byte{0x50, 1, 2}, 5},
+		{"missing offset", []byte{0x10, 'a', 0}, 5},
+		{"zero offset", []byte{0x10, 'a', 0, 0}, 5},
+		{"offset out of range", []byte{0x10, 'a', 2, 0}, 5},
+		{"unfinished length", []byte{0xf0, 0xff}, 300},
+		{"wrong size", []byte{0x30, 'a', 'b', 'c'}, 4},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := lz4Decompress(c.data, c.size)
+			if err == nil {
+				t.Error("error expected")
+			}
+		})
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, compression := range []uint32{CompressionNone, CompressionLZMA, CompressionLZ4, CompressionLZ4HC} {
+		for name, data := range compressionSamples() {
+			packed, err := compress(data, compression)
+			if err != nil {
+				t.Fatalf("%v/%v: %v", compression, name, err)
+			}
+			unpacked, err := decompress(packed, len(data), compression)
+			if err != nil {
+				t.Fatalf("%v/%v: %v", compression, name, err)
+			}
+			if !bytes.Equal(unpacked, data) {
+				t.Errorf("%v/%v: data mismatch", compression, name)
+			}
+		}
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	samples := compressionSamples()
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"CAB-0123456789abcdef", samples["text"]},
+		{"CAB-0123456789abcdef.resS", samples["random"]},
+		{"CAB-0123456789abcdef.resource", samples["short"]},
+		{"empty", samples["empty"]},
+	}
+
+	cases := []struct {
+		name        string
+		signature   string
+		version     uint32
+		flags       uint32
+		compression uint32
+	}{
+		{"fs uncompressed", BundleFS, 6, 0, CompressionNone},
+		{"fs lz4", BundleFS, 6, CompressionLZ4HC, CompressionLZ4},
+		{"fs lzma", BundleFS, 6, CompressionLZMA, CompressionLZMA},
+		{"fs v7 padded", BundleFS, 7, CompressionLZ4 | bundleInfoPaddingStart, CompressionLZ4},
+		{"web", BundleWeb, 3, 0, CompressionLZMA},
+		{"raw", BundleRaw, 3, 0, CompressionNone},
+		{"web v4", BundleWeb, 4, 0, CompressionLZMA},
+	}
+
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src := &Bundle{
+				Signature:     c.signature,
+				FormatVersion: c.version,
+				UnityVersion:  "5.x.x",
+				UnityRevision: "5.6.7f1",
+				Flags:         c.flags,
+				Compression:   c.compression,
+			}
+			for _, f := range files {
+				src.Files = append(src.Files, BundleFile{Name: f.name, Flags: 4, Size: int64(len(f.data)), data: bytes.NewReader(f.data)})
+			}
+
+			file := path.Join(dir, c.name)
+			replaced := []byte("replaced data")
+			err := CreateModifiedBundle(file, src, map[string][]byte{files[2].name: replaced})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bundle, err := OpenBundle(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bundle.Close()
+
+			if bundle.Signature != c.signature || bundle.FormatVersion != c.version || bundle.Compression != c.compression {
+				t.Errorf("header mismatch: %v %v %v", bundle.Signature, bundle.FormatVersion, bundle.Compression)
+			}
+			if len(bundle.Files) != len(files) {
+				t.Fatalf("%v files, %v expected", len(bundle.Files), len(files))
+			}
+			for i, f := range bundle.Files {
+				expected := files[i].data
+				if i == 2 {
+					expected = replaced
+				}
+				data, err := ioutil.ReadAll(f.Reader())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f.Name != files[i].name || !bytes.Equal(data, expected) {
+					t.Errorf("file %v(%v bytes) doesn't match %v", f.Name, len(data), files[i].name)
+				}
+			}
+		})
+	}
+}
+
+func TestBundleFilePath(t *testing.T) {
+	cases := []struct {
+		name, path string
+	}{
+		{"CAB-1234", "out/CAB-1234"},
+		{"data/level0", "out/data/level0"},
+		{"data/../level0", "out/level0"},
+		{"../outside", ""},
+		{"data/../../outside", ""},
+		{"..\\outside", ""},
+		{"/etc/passwd", ""},
+		{"..", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		file, err := BundleFile{Name: c.name}.Path("out")
+		if c.path == "" {
+			if err == nil {
+				t.Errorf("%q: error expected, got %v", c.name, file)
+			}
+			continue
+		}
+		if err != nil || file != c.path {
+			t.Errorf("%q: got %v, %v, expected %v", c.name, file, err, c.path)
+		}
+	}
+}
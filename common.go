@@ -3,13 +3,16 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 func PrintHeader() error {
@@ -79,6 +82,34 @@ func PrintHexDump() error {
 	})
 }
 
+func PrintDecoded() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	var filterByType uint64
+	if len(os.Args) > 3 {
+		filterByType, err = strconv.ParseUint(os.Args[3], 10, 32)
+		if err != nil {
+			return errors.Errorf("invalid type_id: %v", filterByType)
+		}
+	}
+
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if filterByType != 0 && desc.TypeID != uint32(filterByType) {
+			return nil
+		}
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			return err
+		}
+		log.Printf("%+v\n%v", desc, dump(val))
+		return nil
+	})
+}
+
 func GrepDump() error {
 	assets, err := NewAssetsReader(os.Args[2])
 	if err != nil {
@@ -115,24 +146,402 @@ func UnpackAssets() error {
 	}
 
 	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
-		dir := path.Join(os.Args[3], strconv.FormatUint(uint64(desc.TypeID), 10))
-		err := os.MkdirAll(dir, 0777)
+		file := objectFile(os.Args[3], desc)
+		err := os.MkdirAll(path.Dir(file), 0777)
 		if err != nil {
 			return err
 		}
 
-		file := path.Join(dir, strconv.FormatUint(uint64(desc.ID), 10))
-		out, err := os.Create(file)
+		out, err := CreateUnpacked(file)
 		if err != nil {
 			return err
 		}
+		defer out.Close()
 
 		_, err = io.Copy(out, r)
 		if err != nil {
-			out.Close()
+			return err
+		}
+		return out.Commit()
+	})
+}
+
+func RepackAssets() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	dir := os.Args[3]
+
+	var replace []ReplacementObject
+	var remove []uint64
+	known := make(map[uint64]bool)
+
+	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		known[desc.ID] = true
+
+		data, err := ioutil.ReadFile(objectFile(dir, desc))
+		if os.IsNotExist(err) {
+			log.Printf("  removing %+v", desc)
+			remove = append(remove, desc.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		orig, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(orig, data) {
+			return nil
+		}
+
+		log.Printf("  replacing %+v", desc)
+		replace = append(replace, ReplacementObject{
+			TargetID: desc.ID,
+			CustomObject: CustomObject{
+				TypeID:  desc.TypeID,
+				ClassID: desc.ClassID,
+				Data:    data,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	add, err := newObjectFiles(assets, dir, known)
+	if err != nil {
+		return err
+	}
+
+	var addObjects []CustomObject
+	for _, obj := range add {
+		addObjects = append(addObjects, obj.CustomObject)
+	}
+
+	maxID, err := CreateModifiedAssets(os.Args[4], assets, addObjects, replace, remove)
+	if err != nil {
+		return err
+	}
+
+	// IDs of the new objects are assigned on creation
+	for i, obj := range add {
+		log.Printf("  added %v as %v", obj.File, maxID-uint64(len(add)-i-1))
+	}
+
+	return nil
+}
+
+type objectFileData struct {
+	CustomObject
+	File string
+}
+
+// Searches the unpacked dir for objects missing in the known set.
+func newObjectFiles(assets *AssetsReader, dir string, known map[uint64]bool) ([]objectFileData, error) {
+	types, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []objectFileData
+	for _, t := range types {
+		typeID, err := strconv.ParseUint(t.Name(), 10, 32)
+		if !t.IsDir() || err != nil {
+			continue
+		}
+
+		// Negative type ids are used by script types
+		classID := uint16(typeID)
+		if int32(typeID) < 0 {
+			classID = MonoBehaviourTypeID
+		}
+
+		files, err := ioutil.ReadDir(path.Join(dir, t.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var ids []uint64
+		for _, f := range files {
+			id, err := strconv.ParseUint(f.Name(), 10, 64)
+			if f.IsDir() || err != nil || known[id] {
+				continue
+			}
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+
+		for _, id := range ids {
+			file := path.Join(dir, t.Name(), strconv.FormatUint(id, 10))
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			obj := objectFileData{
+				CustomObject: CustomObject{
+					TypeID:  uint32(typeID),
+					ClassID: classID,
+					Data:    data,
+				},
+				File: file,
+			}
+			if assets.Header.Version >= 16 {
+				obj.TypeIndex, err = newObjectClass(assets, obj.TypeID, data)
+				if err != nil {
+					return nil, errors.Wrap(err, file)
+				}
+			}
+			ret = append(ret, obj)
+		}
+	}
+
+	return ret, nil
+}
+
+// Finds the class of a new object for files of version 16+, which refer to classes by index.
+// Script types share the class ID, so the script referred by the object has to match as well.
+func newObjectClass(assets *AssetsReader, typeID uint32, data []byte) (uint32, error) {
+	meta := assets.MetaData
+	var matches []uint32
+	for i, class := range meta.TypeInfo.Classes {
+		if class.ID == typeID {
+			matches = append(matches, uint32(i))
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, errors.Errorf("type %v not found", typeID)
+	case 1:
+		return matches[0], nil
+	}
+
+	// Classes refer to scripts since version 17, type trees are required to find the object's one
+	var found []uint32
+	for _, idx := range matches {
+		class := meta.TypeInfo.Classes[idx]
+		if assets.Header.Version < 17 || !meta.TypeInfo.EnableTypeTree ||
+			class.ScriptTypeIndex < 0 || int(class.ScriptTypeIndex) >= len(meta.Scripts) {
+			continue
+		}
+		val, err := decodeSized(bytes.NewReader(data), int64(len(data)), class.Info, assets.Order)
+		if err != nil {
+			continue
+		}
+		script, err := fieldValue(val, "m_Script")
+		ptr, ok := script.(PPtr)
+		ref := meta.Scripts[class.ScriptTypeIndex]
+		if err == nil && ok && int64(ptr.FileID) == int64(ref.FileIndex) && uint64(ptr.PathID) == ref.ID {
+			found = append(found, idx)
+		}
+	}
+	if len(found) != 1 {
+		return 0, errors.Errorf("type %v is ambiguous, %v of %v classes match the object", typeID, len(found), len(matches))
+	}
+	return found[0], nil
+}
+
+func ExportJSON() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			log.Printf("[warn] skipping %+v: %v", desc, err)
+			return nil
+		}
+
+		// Skipped objects are kept as is by import-json, but partially exported ones would not be
+		data, err := json.MarshalIndent(val, "", "  ")
+		if err != nil {
+			return errors.Wrapf(err, "object %v", desc.ID)
+		}
+
+		file := objectFile(os.Args[3], desc) + ".json"
+		err = os.MkdirAll(path.Dir(file), 0777)
+		if err != nil {
 			return err
 		}
 
-		return out.Close()
+		return WriteUnpacked(file, data)
 	})
 }
+
+func ImportJSON() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	var replace []ReplacementObject
+	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		file := objectFile(os.Args[3], desc) + ".json"
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		val, err := ParseJSONValue(data)
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+
+		encoded, err := assets.EncodeObject(desc, val)
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+
+		orig, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(orig, encoded) {
+			return nil
+		}
+
+		log.Printf("  replacing %+v", desc)
+		replace = append(replace, ReplacementObject{
+			TargetID: desc.ID,
+			CustomObject: CustomObject{
+				TypeID:  desc.TypeID,
+				ClassID: desc.ClassID,
+				Data:    encoded,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(replace) == 0 {
+		log.Print("No changes found")
+	}
+
+	_, err = CreateModifiedAssets(os.Args[4], assets, nil, replace, nil)
+	return err
+}
+
+// Path of the object file as created by UnpackAssets: <dir>/<type_id>/<id>
+func objectFile(dir string, desc Object) string {
+	return path.Join(dir, strconv.FormatUint(uint64(desc.TypeID), 10), strconv.FormatUint(desc.ID, 10))
+}
+
+// Names files after objects for the commands working with named objects(textures, text assets etc).
+// Names are not unique, so the first object gets a plain name and the following ones get id suffix.
+// Objects must be processed in the same order(see RangeObjects) to get the same names.
+type fileNamer map[string]bool
+
+func (n fileNamer) name(name string, id uint64, ext string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	file := name + ext
+	if name == "" || n[strings.ToLower(file)] {
+		file = name + "_" + strconv.FormatUint(id, 10) + ext
+	}
+	n[strings.ToLower(file)] = true
+	return file
+}
+
+func BundleList() error {
+	bundle, err := OpenBundle(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	log.Print(dump(bundle))
+	return nil
+}
+
+func BundleUnpack() error {
+	bundle, err := OpenBundle(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	for _, f := range bundle.Files {
+		file, err := f.Path(os.Args[3])
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(path.Dir(file), 0777)
+		if err != nil {
+			return err
+		}
+
+		out, err := CreateUnpacked(file)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, f.Reader())
+		if err == nil {
+			err = out.Commit()
+		}
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func BundlePack() error {
+	bundle, err := OpenBundle(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+
+	replace := make(map[string][]byte)
+	for _, f := range bundle.Files {
+		file, err := f.Path(os.Args[3])
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		orig, err := ioutil.ReadAll(f.Reader())
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(orig, data) {
+			continue
+		}
+
+		log.Printf("  replacing %v", f.Name)
+		replace[f.Name] = data
+	}
+
+	return CreateModifiedBundle(os.Args[4], bundle, replace)
+}
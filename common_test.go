@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewObjectClass(t *testing.T) {
+	monoType := func(fields ...TypeInfo) TypeInfo {
+		return structType("MonoBehaviour", "Base", append([]TypeInfo{
+			pptrType("m_GameObject", 8),
+			alignedType(leafType("UInt8", "m_Enabled", 1)),
+			pptrType("m_Script", 8),
+		}, fields...)...)
+	}
+	mono := func(scriptID int64, fields ...interface{}) []byte {
+		return packed(le, append([]interface{}{int32(0), int64(1), uint8(1), []byte{0, 0, 0}, int32(0), scriptID}, fields...)...)
+	}
+
+	assets := &AssetsReader{Order: le}
+	assets.Header.Version = 17
+	assets.MetaData = MetaData{
+		TypeInfo: TypesHeader{EnableTypeTree: true, Classes: []Class{
+			{ID: 1, ScriptTypeIndex: -1},
+			{ID: MonoBehaviourTypeID, ScriptTypeIndex: 0, Info: monoType()},
+			{ID: MonoBehaviourTypeID, ScriptTypeIndex: 1, Info: monoType(leafType("int", "m_Value", 4))},
+			// Same layout as the previous one, but another script
+			{ID: MonoBehaviourTypeID, ScriptTypeIndex: 2, Info: monoType(leafType("int", "m_Value", 4))},
+		}},
+		Scripts: []ScriptType{{0, 10}, {0, 11}, {0, 12}},
+	}
+
+	cases := []struct {
+		name   string
+		typeID uint32
+		data   []byte
+		index  uint32
+	}{
+		{"single class", 1, nil, 0},
+		{"script", MonoBehaviourTypeID, mono(10), 1},
+		{"layout shared by scripts", MonoBehaviourTypeID, mono(11, int32(5)), 2},
+		{"another script", MonoBehaviourTypeID, mono(12, int32(5)), 3},
+	}
+	for _, c := range cases {
+		idx, err := newObjectClass(assets, c.typeID, c.data)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+		} else if idx != c.index {
+			t.Errorf("%v: class %v, %v expected", c.name, idx, c.index)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"unknown script":  mono(13),
+		"layout mismatch": mono(10, int32(5)),
+	} {
+		_, err := newObjectClass(assets, MonoBehaviourTypeID, data)
+		if err == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+	if _, err := newObjectClass(assets, 2, nil); err == nil {
+		t.Error("unknown type: error expected")
+	}
+
+	// Scripts are not referred by classes before version 17
+	assets.Header.Version = 16
+	if _, err := newObjectClass(assets, MonoBehaviourTypeID, mono(10)); err == nil {
+		t.Error("version 16: error expected")
+	}
+}
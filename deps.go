@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* Cross-file graph of the objects from the assets files of a data root.
+Edges are PPtrs found in the objects decoded with the type trees and the Dependent list of the resource manager.
+Scenes(mainData and levelN files) are loaded by the player directly, so their objects are the roots of the graph,
+everything else is reachable only by references, resources are referred by the resource manager in mainData.
+*/
+
+var sceneFile = regexp.MustCompile(`^(maindata|level\d+)$`)
+
+// Object in the graph, file is the lower case file name.
+type objectKey struct {
+	File string
+	ID   uint64
+}
+
+func (k objectKey) String() string {
+	return fmt.Sprintf("%v:%v", k.File, k.ID)
+}
+
+type depsObject struct {
+	objectKey
+	TypeID uint32
+	Name   string `json:",omitempty"`
+	// Referred file is not in the data root, e.g. built-in resources
+	External  bool `json:",omitempty"`
+	Reachable bool
+}
+
+type depsReference struct {
+	From objectKey
+	To   objectKey
+}
+
+type depsGraph struct {
+	Objects    []*depsObject
+	References []depsReference
+
+	objects map[objectKey]*depsObject
+	// Referring objects by target
+	referrers map[objectKey][]objectKey
+}
+
+// deps <data_root> [--refs file:path_id] [--unreachable] [--export graph.dot|graph.json]
+func PrintDeps() error {
+	var refs []string
+	var export string
+	unreachable := false
+	for i := 3; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "--unreachable":
+			unreachable = true
+		case arg == "--refs" && i+1 < len(os.Args):
+			i++
+			refs = append(refs, os.Args[i])
+		case arg == "--export" && i+1 < len(os.Args):
+			i++
+			export = os.Args[i]
+		default:
+			return errors.Errorf("unknown argument %v", arg)
+		}
+	}
+
+	graph, err := buildDepsGraph(os.Args[2])
+	if err != nil {
+		return err
+	}
+
+	reachable := 0
+	for _, obj := range graph.Objects {
+		if obj.Reachable {
+			reachable++
+		}
+	}
+	log.Printf("%v objects, %v references, %v unreachable", len(graph.Objects), len(graph.References), len(graph.Objects)-reachable)
+
+	for _, ref := range refs {
+		file, id, err := splitReference(ref)
+		if err != nil {
+			return err
+		}
+		key := objectKey{File: strings.ToLower(path.Base(file)), ID: uint64(id)}
+		if graph.objects[key] == nil {
+			return errors.Errorf("object %v not found", ref)
+		}
+
+		log.Printf("%v is referred by:", graph.describe(key))
+		for _, from := range graph.referrers[key] {
+			log.Printf("  %v", graph.describe(from))
+		}
+	}
+
+	if unreachable {
+		log.Print("Unreachable objects:")
+		for _, obj := range graph.Objects {
+			if !obj.Reachable {
+				log.Printf("  %v", graph.describe(obj.objectKey))
+			}
+		}
+	}
+
+	if export == "" {
+		return nil
+	}
+	var data []byte
+	if isJSONFile(export) {
+		data, err = json.MarshalIndent(graph, "", "  ")
+		if err != nil {
+			return err
+		}
+	} else {
+		data = graph.dot()
+	}
+	return WriteOutput(export, data)
+}
+
+func buildDepsGraph(dataRoot string) (*depsGraph, error) {
+	infos, err := ioutil.ReadDir(dataRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &depsGraph{
+		objects:   make(map[objectKey]*depsObject),
+		referrers: make(map[objectKey][]objectKey),
+	}
+
+	var files []*AssetsReader
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, info := range infos {
+		name := strings.ToLower(info.Name())
+		if info.IsDir() || !sceneFile.MatchString(name) && path.Ext(name) != ".assets" {
+			continue
+		}
+
+		log.Printf("Parsing %v...", info.Name())
+		file, err := NewAssetsReader(path.Join(dataRoot, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+
+		for _, obj := range file.MetaData.Objects {
+			graph.add(&depsObject{objectKey: objectKey{File: name, ID: obj.ID}, TypeID: obj.TypeID})
+		}
+	}
+
+	for _, file := range files {
+		err = graph.addReferences(file)
+		if err != nil {
+			return nil, errors.Wrap(err, file.Name())
+		}
+	}
+
+	// Dependencies of the resources are listed in mainData explicitly
+	for _, file := range files {
+		if !strings.EqualFold(file.Name(), MainData) {
+			continue
+		}
+		res, _, err := ReadResourceManager(file)
+		if err != nil {
+			log.Printf("[warn] dependencies of the resources are skipped: %v", err)
+			continue
+		}
+		for _, d := range res.Dependent {
+			for _, dep := range d.Dependencies {
+				graph.link(graph.key(file, d.Object.FileID, uint64(d.Object.PathID)), graph.key(file, dep.FileID, uint64(dep.PathID)))
+			}
+		}
+	}
+
+	graph.markReachable()
+	return graph, nil
+}
+
+func (g *depsGraph) add(obj *depsObject) {
+	g.objects[obj.objectKey] = obj
+	g.Objects = append(g.Objects, obj)
+}
+
+// Key of the object referred from the file.
+func (g *depsGraph) key(from *AssetsReader, fileID uint32, pathID uint64) objectKey {
+	name := strings.ToLower(from.Name())
+	if fileID > 0 && int(fileID) <= len(from.MetaData.Externals) {
+		name = strings.ToLower(path.Base(strings.TrimPrefix(from.MetaData.Externals[fileID-1].FilePath, archivePrefix)))
+	} else if fileID > 0 {
+		name = fmt.Sprintf("<file %v of %v>", fileID, name)
+	}
+	return objectKey{File: name, ID: pathID}
+}
+
+func (g *depsGraph) link(from, to objectKey) {
+	if g.objects[to] == nil {
+		// Objects of the built-in or missing files are added as they are met
+		g.add(&depsObject{objectKey: to, External: true})
+	}
+	for _, f := range g.referrers[to] {
+		if f == from {
+			return
+		}
+	}
+	g.referrers[to] = append(g.referrers[to], from)
+	g.References = append(g.References, depsReference{From: from, To: to})
+}
+
+// Decodes the objects of the file and adds edges for the PPtrs in them.
+func (g *depsGraph) addReferences(file *AssetsReader) error {
+	if !file.MetaData.TypeInfo.EnableTypeTree {
+		log.Printf("[warn] type trees are stripped from %v, its references are unknown", file.Name())
+		return nil
+	}
+
+	for _, obj := range file.MetaData.Objects {
+		val, err := file.DecodeObject(obj, file.ObjectReader(obj))
+		if err != nil {
+			log.Printf("[warn] references of %v:%v are unknown: %v", file.Name(), obj.ID, err)
+			continue
+		}
+
+		from := g.key(file, 0, obj.ID)
+		if name, err := fieldValue(val, "m_Name"); err == nil {
+			g.objects[from].Name, _ = name.(string)
+		}
+
+		rangePPtrs(val, func(ptr PPtr) {
+			if ptr.PathID == 0 || ptr.FileID < 0 {
+				return
+			}
+			g.link(from, g.key(file, uint32(ptr.FileID), uint64(ptr.PathID)))
+		})
+	}
+	return nil
+}
+
+func rangePPtrs(val interface{}, f func(ptr PPtr)) {
+	switch v := val.(type) {
+	case PPtr:
+		f(v)
+	case *Struct:
+		for _, field := range v.Fields {
+			rangePPtrs(field.Value, f)
+		}
+	case []interface{}:
+		for _, item := range v {
+			rangePPtrs(item, f)
+		}
+	}
+}
+
+func (g *depsGraph) markReachable() {
+	edges := make(map[objectKey][]objectKey)
+	for _, ref := range g.References {
+		edges[ref.From] = append(edges[ref.From], ref.To)
+	}
+
+	var queue []objectKey
+	for _, obj := range g.Objects {
+		if sceneFile.MatchString(obj.File) {
+			obj.Reachable = true
+			queue = append(queue, obj.objectKey)
+		}
+	}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for _, to := range edges[key] {
+			if obj := g.objects[to]; !obj.Reachable {
+				obj.Reachable = true
+				queue = append(queue, to)
+			}
+		}
+	}
+}
+
+func (g *depsGraph) describe(key objectKey) string {
+	obj := g.objects[key]
+	switch {
+	case obj == nil:
+		return key.String()
+	case obj.External:
+		return key.String() + " (not in data root)"
+	case obj.Name != "":
+		return fmt.Sprintf("%v %v (type %v)", key, obj.Name, obj.TypeID)
+	}
+	return fmt.Sprintf("%v (type %v)", key, obj.TypeID)
+}
+
+// Graphviz representation, unreachable objects are dashed, external ones are grey.
+func (g *depsGraph) dot() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("digraph deps {\n")
+
+	objects := append([]*depsObject(nil), g.Objects...)
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].File < objects[j].File
+	})
+	for _, obj := range objects {
+		var attrs []string
+		attrs = append(attrs, "label="+dotQuote(g.describe(obj.objectKey)))
+		if !obj.Reachable {
+			attrs = append(attrs, "style=dashed")
+		}
+		if obj.External {
+			attrs = append(attrs, "color=grey")
+		}
+		fmt.Fprintf(&buf, "  %v [%v];\n", dotQuote(obj.String()), strings.Join(attrs, ", "))
+	}
+	for _, ref := range g.References {
+		fmt.Fprintf(&buf, "  %v -> %v;\n", dotQuote(ref.From.String()), dotQuote(ref.To.String()))
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDepsMarkReachable(t *testing.T) {
+	key := func(file string, id uint64) objectKey {
+		return objectKey{File: file, ID: id}
+	}
+	cases := []struct {
+		name    string
+		objects []objectKey
+		links   [][2]objectKey
+		// Expected reachable objects in any order
+		reachable []objectKey
+	}{
+		{
+			name:      "scenes are roots",
+			objects:   []objectKey{key("maindata", 1), key("level0", 1), key("level12", 2), key("sharedassets0.assets", 1)},
+			reachable: []objectKey{key("maindata", 1), key("level0", 1), key("level12", 2)},
+		},
+		{
+			name:    "chain over files",
+			objects: []objectKey{key("level0", 1), key("sharedassets0.assets", 1), key("resources.assets", 5), key("resources.assets", 6)},
+			links: [][2]objectKey{
+				{key("level0", 1), key("sharedassets0.assets", 1)},
+				{key("sharedassets0.assets", 1), key("resources.assets", 5)},
+				// Referred only by an unreachable object
+				{key("resources.assets", 6), key("resources.assets", 5)},
+			},
+			reachable: []objectKey{key("level0", 1), key("sharedassets0.assets", 1), key("resources.assets", 5)},
+		},
+		{
+			name:    "cycles and external objects",
+			objects: []objectKey{key("maindata", 1), key("sharedassets0.assets", 1), key("sharedassets0.assets", 2), key("sharedassets1.assets", 1)},
+			links: [][2]objectKey{
+				{key("maindata", 1), key("sharedassets0.assets", 1)},
+				{key("sharedassets0.assets", 1), key("sharedassets0.assets", 2)},
+				{key("sharedassets0.assets", 2), key("sharedassets0.assets", 1)},
+				{key("sharedassets0.assets", 2), key("unity default resources", 10)},
+				{key("sharedassets1.assets", 1), key("sharedassets1.assets", 1)},
+			},
+			reachable: []objectKey{key("maindata", 1), key("sharedassets0.assets", 1), key("sharedassets0.assets", 2), key("unity default resources", 10)},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := &depsGraph{
+				objects:   make(map[objectKey]*depsObject),
+				referrers: make(map[objectKey][]objectKey),
+			}
+			for _, k := range c.objects {
+				g.add(&depsObject{objectKey: k})
+			}
+			for _, l := range c.links {
+				g.link(l[0], l[1])
+			}
+			g.markReachable()
+
+			var reachable []objectKey
+			for _, obj := range g.Objects {
+				if obj.Reachable {
+					reachable = append(reachable, obj.objectKey)
+				}
+			}
+			sortKeys := func(keys []objectKey) {
+				sort.Slice(keys, func(i, j int) bool {
+					return keys[i].String() < keys[j].String()
+				})
+			}
+			sortKeys(reachable)
+			sortKeys(c.reachable)
+			if !reflect.DeepEqual(reachable, c.reachable) {
+				t.Errorf("reachable %v\nexpected %v", reachable, c.reachable)
+			}
+		})
+	}
+}
+
+func TestDepsLink(t *testing.T) {
+	g := &depsGraph{
+		objects:   make(map[objectKey]*depsObject),
+		referrers: make(map[objectKey][]objectKey),
+	}
+	from, to := objectKey{"level0", 1}, objectKey{"unity default resources", 10}
+	g.add(&depsObject{objectKey: from})
+	g.link(from, to)
+	g.link(from, to)
+
+	if len(g.References) != 1 || len(g.referrers[to]) != 1 {
+		t.Errorf("duplicated references %+v", g.References)
+	}
+	if obj := g.objects[to]; obj == nil || !obj.External {
+		t.Errorf("missing object is not added as external: %+v", obj)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+)
+
+/* S3TC block compression, see https://www.khronos.org/opengl/wiki/S3_Texture_Compression
+Image is split into 4x4 blocks, row by row. Each block is
+	DXT1: 2 RGB565 colors + 2-bit indices of 4 colors palette(interpolated)
+	DXT5: 2 alpha values + 3-bit indices of 8 alpha palette, DXT1 color block
+
+The compressor uses the extreme block colors along their principal axis as the palette endpoints,
+it's fast and good enough for the textures being replaced, but don't expect the quality of the offline tools.
+*/
+
+func decodeDXT1(data []byte, width, height int) *image.NRGBA {
+	return decodeBlocks(data, width, height, 8, func(block []byte, out *[16]color.NRGBA) {
+		decodeColorBlock(block, out, true)
+	})
+}
+
+func decodeDXT5(data []byte, width, height int) *image.NRGBA {
+	return decodeBlocks(data, width, height, 16, func(block []byte, out *[16]color.NRGBA) {
+		decodeColorBlock(block[8:], out, false)
+
+		alpha := dxt5AlphaPalette(block[0], block[1])
+		// 48 bits of indices, little endian
+		var bits uint64
+		for i := 7; i >= 2; i-- {
+			bits = bits<<8 | uint64(block[i])
+		}
+		for i := range out {
+			out[i].A = alpha[bits>>(3*uint(i))&7]
+		}
+	})
+}
+
+func decodeBlocks(data []byte, width, height, blockSize int, decode func(block []byte, out *[16]color.NRGBA)) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var pixels [16]color.NRGBA
+
+	pos := 0
+	for by := 0; by < height; by += 4 {
+		for bx := 0; bx < width; bx += 4 {
+			if pos+blockSize > len(data) {
+				return img
+			}
+			decode(data[pos:pos+blockSize], &pixels)
+			pos += blockSize
+
+			for i, c := range pixels {
+				x, y := bx+i%4, by+i/4
+				if x < width && y < height {
+					img.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+func decodeColorBlock(block []byte, out *[16]color.NRGBA, allowAlpha bool) {
+	c0 := binary.LittleEndian.Uint16(block)
+	c1 := binary.LittleEndian.Uint16(block[2:])
+	palette := dxtColorPalette(c0, c1, allowAlpha)
+
+	indices := binary.LittleEndian.Uint32(block[4:])
+	for i := range out {
+		out[i] = palette[indices>>(2*uint(i))&3]
+	}
+}
+
+func dxtColorPalette(c0, c1 uint16, allowAlpha bool) [4]color.NRGBA {
+	var ret [4]color.NRGBA
+	ret[0] = rgb565(c0)
+	ret[1] = rgb565(c1)
+
+	if c0 > c1 || !allowAlpha {
+		ret[2] = mixColors(ret[0], ret[1], 2, 1)
+		ret[3] = mixColors(ret[0], ret[1], 1, 2)
+	} else {
+		ret[2] = mixColors(ret[0], ret[1], 1, 1)
+		ret[3] = color.NRGBA{}
+	}
+	return ret
+}
+
+func dxt5AlphaPalette(a0, a1 uint8) [8]uint8 {
+	ret := [8]uint8{a0, a1}
+	if a0 > a1 {
+		for i := 1; i < 7; i++ {
+			ret[i+1] = uint8((int(a0)*(7-i) + int(a1)*i) / 7)
+		}
+	} else {
+		for i := 1; i < 5; i++ {
+			ret[i+1] = uint8((int(a0)*(5-i) + int(a1)*i) / 5)
+		}
+		ret[6] = 0
+		ret[7] = 255
+	}
+	return ret
+}
+
+func mixColors(a, b color.NRGBA, wa, wb int) color.NRGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8((int(x)*wa + int(y)*wb) / (wa + wb))
+	}
+	return color.NRGBA{R: mix(a.R, b.R), G: mix(a.G, b.G), B: mix(a.B, b.B), A: 255}
+}
+
+func encodeDXT1(img *image.NRGBA) []byte {
+	return encodeBlocks(img, 8, func(pixels *[16]color.NRGBA, block []byte) {
+		encodeColorBlock(pixels, block, true)
+	})
+}
+
+func encodeDXT5(img *image.NRGBA) []byte {
+	return encodeBlocks(img, 16, func(pixels *[16]color.NRGBA, block []byte) {
+		encodeAlphaBlock(pixels, block)
+		encodeColorBlock(pixels, block[8:], false)
+	})
+}
+
+func encodeBlocks(img *image.NRGBA, blockSize int, encode func(pixels *[16]color.NRGBA, block []byte)) []byte {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	ret := make([]byte, 0, (width+3)/4*((height+3)/4)*blockSize)
+	var pixels [16]color.NRGBA
+
+	for by := 0; by < height; by += 4 {
+		for bx := 0; bx < width; bx += 4 {
+			// Partial blocks are padded with the edge pixels
+			for i := range pixels {
+				x, y := minInt(bx+i%4, width-1), minInt(by+i/4, height-1)
+				pixels[i] = img.NRGBAAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			}
+
+			block := make([]byte, blockSize)
+			encode(&pixels, block)
+			ret = append(ret, block...)
+		}
+	}
+
+	return ret
+}
+
+func encodeColorBlock(pixels *[16]color.NRGBA, block []byte, allowAlpha bool) {
+	var opaque []color.NRGBA
+	for _, p := range pixels {
+		if !allowAlpha || p.A >= 128 {
+			opaque = append(opaque, p)
+		}
+	}
+	transparent := len(opaque) < len(pixels)
+
+	var c0, c1 uint16
+	if len(opaque) > 0 {
+		lo, hi := colorEndpoints(opaque)
+		c0, c1 = toRGB565(hi), toRGB565(lo)
+	}
+	// c0 > c1 selects 4 colors palette, otherwise the last color is transparent black
+	if transparent == (c0 > c1) {
+		c0, c1 = c1, c0
+	}
+	binary.LittleEndian.PutUint16(block, c0)
+	binary.LittleEndian.PutUint16(block[2:], c1)
+
+	palette := dxtColorPalette(c0, c1, allowAlpha)
+	colors := 4
+	if allowAlpha && c0 <= c1 {
+		colors = 3
+	}
+
+	var indices uint32
+	for i, p := range pixels {
+		index := 3
+		if !transparent || p.A >= 128 {
+			index = nearestColor(p, palette[:colors])
+		}
+		indices |= uint32(index) << (2 * uint(i))
+	}
+	binary.LittleEndian.PutUint32(block[4:], indices)
+}
+
+// Picks the extreme colors along the principal axis of the colors distribution.
+func colorEndpoints(colors []color.NRGBA) (lo, hi color.NRGBA) {
+	var mean [3]float64
+	for _, c := range colors {
+		mean[0] += float64(c.R)
+		mean[1] += float64(c.G)
+		mean[2] += float64(c.B)
+	}
+	for i := range mean {
+		mean[i] /= float64(len(colors))
+	}
+
+	var cov [3][3]float64
+	for _, c := range colors {
+		d := [3]float64{float64(c.R) - mean[0], float64(c.G) - mean[1], float64(c.B) - mean[2]}
+		for i := range d {
+			for j := range d {
+				cov[i][j] += d[i] * d[j]
+			}
+		}
+	}
+
+	// Power iteration converges to the eigenvector of the largest eigenvalue
+	axis := [3]float64{1, 1, 1}
+	for iter := 0; iter < 8; iter++ {
+		var next [3]float64
+		var norm float64
+		for i := range next {
+			for j := range axis {
+				next[i] += cov[i][j] * axis[j]
+			}
+			norm = math.Max(norm, math.Abs(next[i]))
+		}
+		if norm == 0 {
+			break
+		}
+		for i := range next {
+			axis[i] = next[i] / norm
+		}
+	}
+
+	minProj, maxProj := math.Inf(1), math.Inf(-1)
+	for _, c := range colors {
+		proj := float64(c.R)*axis[0] + float64(c.G)*axis[1] + float64(c.B)*axis[2]
+		if proj < minProj {
+			minProj, lo = proj, c
+		}
+		if proj > maxProj {
+			maxProj, hi = proj, c
+		}
+	}
+	return lo, hi
+}
+
+func nearestColor(c color.NRGBA, palette []color.NRGBA) int {
+	best, bestDist := 0, -1
+	for i, p := range palette {
+		dr, dg, db := int(c.R)-int(p.R), int(c.G)-int(p.G), int(c.B)-int(p.B)
+		dist := dr*dr + dg*dg + db*db
+		if bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+func encodeAlphaBlock(pixels *[16]color.NRGBA, block []byte) {
+	lo, hi := uint8(255), uint8(0)
+	for _, p := range pixels {
+		if p.A < lo {
+			lo = p.A
+		}
+		if p.A > hi {
+			hi = p.A
+		}
+	}
+
+	// a0 > a1 selects 8 interpolated values palette
+	block[0], block[1] = hi, lo
+	if hi == lo {
+		return
+	}
+	palette := dxt5AlphaPalette(hi, lo)
+
+	var bits uint64
+	for i, p := range pixels {
+		best, bestDist := 0, 256
+		for j, a := range palette {
+			dist := int(p.A) - int(a)
+			if dist < 0 {
+				dist = -dist
+			}
+			if dist < bestDist {
+				best, bestDist = j, dist
+			}
+		}
+		bits |= uint64(best) << (3 * uint(i))
+	}
+	for i := 2; i < 8; i++ {
+		block[i] = uint8(bits)
+		bits >>= 8
+	}
+}
+
+func toRGB565(c color.NRGBA) uint16 {
+	r := (uint16(c.R)*31 + 127) / 255
+	g := (uint16(c.G)*63 + 127) / 255
+	b := (uint16(c.B)*31 + 127) / 255
+	return r<<11 | g<<5 | b
+}
+
+func rgb565(c uint16) color.NRGBA {
+	r := uint8(c >> 11 & 0x1f)
+	g := uint8(c >> 5 & 0x3f)
+	b := uint8(c & 0x1f)
+	return color.NRGBA{R: r<<3 | r>>2, G: g<<2 | g>>4, B: b<<3 | b>>2, A: 255}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+/* FLAC stream decoder, see https://xiph.org/flac/format.html for the format.
+Only STREAMINFO is read from the metadata, CRC and MD5 checksums are not verified.
+*/
+
+const flacMagic = "fLaC"
+
+type flacStreamInfo struct {
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	Samples       uint64
+}
+
+// MSB first bit reader.
+type flacBitReader struct {
+	data []byte
+	pos  uint64
+}
+
+var errFLACTruncated = errors.New("FLAC data is truncated")
+
+func (r *flacBitReader) Read(bits uint) (uint64, error) {
+	if r.pos+uint64(bits) > uint64(len(r.data))*8 {
+		return 0, errFLACTruncated
+	}
+	var ret uint64
+	for bits > 0 {
+		offset := uint(r.pos % 8)
+		n := minInt(int(bits), int(8-offset))
+		b := uint64(r.data[r.pos/8]>>(8-offset-uint(n))) & (1<<uint(n) - 1)
+		ret = ret<<uint(n) | b
+		bits -= uint(n)
+		r.pos += uint64(n)
+	}
+	return ret, nil
+}
+
+func (r *flacBitReader) ReadSigned(bits uint) (int64, error) {
+	if bits == 0 {
+		return 0, nil
+	}
+	v, err := r.Read(bits)
+	return int64(v<<(64-bits)) >> (64 - bits), err
+}
+
+// Counts zero bits before the next set one.
+func (r *flacBitReader) ReadUnary() (uint64, error) {
+	var ret uint64
+	for {
+		if r.pos >= uint64(len(r.data))*8 {
+			return 0, errFLACTruncated
+		}
+		// Skip whole zero bytes at once
+		if r.pos%8 == 0 && r.data[r.pos/8] == 0 {
+			ret += 8
+			r.pos += 8
+			continue
+		}
+		if r.data[r.pos/8]>>(7-r.pos%8)&1 != 0 {
+			r.pos++
+			return ret, nil
+		}
+		ret++
+		r.pos++
+	}
+}
+
+func (r *flacBitReader) Align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+func ParseFLAC(data []byte) (PCMAudio, error) {
+	// ID3v2 tags are sometimes prepended to the stream
+	data, err := skipID3v2(data)
+	if err != nil {
+		return PCMAudio{}, err
+	}
+	if len(data) < 4 || string(data[:4]) != flacMagic {
+		return PCMAudio{}, errors.New("not a FLAC file")
+	}
+
+	var info flacStreamInfo
+	gotInfo := false
+	pos := 4
+	for last := false; !last; {
+		if pos+4 > len(data) {
+			return PCMAudio{}, errFLACTruncated
+		}
+		last = data[pos]&0x80 != 0
+		typ := data[pos] & 0x7f
+		size := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		pos += 4
+		if pos+size > len(data) {
+			return PCMAudio{}, errFLACTruncated
+		}
+
+		if typ == 0 && size >= 18 {
+			r := flacBitReader{data: data[pos+10 : pos+18]}
+			rate, _ := r.Read(20)
+			channels, _ := r.Read(3)
+			bits, _ := r.Read(5)
+			samples, _ := r.Read(36)
+			info = flacStreamInfo{int(rate), int(channels) + 1, int(bits) + 1, samples}
+			gotInfo = true
+		}
+		pos += size
+	}
+	if !gotInfo {
+		return PCMAudio{}, errors.New("STREAMINFO is missing")
+	}
+	if info.SampleRate == 0 {
+		return PCMAudio{}, errors.New("invalid sample rate")
+	}
+
+	ret := PCMAudio{
+		Channels:      info.Channels,
+		SampleRate:    info.SampleRate,
+		BitsPerSample: (info.BitsPerSample + 7) / 8 * 8,
+	}
+	ret.Data = make([]byte, 0, info.Samples*uint64(info.Channels*ret.BitsPerSample/8))
+
+	r := flacBitReader{data: data[pos:]}
+	samples := make([][]int64, info.Channels)
+	for frame := 0; r.pos/8 < uint64(len(r.data)); frame++ {
+		blockSize, err := decodeFLACFrame(&r, info, samples)
+		if err == errFLACTruncated && frame > 0 {
+			// Truncated last frame is dropped like players do
+			break
+		}
+		if err != nil {
+			return ret, errors.Wrapf(err, "frame %v", frame)
+		}
+		ret.Data = appendPCM(ret.Data, samples, blockSize, info.BitsPerSample, ret.BitsPerSample)
+	}
+
+	return ret, nil
+}
+
+// Decodes a frame into samples per channel, returns the block size.
+func decodeFLACFrame(r *flacBitReader, info flacStreamInfo, samples [][]int64) (int, error) {
+	sync, err := r.Read(14)
+	if err != nil {
+		return 0, err
+	}
+	if sync != 0x3ffe {
+		return 0, errors.New("frame sync code not found")
+	}
+
+	// Reserved bit and blocking strategy
+	r.Read(2)
+	blockCode, _ := r.Read(4)
+	rateCode, _ := r.Read(4)
+	assignment, _ := r.Read(4)
+	sizeCode, _ := r.Read(3)
+	_, err = r.Read(1)
+	if err != nil {
+		return 0, err
+	}
+
+	// UTF-8 like coded frame or sample number
+	first, err := r.Read(8)
+	if err != nil {
+		return 0, err
+	}
+	for mask := uint64(0x80); first&mask != 0 && mask > 1; mask >>= 1 {
+		if mask != 0x80 {
+			r.Read(8)
+		}
+	}
+
+	var blockSize int
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		v, _ := r.Read(8)
+		blockSize = int(v) + 1
+	case blockCode == 7:
+		v, _ := r.Read(16)
+		blockSize = int(v) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return 0, errors.New("reserved block size")
+	}
+
+	// Sample rate is taken from STREAMINFO, the frame may only repeat it
+	switch rateCode {
+	case 12:
+		r.Read(8)
+	case 13, 14:
+		r.Read(16)
+	case 15:
+		return 0, errors.New("invalid sample rate")
+	}
+
+	bits := info.BitsPerSample
+	if sizeCode != 0 {
+		bits = []int{0, 8, 12, 0, 16, 20, 24, 32}[sizeCode]
+		if bits == 0 {
+			return 0, errors.New("reserved sample size")
+		}
+	}
+
+	channels := int(assignment) + 1
+	if assignment >= 8 {
+		if assignment > 10 {
+			return 0, errors.Errorf("reserved channel assignment %v", assignment)
+		}
+		channels = 2
+	}
+	if channels != info.Channels {
+		return 0, errors.Errorf("%v channels in the frame, %v expected", channels, info.Channels)
+	}
+
+	// CRC-8 of the header
+	_, err = r.Read(8)
+	if err != nil {
+		return 0, err
+	}
+
+	for ch := 0; ch < channels; ch++ {
+		// Side channel has an extra bit
+		chBits := bits
+		if (assignment == 8 || assignment == 10) && ch == 1 || assignment == 9 && ch == 0 {
+			chBits++
+		}
+
+		if cap(samples[ch]) < blockSize {
+			samples[ch] = make([]int64, blockSize)
+		}
+		samples[ch] = samples[ch][:blockSize]
+		err = decodeFLACSubframe(r, uint(chBits), samples[ch])
+		if err != nil {
+			return 0, errors.Wrapf(err, "channel %v", ch)
+		}
+	}
+
+	switch assignment {
+	case 8:
+		for i, side := range samples[1] {
+			samples[1][i] = samples[0][i] - side
+		}
+	case 9:
+		for i, side := range samples[0] {
+			samples[0][i] = side + samples[1][i]
+		}
+	case 10:
+		for i, mid := range samples[0] {
+			side := samples[1][i]
+			mid = mid<<1 | side&1
+			samples[0][i] = (mid + side) >> 1
+			samples[1][i] = (mid - side) >> 1
+		}
+	}
+
+	// Padding and CRC-16 of the frame
+	r.Align()
+	_, err = r.Read(16)
+	return blockSize, err
+}
+
+var flacFixedCoefs = [][]int64{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func decodeFLACSubframe(r *flacBitReader, bits uint, out []int64) error {
+	header, err := r.Read(8)
+	if err != nil {
+		return err
+	}
+	if header&0x80 != 0 {
+		return errors.New("invalid subframe padding")
+	}
+	typ := header >> 1 & 0x3f
+
+	wasted := uint(0)
+	if header&1 != 0 {
+		k, err := r.ReadUnary()
+		if err != nil {
+			return err
+		}
+		wasted = uint(k) + 1
+		if wasted >= bits {
+			return errors.New("invalid wasted bits count")
+		}
+		bits -= wasted
+	}
+
+	switch {
+	case typ == 0:
+		v, err := r.ReadSigned(bits)
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = v
+		}
+
+	case typ == 1:
+		for i := range out {
+			out[i], err = r.ReadSigned(bits)
+			if err != nil {
+				return err
+			}
+		}
+
+	case typ >= 8 && typ <= 12:
+		order := int(typ - 8)
+		err = decodeFLACPrediction(r, bits, out, flacFixedCoefs[order], 0)
+		if err != nil {
+			return err
+		}
+
+	case typ >= 32:
+		order := int(typ-32) + 1
+		if order > len(out) {
+			return errors.New("LPC order exceeds block size")
+		}
+		// Warm up samples come first, read them into place before the coefficients
+		for i := 0; i < order; i++ {
+			out[i], err = r.ReadSigned(bits)
+			if err != nil {
+				return err
+			}
+		}
+		precision, err := r.Read(4)
+		if err != nil {
+			return err
+		}
+		if precision == 15 {
+			return errors.New("invalid LPC precision")
+		}
+		shift, err := r.ReadSigned(5)
+		if err != nil {
+			return err
+		}
+		if shift < 0 {
+			return errors.New("negative LPC shift")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			coefs[i], err = r.ReadSigned(uint(precision) + 1)
+			if err != nil {
+				return err
+			}
+		}
+		err = decodeFLACResidual(r, out, order)
+		if err != nil {
+			return err
+		}
+		predictFLAC(out, coefs, uint(shift))
+
+	default:
+		return errors.Errorf("reserved subframe type %v", typ)
+	}
+
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= wasted
+		}
+	}
+	return nil
+}
+
+// Reads warm up samples and residual, then restores the signal.
+func decodeFLACPrediction(r *flacBitReader, bits uint, out []int64, coefs []int64, shift uint) error {
+	order := len(coefs)
+	if order > len(out) {
+		return errors.New("predictor order exceeds block size")
+	}
+	var err error
+	for i := 0; i < order; i++ {
+		out[i], err = r.ReadSigned(bits)
+		if err != nil {
+			return err
+		}
+	}
+	err = decodeFLACResidual(r, out, order)
+	if err != nil {
+		return err
+	}
+	predictFLAC(out, coefs, shift)
+	return nil
+}
+
+// Adds the prediction to the residual stored after the warm up samples.
+func predictFLAC(out []int64, coefs []int64, shift uint) {
+	order := len(coefs)
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += c * out[i-1-j]
+		}
+		out[i] += sum >> shift
+	}
+}
+
+func decodeFLACResidual(r *flacBitReader, out []int64, order int) error {
+	method, err := r.Read(2)
+	if err != nil {
+		return err
+	}
+	if method > 1 {
+		return errors.Errorf("reserved residual coding method %v", method)
+	}
+	paramBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+
+	partitionOrder, err := r.Read(4)
+	if err != nil {
+		return err
+	}
+	partitions := 1 << partitionOrder
+	if len(out)%partitions != 0 || len(out)/partitions < order {
+		return errors.New("invalid residual partition order")
+	}
+
+	pos := order
+	for p := 0; p < partitions; p++ {
+		count := len(out) / partitions
+		if p == 0 {
+			count -= order
+		}
+
+		param, err := r.Read(paramBits)
+		if err != nil {
+			return err
+		}
+
+		if param == escape {
+			bits, err := r.Read(5)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < count; i++ {
+				out[pos], err = r.ReadSigned(uint(bits))
+				if err != nil {
+					return err
+				}
+				pos++
+			}
+			continue
+		}
+
+		for i := 0; i < count; i++ {
+			high, err := r.ReadUnary()
+			if err != nil {
+				return err
+			}
+			low, err := r.Read(uint(param))
+			if err != nil {
+				return err
+			}
+			v := high<<param | low
+			out[pos] = int64(v>>1) ^ -int64(v&1)
+			pos++
+		}
+	}
+	return nil
+}
+
+// Appends interleaved little endian samples, widening them to the container size.
+func appendPCM(data []byte, samples [][]int64, count, bits, containerBits int) []byte {
+	shift := uint(containerBits - bits)
+	var buf [4]byte
+	for i := 0; i < count; i++ {
+		for _, ch := range samples {
+			v := ch[i] << shift
+			switch containerBits {
+			case 8:
+				// 8-bit PCM is unsigned
+				data = append(data, uint8(v+128))
+			case 16:
+				binary.LittleEndian.PutUint16(buf[:], uint16(v))
+				data = append(data, buf[:2]...)
+			case 24:
+				binary.LittleEndian.PutUint32(buf[:], uint32(v))
+				data = append(data, buf[:3]...)
+			default:
+				binary.LittleEndian.PutUint32(buf[:], uint32(v))
+				data = append(data, buf[:4]...)
+			}
+		}
+	}
+	return data
+}
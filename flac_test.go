@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// MSB first bit writer producing the test streams.
+type flacTestWriter struct {
+	data []byte
+	pos  uint
+}
+
+func (w *flacTestWriter) Write(v uint64, bits uint) {
+	for i := int(bits) - 1; i >= 0; i-- {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.data[len(w.data)-1] |= 1 << (7 - w.pos%8)
+		}
+		w.pos++
+	}
+}
+
+func (w *flacTestWriter) WriteSigned(v int64, bits uint) {
+	w.Write(uint64(v)&(1<<bits-1), bits)
+}
+
+func (w *flacTestWriter) Align() {
+	for w.pos%8 != 0 {
+		w.Write(0, 1)
+	}
+}
+
+type flacTestSubframe struct {
+	// 0 constant, 1 verbatim, 8 fixed, 32 LPC as in the subframe header
+	typ    int
+	order  int
+	coefs  []int64
+	shift  uint
+	wasted uint
+	// The last residual partition is stored as raw values
+	escape bool
+}
+
+func (s flacTestSubframe) write(w *flacTestWriter, x []int64, bits uint) {
+	typ := s.typ
+	switch typ {
+	case 8:
+		typ += s.order
+	case 32:
+		typ += len(s.coefs) - 1
+	}
+	w.Write(uint64(typ), 7)
+	if s.wasted > 0 {
+		w.Write(1, 1)
+		w.Write(1, s.wasted)
+		bits -= s.wasted
+		shifted := make([]int64, len(x))
+		for i, v := range x {
+			shifted[i] = v >> s.wasted
+		}
+		x = shifted
+	} else {
+		w.Write(0, 1)
+	}
+
+	switch s.typ {
+	case 0:
+		w.WriteSigned(x[0], bits)
+	case 1:
+		for _, v := range x {
+			w.WriteSigned(v, bits)
+		}
+	case 8:
+		s.writePrediction(w, x, bits, flacFixedCoefs[s.order])
+	case 32:
+		s.writePrediction(w, x, bits, s.coefs)
+	}
+}
+
+func (s flacTestSubframe) writePrediction(w *flacTestWriter, x []int64, bits uint, coefs []int64) {
+	order := len(coefs)
+	for _, v := range x[:order] {
+		w.WriteSigned(v, bits)
+	}
+	if s.typ == 32 {
+		const precision = 12
+		w.Write(precision-1, 4)
+		w.WriteSigned(int64(s.shift), 5)
+		for _, c := range coefs {
+			w.WriteSigned(c, precision)
+		}
+	}
+
+	residual := make([]int64, len(x))
+	for i := order; i < len(x); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += c * x[i-1-j]
+		}
+		residual[i] = x[i] - sum>>s.shift
+	}
+
+	// Rice coding with two partitions and a fixed parameter
+	const param = 4
+	w.Write(0, 2)
+	w.Write(1, 4)
+	half := len(x) / 2
+	for p, part := range [][]int64{residual[order:half], residual[half:]} {
+		if s.escape && p == 1 {
+			w.Write(15, 4)
+			w.Write(uint64(bits+2), 5)
+			for _, v := range part {
+				w.WriteSigned(v, bits+2)
+			}
+			continue
+		}
+		w.Write(param, 4)
+		for _, v := range part {
+			u := uint64(v<<1) ^ uint64(v>>63)
+			for i := uint64(0); i < u>>param; i++ {
+				w.Write(0, 1)
+			}
+			w.Write(1, 1)
+			w.Write(u&(1<<param-1), param)
+		}
+	}
+}
+
+type flacTestStream struct {
+	bits     uint
+	channels int
+	// Stereo decorrelation as in the frame header, independent channels if zero
+	assignment int
+	rate       int
+	// Sizes of the frames, the last one may be shorter
+	frames []int
+	sub    flacTestSubframe
+	// PADDING block after STREAMINFO
+	padding bool
+}
+
+// Generates the samples and encodes them.
+func (c flacTestStream) encode() ([]byte, [][]int64) {
+	total := 0
+	for _, size := range c.frames {
+		total += size
+	}
+	rnd := rand.New(rand.NewSource(int64(c.bits)))
+	amp := math.Exp2(float64(c.bits-1)) * 0.7
+	samples := make([][]int64, c.channels)
+	for ch := range samples {
+		samples[ch] = make([]int64, total)
+		for i := range samples[ch] {
+			v := int64(amp*math.Sin(float64(i)*0.05*float64(ch+1))) + rnd.Int63n(9) - 4
+			if c.sub.typ == 0 {
+				v = int64(ch*100 - 50)
+			}
+			samples[ch][i] = v &^ (1<<c.sub.wasted - 1)
+		}
+	}
+
+	w := &flacTestWriter{}
+	for _, b := range []byte(flacMagic) {
+		w.Write(uint64(b), 8)
+	}
+	if c.padding {
+		w.Write(0, 1)
+	} else {
+		w.Write(1, 1)
+	}
+	w.Write(0, 7)
+	w.Write(34, 24)
+	w.Write(uint64(c.frames[0]), 16)
+	w.Write(uint64(c.frames[0]), 16)
+	w.Write(0, 48)
+	w.Write(uint64(c.rate), 20)
+	w.Write(uint64(c.channels-1), 3)
+	w.Write(uint64(c.bits-1), 5)
+	w.Write(uint64(total), 36)
+	w.Write(0, 64)
+	w.Write(0, 64)
+	if c.padding {
+		w.Write(1<<7|1, 8)
+		w.Write(5, 24)
+		w.Write(0, 40)
+	}
+
+	pos := 0
+	for f, size := range c.frames {
+		w.Write(0x3ffe, 14)
+		w.Write(0, 2)
+		// Block size follows as 16 bits, sample rate and size are taken from STREAMINFO
+		w.Write(7, 4)
+		w.Write(0, 4)
+		if c.assignment >= 8 {
+			w.Write(uint64(c.assignment), 4)
+		} else {
+			w.Write(uint64(c.channels-1), 4)
+		}
+		w.Write(0, 4)
+		w.Write(uint64(f), 8)
+		w.Write(uint64(size-1), 16)
+		w.Write(0, 8)
+
+		block := make([][]int64, c.channels)
+		for ch := range block {
+			block[ch] = samples[ch][pos : pos+size]
+		}
+		subframes, bits := block, []uint{c.bits, c.bits}
+		if c.assignment >= 8 {
+			l, r := block[0], block[1]
+			side, mid := make([]int64, size), make([]int64, size)
+			for i := range side {
+				side[i] = l[i] - r[i]
+				mid[i] = (l[i] + r[i]) >> 1
+			}
+			switch c.assignment {
+			case 8:
+				subframes, bits = [][]int64{l, side}, []uint{c.bits, c.bits + 1}
+			case 9:
+				subframes, bits = [][]int64{side, r}, []uint{c.bits + 1, c.bits}
+			case 10:
+				subframes, bits = [][]int64{mid, side}, []uint{c.bits, c.bits + 1}
+			}
+		}
+		for ch, x := range subframes {
+			chBits := c.bits
+			if ch < len(bits) {
+				chBits = bits[ch]
+			}
+			c.sub.write(w, x, chBits)
+		}
+
+		w.Align()
+		w.Write(0, 16)
+		pos += size
+	}
+	return w.data, samples
+}
+
+// Interleaved samples of PCM audio as integers of the container size.
+func pcmValues(audio PCMAudio) []int64 {
+	size := audio.BitsPerSample / 8
+	var ret []int64
+	for i := 0; i+size <= len(audio.Data); i += size {
+		b := audio.Data[i:]
+		switch size {
+		case 1:
+			ret = append(ret, int64(b[0])-128)
+		case 2:
+			ret = append(ret, int64(int16(binary.LittleEndian.Uint16(b))))
+		case 3:
+			ret = append(ret, int64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8))
+		case 4:
+			ret = append(ret, int64(int32(binary.LittleEndian.Uint32(b))))
+		}
+	}
+	return ret
+}
+
+func TestParseFLAC(t *testing.T) {
+	lpc := flacTestSubframe{typ: 32, coefs: []int64{1800, -900, 100}, shift: 10}
+	cases := []struct {
+		name string
+		flacTestStream
+	}{
+		{"verbatim", flacTestStream{bits: 16, channels: 2, rate: 44100, frames: []int{64, 64}, sub: flacTestSubframe{typ: 1}}},
+		{"constant", flacTestStream{bits: 16, channels: 1, rate: 22050, frames: []int{32}, sub: flacTestSubframe{typ: 0}}},
+		{"fixed order 0", flacTestStream{bits: 8, channels: 1, rate: 8000, frames: []int{40, 40}, sub: flacTestSubframe{typ: 8}}},
+		{"fixed order 2", flacTestStream{bits: 16, channels: 2, rate: 44100, frames: []int{128, 128, 50}, sub: flacTestSubframe{typ: 8, order: 2}}},
+		{"fixed order 4", flacTestStream{bits: 24, channels: 1, rate: 96000, frames: []int{64}, sub: flacTestSubframe{typ: 8, order: 4}}},
+		{"lpc", flacTestStream{bits: 16, channels: 2, rate: 48000, frames: []int{96, 96}, sub: lpc}},
+		{"escaped partition", flacTestStream{bits: 24, channels: 2, rate: 48000, frames: []int{96}, sub: flacTestSubframe{typ: 32, coefs: lpc.coefs, shift: 10, escape: true}}},
+		{"wasted bits", flacTestStream{bits: 16, channels: 1, rate: 44100, frames: []int{64}, sub: flacTestSubframe{typ: 1, wasted: 3}}},
+		{"12 bits", flacTestStream{bits: 12, channels: 2, rate: 32000, frames: []int{64}, sub: flacTestSubframe{typ: 8, order: 1}}},
+		{"left side", flacTestStream{bits: 16, channels: 2, assignment: 8, rate: 44100, frames: []int{64, 30}, sub: flacTestSubframe{typ: 8, order: 2}}},
+		{"side right", flacTestStream{bits: 24, channels: 2, assignment: 9, rate: 44100, frames: []int{64}, sub: lpc}},
+		{"mid side", flacTestStream{bits: 16, channels: 2, assignment: 10, rate: 44100, frames: []int{64, 64}, sub: flacTestSubframe{typ: 1}}},
+		{"multichannel", flacTestStream{bits: 16, channels: 6, rate: 48000, frames: []int{32}, sub: flacTestSubframe{typ: 8, order: 3}}},
+		{"padding block", flacTestStream{bits: 16, channels: 1, rate: 44100, frames: []int{32}, sub: flacTestSubframe{typ: 1}, padding: true}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, samples := c.encode()
+			audio, err := ParseFLAC(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			container := int(c.bits+7) / 8 * 8
+			if audio.Channels != c.channels || audio.SampleRate != c.rate || audio.BitsPerSample != container {
+				t.Errorf("%v channels, %v Hz, %v bits", audio.Channels, audio.SampleRate, audio.BitsPerSample)
+			}
+			var expected []int64
+			for i := range samples[0] {
+				for ch := range samples {
+					expected = append(expected, samples[ch][i]<<uint(container-int(c.bits)))
+				}
+			}
+			if values := pcmValues(audio); !reflect.DeepEqual(values, expected) {
+				t.Errorf("decoded %v\nexpected %v", values, expected)
+			}
+		})
+	}
+}
+
+func TestParseFLACID3(t *testing.T) {
+	data, samples := flacTestStream{bits: 16, channels: 1, rate: 44100, frames: []int{16}, sub: flacTestSubframe{typ: 1}}.encode()
+	tag := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x04"), "tags"...)
+	audio, err := ParseFLAC(append(tag, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.Frames() != len(samples[0]) {
+		t.Errorf("%v frames, %v expected", audio.Frames(), len(samples[0]))
+	}
+}
+
+func TestParseFLACErrors(t *testing.T) {
+	stream := flacTestStream{bits: 16, channels: 2, rate: 44100, frames: []int{64}, sub: flacTestSubframe{typ: 1}}
+	data, _ := stream.encode()
+	// Frames start right after the STREAMINFO block
+	const frame = 4 + 4 + 34
+
+	modified := func(pos int, b byte) []byte {
+		ret := append([]byte(nil), data...)
+		ret[pos] = b
+		return ret
+	}
+	cases := map[string][]byte{
+		"not flac":             []byte("RIFF...."),
+		"truncated metadata":   data[:20],
+		"missing streaminfo":   {'f', 'L', 'a', 'C', 0x81, 0, 0, 0},
+		"bad sync":             modified(frame, 0),
+		"reserved assignment":  modified(frame+3, 0xb0),
+		"wrong channels count": modified(frame+3, 0x00),
+		"truncated frame":      data[:frame+20],
+		"ID3 out of range":     []byte("ID3\x03\x00\x00\x00\x00\x7f\x7f"),
+	}
+	for name, data := range cases {
+		_, err := ParseFLAC(data)
+		if err == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+}
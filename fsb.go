@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+/* FMOD sound bank v5, the container of AudioClip data since unity 5.0.
+Header(60 bytes, 64 for version 0):
+	"FSB5", version, samples count, sample headers size, name table size, data size, codec(mode),
+	8 zero bytes, 16 bytes hash, 8 unknown bytes
+Sample headers are 64-bit bit fields, optionally followed by extra chunks(next chunk flag):
+	bit 0: next chunk, bits 1-4: frequency index, bit 5: stereo, bits 6-33: data offset / 16, bits 34-63: frames
+Chunks: 32-bit header(bit 0: next chunk, bits 1-24: size, bits 25-31: type) followed by the data.
+Name table: offsets of null terminated names relative to the table start.
+See https://github.com/HearthSim/python-fsb5 for details.
+*/
+
+type FSBCodec uint32
+
+const (
+	FSBCodecNone     FSBCodec = 0
+	FSBCodecPCM8     FSBCodec = 1
+	FSBCodecPCM16    FSBCodec = 2
+	FSBCodecPCM24    FSBCodec = 3
+	FSBCodecPCM32    FSBCodec = 4
+	FSBCodecPCMFloat FSBCodec = 5
+	FSBCodecGCADPCM  FSBCodec = 6
+	FSBCodecIMAADPCM FSBCodec = 7
+	FSBCodecVAG      FSBCodec = 8
+	FSBCodecHEVAG    FSBCodec = 9
+	FSBCodecXMA      FSBCodec = 10
+	FSBCodecMPEG     FSBCodec = 11
+	FSBCodecCELT     FSBCodec = 12
+	FSBCodecAT9      FSBCodec = 13
+	FSBCodecXWMA     FSBCodec = 14
+	FSBCodecVorbis   FSBCodec = 15
+	FSBCodecFADPCM   FSBCodec = 16
+)
+
+var fsbCodecNames = map[FSBCodec]string{
+	FSBCodecNone:     "None",
+	FSBCodecPCM8:     "PCM8",
+	FSBCodecPCM16:    "PCM16",
+	FSBCodecPCM24:    "PCM24",
+	FSBCodecPCM32:    "PCM32",
+	FSBCodecPCMFloat: "PCMFloat",
+	FSBCodecGCADPCM:  "GCADPCM",
+	FSBCodecIMAADPCM: "IMAADPCM",
+	FSBCodecVAG:      "VAG",
+	FSBCodecHEVAG:    "HEVAG",
+	FSBCodecXMA:      "XMA",
+	FSBCodecMPEG:     "MPEG",
+	FSBCodecCELT:     "CELT",
+	FSBCodecAT9:      "AT9",
+	FSBCodecXWMA:     "XWMA",
+	FSBCodecVorbis:   "Vorbis",
+	FSBCodecFADPCM:   "FADPCM",
+}
+
+func (c FSBCodec) String() string {
+	if name, ok := fsbCodecNames[c]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+var fsbFrequencies = map[uint64]int{
+	1: 8000, 2: 11000, 3: 11025, 4: 16000, 5: 22050, 6: 24000, 7: 32000, 8: 44100, 9: 48000,
+}
+
+const (
+	fsbMagic      = "FSB5"
+	fsbHeaderSize = 60
+
+	fsbChunkChannels  = 1
+	fsbChunkFrequency = 2
+)
+
+type fsbHeader struct {
+	Magic             [4]byte
+	Version           uint32
+	SampleCount       uint32
+	SampleHeadersSize uint32
+	NameTableSize     uint32
+	DataSize          uint32
+	Codec             FSBCodec
+	Zero              [8]byte
+	Hash              [16]byte
+	Unknown           [8]byte
+}
+
+type FSB5 struct {
+	Version uint32
+	Codec   FSBCodec
+	Samples []FSBSample
+}
+
+type FSBSample struct {
+	Name      string
+	Frequency int
+	Channels  int
+	Frames    uint64
+	Data      []byte `json:"-"`
+}
+
+func IsFSB5(data []byte) bool {
+	return len(data) >= 4 && string(data[:4]) == fsbMagic
+}
+
+func ParseFSB5(data []byte) (*FSB5, error) {
+	var header fsbHeader
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read FSB5 header")
+	}
+	if string(header.Magic[:]) != fsbMagic {
+		return nil, errors.New("not a FSB5 file")
+	}
+
+	pos := fsbHeaderSize
+	if header.Version == 0 {
+		pos += 4
+	}
+
+	samplesStart := pos
+	namesStart := samplesStart + int(header.SampleHeadersSize)
+	dataStart := namesStart + int(header.NameTableSize)
+	dataEnd := dataStart + int(header.DataSize)
+	if dataEnd > len(data) {
+		return nil, errors.Errorf("FSB5 data is truncated: %v bytes, %v expected", len(data), dataEnd)
+	}
+
+	ret := &FSB5{Version: header.Version, Codec: header.Codec}
+	offsets := make([]int, header.SampleCount)
+	for i := range offsets {
+		if pos+8 > namesStart {
+			return nil, errors.New("FSB5 sample headers are truncated")
+		}
+		raw := binary.LittleEndian.Uint64(data[pos:])
+		pos += 8
+
+		sample := FSBSample{
+			Frequency: fsbFrequencies[raw>>1&0xf],
+			Channels:  int(raw>>5&1) + 1,
+			Frames:    raw >> 34 & 0x3fffffff,
+		}
+		offsets[i] = int(raw>>6&0xfffffff) * 16
+
+		for next := raw&1 != 0; next; {
+			if pos+4 > namesStart {
+				return nil, errors.New("FSB5 sample chunks are truncated")
+			}
+			chunk := binary.LittleEndian.Uint32(data[pos:])
+			pos += 4
+			next = chunk&1 != 0
+			size := int(chunk >> 1 & 0xffffff)
+			if pos+size > namesStart {
+				return nil, errors.New("FSB5 sample chunks are truncated")
+			}
+
+			switch chunk >> 25 {
+			case fsbChunkChannels:
+				if size >= 1 {
+					sample.Channels = int(data[pos])
+				}
+			case fsbChunkFrequency:
+				if size >= 4 {
+					sample.Frequency = int(binary.LittleEndian.Uint32(data[pos:]))
+				}
+			}
+			pos += size
+		}
+
+		ret.Samples = append(ret.Samples, sample)
+	}
+
+	for i := range ret.Samples {
+		start, end := offsets[i], int(header.DataSize)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		if start > end || dataStart+end > dataEnd {
+			return nil, errors.Errorf("FSB5 sample %v data out of range", i)
+		}
+		ret.Samples[i].Data = data[dataStart+start : dataStart+end]
+
+		if header.NameTableSize > 0 && namesStart+4*(i+1) <= dataStart {
+			offset := namesStart + int(binary.LittleEndian.Uint32(data[namesStart+4*i:]))
+			if offset < dataStart {
+				name := data[offset:dataStart]
+				if end := bytes.IndexByte(name, 0); end >= 0 {
+					name = name[:end]
+				}
+				ret.Samples[i].Name = string(name)
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// Returns the first sample as a plain audio file if the codec allows it.
+func (f *FSB5) Extract() (ext string, data []byte, ok bool) {
+	if len(f.Samples) == 0 {
+		return "", nil, false
+	}
+	sample := f.Samples[0]
+
+	switch f.Codec {
+	case FSBCodecPCM8, FSBCodecPCM16, FSBCodecPCM32:
+		bits := map[FSBCodec]int{FSBCodecPCM8: 8, FSBCodecPCM16: 16, FSBCodecPCM32: 32}[f.Codec]
+		return ".wav", PCMAudio{
+			Channels:      sample.Channels,
+			SampleRate:    sample.Frequency,
+			BitsPerSample: bits,
+			Data:          sample.Data,
+		}.WAV(), true
+
+	case FSBCodecMPEG:
+		// Raw MPEG frames, possibly with some padding between them which players skip
+		return ".mp3", sample.Data, true
+	}
+
+	// Vorbis packets are stored without the headers, they can't be restored without the FMOD setup headers database
+	return "", nil, false
+}
+
+// Creates a single sample FSB5 container with PCM data.
+func NewFSB5(audio PCMAudio) ([]byte, error) {
+	var codec FSBCodec
+	switch audio.BitsPerSample {
+	case 8:
+		codec = FSBCodecPCM8
+	case 16:
+		codec = FSBCodecPCM16
+	case 32:
+		codec = FSBCodecPCM32
+	default:
+		return nil, errors.Errorf("unsupported bits per sample %v", audio.BitsPerSample)
+	}
+	if audio.Channels < 1 || audio.Channels > 255 {
+		return nil, errors.Errorf("unsupported channels count %v", audio.Channels)
+	}
+
+	var chunks [][]byte
+	var freqIndex uint64
+	for idx, freq := range fsbFrequencies {
+		if freq == audio.SampleRate {
+			freqIndex = idx
+		}
+	}
+	if freqIndex == 0 {
+		chunk := make([]byte, 4)
+		binary.LittleEndian.PutUint32(chunk, uint32(audio.SampleRate))
+		chunks = append(chunks, fsbChunk(fsbChunkFrequency, chunk))
+	}
+	if audio.Channels > 2 {
+		chunks = append(chunks, fsbChunk(fsbChunkChannels, []byte{uint8(audio.Channels)}))
+	}
+
+	raw := freqIndex<<1 | uint64(audio.Frames())<<34
+	if audio.Channels == 2 {
+		raw |= 1 << 5
+	}
+	if len(chunks) > 0 {
+		raw |= 1
+	}
+
+	var samples bytes.Buffer
+	binary.Write(&samples, binary.LittleEndian, raw)
+	for i, chunk := range chunks {
+		if i < len(chunks)-1 {
+			chunk[0] |= 1
+		}
+		samples.Write(chunk)
+	}
+
+	header := fsbHeader{
+		Version:           1,
+		SampleCount:       1,
+		SampleHeadersSize: uint32(samples.Len()),
+		DataSize:          uint32(len(audio.Data)),
+		Codec:             codec,
+	}
+	copy(header.Magic[:], fsbMagic)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(samples.Bytes())
+	buf.Write(audio.Data)
+	return buf.Bytes(), nil
+}
+
+func fsbChunk(typ uint32, data []byte) []byte {
+	ret := make([]byte, 4, 4+len(data))
+	binary.LittleEndian.PutUint32(ret, uint32(len(data))<<1|typ<<25)
+	return append(ret, data...)
+}
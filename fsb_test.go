@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestFSB5RoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		audio PCMAudio
+		codec FSBCodec
+	}{
+		{"pcm8 mono", PCMAudio{1, 22050, 8, []byte{1, 2, 3, 4, 5}}, FSBCodecPCM8},
+		{"pcm16 stereo", PCMAudio{2, 44100, 16, bytes.Repeat([]byte{1, 2, 3, 4}, 100)}, FSBCodecPCM16},
+		{"pcm32 multichannel", PCMAudio{6, 48000, 32, make([]byte, 6*4*10)}, FSBCodecPCM32},
+		{"custom frequency", PCMAudio{2, 37800, 16, make([]byte, 4*7)}, FSBCodecPCM16},
+		{"custom frequency multichannel", PCMAudio{3, 96000, 16, make([]byte, 6*3)}, FSBCodecPCM16},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := NewFSB5(c.audio)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsFSB5(data) {
+				t.Error("FSB5 signature is missing")
+			}
+
+			fsb, err := ParseFSB5(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := []FSBSample{{
+				Frequency: c.audio.SampleRate,
+				Channels:  c.audio.Channels,
+				Frames:    uint64(c.audio.Frames()),
+				Data:      c.audio.Data,
+			}}
+			if fsb.Codec != c.codec || !reflect.DeepEqual(fsb.Samples, expected) {
+				t.Errorf("parsed %v %+v\nexpected %v %+v", fsb.Codec, fsb.Samples, c.codec, expected)
+			}
+
+			ext, wav, ok := fsb.Extract()
+			if !ok || ext != ".wav" {
+				t.Fatalf("extracted as %q, %v", ext, ok)
+			}
+			audio, err := ParseWAV(wav)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(audio, c.audio) {
+				t.Errorf("extracted %+v\nexpected %+v", audio, c.audio)
+			}
+		})
+	}
+}
+
+func TestNewFSB5Errors(t *testing.T) {
+	for _, audio := range []PCMAudio{
+		{1, 44100, 24, make([]byte, 3)},
+		{0, 44100, 16, nil},
+		{256, 44100, 8, make([]byte, 256)},
+	} {
+		_, err := NewFSB5(audio)
+		if err == nil {
+			t.Errorf("%v channels, %v bits: error expected", audio.Channels, audio.BitsPerSample)
+		}
+	}
+}
+
+// Bank of several samples with names as written by FMOD.
+func fsbTestBank(version uint32, codec FSBCodec) []byte {
+	samples := packed(le,
+		// 44100 Hz stereo, 100 frames, next chunk
+		uint64(8<<1|1<<5|1|100<<34),
+		uint32(4<<1|fsbChunkFrequency<<25), uint32(12345),
+		// Second sample data starts at 32
+		uint64(3<<1|2<<6|50<<34),
+	)
+	names := packed(le, uint32(8), uint32(14), []byte("music\x00intro\x00\x00\x00"))
+	data := append(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 20)...)
+
+	header := fsbHeader{
+		Version:           version,
+		SampleCount:       2,
+		SampleHeadersSize: uint32(len(samples)),
+		NameTableSize:     uint32(len(names)),
+		DataSize:          uint32(len(data)),
+		Codec:             codec,
+	}
+	copy(header.Magic[:], fsbMagic)
+	ret := packed(le, header)
+	if version == 0 {
+		ret = append(ret, 0, 0, 0, 0)
+	}
+	return packed(le, ret, samples, names, data)
+}
+
+func TestParseFSB5(t *testing.T) {
+	for _, version := range []uint32{0, 1} {
+		fsb, err := ParseFSB5(fsbTestBank(version, FSBCodecMPEG))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := &FSB5{Version: version, Codec: FSBCodecMPEG, Samples: []FSBSample{
+			{Name: "music", Frequency: 12345, Channels: 2, Frames: 100, Data: bytes.Repeat([]byte{1}, 32)},
+			{Name: "intro", Frequency: 11025, Channels: 1, Frames: 50, Data: bytes.Repeat([]byte{2}, 20)},
+		}}
+		if !reflect.DeepEqual(fsb, expected) {
+			t.Errorf("version %v: parsed %+v\nexpected %+v", version, fsb, expected)
+		}
+
+		ext, data, ok := fsb.Extract()
+		if !ok || ext != ".mp3" || !bytes.Equal(data, expected.Samples[0].Data) {
+			t.Errorf("version %v: extracted as %q, %v", version, ext, ok)
+		}
+	}
+
+	fsb, err := ParseFSB5(fsbTestBank(1, FSBCodecVorbis))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := fsb.Extract(); ok {
+		t.Error("vorbis samples can't be extracted")
+	}
+}
+
+func TestParseFSB5Errors(t *testing.T) {
+	bank := fsbTestBank(1, FSBCodecPCM16)
+	modified := func(pos int, v uint32) []byte {
+		ret := append([]byte(nil), bank...)
+		binary.LittleEndian.PutUint32(ret[pos:], v)
+		return ret
+	}
+	cases := map[string][]byte{
+		"not fsb":           append([]byte("FSB4"), bank[4:]...),
+		"truncated header":  bank[:30],
+		"truncated data":    bank[:len(bank)-1],
+		"too many samples":  modified(8, 3),
+		"truncated chunk":   modified(fsbHeaderSize+8, 40<<1|fsbChunkFrequency<<25),
+		"data out of range": modified(fsbHeaderSize+16, 3<<1|100<<6),
+	}
+	for name, data := range cases {
+		_, err := ParseFSB5(data)
+		if err == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/* Installs the output of the pack commands into the data root.
+The manifest in the data root lists sha256 of the replaced and installed files,
+so uninstall restores the originals only if the installed files are still in place.
+The manifest is updated after each file, so interrupted runs can be resumed or undone.
+*/
+
+const InstallManifest = "shadowed-install.json"
+
+type installManifest struct {
+	// Output dir of the last install
+	Source string
+	Files  []installedFile
+}
+
+type installedFile struct {
+	// Relative to the data root
+	Path string
+	// Hash of the replaced file, empty for new files
+	Original string `json:",omitempty"`
+	// Copy of the replaced file, relative to the data root
+	Backup string `json:",omitempty"`
+	New    string
+}
+
+// install <output_dir> <data_root>
+func Install() error {
+	outputDir, dataRoot := os.Args[2], os.Args[3]
+
+	if _, err := os.Stat(path.Join(dataRoot, MainData)); err != nil {
+		return errors.Errorf("%v doesn't look like a data root, %v is missing", dataRoot, MainData)
+	}
+
+	manifest, err := readInstallManifest(dataRoot)
+	if os.IsNotExist(errors.Cause(err)) {
+		manifest, err = installManifest{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	installed := make(map[string]int)
+	for i, f := range manifest.Files {
+		installed[strings.ToLower(f.Path)] = i
+	}
+
+	files, err := installFiles(outputDir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.Errorf("nothing to install in %v", outputDir)
+	}
+
+	// Everything is checked before the first file is replaced
+	current := make(map[string]string)
+	for _, file := range files {
+		target := path.Join(dataRoot, file)
+		hash, err := fileHash(target)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		current[file] = hash
+
+		// Originals restored after the previous install are replaced again
+		if i, ok := installed[strings.ToLower(file)]; ok && hash != manifest.Files[i].New && hash != manifest.Files[i].Original {
+			return errors.Errorf("%v was changed after the previous install, the game may have been updated; "+
+				"verify the game files and remove %v", file, InstallManifest)
+		}
+
+		name := strings.ToLower(path.Base(file))
+		if hash != "" && (sceneFile.MatchString(name) || path.Ext(name) == ".assets") {
+			err = checkSameBuild(path.Join(outputDir, file), target)
+			if err != nil {
+				return errors.Wrap(err, file)
+			}
+		}
+	}
+
+	manifest.Source = outputDir
+	for _, file := range files {
+		log.Printf("  installing %v", file)
+		err = os.MkdirAll(path.Dir(path.Join(dataRoot, file)), 0777)
+		if err != nil {
+			return err
+		}
+		backup, err := copyFile(path.Join(outputDir, file), path.Join(dataRoot, file))
+		if err != nil {
+			return err
+		}
+		hash, err := fileHash(path.Join(dataRoot, file))
+		if err != nil {
+			return err
+		}
+
+		// The original is kept from the first install
+		if i, ok := installed[strings.ToLower(file)]; ok {
+			manifest.Files[i].New = hash
+		} else {
+			entry := installedFile{Path: file, Original: current[file], New: hash}
+			if backup != "" {
+				entry.Backup, err = filepath.Rel(dataRoot, backup)
+				if err != nil {
+					return err
+				}
+				entry.Backup = filepath.ToSlash(entry.Backup)
+			}
+			manifest.Files = append(manifest.Files, entry)
+			installed[strings.ToLower(file)] = len(manifest.Files) - 1
+		}
+
+		err = writeInstallManifest(dataRoot, manifest)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uninstall <data_root>
+func Uninstall() error {
+	dataRoot := os.Args[2]
+
+	manifest, err := readInstallManifest(dataRoot)
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.Errorf("nothing is installed to %v", dataRoot)
+	}
+	if err != nil {
+		return err
+	}
+
+	var restore []installedFile
+	for _, f := range manifest.Files {
+		hash, err := fileHash(path.Join(dataRoot, f.Path))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if hash == f.Original {
+			// E.g. restored by verifying the game files, missing for new files
+			log.Printf("  %v is already original", f.Path)
+			continue
+		}
+		if hash != f.New {
+			return errors.Errorf("%v was changed after the install, the game may have been updated; "+
+				"verify the game files and remove %v instead", f.Path, InstallManifest)
+		}
+		if f.Original != "" {
+			f.Backup, err = originalBackup(dataRoot, f)
+			if err != nil {
+				return err
+			}
+		}
+		restore = append(restore, f)
+	}
+
+	for i, f := range restore {
+		target := path.Join(dataRoot, f.Path)
+		if f.Original == "" {
+			// No backup, restore would bring the file back
+			log.Printf("  removing %v", f.Path)
+			err = os.Remove(target)
+		} else {
+			log.Printf("  restoring %v", f.Path)
+			_, err = copyFile(path.Join(dataRoot, f.Backup), target)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only the files left to restore stay in the manifest
+		if i+1 < len(restore) {
+			manifest.Files = restore[i+1:]
+			err = writeInstallManifest(dataRoot, manifest)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return os.Remove(path.Join(dataRoot, InstallManifest))
+}
+
+// Finds the backup of the original file, relative to the data root.
+// The recorded one may be pruned by later runs, see pruneBackups, so any other backup with the same hash would do.
+func originalBackup(dataRoot string, f installedFile) (string, error) {
+	hash, err := fileHash(path.Join(dataRoot, f.Backup))
+	if err == nil && hash == f.Original {
+		return f.Backup, nil
+	}
+
+	target := path.Join(dataRoot, f.Path)
+	infos, err := ioutil.ReadDir(path.Dir(target))
+	if err != nil {
+		return "", err
+	}
+	for _, info := range infos {
+		m := backupFile.FindStringSubmatch(info.Name())
+		if m == nil || m[1] != path.Base(target) {
+			continue
+		}
+		hash, err := fileHash(path.Join(path.Dir(target), info.Name()))
+		if err != nil {
+			return "", err
+		}
+		if hash == f.Original {
+			return path.Join(path.Dir(f.Path), info.Name()), nil
+		}
+	}
+	return "", errors.Errorf("original %v is not available, there is no backup matching it", f.Path)
+}
+
+// Files of the output dir relative to it, backups and temporary files are skipped.
+func installFiles(dir string) ([]string, error) {
+	var ret []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if backupFile.MatchString(info.Name()) || sizeRecordFile.MatchString(info.Name()) || strings.HasPrefix(info.Name(), ".") || info.Name() == InstallManifest {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		ret = append(ret, filepath.ToSlash(rel))
+		return nil
+	})
+	return ret, err
+}
+
+// Refuses assets files made for another build of the game, e.g. from a wrong data root.
+func checkSameBuild(file, target string) error {
+	assets, err := NewAssetsReader(file)
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	original, err := NewAssetsReader(target)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+
+	version, originalVersion := assets.MetaData.TypeInfo.Signature, original.MetaData.TypeInfo.Signature
+	if version != originalVersion {
+		return errors.Errorf("made for unity %v, the game uses %v", version, originalVersion)
+	}
+
+	externals, originalExternals := assets.MetaData.Externals, original.MetaData.Externals
+	if len(externals) != len(originalExternals) {
+		return errors.New("made from another data root, externals differ")
+	}
+	for i := range externals {
+		if !strings.EqualFold(externals[i].FilePath, originalExternals[i].FilePath) {
+			return errors.Errorf("made from another data root, %v is referred instead of %v",
+				externals[i].FilePath, originalExternals[i].FilePath)
+		}
+	}
+	return nil
+}
+
+func fileHash(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func readInstallManifest(dataRoot string) (installManifest, error) {
+	var ret installManifest
+	file := path.Join(dataRoot, InstallManifest)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ret, err
+	}
+	err = json.Unmarshal(data, &ret)
+	return ret, errors.Wrap(err, file)
+}
+
+// The manifest is replaced atomically, but its previous versions are of no use.
+func writeInstallManifest(dataRoot string, manifest installManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	out, err := CreateOutput(path.Join(dataRoot, InstallManifest))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.noBackup = true
+
+	_, err = out.Write(data)
+	if err != nil {
+		return err
+	}
+	return out.Commit()
+}
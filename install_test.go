@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		file := path.Join(dir, name)
+		err := os.MkdirAll(path.Dir(file), 0777)
+		if err == nil {
+			err = ioutil.WriteFile(file, []byte(data), 0666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func runInstallCommand(cmd func() error, args ...string) error {
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = append([]string{"shadowed", "install"}, args...)
+	return cmd()
+}
+
+func TestInstallUninstall(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "shadowed-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	outputDir, dataRoot := path.Join(tmp, "output"), path.Join(tmp, "data")
+	original := map[string]string{
+		MainData:                    "main",
+		"StreamingAssets/music.bnk": "music",
+		"sounds.resS":               "sounds",
+	}
+	writeTestFiles(t, dataRoot, original)
+	writeTestFiles(t, outputDir, map[string]string{
+		"StreamingAssets/music.bnk": "new music",
+		"sounds.resS":               "new sounds",
+		"added.txt":                 "added",
+	})
+
+	err = runInstallCommand(Install, outputDir, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readInstallManifest(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 3 || manifest.Source != outputDir {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	// Restored by verifying the game files, uninstall skips it and install replaces it again
+	writeTestFiles(t, dataRoot, map[string]string{"sounds.resS": "sounds"})
+	err = runInstallCommand(Install, outputDir, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, dataRoot, map[string]string{"sounds.resS": "sounds"})
+	err = os.Remove(path.Join(dataRoot, "added.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runInstallCommand(Uninstall, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range original {
+		data, err := ioutil.ReadFile(path.Join(dataRoot, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("%v: %q, %v after uninstall", name, data, err)
+		}
+	}
+	for _, name := range []string{"added.txt", InstallManifest} {
+		if _, err := os.Stat(path.Join(dataRoot, name)); !os.IsNotExist(err) {
+			t.Errorf("%v is left after uninstall", name)
+		}
+	}
+}
+
+// The backup made by the install may be pruned by the following reinstalls.
+func TestUninstallPrunedBackup(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "shadowed-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	outputDir, dataRoot := path.Join(tmp, "output"), path.Join(tmp, "data")
+	writeTestFiles(t, dataRoot, map[string]string{MainData: "main", "sounds.resS": "sounds"})
+	writeTestFiles(t, outputDir, map[string]string{"sounds.resS": "new sounds"})
+
+	install := func(data string) {
+		writeTestFiles(t, outputDir, map[string]string{"sounds.resS": data})
+		err := runInstallCommand(Install, outputDir, dataRoot)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	install("new sounds")
+	err = runInstallCommand(Uninstall, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	install("new sounds")
+	for i := 0; i < maxBackups; i++ {
+		install(fmt.Sprintf("new sounds %v", i))
+	}
+
+	manifest, err := readInstallManifest(dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(dataRoot, manifest.Files[0].Backup)); !os.IsNotExist(err) {
+		t.Fatalf("backup %v is expected to be pruned", manifest.Files[0].Backup)
+	}
+
+	err = runInstallCommand(Uninstall, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path.Join(dataRoot, "sounds.resS"))
+	if err != nil || string(data) != "sounds" {
+		t.Errorf("%q, %v after uninstall", data, err)
+	}
+}
+
+// Files changed after the install are not overwritten.
+func TestUninstallChanged(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "shadowed-install")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	outputDir, dataRoot := path.Join(tmp, "output"), path.Join(tmp, "data")
+	writeTestFiles(t, dataRoot, map[string]string{MainData: "main", "sounds.resS": "sounds"})
+	writeTestFiles(t, outputDir, map[string]string{"sounds.resS": "new sounds"})
+
+	err = runInstallCommand(Install, outputDir, dataRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, dataRoot, map[string]string{"sounds.resS": "updated sounds"})
+
+	if runInstallCommand(Uninstall, dataRoot) == nil {
+		t.Error("uninstall of the changed file is expected to fail")
+	}
+	if runInstallCommand(Install, outputDir, dataRoot) == nil {
+		t.Error("install over the changed file is expected to fail")
+	}
+	data, err := ioutil.ReadFile(path.Join(dataRoot, "sounds.resS"))
+	if err != nil || string(data) != "updated sounds" {
+		t.Errorf("changed file is overwritten: %q, %v", data, err)
+	}
+}
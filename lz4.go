@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+)
+
+/* LZ4 block format as used by unity bundles(no frames, sizes are stored by the bundle itself).
+See https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+
+LZ4HC produces the same format, so the same decoder works for both.
+*/
+
+const (
+	lz4MinMatch = 4
+	// The last 5 bytes are always literals and the last match must start 12 bytes before the end
+	lz4LastLiterals = 5
+	lz4MatchLimit   = 12
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 16
+)
+
+func lz4Decompress(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		litLen, n, err := lz4Length(src[i:], int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+
+		if i+litLen > len(src) {
+			return nil, errors.New("lz4: literals out of range")
+		}
+		dst = append(dst, src[i:i+litLen]...)
+		i += litLen
+
+		// The last sequence has literals only
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errors.New("lz4: unexpected end of block")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errors.Errorf("lz4: invalid offset %v", offset)
+		}
+
+		matchLen, n, err := lz4Length(src[i:], int(token&0xf))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		matchLen += lz4MinMatch
+
+		// Matches can overlap with the data they produce, so copy byte by byte
+		pos := len(dst) - offset
+		for j := 0; j < matchLen; j++ {
+			dst = append(dst, dst[pos+j])
+		}
+	}
+
+	if len(dst) != size {
+		return nil, errors.Errorf("lz4: unexpected decompressed size %v, %v expected", len(dst), size)
+	}
+	return dst, nil
+}
+
+// Reads extra bytes of length if the token part is saturated.
+func lz4Length(src []byte, base int) (length, n int, err error) {
+	length = base
+	if base != 0xf {
+		return
+	}
+	for {
+		if n >= len(src) {
+			return 0, 0, errors.New("lz4: unexpected end of block")
+		}
+		b := src[n]
+		n++
+		length += int(b)
+		if b != 0xff {
+			return
+		}
+	}
+}
+
+// Simple greedy compressor, ratio is far from lz4hc, but it's good enough for repacking.
+func lz4Compress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2+16)
+	// Positions are shifted by 1, so zero means empty slot
+	table := make([]int32, 1<<lz4HashLog)
+
+	anchor := 0
+	for i := 0; i+lz4MatchLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		matchLen := lz4MinMatch
+		for i+matchLen < len(src)-lz4LastLiterals && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+
+	return lz4Sequence(dst, src[anchor:], 0, 0)
+}
+
+// Appends sequence to dst, zero matchLen means the last literals only sequence.
+func lz4Sequence(dst, literals []byte, offset, matchLen int) []byte {
+	token := byte(minInt(len(literals), 0xf) << 4)
+	if matchLen > 0 {
+		token |= byte(minInt(matchLen-lz4MinMatch, 0xf))
+	}
+
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(literals))
+	dst = append(dst, literals...)
+
+	if matchLen == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	return lz4AppendLength(dst, matchLen-lz4MinMatch)
+}
+
+func lz4AppendLength(dst []byte, length int) []byte {
+	if length < 0xf {
+		return dst
+	}
+	for length -= 0xf; length >= 0xff; length -= 0xff {
+		dst = append(dst, 0xff)
+	}
+	return append(dst, byte(length))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -27,6 +27,9 @@ func main() {
 	case "hex":
 		err = PrintHexDump()
 
+	case "decode":
+		err = PrintDecoded()
+
 	case "grep":
 		err = GrepDump()
 
@@ -37,7 +40,87 @@ func main() {
 
 		err = UnpackAssets()
 
+	case "repack":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = RepackAssets()
+
+	case "export-json":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = ExportJSON()
+
+	case "import-json":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = ImportJSON()
+
+	case "bundle-list":
+		err = BundleList()
+
+	case "bundle-unpack":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = BundleUnpack()
+
+	case "bundle-pack":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = BundlePack()
+
+	case "texture-list":
+		err = TextureList()
+
+	case "texture-unpack":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = TextureUnpack()
+
+	case "texture-pack":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = TexturePack()
+
+	case "text-unpack":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = TextUnpack()
+
+	case "text-pack":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = TextPack()
+
+	case "mesh-export":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = MeshExport()
+
 	case "music-list":
+		if len(os.Args) < 3 {
+			usage()
+		}
+
 		err = MusicList()
 
 	case "music-unpack":
@@ -54,12 +137,94 @@ func main() {
 
 		err = MusicPack()
 
+	case "music-merge":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = MusicMerge()
+
 	case "music-parse":
 		err = ParseMusicLib()
 
+	case "mlib-export":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = MusicLibExport()
+
+	case "mlib-import":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = MusicLibImport()
+
+	case "mlib-group":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = MusicLibGroup()
+
 	case "dump-resources":
 		err = DumpResources()
 
+	case "resource-ls":
+		err = ResourcesList()
+
+	case "resource-get":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = ResourceGet()
+
+	case "resources-export":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = ResourcesExport()
+
+	case "resources-add":
+		if len(os.Args) < 6 {
+			usage()
+		}
+
+		err = ResourcesAdd()
+
+	case "resources-remove":
+		if len(os.Args) < 5 {
+			usage()
+		}
+
+		err = ResourcesRemove()
+
+	case "resources-rename":
+		if len(os.Args) < 6 {
+			usage()
+		}
+
+		err = ResourcesRename()
+
+	case "install":
+		if len(os.Args) < 4 {
+			usage()
+		}
+
+		err = Install()
+
+	case "uninstall":
+		err = Uninstall()
+
+	case "restore":
+		err = Restore()
+
+	case "deps":
+		err = PrintDeps()
+
 	case "cpack-make-writable":
 		err = CPackMakeWritable()
 
@@ -78,7 +243,7 @@ func main() {
 func usage() {
 	log.Print(`Usage:  shadowed <command> [arguments...]
 
-Common commands (should work with most unity assets files with version 9):
+Common commands (should work with most unity assets files with versions 9-22):
     header <assets_file>
         Print file metadata(excluding objects).
 
@@ -91,6 +256,10 @@ Common commands (should work with most unity assets files with version 9):
         Optionaly can filter objects by type_id.
         Can take a lot of time on a large file.
 
+    decode <assets_file> [type_id]
+        Print objects decoded with the type trees from the file metadata.
+        Optionaly can filter objects by type_id.
+
     grep <assets_file> <string>
         Print hexdump of objects containing the given string..
 
@@ -98,18 +267,162 @@ Common commands (should work with most unity assets files with version 9):
         Dumps all the objects from the assets file to the output directory.
         Subdirectories and files are named after class/object ids.
 
+    repack <assets_file> <unpacked_dir> <output_file>
+        Create a modified version of the assets file from the unpacked_dir(see unpack).
+        Changed files replace the original objects, missing ones are removed.
+        Files with unknown ids are added as new objects with newly assigned ids.
+
+    export-json <assets_file> <output_dir>
+        Same as unpack, but objects are decoded with type trees and saved as .json files.
+
+    import-json <assets_file> <json_dir> <output_file>
+        Create a modified version of the assets file
+        by replacing objects with the edited ones from json_dir(see export-json).
+        Missing files are ignored.
+
+    install <output_dir> <data_root>
+        Copy the files made by the pack commands into the data root.
+        Replaced assets files are checked to be from the same game build, then the hashes of the replaced
+        and new files are saved to shadowed-install.json in the data root. Installing again keeps the originals.
+
+    uninstall <data_root>
+        Restore the files replaced by install and remove the added ones.
+        Refuses to do anything if the installed files were changed since, e.g. by a game update.
+
+    restore <data_root> [backup_dir]
+        Roll the data root back to the backups. Modified files are written through temporary files
+        and overwritten ones are kept as <name>.<timestamp>.bak, the oldest backups are restored by default.
+        Stream files appended in place by music-pack --incremental are truncated to the recorded size.
+        With backup_dir the files are taken from a copy of the data root or a flat copy of the files
+        listed in README instead. Restored files are backed up as well.
+
+    deps <data_root> [--refs file:path_id]... [--unreachable] [--export graph.dot|graph.json]
+        Build the graph of references between objects of mainData, levelN and .assets files in data_root.
+        Objects of the scenes(mainData and levelN) are the roots, others are reachable only by references,
+        including the resources and their dependencies listed by the resource manager.
+        --refs prints objects referring the given one, --unreachable lists objects no one refers.
+        --export saves the graph as JSON or Graphviz DOT depending on the extension.
+
+Resource manager commands(mainData of unity 4 players):
+    resource-ls <data_root> [prefix]
+        List resources loadable by name with the objects they refer, e.g. music/.
+
+    resource-get <data_root> <resource_path> <output>
+        Save the object loaded by the resource path, e.g. music/combat-01.
+        The object is decoded with the type tree for .json output, raw data is saved otherwise.
+
+    resources-export <data_root> <output.json>
+        Save the ResourceManager from mainData as JSON along with the file names by FileID.
+
+    resources-add <data_root> <output_dir> <name> <file:path_id> [dependency file:path_id...]
+        Register the object as a resource loadable by the name, e.g. resources.assets:1234.
+        Dependencies are added to the dependency graph of the object.
+
+    resources-remove <data_root> <output_dir> <name>...
+        Remove the resources, the objects are removed from the dependency graph
+        if they are not loaded by other names.
+
+    resources-rename <data_root> <output_dir> <name> <new_name>
+        Rename the resource.
+
+    Editing commands check the references point to existing objects and write modified mainData to output_dir.
+
+Asset bundle commands(UnityFS, UnityWeb and UnityRaw):
+    bundle-list <bundle_file>
+        Print bundle header and list of files.
+
+    bundle-unpack <bundle_file> <output_dir>
+        Extract all the files from the bundle to the output directory.
+        Extracted serialized files can be used with the common commands.
+
+    bundle-pack <bundle_file> <files_dir> <output_file>
+        Create a modified version of the bundle
+        by replacing files with ones from files_dir(see bundle-unpack).
+        Missing files are kept as is, the original compression is used.
+
+Texture commands(Alpha8, ARGB4444, RGBA4444, RGB565, RGB24, RGBA32, ARGB32, BGRA32, DXT1 and DXT5):
+    texture-list <assets_file>
+        Print Texture2D objects info.
+
+    texture-unpack <assets_file> <output_dir>
+        Save all the textures from the assets file as .png images to the output directory.
+        Files are named after textures, object id is appended to duplicated names.
+        Streamed data is read from .resS files next to the assets file.
+
+    texture-pack <assets_file> <png_dir> <output_file>
+        Create a modified version of the assets file
+        by replacing textures with .png images from png_dir(see texture-unpack).
+        Images are converted to the original texture format and may have a different size,
+        mip levels are regenerated. Missing files are ignored.
+        Modified .resS files for streamed textures are written next to the output file,
+        they hold the data of every object streamed from them, so the old files are not needed.
+
+Text asset commands:
+    text-unpack <assets_file> <output_dir>
+        Save the contents of all the TextAsset objects from the assets file to the output directory.
+        Files are named after text assets, object id is appended to duplicated names.
+
+    text-pack <assets_file> <text_dir> <output_file>
+        Create a modified version of the assets file
+        by replacing text assets with the files from text_dir(see text-unpack).
+        Missing files are ignored, unknown ones are skipped with a warning.
+
+Mesh commands:
+    mesh-export <assets_file> <output_dir> [--format obj|gltf]
+        Export all the meshes from the assets file to the output directory, obj is used by default.
+        Vertex positions, normals, colors(gltf only), the first uv channel and submeshes are exported.
+        Files are named after meshes, object id is appended to duplicated names.
+
 Shadowrun-specific commands:
-    music-list <data_root>
-        List all the music in the resources.assets.
+    music-list <data_root> [music_dir]
+        List all the music in the resources.assets with sample rate, channels and duration.
+        Tracks from music_dir are listed as well if it is given.
 
     music-unpack <data_root> <output_dir>
         Unpack all the music tracks from resources.assets{,.resS} to the output directory.
+        Unity 5.0+ clips are extracted from FSB5 containers when possible(PCM, MPEG),
+        saved as .fsb otherwise.
 
-    music-pack <data_root> <music_dir> <output_dir>
+    music-pack <data_root> <music_dir> <output_dir> [--quality 0-10] [--rate hz] [--incremental] [--manifest file]
         Create a modified version of the resources files from data_root
         by adding new tracks from music_dir and replacing onl ones with same name.
+        Tracks missing in music_dir are removed.
+        Unity 4 clips take .ogg(or other types supported by unity 4) files,
+        .wav, .flac and .mp3 files are encoded to ogg with the given quality(5 by default).
+        Unity 5.0+ clips take .fsb, PCM .wav, .flac and .mp3 files, the latter are decoded to PCM.
+        --rate resamples .wav, .flac and .mp3 files, the original rate is kept by default.
+        Encoded files are cached in the user cache directory.
+        With --incremental the original stream file is kept and only new or changed tracks
+        are appended to it, data of the removed and replaced tracks stays in the file.
+        If output_dir is the data root the stream file is appended in place instead of being copied,
+        which takes seconds, its original size is recorded for restore.
+        With another output_dir the whole stream file is copied there first.
+        Hashes of the unchanged tracks are cached in the user cache directory.
+        --manifest takes a YAML or JSON file which maps files from music_dir to track names and groups
+        and tells which vanilla tracks to keep or drop, instead of taking everything from music_dir.
         Place new files to output_dir along with updated music.mlib.bytes.
 
+    music-merge <target_data_root> <source_data_root>... <output_dir> [--prefix text|--suffix text] [--incremental]
+        Add music of the source games to the target one, all the target tracks are kept.
+        Imported tracks are grouped in the music lib per game, e.g. "Dragonfall: Combat".
+        Tracks with names taken by different ones get the suffix("-{game}" by default) or the prefix,
+        {game} is replaced with the data root name without _Data. Identical tracks are not duplicated.
+        --incremental works as for music-pack.
+
+    mlib-export <music.mlib.bytes> <output.json|output.txt>
+        Convert the music lib to JSON or txtpack text depending on the output extension.
+
+    mlib-import <input.json|input.txt> <music.mlib.bytes>
+        Convert edited JSON or txtpack text back to the music lib.
+
+    mlib-group add <music.mlib.bytes> <group> [tracks...]
+    mlib-group remove <music.mlib.bytes> <group>
+    mlib-group rename <music.mlib.bytes> <group> <new_name>
+    mlib-group move-track <music.mlib.bytes> <track> <to_group> [from_group]
+        Edit groups of the music lib in place: create a group or add tracks to an existing one,
+        remove or rename a group, move a track to another group(from all its groups by default).
+        Groups left empty are removed.
+
     dump-resources <data_root>
         Print dump of ResourcesManager from the mainData file.
 
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"github.com/betrok/shadowed/class"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+)
+
+/* Music manifest describes the result of music-pack instead of deriving it from the music dir:
+
+	# What to do with the vanilla tracks not mentioned below: keep(default) or drop
+	vanilla: keep
+	keep: [Track-A]
+	drop: [Track-B]
+	tracks:
+	  # Name defaults to the file name without extension, a track with a vanilla name replaces it.
+	  # Groups are optional, the track is moved to the given groups of the music lib which are created if needed.
+	  - file: boss.flac
+	    name: Boss-Custom
+	    groups: [Combat]
+	# Groups listed here go first in the music lib in the given order, the others follow sorted by name
+	group_order: [Combat, Ambient]
+
+JSON works as well, since it is a subset of YAML.
+*/
+
+type MusicManifest struct {
+	Vanilla    string          `yaml:"vanilla"`
+	Keep       []string        `yaml:"keep"`
+	Drop       []string        `yaml:"drop"`
+	Tracks     []ManifestTrack `yaml:"tracks"`
+	GroupOrder []string        `yaml:"group_order"`
+}
+
+type ManifestTrack struct {
+	// Relative to the music dir
+	File   string   `yaml:"file"`
+	Name   string   `yaml:"name"`
+	Groups []string `yaml:"groups"`
+}
+
+const (
+	manifestKeep = "keep"
+	manifestDrop = "drop"
+)
+
+func ReadMusicManifest(file string) (MusicManifest, error) {
+	var ret MusicManifest
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ret, err
+	}
+	// Strict mode catches misspelled keys, which would be silently ignored otherwise
+	err = yaml.UnmarshalStrict(data, &ret)
+	if err != nil {
+		return ret, errors.Wrap(err, file)
+	}
+	return ret, errors.Wrap(ret.validate(), file)
+}
+
+func (m *MusicManifest) validate() error {
+	switch m.Vanilla {
+	case "":
+		m.Vanilla = manifestKeep
+	case manifestKeep, manifestDrop:
+	default:
+		return errors.Errorf("vanilla must be %v or %v, got %q", manifestKeep, manifestDrop, m.Vanilla)
+	}
+
+	names := make(map[string]bool)
+	for i := range m.Tracks {
+		t := &m.Tracks[i]
+		if t.File == "" {
+			return errors.Errorf("track %v: file is missing", i)
+		}
+		if t.Name == "" {
+			t.Name = strings.TrimSuffix(path.Base(t.File), path.Ext(t.File))
+		}
+		if names[strings.ToLower(t.Name)] {
+			return errors.Errorf("duplicated track %v", t.Name)
+		}
+		names[strings.ToLower(t.Name)] = true
+	}
+
+	keep := listed(m.Keep)
+	for _, name := range m.Drop {
+		if keep[strings.ToLower(name)] {
+			return errors.Errorf("%v is both kept and dropped", name)
+		}
+		if names[strings.ToLower(name)] {
+			return errors.Errorf("%v is both dropped and packed", name)
+		}
+	}
+	return nil
+}
+
+// Returns the tracks to pack: files from the manifest and the kept vanilla clips.
+func (m MusicManifest) sources(musicDir string, clips []AudioClip) []musicSource {
+	var ret []musicSource
+	replaced := make(map[string]bool)
+	for _, t := range m.Tracks {
+		ret = append(ret, musicSource{Name: t.Name, File: path.Join(musicDir, t.File)})
+		replaced[strings.ToLower(t.Name)] = true
+	}
+
+	keep := listed(m.Keep)
+	drop := listed(m.Drop)
+	for i, c := range clips {
+		name := strings.ToLower(c.Name)
+		kept := keep[name]
+		delete(keep, name)
+		if replaced[name] || drop[name] {
+			continue
+		}
+		if kept || m.Vanilla == manifestKeep {
+			ret = append(ret, musicSource{Name: c.Name, Clip: &clips[i]})
+		}
+	}
+
+	for _, name := range m.Keep {
+		if keep[strings.ToLower(name)] {
+			log.Printf("[warn] %v is not found in the assets and can't be kept", name)
+		}
+	}
+	return ret
+}
+
+// Names of the tracks with explicit groups.
+func (m MusicManifest) grouped() map[string]bool {
+	ret := make(map[string]bool)
+	for _, t := range m.Tracks {
+		if len(t.Groups) > 0 {
+			ret[strings.ToLower(t.Name)] = true
+		}
+	}
+	return ret
+}
+
+// Moves the manifest tracks to their groups and orders the groups.
+// Tracks without groups are left as is.
+func (m MusicManifest) applyGroups(lib *class.MusicLib) {
+	removeTracks(lib, m.grouped())
+
+	for _, t := range m.Tracks {
+		for _, name := range t.Groups {
+			group := findGroup(lib, name)
+			if group == nil {
+				group = &class.MusicGroup{Name: name}
+				lib.Groups = append(lib.Groups, group)
+				log.Printf("  creating group %v", name)
+			}
+			group.Tracks = append(group.Tracks, t.Name)
+			log.Printf("  adding %v to group %v", t.Name, name)
+		}
+	}
+
+	var ordered []*class.MusicGroup
+	for _, name := range m.GroupOrder {
+		group := findGroup(lib, name)
+		if group == nil {
+			log.Printf("[warn] group %v is not found in the lib and can't be ordered", name)
+			continue
+		}
+		ordered = append(ordered, group)
+	}
+	inOrder := listed(m.GroupOrder)
+	for _, group := range lib.Groups {
+		if !inOrder[strings.ToLower(group.Name)] {
+			ordered = append(ordered, group)
+		}
+	}
+	lib.Groups = ordered
+}
+
+func findGroup(lib *class.MusicLib, name string) *class.MusicGroup {
+	for _, group := range lib.Groups {
+		if strings.EqualFold(group.Name, name) {
+			return group
+		}
+	}
+	return nil
+}
+
+// Case insensitive set of the names.
+func listed(names []string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, name := range names {
+		ret[strings.ToLower(name)] = true
+	}
+	return ret
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/betrok/shadowed/class"
+	"reflect"
+	"testing"
+)
+
+func TestMusicManifestValidate(t *testing.T) {
+	m := MusicManifest{Tracks: []ManifestTrack{{File: "sub/boss.flac"}, {File: "a.ogg", Name: "Intro"}}}
+	err := m.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Vanilla != manifestKeep || m.Tracks[0].Name != "boss" || m.Tracks[1].Name != "Intro" {
+		t.Errorf("unexpected defaults %+v", m)
+	}
+
+	cases := map[string]MusicManifest{
+		"unknown vanilla":    {Vanilla: "replace"},
+		"missing file":       {Tracks: []ManifestTrack{{Name: "A"}}},
+		"duplicated track":   {Tracks: []ManifestTrack{{File: "a.ogg"}, {File: "b.ogg", Name: "A"}}},
+		"kept and dropped":   {Keep: []string{"A"}, Drop: []string{"a"}},
+		"dropped and packed": {Drop: []string{"A"}, Tracks: []ManifestTrack{{File: "a.ogg"}}},
+	}
+	for name, m := range cases {
+		if m.validate() == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+}
+
+func TestMusicManifestSources(t *testing.T) {
+	clips := []AudioClip{{Name: "Intro"}, {Name: "Boss"}, {Name: "Ambient"}, {Name: "Credits"}}
+
+	// Clip sources are listed by name
+	type source struct{ Name, File string }
+	cases := []struct {
+		name     string
+		manifest MusicManifest
+		sources  []source
+	}{
+		{
+			name:     "vanilla kept",
+			manifest: MusicManifest{Vanilla: manifestKeep, Drop: []string{"credits"}},
+			sources:  []source{{"Intro", ""}, {"Boss", ""}, {"Ambient", ""}},
+		},
+		{
+			name:     "vanilla dropped",
+			manifest: MusicManifest{Vanilla: manifestDrop, Keep: []string{"AMBIENT", "Missing"}},
+			sources:  []source{{"Ambient", ""}},
+		},
+		{
+			name: "tracks replace vanilla",
+			manifest: MusicManifest{Vanilla: manifestKeep, Drop: []string{"Intro"}, Tracks: []ManifestTrack{
+				{File: "boss.flac", Name: "boss"},
+				{File: "new.ogg", Name: "New"},
+			}},
+			sources: []source{{"boss", "music/boss.flac"}, {"New", "music/new.ogg"}, {"Ambient", ""}, {"Credits", ""}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var sources []source
+			for _, s := range c.manifest.sources("music", clips) {
+				if s.Clip != nil && s.Clip.Name != s.Name {
+					t.Errorf("%v refers to clip %v", s.Name, s.Clip.Name)
+				}
+				sources = append(sources, source{s.Name, s.File})
+			}
+			if !reflect.DeepEqual(sources, c.sources) {
+				t.Errorf("sources %v\nexpected %v", sources, c.sources)
+			}
+		})
+	}
+}
+
+func TestMusicManifestApplyGroups(t *testing.T) {
+	lib := func(groups ...[]string) *class.MusicLib {
+		ret := &class.MusicLib{}
+		for _, g := range groups {
+			ret.Groups = append(ret.Groups, &class.MusicGroup{Name: g[0], Tracks: g[1:]})
+		}
+		return ret
+	}
+	vanilla := func() *class.MusicLib {
+		return lib([]string{"Ambient", "Intro", "Boss"}, []string{"Combat", "Fight"}, []string{"Credits", "Outro"})
+	}
+
+	cases := []struct {
+		name     string
+		manifest MusicManifest
+		lib      *class.MusicLib
+	}{
+		{
+			name:     "no groups",
+			manifest: MusicManifest{Tracks: []ManifestTrack{{File: "new.ogg", Name: "New"}}},
+			lib:      vanilla(),
+		},
+		{
+			name: "moved and created",
+			manifest: MusicManifest{Tracks: []ManifestTrack{
+				{File: "boss.ogg", Name: "boss", Groups: []string{"combat", "Bosses"}},
+				{File: "fight.ogg", Name: "Fight", Groups: []string{"Bosses"}},
+			}},
+			// Combat is emptied and removed before the track is added back
+			lib: lib([]string{"Ambient", "Intro"}, []string{"Credits", "Outro"}, []string{"combat", "boss"}, []string{"Bosses", "boss", "Fight"}),
+		},
+		{
+			name:     "ordered",
+			manifest: MusicManifest{GroupOrder: []string{"credits", "Missing", "Combat"}},
+			lib:      lib([]string{"Credits", "Outro"}, []string{"Combat", "Fight"}, []string{"Ambient", "Intro", "Boss"}),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lib := vanilla()
+			c.manifest.applyGroups(lib)
+			if !reflect.DeepEqual(lib, c.lib) {
+				t.Errorf("groups %v\nexpected %v", lib, c.lib)
+			}
+		})
+	}
+}
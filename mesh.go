@@ -0,0 +1,860 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+const MeshTypeID = 43
+
+/* Mesh layout changed a lot between unity versions, the decoder relies on the type tree and handles:
+	vertex data: 4.x(explicit streams), 5.x-2017(computed streams), 2018+(more channels), 2019+(new formats enum)
+	and streamed vertex data(m_StreamData);
+	16 and 32-bit index buffers(m_IndexFormat, 2017.3+), base vertex of submeshes;
+	compressed meshes(m_CompressedMesh with packed bit vectors).
+Tangents, skinning and blend shapes are ignored.
+*/
+
+// Decoded geometry in unity coordinates(left-handed, Y up).
+type Mesh struct {
+	Name     string
+	Vertices [][3]float32
+	Normals  [][3]float32 `json:",omitempty"`
+	UV       [][2]float32 `json:",omitempty"`
+	Colors   [][4]float32 `json:",omitempty"`
+	// Triangles of each submesh, 3 indices per triangle
+	SubMeshes [][]uint32
+}
+
+func (m Mesh) triangleCount() int {
+	count := 0
+	for _, triangles := range m.SubMeshes {
+		count += len(triangles) / 3
+	}
+	return count
+}
+
+// See UnityEngine.MeshTopology
+const (
+	topologyTriangles = 0
+	// Deprecated, but can still be found in unity 4 files
+	topologyTriangleStrip = 1
+	topologyQuads         = 2
+)
+
+func ParseMesh(assets *AssetsReader, val interface{}) (Mesh, error) {
+	var ret Mesh
+
+	name, err := fieldValue(val, "m_Name")
+	if err != nil {
+		return ret, err
+	}
+	ret.Name, _ = name.(string)
+
+	major, _ := assets.MetaData.TypeInfo.Signature.Version()
+
+	vertexData, err := fieldValue(val, "m_VertexData")
+	if err != nil {
+		return ret, err
+	}
+	err = ret.readVertexData(assets, val, vertexData, major)
+	if err != nil {
+		return ret, errors.Wrap(err, "m_VertexData")
+	}
+
+	indexSize := 2
+	if format, err := fieldValue(val, "m_IndexFormat"); err == nil {
+		f, err := intValue(format)
+		if err != nil {
+			return ret, errors.Wrap(err, "m_IndexFormat")
+		}
+		if f == 1 {
+			indexSize = 4
+		}
+	}
+
+	data, err := fieldValue(val, "m_IndexBuffer")
+	if err != nil {
+		return ret, err
+	}
+	indexBuffer, err := bytesValue(data)
+	if err != nil {
+		return ret, errors.Wrap(err, "m_IndexBuffer")
+	}
+
+	var indices []uint32
+	if len(indexBuffer) > 0 {
+		indices = make([]uint32, len(indexBuffer)/indexSize)
+		for i := range indices {
+			if indexSize == 2 {
+				indices[i] = uint32(assets.Order.Uint16(indexBuffer[i*2:]))
+			} else {
+				indices[i] = assets.Order.Uint32(indexBuffer[i*4:])
+			}
+		}
+	}
+
+	if len(ret.Vertices) == 0 || len(indices) == 0 {
+		compressed, err := fieldValue(val, "m_CompressedMesh")
+		if err != nil {
+			return ret, err
+		}
+		triangles, err := ret.readCompressed(compressed)
+		if err != nil {
+			return ret, errors.Wrap(err, "m_CompressedMesh")
+		}
+		if len(indices) == 0 {
+			indices = triangles
+		}
+	}
+
+	subMeshes, err := fieldValue(val, "m_SubMeshes")
+	if err != nil {
+		return ret, err
+	}
+	list, ok := subMeshes.([]interface{})
+	if !ok {
+		return ret, errors.Errorf("m_SubMeshes: array expected, got %T", subMeshes)
+	}
+	for i, sub := range list {
+		triangles, err := subMeshTriangles(sub, indices, indexSize)
+		if err != nil {
+			return ret, errors.Wrapf(err, "m_SubMeshes[%v]", i)
+		}
+		for _, index := range triangles {
+			if int(index) >= len(ret.Vertices) {
+				return ret, errors.Errorf("m_SubMeshes[%v]: vertex index %v out of range", i, index)
+			}
+		}
+		ret.SubMeshes = append(ret.SubMeshes, triangles)
+	}
+
+	// Meshes without submeshes are drawn as a single triangle list over the whole index buffer
+	if len(list) == 0 && len(indices) >= 3 {
+		triangles := indices[:len(indices)/3*3]
+		for _, index := range triangles {
+			if int(index) >= len(ret.Vertices) {
+				return ret, errors.Errorf("m_IndexBuffer: vertex index %v out of range", index)
+			}
+		}
+		ret.SubMeshes = [][]uint32{triangles}
+	}
+
+	return ret, nil
+}
+
+func subMeshTriangles(val interface{}, indices []uint32, indexSize int) ([]uint32, error) {
+	var fields [3]int64
+	for i, name := range []string{"firstByte", "indexCount", "topology"} {
+		v, err := fieldValue(val, name)
+		if err != nil {
+			return nil, err
+		}
+		fields[i], err = intValue(v)
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+	}
+	first, count, topology := int(fields[0])/indexSize, int(fields[1]), fields[2]
+
+	var baseVertex uint32
+	if v, err := fieldValue(val, "baseVertex"); err == nil {
+		base, err := uintValue(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "baseVertex")
+		}
+		baseVertex = uint32(base)
+	}
+
+	if first+count > len(indices) {
+		return nil, errors.Errorf("indices [%v:%v] out of range, %v total", first, first+count, len(indices))
+	}
+	src := indices[first : first+count]
+
+	var ret []uint32
+	switch topology {
+	case topologyTriangles:
+		ret = append(ret, src[:count/3*3]...)
+
+	case topologyTriangleStrip:
+		for i := 0; i+2 < len(src); i++ {
+			a, b, c := src[i], src[i+1], src[i+2]
+			// Degenerate triangles are used to join strips
+			if a == b || b == c || a == c {
+				continue
+			}
+			if i%2 == 1 {
+				a, b = b, a
+			}
+			ret = append(ret, a, b, c)
+		}
+
+	case topologyQuads:
+		for i := 0; i+3 < len(src); i += 4 {
+			ret = append(ret, src[i], src[i+1], src[i+2], src[i], src[i+2], src[i+3])
+		}
+
+	default:
+		// Lines and points don't make sense for the export formats
+		log.Printf("[warn] skipping submesh with topology %v", topology)
+		return nil, nil
+	}
+
+	for i := range ret {
+		ret[i] += baseVertex
+	}
+	return ret, nil
+}
+
+// Unified vertex component formats, see vertexFormatOf for the mapping of unity enums.
+type vertexFormat int
+
+const (
+	vertexFloat vertexFormat = iota
+	vertexHalf
+	vertexUNorm8
+	vertexSNorm8
+	vertexUNorm16
+	vertexSNorm16
+	vertexUInt8
+	vertexSInt8
+	vertexUInt16
+	vertexSInt16
+	vertexUInt32
+	vertexSInt32
+)
+
+var vertexFormatSizes = [...]int{4, 2, 1, 1, 2, 2, 1, 1, 2, 2, 4, 4}
+
+var (
+	// VertexChannelFormat, before 2017.1
+	vertexFormats4 = []vertexFormat{vertexFloat, vertexHalf, vertexUNorm8, vertexUInt8, vertexUInt32}
+	// VertexFormat, 2017.1-2018.4, the third one is "color"
+	vertexFormats2017 = []vertexFormat{
+		vertexFloat, vertexHalf, vertexUNorm8, vertexUNorm8, vertexSNorm8, vertexUNorm16, vertexSNorm16,
+		vertexUInt8, vertexSInt8, vertexUInt16, vertexSInt16, vertexUInt32, vertexSInt32,
+	}
+	// VertexFormat, 2019.1+
+	vertexFormats2019 = []vertexFormat{
+		vertexFloat, vertexHalf, vertexUNorm8, vertexSNorm8, vertexUNorm16, vertexSNorm16,
+		vertexUInt8, vertexSInt8, vertexUInt16, vertexSInt16, vertexUInt32, vertexSInt32,
+	}
+)
+
+func vertexFormatOf(format int64, major int) (vertexFormat, error) {
+	formats := vertexFormats2019
+	switch {
+	case major < 2017:
+		formats = vertexFormats4
+	case major < 2019:
+		formats = vertexFormats2017
+	}
+	if format < 0 || int(format) >= len(formats) {
+		return 0, errors.Errorf("unknown vertex format %v", format)
+	}
+	return formats[format], nil
+}
+
+// Reads a single component as float, normalized formats are mapped to [0, 1] or [-1, 1].
+func readVertexComponent(data []byte, format vertexFormat, order binary.ByteOrder) float32 {
+	switch format {
+	case vertexFloat:
+		return math.Float32frombits(order.Uint32(data))
+	case vertexHalf:
+		return halfToFloat(order.Uint16(data))
+	case vertexUNorm8:
+		return float32(data[0]) / 255
+	case vertexSNorm8:
+		return float32(math.Max(float64(int8(data[0]))/127, -1))
+	case vertexUNorm16:
+		return float32(order.Uint16(data)) / 65535
+	case vertexSNorm16:
+		return float32(math.Max(float64(int16(order.Uint16(data)))/32767, -1))
+	case vertexUInt8:
+		return float32(data[0])
+	case vertexSInt8:
+		return float32(int8(data[0]))
+	case vertexUInt16:
+		return float32(order.Uint16(data))
+	case vertexSInt16:
+		return float32(int16(order.Uint16(data)))
+	case vertexUInt32:
+		return float32(order.Uint32(data))
+	default:
+		return float32(int32(order.Uint32(data)))
+	}
+}
+
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := int(h >> 10 & 0x1f)
+	mant := uint32(h & 0x3ff)
+
+	switch {
+	case exp == 0 && mant == 0:
+		return math.Float32frombits(sign)
+	case exp == 0:
+		// Subnormal
+		f := float32(mant) / 1024 / 16384
+		if sign != 0 {
+			return -f
+		}
+		return f
+	case exp == 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | mant<<13)
+	default:
+		return math.Float32frombits(sign | uint32(exp-15+127)<<23 | mant<<13)
+	}
+}
+
+type vertexChannel struct {
+	stream    int
+	offset    int
+	format    vertexFormat
+	dimension int
+}
+
+type vertexStream struct {
+	offset int
+	stride int
+}
+
+// Shader channel indices of the exported attributes, depend on the number of channels.
+type channelLayout struct {
+	normal, color, uv int
+}
+
+var (
+	// 4.x: vertex, normal, color, uv0, uv1, tangent
+	// 5.x-2017: vertex, normal, color, uv0-uv3, tangent
+	channelLayout4 = channelLayout{normal: 1, color: 2, uv: 3}
+	// 2018+: vertex, normal, tangent, color, uv0-uv7, blend weights, blend indices
+	channelLayout2018 = channelLayout{normal: 1, color: 3, uv: 4}
+)
+
+func (m *Mesh) readVertexData(assets *AssetsReader, mesh, val interface{}, major int) error {
+	countVal, err := fieldValue(val, "m_VertexCount")
+	if err != nil {
+		return err
+	}
+	count, err := intValue(countVal)
+	if err != nil {
+		return errors.Wrap(err, "m_VertexCount")
+	}
+	if count == 0 {
+		return nil
+	}
+
+	dataVal, err := fieldValue(val, "m_DataSize")
+	if err != nil {
+		return err
+	}
+	data, err := bytesValue(dataVal)
+	if err != nil {
+		return errors.Wrap(err, "m_DataSize")
+	}
+
+	if len(data) == 0 {
+		streamVal, err := fieldValue(mesh, "m_StreamData")
+		if err != nil {
+			return errors.New("vertex data is empty")
+		}
+		stream, err := ParseStreamInfo(streamVal)
+		if err != nil {
+			return err
+		}
+		r, err := assets.StreamData(stream)
+		if err != nil {
+			return err
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	channels, err := parseVertexChannels(val, major)
+	if err != nil {
+		return err
+	}
+
+	streams, err := parseVertexStreams(val, channels, int(count))
+	if err != nil {
+		return err
+	}
+
+	layout := channelLayout4
+	if len(channels) > 8 {
+		layout = channelLayout2018
+	}
+
+	// Components are read to flat buffers with fixed dimensions, extra ones are dropped
+	readAttribute := func(index, dim int) ([]float32, error) {
+		if index >= len(channels) || channels[index].dimension == 0 {
+			return nil, nil
+		}
+		ch := channels[index]
+		if ch.stream >= len(streams) {
+			return nil, errors.Errorf("channel %v: stream %v is missing", index, ch.stream)
+		}
+		st := streams[ch.stream]
+		size := vertexFormatSizes[ch.format]
+		n := minInt(ch.dimension, dim)
+
+		ret := make([]float32, int(count)*dim)
+		for i := 0; i < int(count); i++ {
+			pos := st.offset + i*st.stride + ch.offset
+			if pos+ch.dimension*size > len(data) {
+				return nil, errors.Errorf("channel %v: vertex data out of range", index)
+			}
+			for j := 0; j < n; j++ {
+				ret[i*dim+j] = readVertexComponent(data[pos+j*size:], ch.format, assets.Order)
+			}
+		}
+		return ret, nil
+	}
+
+	vertices, err := readAttribute(0, 3)
+	if err != nil {
+		return err
+	}
+	normals, err := readAttribute(layout.normal, 3)
+	if err != nil {
+		return err
+	}
+	colors, err := readAttribute(layout.color, 4)
+	if err != nil {
+		return err
+	}
+	uv, err := readAttribute(layout.uv, 2)
+	if err != nil {
+		return err
+	}
+
+	m.Vertices = vec3List(vertices)
+	m.Normals = vec3List(normals)
+	m.UV = vec2List(uv)
+	m.Colors = vec4List(colors)
+	return nil
+}
+
+func parseVertexChannels(val interface{}, major int) ([]vertexChannel, error) {
+	channelsVal, err := fieldValue(val, "m_Channels")
+	if err != nil {
+		return nil, err
+	}
+	list, ok := channelsVal.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("m_Channels: array expected, got %T", channelsVal)
+	}
+
+	ret := make([]vertexChannel, len(list))
+	for i, item := range list {
+		var fields [4]int64
+		for j, name := range []string{"stream", "offset", "format", "dimension"} {
+			v, err := fieldValue(item, name)
+			if err != nil {
+				return nil, errors.Wrapf(err, "m_Channels[%v]", i)
+			}
+			fields[j], err = intValue(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "m_Channels[%v].%v", i, name)
+			}
+		}
+
+		format, err := vertexFormatOf(fields[2], major)
+		if err != nil {
+			return nil, errors.Wrapf(err, "m_Channels[%v]", i)
+		}
+		ret[i] = vertexChannel{
+			stream: int(fields[0]),
+			offset: int(fields[1]),
+			format: format,
+			// 2019+ uses the high bits for flags
+			dimension: int(fields[3] & 0xf),
+		}
+
+		// Old color channel is a packed RGBA32 with dimension 1
+		if major < 2018 && len(list) <= 8 && i == channelLayout4.color && fields[2] == 2 && ret[i].dimension > 0 {
+			ret[i].dimension = 4
+		}
+	}
+	return ret, nil
+}
+
+func parseVertexStreams(val interface{}, channels []vertexChannel, count int) ([]vertexStream, error) {
+	// 4.x stores streams explicitly
+	if streamsVal, err := fieldValue(val, "m_Streams"); err == nil {
+		list, ok := streamsVal.([]interface{})
+		if !ok {
+			return nil, errors.Errorf("m_Streams: array expected, got %T", streamsVal)
+		}
+
+		ret := make([]vertexStream, len(list))
+		for i, item := range list {
+			var fields [2]uint64
+			for j, name := range []string{"offset", "stride"} {
+				v, err := fieldValue(item, name)
+				if err != nil {
+					return nil, errors.Wrapf(err, "m_Streams[%v]", i)
+				}
+				fields[j], err = uintValue(v)
+				if err != nil {
+					return nil, errors.Wrapf(err, "m_Streams[%v].%v", i, name)
+				}
+			}
+			ret[i] = vertexStream{offset: int(fields[0]), stride: int(fields[1])}
+		}
+		return ret, nil
+	}
+
+	// Streams follow each other aligned to 16 bytes, vertex stride is the sum of its channels
+	streamCount := 0
+	for _, ch := range channels {
+		if ch.dimension > 0 && ch.stream >= streamCount {
+			streamCount = ch.stream + 1
+		}
+	}
+
+	ret := make([]vertexStream, streamCount)
+	offset := 0
+	for s := range ret {
+		stride := 0
+		for _, ch := range channels {
+			if ch.stream == s && ch.dimension > 0 {
+				stride += ch.dimension * vertexFormatSizes[ch.format]
+			}
+		}
+		ret[s] = vertexStream{offset: offset, stride: stride}
+		offset = int(align(uint32(offset+count*stride), 16))
+	}
+	return ret, nil
+}
+
+// Compressed meshes store quantized values packed into bit streams.
+type packedBitVector struct {
+	count   int
+	rangeV  float32
+	start   float32
+	data    []byte
+	bitSize uint
+}
+
+func parsePackedBitVector(val interface{}, name string) (packedBitVector, error) {
+	var ret packedBitVector
+
+	vector, err := fieldValue(val, name)
+	if err != nil {
+		return ret, err
+	}
+
+	count, err := fieldValue(vector, "m_NumItems")
+	if err != nil {
+		return ret, errors.Wrap(err, name)
+	}
+	c, err := intValue(count)
+	if err != nil {
+		return ret, errors.Wrap(err, name)
+	}
+	ret.count = int(c)
+
+	data, err := fieldValue(vector, "m_Data")
+	if err != nil {
+		return ret, errors.Wrap(err, name)
+	}
+	ret.data, err = bytesValue(data)
+	if err != nil {
+		return ret, errors.Wrap(err, name)
+	}
+
+	// Bit size is omitted for the vectors of 32-bit values in some versions
+	ret.bitSize = 32
+	if bitSize, err := fieldValue(vector, "m_BitSize"); err == nil {
+		b, err := uintValue(bitSize)
+		if err != nil {
+			return ret, errors.Wrap(err, name)
+		}
+		ret.bitSize = uint(b)
+	}
+
+	// Range and start are present for float vectors only
+	for _, field := range []struct {
+		name string
+		dst  *float32
+	}{
+		{"m_Range", &ret.rangeV},
+		{"m_Start", &ret.start},
+	} {
+		v, err := fieldValue(vector, field.name)
+		if err != nil {
+			continue
+		}
+		f, err := floatValue(v)
+		if err != nil {
+			return ret, errors.Wrapf(err, "%v.%v", name, field.name)
+		}
+		*field.dst = float32(f)
+	}
+
+	return ret, nil
+}
+
+// Bits are packed starting from the least significant one.
+func (p packedBitVector) ints() []uint32 {
+	ret := make([]uint32, p.count)
+	pos := uint(0)
+	for i := range ret {
+		var v uint32
+		for b := uint(0); b < p.bitSize; b++ {
+			if int(pos/8) >= len(p.data) {
+				break
+			}
+			if p.data[pos/8]>>(pos%8)&1 != 0 {
+				v |= 1 << b
+			}
+			pos++
+		}
+		ret[i] = v
+	}
+	return ret
+}
+
+func (p packedBitVector) floats() []float32 {
+	maxValue := float64(uint64(1)<<p.bitSize - 1)
+	ret := make([]float32, p.count)
+	for i, v := range p.ints() {
+		if maxValue == 0 {
+			ret[i] = p.start
+			continue
+		}
+		ret[i] = p.start + float32(float64(v)*float64(p.rangeV)/maxValue)
+	}
+	return ret
+}
+
+// See channel bits of m_UVInfo in readCompressed.
+const (
+	uvInfoBits       = 4
+	uvDimensionMask  = 3
+	uvChannelExists  = 4
+	uvChannelsPacked = 8
+)
+
+// Reads vertex attributes of the compressed mesh(unless they are read from the vertex data) and returns triangles.
+func (m *Mesh) readCompressed(val interface{}) ([]uint32, error) {
+	triangles, err := parsePackedBitVector(val, "m_Triangles")
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Vertices) > 0 {
+		return triangles.ints(), nil
+	}
+
+	vertices, err := parsePackedBitVector(val, "m_Vertices")
+	if err != nil {
+		return nil, err
+	}
+	m.Vertices = vec3List(vertices.floats())
+	count := len(m.Vertices)
+
+	uv, err := parsePackedBitVector(val, "m_UV")
+	if err != nil {
+		return nil, err
+	}
+	uvData := uv.floats()
+
+	var uvInfo uint64
+	if info, err := fieldValue(val, "m_UVInfo"); err == nil {
+		uvInfo, err = uintValue(info)
+		if err != nil {
+			return nil, errors.Wrap(err, "m_UVInfo")
+		}
+	}
+	if uvInfo != 0 {
+		// 4 bits per channel: dimension-1 and existence flag, channels are packed one after another
+		for offset, ch := 0, uint(0); ch < uvChannelsPacked; ch++ {
+			bits := uvInfo >> (ch * uvInfoBits)
+			if bits&uvChannelExists == 0 {
+				continue
+			}
+			dim := 1 + int(bits&uvDimensionMask)
+			if ch == 0 && dim >= 2 && offset+count*dim <= len(uvData) {
+				for i := 0; i < count; i++ {
+					m.UV = append(m.UV, [2]float32{uvData[offset+i*dim], uvData[offset+i*dim+1]})
+				}
+			}
+			offset += count * dim
+		}
+	} else if len(uvData) >= count*2 {
+		m.UV = vec2List(uvData[:count*2])
+	}
+
+	normals, err := parsePackedBitVector(val, "m_Normals")
+	if err != nil {
+		return nil, err
+	}
+	if normals.count > 0 {
+		signs, err := parsePackedBitVector(val, "m_NormalSigns")
+		if err != nil {
+			return nil, err
+		}
+		m.Normals = unpackNormals(normals.floats(), signs.ints())
+		if len(m.Normals) != count {
+			return nil, errors.Errorf("%v normals for %v vertices", len(m.Normals), count)
+		}
+	}
+
+	// 5.0+ stores colors as floats, older versions as packed RGBA32
+	if colors, err := parsePackedBitVector(val, "m_FloatColors"); err == nil {
+		if colors.count == count*4 {
+			m.Colors = vec4List(colors.floats())
+		}
+	} else if colors, err := parsePackedBitVector(val, "m_Colors"); err == nil {
+		if colors.count == count {
+			for _, c := range colors.ints() {
+				m.Colors = append(m.Colors, [4]float32{
+					float32(c&0xff) / 255,
+					float32(c>>8&0xff) / 255,
+					float32(c>>16&0xff) / 255,
+					float32(c>>24) / 255,
+				})
+			}
+		}
+	}
+
+	return triangles.ints(), nil
+}
+
+// Normals are stored as x, y pairs, z is restored from the unit length and the sign.
+func unpackNormals(xy []float32, signs []uint32) [][3]float32 {
+	ret := make([][3]float32, len(xy)/2)
+	for i := range ret {
+		x, y := float64(xy[i*2]), float64(xy[i*2+1])
+		zsqr := 1 - x*x - y*y
+		var z float64
+		if zsqr >= 0 {
+			z = math.Sqrt(zsqr)
+		} else {
+			l := math.Sqrt(x*x + y*y)
+			x, y = x/l, y/l
+		}
+		if i < len(signs) && signs[i] == 0 {
+			z = -z
+		}
+		ret[i] = [3]float32{float32(x), float32(y), float32(z)}
+	}
+	return ret
+}
+
+func vec2List(flat []float32) [][2]float32 {
+	if len(flat) == 0 {
+		return nil
+	}
+	ret := make([][2]float32, len(flat)/2)
+	for i := range ret {
+		copy(ret[i][:], flat[i*2:])
+	}
+	return ret
+}
+
+func vec3List(flat []float32) [][3]float32 {
+	if len(flat) == 0 {
+		return nil
+	}
+	ret := make([][3]float32, len(flat)/3)
+	for i := range ret {
+		copy(ret[i][:], flat[i*3:])
+	}
+	return ret
+}
+
+func vec4List(flat []float32) [][4]float32 {
+	if len(flat) == 0 {
+		return nil
+	}
+	ret := make([][4]float32, len(flat)/4)
+	for i := range ret {
+		copy(ret[i][:], flat[i*4:])
+	}
+	return ret
+}
+
+func MeshExport() error {
+	format := "obj"
+	for i := 4; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "--format" && i+1 < len(os.Args):
+			i++
+			format = os.Args[i]
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		default:
+			return errors.Errorf("unknown argument %v", arg)
+		}
+	}
+
+	var write func(w io.Writer, m Mesh) error
+	switch format {
+	case "obj":
+		write = writeOBJ
+	case "gltf":
+		write = writeGLTF
+	default:
+		return errors.Errorf("unknown mesh format %v", format)
+	}
+
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	err = os.MkdirAll(os.Args[3], 0777)
+	if err != nil {
+		return err
+	}
+
+	names := make(fileNamer)
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != MeshTypeID {
+			return nil
+		}
+
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			return err
+		}
+
+		mesh, err := ParseMesh(assets, val)
+		if err != nil {
+			log.Printf("[warn] skipping mesh %v(%v): %v", mesh.Name, desc.ID, err)
+			return nil
+		}
+		if len(mesh.Vertices) == 0 || mesh.triangleCount() == 0 {
+			log.Printf("[warn] skipping empty mesh %v(%v)", mesh.Name, desc.ID)
+			return nil
+		}
+
+		file := path.Join(os.Args[3], names.name(mesh.Name, desc.ID, "."+format))
+		out, err := CreateUnpacked(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		err = write(out, mesh)
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+
+		log.Printf("  %v: %v vertices, %v submeshes", file, len(mesh.Vertices), len(mesh.SubMeshes))
+		return out.Commit()
+	})
+}
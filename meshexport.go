@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+/* Both formats are right-handed, so X axis is mirrored and triangles winding is reversed on export.
+Texture coordinates of glTF start from the top left corner, so V is flipped as well.
+*/
+
+func writeOBJ(w io.Writer, m Mesh) error {
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "# %v\n", m.Name)
+	for _, v := range m.Vertices {
+		fmt.Fprintf(out, "v %v %v %v\n", -v[0], v[1], v[2])
+	}
+	for _, uv := range m.UV {
+		fmt.Fprintf(out, "vt %v %v\n", uv[0], uv[1])
+	}
+	for _, n := range m.Normals {
+		fmt.Fprintf(out, "vn %v %v %v\n", -n[0], n[1], n[2])
+	}
+
+	// Indices are 1-based, the same index is used for all the attributes
+	vertex := func(i uint32) string {
+		i++
+		switch {
+		case len(m.UV) > 0 && len(m.Normals) > 0:
+			return fmt.Sprintf("%v/%v/%v", i, i, i)
+		case len(m.UV) > 0:
+			return fmt.Sprintf("%v/%v", i, i)
+		case len(m.Normals) > 0:
+			return fmt.Sprintf("%v//%v", i, i)
+		default:
+			return fmt.Sprint(i)
+		}
+	}
+
+	for s, triangles := range m.SubMeshes {
+		fmt.Fprintf(out, "g %v_%v\n", m.Name, s)
+		for i := 0; i+2 < len(triangles); i += 3 {
+			fmt.Fprintf(out, "f %v %v %v\n", vertex(triangles[i]), vertex(triangles[i+2]), vertex(triangles[i+1]))
+		}
+	}
+
+	return out.Flush()
+}
+
+// Minimal subset of glTF 2.0, see https://github.com/KhronosGroup/glTF/tree/master/specification/2.0
+type gltfDocument struct {
+	Asset       gltfAsset        `json:"asset"`
+	Scene       int              `json:"scene"`
+	Scenes      []gltfScene      `json:"scenes"`
+	Nodes       []gltfNode       `json:"nodes"`
+	Meshes      []gltfMesh       `json:"meshes"`
+	Accessors   []gltfAccessor   `json:"accessors"`
+	BufferViews []gltfBufferView `json:"bufferViews"`
+	Buffers     []gltfBuffer     `json:"buffers"`
+}
+
+type gltfAsset struct {
+	Version   string `json:"version"`
+	Generator string `json:"generator"`
+}
+
+type gltfScene struct {
+	Nodes []int `json:"nodes"`
+}
+
+type gltfNode struct {
+	Name string `json:"name"`
+	Mesh int    `json:"mesh"`
+}
+
+type gltfMesh struct {
+	Name       string          `json:"name"`
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    int            `json:"indices"`
+	Mode       int            `json:"mode"`
+}
+
+type gltfAccessor struct {
+	BufferView    int       `json:"bufferView"`
+	ComponentType int       `json:"componentType"`
+	Count         int       `json:"count"`
+	Type          string    `json:"type"`
+	Min           []float32 `json:"min,omitempty"`
+	Max           []float32 `json:"max,omitempty"`
+}
+
+type gltfBufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	Target     int `json:"target,omitempty"`
+}
+
+type gltfBuffer struct {
+	ByteLength int    `json:"byteLength"`
+	URI        string `json:"uri"`
+}
+
+const (
+	gltfFloat         = 5126
+	gltfUnsignedInt   = 5125
+	gltfArrayBuffer   = 34962
+	gltfElementBuffer = 34963
+	gltfTriangles     = 4
+)
+
+// Writes a self-contained .gltf file, binary data is embedded as base64 data uri.
+func writeGLTF(w io.Writer, m Mesh) error {
+	doc := gltfDocument{
+		Asset:  gltfAsset{Version: "2.0", Generator: "shadowed"},
+		Scenes: []gltfScene{{Nodes: []int{0}}},
+		Nodes:  []gltfNode{{Name: m.Name, Mesh: 0}},
+	}
+	var buf bytes.Buffer
+
+	// Appends data as a new buffer view and returns index of the accessor
+	addAccessor := func(data interface{}, count int, componentType int, typ string, target int) int {
+		offset := buf.Len()
+		binary.Write(&buf, binary.LittleEndian, data)
+		doc.BufferViews = append(doc.BufferViews, gltfBufferView{
+			ByteOffset: offset,
+			ByteLength: buf.Len() - offset,
+			Target:     target,
+		})
+		doc.Accessors = append(doc.Accessors, gltfAccessor{
+			BufferView:    len(doc.BufferViews) - 1,
+			ComponentType: componentType,
+			Count:         count,
+			Type:          typ,
+		})
+		return len(doc.Accessors) - 1
+	}
+
+	attributes := make(map[string]int)
+
+	positions := make([][3]float32, len(m.Vertices))
+	min := [3]float32{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+	max := [3]float32{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+	for i, v := range m.Vertices {
+		positions[i] = [3]float32{-v[0], v[1], v[2]}
+		for j, c := range positions[i] {
+			min[j] = float32(math.Min(float64(min[j]), float64(c)))
+			max[j] = float32(math.Max(float64(max[j]), float64(c)))
+		}
+	}
+	attributes["POSITION"] = addAccessor(positions, len(positions), gltfFloat, "VEC3", gltfArrayBuffer)
+	// Bounds are required for positions
+	if len(positions) > 0 {
+		doc.Accessors[attributes["POSITION"]].Min = min[:]
+		doc.Accessors[attributes["POSITION"]].Max = max[:]
+	}
+
+	if len(m.Normals) == len(m.Vertices) {
+		normals := make([][3]float32, len(m.Normals))
+		for i, n := range m.Normals {
+			normals[i] = [3]float32{-n[0], n[1], n[2]}
+		}
+		attributes["NORMAL"] = addAccessor(normals, len(normals), gltfFloat, "VEC3", gltfArrayBuffer)
+	}
+
+	if len(m.UV) == len(m.Vertices) {
+		uv := make([][2]float32, len(m.UV))
+		for i, t := range m.UV {
+			uv[i] = [2]float32{t[0], 1 - t[1]}
+		}
+		attributes["TEXCOORD_0"] = addAccessor(uv, len(uv), gltfFloat, "VEC2", gltfArrayBuffer)
+	}
+
+	if len(m.Colors) == len(m.Vertices) {
+		attributes["COLOR_0"] = addAccessor(m.Colors, len(m.Colors), gltfFloat, "VEC4", gltfArrayBuffer)
+	}
+
+	mesh := gltfMesh{Name: m.Name}
+	for _, triangles := range m.SubMeshes {
+		if len(triangles) == 0 {
+			continue
+		}
+		indices := make([]uint32, len(triangles))
+		for i := 0; i+2 < len(triangles); i += 3 {
+			indices[i], indices[i+1], indices[i+2] = triangles[i], triangles[i+2], triangles[i+1]
+		}
+		mesh.Primitives = append(mesh.Primitives, gltfPrimitive{
+			Attributes: attributes,
+			Indices:    addAccessor(indices, len(indices), gltfUnsignedInt, "SCALAR", gltfElementBuffer),
+			Mode:       gltfTriangles,
+		})
+	}
+	doc.Meshes = []gltfMesh{mesh}
+
+	doc.Buffers = []gltfBuffer{{
+		ByteLength: buf.Len(),
+		URI:        "data:application/octet-stream;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+)
+
+/* Layout of the metadata depends on the file version, see
+https://github.com/HearthSim/UnityPack/wiki/Format-Documentation and UnityPy sources for details.
+Only the versions 9+ are handled here, everything before is long dead anyway.
+*/
+
+const MonoBehaviourTypeID = 114
+
+func (m *MetaData) read(r io.ReadSeeker, order binary.ByteOrder, header Header) error {
+	version := header.Version
+	types := &m.TypeInfo
+
+	err := readAll(r, order, &types.Signature, &types.Platform)
+	if err != nil {
+		return err
+	}
+
+	types.EnableTypeTree = true
+	if version >= 13 {
+		err = read(r, &types.EnableTypeTree, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	var count uint32
+	err = read(r, &count, order, true)
+	if err != nil {
+		return err
+	}
+
+	types.Classes = make([]Class, count)
+	for i := range types.Classes {
+		err = types.Classes[i].read(r, order, version, types.EnableTypeTree, false)
+		if err != nil {
+			return errors.Wrapf(err, "class #%v", i)
+		}
+	}
+
+	if version < 14 {
+		err = read(r, &types.BigIDEnabled, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = read(r, &count, order, true)
+	if err != nil {
+		return err
+	}
+
+	m.Objects = make([]Object, count)
+	for i := range m.Objects {
+		obj := &m.Objects[i]
+		err = obj.read(r, order, version, types.BigIDEnabled != 0)
+		if err != nil {
+			return errors.Wrapf(err, "object #%v", i)
+		}
+
+		if version >= 16 {
+			if int(obj.TypeID) >= len(types.Classes) {
+				return errors.Errorf("object %v: invalid type index %v", obj.ID, obj.TypeID)
+			}
+			obj.TypeIndex = obj.TypeID
+			obj.TypeID = types.Classes[obj.TypeIndex].ID
+			obj.ClassID = uint16(obj.TypeID)
+		}
+	}
+
+	if version >= 11 {
+		err = read(r, &count, order, true)
+		if err != nil {
+			return err
+		}
+
+		m.Scripts = make([]ScriptType, count)
+		for i := range m.Scripts {
+			err = m.Scripts[i].read(r, order, version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = read(r, &m.Externals, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version >= 20 {
+		err = read(r, &count, order, true)
+		if err != nil {
+			return err
+		}
+
+		m.RefTypes = make([]Class, count)
+		for i := range m.RefTypes {
+			err = m.RefTypes[i].read(r, order, version, types.EnableTypeTree, true)
+			if err != nil {
+				return errors.Wrapf(err, "reference type #%v", i)
+			}
+		}
+	}
+
+	// Not every writer cares about user information, so check if there is something left
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if pos < header.Size()+int64(header.MetaSize) {
+		err = read(r, &m.UserInformation, order, true)
+	}
+
+	return err
+}
+
+func (m MetaData) write(w *alignWriter, order binary.ByteOrder, header Header) error {
+	version := header.Version
+	types := m.TypeInfo
+
+	err := writeAll(w, order, types.Signature, types.Platform)
+	if err != nil {
+		return err
+	}
+
+	if version >= 13 {
+		err = write(w, types.EnableTypeTree, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write(w, uint32(len(types.Classes)), order, true)
+	if err != nil {
+		return err
+	}
+
+	for _, class := range types.Classes {
+		err = class.write(w, order, version, types.EnableTypeTree, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 14 {
+		err = write(w, types.BigIDEnabled, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write(w, uint32(len(m.Objects)), order, true)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range m.Objects {
+		if version >= 16 {
+			obj.TypeIndex, err = types.classIndex(obj)
+			if err != nil {
+				return err
+			}
+			obj.TypeID = obj.TypeIndex
+		}
+
+		err = obj.write(w, order, version, types.BigIDEnabled != 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version >= 11 {
+		err = write(w, uint32(len(m.Scripts)), order, true)
+		if err != nil {
+			return err
+		}
+
+		for _, script := range m.Scripts {
+			err = script.write(w, order, version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = write(w, m.Externals, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version >= 20 {
+		err = write(w, uint32(len(m.RefTypes)), order, true)
+		if err != nil {
+			return err
+		}
+
+		for _, class := range m.RefTypes {
+			err = class.write(w, order, version, types.EnableTypeTree, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return write(w, m.UserInformation, order, true)
+}
+
+// Finds index of the object's class, the original one is preferred
+// since script types share the same class ID.
+func (t TypesHeader) classIndex(obj Object) (uint32, error) {
+	if int(obj.TypeIndex) < len(t.Classes) && t.Classes[obj.TypeIndex].ID == obj.TypeID {
+		return obj.TypeIndex, nil
+	}
+	for i, class := range t.Classes {
+		if class.ID == obj.TypeID {
+			return uint32(i), nil
+		}
+	}
+	return 0, errors.Errorf("object %v: type %v not found", obj.ID, obj.TypeID)
+}
+
+// Fields of the object after ID and Shift which don't need any special handling.
+func (o *Object) fields(version uint32) []interface{} {
+	ret := []interface{}{&o.Size, &o.TypeID}
+	if version < 16 {
+		ret = append(ret, &o.ClassID)
+	}
+	if version < 11 {
+		ret = append(ret, &o.Destroyed)
+	}
+	if version >= 11 && version < 17 {
+		ret = append(ret, &o.ScriptTypeIndex)
+	}
+	if version == 15 || version == 16 {
+		ret = append(ret, &o.Stripped)
+	}
+	return ret
+}
+
+func (o *Object) read(r io.ReadSeeker, order binary.ByteOrder, version uint32, bigID bool) error {
+	var err error
+	switch {
+	case bigID:
+		err = read(r, &o.ID, order, true)
+
+	case version < 14:
+		var id uint32
+		err = read(r, &id, order, true)
+		o.ID = uint64(id)
+
+	default:
+		err = readAlign(r, 4)
+		if err == nil {
+			err = read(r, &o.ID, order, true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if version >= 22 {
+		err = read(r, &o.Shift, order, true)
+	} else {
+		var shift uint32
+		err = read(r, &shift, order, true)
+		o.Shift = uint64(shift)
+	}
+	if err != nil {
+		return err
+	}
+
+	return readAll(r, order, o.fields(version)...)
+}
+
+func (o Object) write(w *alignWriter, order binary.ByteOrder, version uint32, bigID bool) error {
+	var err error
+	switch {
+	case bigID:
+		err = write(w, o.ID, order, true)
+
+	case version < 14:
+		err = write(w, uint32(o.ID), order, true)
+
+	default:
+		err = w.align(4)
+		if err == nil {
+			err = write(w, o.ID, order, true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if version >= 22 {
+		err = write(w, o.Shift, order, true)
+	} else {
+		err = write(w, uint32(o.Shift), order, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeAll(w, order, o.fields(version)...)
+}
+
+func (s *ScriptType) read(r io.ReadSeeker, order binary.ByteOrder, version uint32) error {
+	err := read(r, &s.FileIndex, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version < 14 {
+		var id uint32
+		err = read(r, &id, order, true)
+		s.ID = uint64(id)
+		return err
+	}
+
+	err = readAlign(r, 4)
+	if err != nil {
+		return err
+	}
+	return read(r, &s.ID, order, true)
+}
+
+func (s ScriptType) write(w *alignWriter, order binary.ByteOrder, version uint32) error {
+	err := write(w, s.FileIndex, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version < 14 {
+		return write(w, uint32(s.ID), order, true)
+	}
+
+	err = w.align(4)
+	if err != nil {
+		return err
+	}
+	return write(w, s.ID, order, true)
+}
+
+func (c *Class) hasScriptID(version uint32, isRef bool) bool {
+	return (isRef && c.ScriptTypeIndex >= 0) ||
+		(version < 16 && int32(c.ID) < 0) ||
+		(version >= 16 && c.ID == MonoBehaviourTypeID)
+}
+
+func (c *Class) read(r io.ReadSeeker, order binary.ByteOrder, version uint32, typeTree, isRef bool) error {
+	err := read(r, &c.ID, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version >= 16 {
+		err = read(r, &c.IsStripped, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version >= 17 {
+		err = read(r, &c.ScriptTypeIndex, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version >= 13 {
+		if c.hasScriptID(version, isRef) {
+			err = read(r, &c.ScriptID, order, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = read(r, &c.TypeHash, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !typeTree {
+		return nil
+	}
+
+	if version >= 12 || version == 10 {
+		err = c.Info.readBlob(r, order, version)
+	} else {
+		err = c.Info.read(r, order)
+	}
+	if err != nil {
+		return err
+	}
+
+	if version >= 21 {
+		if isRef {
+			err = readAll(r, order, &c.ClassName, &c.NameSpace, &c.AsmName)
+		} else {
+			err = read(r, &c.Dependencies, order, true)
+		}
+	}
+
+	return err
+}
+
+func (c Class) write(w *alignWriter, order binary.ByteOrder, version uint32, typeTree, isRef bool) error {
+	err := write(w, c.ID, order, true)
+	if err != nil {
+		return err
+	}
+
+	if version >= 16 {
+		err = write(w, c.IsStripped, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version >= 17 {
+		err = write(w, c.ScriptTypeIndex, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version >= 13 {
+		if c.hasScriptID(version, isRef) {
+			err = write(w, c.ScriptID, order, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = write(w, c.TypeHash, order, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !typeTree {
+		return nil
+	}
+
+	if version >= 12 || version == 10 {
+		err = c.Info.writeBlob(w, order, version)
+	} else {
+		err = c.Info.write(w, order)
+	}
+	if err != nil {
+		return err
+	}
+
+	if version >= 21 {
+		if isRef {
+			err = writeAll(w, order, c.ClassName, c.NameSpace, c.AsmName)
+		} else {
+			err = write(w, c.Dependencies, order, true)
+		}
+	}
+
+	return err
+}
+
+// Legacy recursive format of type tree
+func (t *TypeInfo) read(r io.ReadSeeker, order binary.ByteOrder) error {
+	err := readAll(r, order, &t.Type, &t.Name, &t.Size, &t.Index, &t.IsArray, &t.Version, &t.Flags)
+	if err != nil {
+		return err
+	}
+
+	var count uint32
+	err = read(r, &count, order, true)
+	if err != nil {
+		return err
+	}
+
+	t.Children = make([]TypeInfo, count)
+	for i := range t.Children {
+		err = t.Children[i].read(r, order)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t TypeInfo) write(w io.Writer, order binary.ByteOrder) error {
+	err := writeAll(w, order, t.Type, t.Name, t.Size, t.Index, t.IsArray, t.Version, t.Flags)
+	if err != nil {
+		return err
+	}
+
+	err = write(w, uint32(len(t.Children)), order, true)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range t.Children {
+		err = child.write(w, order)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Node of flat type tree format used by version 10 and 12+.
+// Tree structure is defined by levels of nodes, strings are stored as offsets in the string buffer
+// or in the common strings table if the highest bit is set.
+type typeNode struct {
+	Version    uint16
+	Level      uint8
+	IsArray    uint8
+	TypeOffset uint32
+	NameOffset uint32
+	Size       uint32
+	Index      uint32
+	Flags      uint32
+}
+
+const commonStringFlag = 0x80000000
+
+func (t *TypeInfo) readBlob(r io.ReadSeeker, order binary.ByteOrder, version uint32) error {
+	var count, strSize uint32
+	err := readAll(r, order, &count, &strSize)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.New("empty type tree")
+	}
+
+	nodes := make([]typeNode, count)
+	hashes := make([]uint64, count)
+	for i := range nodes {
+		err = read(r, &nodes[i], order, true)
+		if err != nil {
+			return err
+		}
+
+		if version >= 19 {
+			err = read(r, &hashes[i], order, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	strs := make([]byte, strSize)
+	_, err = io.ReadFull(r, strs)
+	if err != nil {
+		return err
+	}
+
+	str := func(offset uint32) (string, error) {
+		if offset&commonStringFlag != 0 {
+			ret, ok := commonStringsByOffset[offset&^commonStringFlag]
+			if !ok {
+				return "", errors.Errorf("unknown common string offset %v", offset&^commonStringFlag)
+			}
+			return ret, nil
+		}
+
+		if offset >= uint32(len(strs)) {
+			return "", errors.Errorf("string offset %v is out of range", offset)
+		}
+		end := bytes.IndexByte(strs[offset:], 0)
+		if end == -1 {
+			return string(strs[offset:]), nil
+		}
+		return string(strs[offset : int(offset)+end]), nil
+	}
+
+	infos := make([]TypeInfo, count)
+	levels := make([]uint8, count)
+	for i, node := range nodes {
+		info := &infos[i]
+		info.Type, err = str(node.TypeOffset)
+		if err != nil {
+			return err
+		}
+		info.Name, err = str(node.NameOffset)
+		if err != nil {
+			return err
+		}
+		info.Size = node.Size
+		info.Index = node.Index
+		info.IsArray = uint32(node.IsArray)
+		info.Version = uint32(node.Version)
+		info.Flags = node.Flags
+		info.RefTypeHash = hashes[i]
+		levels[i] = node.Level
+	}
+
+	*t, _ = buildTypeTree(infos, levels, 0)
+	return nil
+}
+
+func buildTypeTree(infos []TypeInfo, levels []uint8, pos int) (TypeInfo, int) {
+	node := infos[pos]
+	next := pos + 1
+	for next < len(infos) && levels[next] > levels[pos] {
+		var child TypeInfo
+		child, next = buildTypeTree(infos, levels, next)
+		node.Children = append(node.Children, child)
+	}
+	return node, next
+}
+
+func (t TypeInfo) writeBlob(w io.Writer, order binary.ByteOrder, version uint32) error {
+	var (
+		nodes  []typeNode
+		hashes []uint64
+		strs   bytes.Buffer
+	)
+
+	local := make(map[string]uint32)
+	offset := func(s string) uint32 {
+		if ret, ok := commonStringOffsets[s]; ok {
+			return ret | commonStringFlag
+		}
+		if ret, ok := local[s]; ok {
+			return ret
+		}
+		ret := uint32(strs.Len())
+		strs.WriteString(s)
+		strs.WriteByte(0)
+		local[s] = ret
+		return ret
+	}
+
+	var flatten func(info TypeInfo, level uint8)
+	flatten = func(info TypeInfo, level uint8) {
+		nodes = append(nodes, typeNode{
+			Version:    uint16(info.Version),
+			Level:      level,
+			IsArray:    uint8(info.IsArray),
+			TypeOffset: offset(info.Type),
+			NameOffset: offset(info.Name),
+			Size:       info.Size,
+			Index:      info.Index,
+			Flags:      info.Flags,
+		})
+		hashes = append(hashes, info.RefTypeHash)
+		for _, child := range info.Children {
+			flatten(child, level+1)
+		}
+	}
+	flatten(t, 0)
+
+	err := writeAll(w, order, uint32(len(nodes)), uint32(strs.Len()))
+	if err != nil {
+		return err
+	}
+
+	for i, node := range nodes {
+		err = write(w, node, order, true)
+		if err != nil {
+			return err
+		}
+
+		if version >= 19 {
+			err = write(w, hashes[i], order, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = w.Write(strs.Bytes())
+	return err
+}
+
+// Reads values one by one, metadata flavor(null-terminated strings).
+func readAll(r io.ReadSeeker, order binary.ByteOrder, values ...interface{}) error {
+	for _, val := range values {
+		err := read(r, val, order, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAll(w io.Writer, order binary.ByteOrder, values ...interface{}) error {
+	for _, val := range values {
+		err := write(w, val, order, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Skips padding up to the next multiple of line.
+// Position is relative to the beginning of the stream.
+func readAlign(r io.Seeker, line int64) error {
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if pos%line == 0 {
+		return nil
+	}
+	_, err = r.Seek(line-pos%line, io.SeekCurrent)
+	return err
+}
+
+// Writer which keeps track of the stream position for alignment purposes.
+type alignWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (w *alignWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.pos += int64(n)
+	return n, err
+}
+
+func (w *alignWriter) align(line int) error {
+	return writeAlign(w, int(w.pos%int64(line)), line)
+}
@@ -0,0 +1,1054 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+)
+
+/* MPEG-1, 2 and 2.5 audio layer III decoder, see ISO/IEC 11172-3 and 13818-3.
+Frames are decoded the straightforward way: Huffman trees, direct IMDCT and polyphase synthesis
+without fast transforms, which is fast enough for music tracks.
+Layers I and II and free format streams are not supported, CRC is not verified.
+Encoder delay and padding from the LAME tag are trimmed, so the tracks loop without gaps.
+*/
+
+const (
+	mp3Granule     = 576
+	mp3Subbands    = 32
+	mp3SubbandSize = mp3Granule / mp3Subbands
+
+	mp3ModeJoint = 1
+	mp3ModeMono  = 3
+
+	// Delay of the hybrid filter bank, trimmed along with the encoder delay
+	mp3DecoderDelay = 529
+	// Main data of a frame can start up to 511 bytes before it
+	mp3MaxReservoir = 511
+)
+
+// Bitrates in kbit/s by the header index for MPEG-1 and MPEG-2/2.5 layer III.
+var mp3Bitrates = [2][15]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// Sample rates of MPEG-1, MPEG-2 and MPEG-2.5 by the rate index.
+var mp3SampleRates = [9]int{44100, 48000, 32000, 22050, 24000, 16000, 11025, 12000, 8000}
+
+// Scale factor band boundaries of long and short blocks by the rate index.
+var mp3LongBands = [9][23]int{
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 52, 62, 74, 90, 110, 134, 162, 196, 238, 288, 342, 418, 576},
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 42, 50, 60, 72, 88, 106, 128, 156, 190, 230, 276, 330, 384, 576},
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 54, 66, 82, 102, 126, 156, 194, 240, 296, 364, 448, 550, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 114, 136, 162, 194, 232, 278, 332, 394, 464, 540, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 12, 24, 36, 48, 60, 72, 88, 108, 132, 160, 192, 232, 280, 336, 400, 476, 566, 568, 570, 572, 574, 576},
+}
+
+var mp3ShortBands = [9][14]int{
+	{0, 4, 8, 12, 16, 22, 30, 40, 52, 66, 84, 106, 136, 192},
+	{0, 4, 8, 12, 16, 22, 28, 38, 50, 64, 80, 100, 126, 192},
+	{0, 4, 8, 12, 16, 22, 30, 42, 58, 78, 104, 138, 180, 192},
+	{0, 4, 8, 12, 18, 24, 32, 42, 56, 74, 100, 132, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 136, 180, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 8, 16, 24, 36, 52, 72, 96, 124, 160, 162, 164, 166, 192},
+}
+
+// Scale factor lengths of MPEG-1 by scalefac_compress.
+var mp3ScalefacLengths = [16][2]int{
+	{0, 0}, {0, 1}, {0, 2}, {0, 3}, {3, 0}, {1, 1}, {1, 2}, {1, 3},
+	{2, 1}, {2, 2}, {2, 3}, {3, 1}, {3, 2}, {3, 3}, {4, 2}, {4, 3},
+}
+
+// Numbers of MPEG-2 scale factors in the four length groups
+// by scalefac_compress range and block type(long, short, mixed).
+var mp3LSFScalefacCounts = [6][3][4]int{
+	{{6, 5, 5, 5}, {9, 9, 9, 9}, {6, 9, 9, 9}},
+	{{6, 5, 7, 3}, {9, 9, 12, 6}, {6, 9, 12, 6}},
+	{{11, 10, 0, 0}, {18, 18, 0, 0}, {15, 18, 0, 0}},
+	{{7, 7, 7, 0}, {12, 12, 12, 0}, {6, 15, 12, 0}},
+	{{6, 6, 6, 3}, {12, 9, 9, 6}, {6, 12, 9, 6}},
+	{{8, 8, 5, 0}, {15, 12, 9, 0}, {6, 18, 9, 0}},
+}
+
+// Added to the long block scale factors with preflag.
+var mp3Pretab = [22]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 3, 2, 0}
+
+type mp3Header struct {
+	// MPEG-2 and 2.5 low sampling frequency streams, single granule per frame
+	LSF bool
+	// Index in mp3SampleRates and the band tables
+	RateIndex int
+	Bitrate   int
+	Padding   bool
+	CRC       bool
+	Mode      int
+	ModeExt   int
+}
+
+// Parses the frame header, ok is false for anything but a valid layer III one.
+func parseMP3Header(b []byte) (h mp3Header, ok bool) {
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	version := b[1] >> 3 & 3
+	layer := b[1] >> 1 & 3
+	bitrate := b[2] >> 4
+	rate := int(b[2] >> 2 & 3)
+	// Reserved values, free format is not supported as well
+	if version == 1 || layer != 1 || bitrate == 0 || bitrate == 15 || rate == 3 {
+		return h, false
+	}
+
+	h.LSF = version != 3
+	switch version {
+	case 3:
+		h.RateIndex = rate
+	case 2:
+		h.RateIndex = 3 + rate
+	default:
+		h.RateIndex = 6 + rate
+	}
+	if h.LSF {
+		h.Bitrate = mp3Bitrates[1][bitrate]
+	} else {
+		h.Bitrate = mp3Bitrates[0][bitrate]
+	}
+	h.CRC = b[1]&1 == 0
+	h.Padding = b[2]>>1&1 != 0
+	h.Mode = int(b[3] >> 6)
+	h.ModeExt = int(b[3] >> 4 & 3)
+	return h, true
+}
+
+func (h mp3Header) SampleRate() int {
+	return mp3SampleRates[h.RateIndex]
+}
+
+func (h mp3Header) Channels() int {
+	if h.Mode == mp3ModeMono {
+		return 1
+	}
+	return 2
+}
+
+func (h mp3Header) Granules() int {
+	if h.LSF {
+		return 1
+	}
+	return 2
+}
+
+func (h mp3Header) FrameSize() int {
+	size := h.Granules() * mp3Granule / 8 * h.Bitrate * 1000 / h.SampleRate()
+	if h.Padding {
+		size++
+	}
+	return size
+}
+
+// Offset of the main data in the frame.
+func (h mp3Header) mainDataOffset() int {
+	offset := 4
+	if h.CRC {
+		offset += 2
+	}
+	switch {
+	case h.LSF && h.Channels() == 1:
+		offset += 9
+	case h.LSF, h.Channels() == 1:
+		offset += 17
+	default:
+		offset += 32
+	}
+	return offset
+}
+
+// Side info of a granule in a channel.
+type mp3GranuleInfo struct {
+	Part23Length     int
+	BigValues        int
+	GlobalGain       int
+	ScalefacCompress int
+	WindowSwitching  bool
+	BlockType        int
+	Mixed            bool
+	TableSelect      [3]int
+	SubblockGain     [3]int
+	Region0Count     int
+	Region1Count     int
+	Preflag          bool
+	ScalefacScale    bool
+	Count1Table      int
+	// Set by the MPEG-2 scale factors of the intensity stereo channel
+	IntensityScale int
+}
+
+type mp3SideInfo struct {
+	MainDataBegin int
+	// Scale factors of the band groups are shared by the granules
+	Scfsi    [2][4]bool
+	Granules [2][2]mp3GranuleInfo
+}
+
+func parseMP3SideInfo(h mp3Header, data []byte) (mp3SideInfo, error) {
+	var side mp3SideInfo
+	r := mp3BitReader{data: data}
+	channels := h.Channels()
+	if h.LSF {
+		side.MainDataBegin = r.Read(8)
+		r.Read(channels)
+	} else {
+		side.MainDataBegin = r.Read(9)
+		if channels == 1 {
+			r.Read(5)
+		} else {
+			r.Read(3)
+		}
+		for ch := 0; ch < channels; ch++ {
+			for i := range side.Scfsi[ch] {
+				side.Scfsi[ch][i] = r.Read(1) != 0
+			}
+		}
+	}
+
+	for gr := 0; gr < h.Granules(); gr++ {
+		for ch := 0; ch < channels; ch++ {
+			g := &side.Granules[gr][ch]
+			g.Part23Length = r.Read(12)
+			g.BigValues = r.Read(9)
+			g.GlobalGain = r.Read(8)
+			if h.LSF {
+				g.ScalefacCompress = r.Read(9)
+			} else {
+				g.ScalefacCompress = r.Read(4)
+			}
+			g.WindowSwitching = r.Read(1) != 0
+			if g.WindowSwitching {
+				g.BlockType = r.Read(2)
+				g.Mixed = r.Read(1) != 0
+				for i := 0; i < 2; i++ {
+					g.TableSelect[i] = r.Read(5)
+				}
+				for i := range g.SubblockGain {
+					g.SubblockGain[i] = r.Read(3)
+				}
+				if g.BlockType == 0 {
+					return side, errors.New("window switching with the normal block type")
+				}
+				// Region 1 spans the rest of the big values
+				g.Region0Count = 7
+				if g.BlockType == 2 && !g.Mixed {
+					g.Region0Count = 8
+				}
+			} else {
+				for i := range g.TableSelect {
+					g.TableSelect[i] = r.Read(5)
+				}
+				g.Region0Count = r.Read(4)
+				g.Region1Count = r.Read(3)
+			}
+			if !h.LSF {
+				g.Preflag = r.Read(1) != 0
+			}
+			g.ScalefacScale = r.Read(1) != 0
+			g.Count1Table = r.Read(1)
+
+			if g.BigValues > mp3Granule/2 {
+				return side, errors.Errorf("%v big values", g.BigValues)
+			}
+		}
+	}
+	return side, nil
+}
+
+// MSB first bit reader, zeros are read past the end of the data.
+type mp3BitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *mp3BitReader) Read(bits int) int {
+	ret := 0
+	for ; bits > 0; bits-- {
+		ret <<= 1
+		if r.pos>>3 < len(r.data) {
+			ret |= int(r.data[r.pos>>3]>>(7-uint(r.pos&7))) & 1
+		}
+		r.pos++
+	}
+	return ret
+}
+
+// Binary tree of a Huffman code, negative children are leaves keeping -symbol-1.
+type mp3HuffmanTree [][2]int32
+
+func newMP3HuffmanTree(codes []uint16, lens []uint8) mp3HuffmanTree {
+	tree := mp3HuffmanTree{{}}
+	for sym, code := range codes {
+		node := 0
+		for b := int(lens[sym]) - 1; b >= 0; b-- {
+			bit := code >> uint(b) & 1
+			if b == 0 {
+				tree[node][bit] = -int32(sym) - 1
+				break
+			}
+			// The root is never a child, so zero marks missing ones
+			if tree[node][bit] == 0 {
+				tree = append(tree, [2]int32{})
+				tree[node][bit] = int32(len(tree) - 1)
+			}
+			node = int(tree[node][bit])
+		}
+	}
+	return tree
+}
+
+func (t mp3HuffmanTree) Decode(r *mp3BitReader) int {
+	node := int32(0)
+	for {
+		node = t[node][r.Read(1)]
+		if node <= 0 {
+			return int(-node - 1)
+		}
+	}
+}
+
+type mp3PairTable struct {
+	tree    mp3HuffmanTree
+	size    int
+	linbits uint
+}
+
+// Big values tables by table_select, tables 0, 4 and 14 are nil.
+var mp3PairTables = func() (tables [32]*mp3PairTable) {
+	trees := make(map[int]mp3HuffmanTree)
+	for i := range tables {
+		base, linbits := i, uint(0)
+		switch {
+		case i >= 24:
+			base, linbits = 24, []uint{4, 5, 6, 7, 8, 9, 11, 13}[i-24]
+		case i >= 16:
+			base, linbits = 16, []uint{1, 2, 3, 4, 6, 8, 10, 13}[i-16]
+		}
+		codes, ok := mp3PairCodes[base]
+		if !ok {
+			continue
+		}
+		if trees[base] == nil {
+			trees[base] = newMP3HuffmanTree(codes.codes, codes.lens)
+		}
+		tables[i] = &mp3PairTable{trees[base], codes.size, linbits}
+	}
+	return
+}()
+
+// Count1 table A, table B is a fixed 4 bit code.
+var mp3QuadTree = newMP3HuffmanTree(
+	[]uint16{1, 5, 4, 5, 6, 5, 4, 4, 7, 3, 6, 0, 7, 2, 3, 1},
+	[]uint8{1, 4, 4, 5, 4, 6, 5, 6, 4, 5, 5, 6, 5, 6, 6, 6},
+)
+
+// |i|^(4/3) for all the values Huffman codes can give.
+var mp3Pow43 = func() (table [8207]float64) {
+	for i := range table {
+		table[i] = math.Pow(float64(i), 4.0/3)
+	}
+	return
+}()
+
+type mp3Scalefactors struct {
+	Long  [22]int
+	Short [13][3]int
+	// Bit lengths of the factors for the MPEG-2 intensity stereo positions
+	LongLen  [22]int
+	ShortLen [13]int
+}
+
+// Scale factor band of a granule, short bands are split by window in the decoding order.
+type mp3Band struct {
+	Start, End int
+	Sfb        int
+	// -1 for long bands
+	Window int
+}
+
+func mp3Bands(h mp3Header, g *mp3GranuleInfo) []mp3Band {
+	long, short := mp3LongBands[h.RateIndex], mp3ShortBands[h.RateIndex]
+	var ret []mp3Band
+	if g.BlockType != 2 {
+		for sfb := 0; sfb < 22; sfb++ {
+			ret = append(ret, mp3Band{long[sfb], long[sfb+1], sfb, -1})
+		}
+		return ret
+	}
+
+	first := 0
+	if g.Mixed {
+		// Mixed blocks have long bands in the first two subbands
+		for sfb := 0; long[sfb+1] <= 36; sfb++ {
+			ret = append(ret, mp3Band{long[sfb], long[sfb+1], sfb, -1})
+		}
+		first = 3
+	}
+	for sfb := first; sfb < 13; sfb++ {
+		width := short[sfb+1] - short[sfb]
+		for w := 0; w < 3; w++ {
+			start := short[sfb]*3 + w*width
+			ret = append(ret, mp3Band{start, start + width, sfb, w})
+		}
+	}
+	return ret
+}
+
+type mp3Decoder struct {
+	header   mp3Header
+	channels int
+	// Main data of the previous frames
+	reservoir []byte
+	scalefacs [2]mp3Scalefactors
+	// The second halves of IMDCT outputs overlapped with the next granule
+	overlap [2][mp3Subbands][mp3SubbandSize]float64
+	// Synthesis filter bank FIFO and its start
+	v    [2][1024]float64
+	vPos [2]int
+	// Decoded samples per channel
+	samples [][]float64
+}
+
+func (d *mp3Decoder) decodeFrame(h mp3Header, frame []byte) error {
+	d.header = h
+	offset := h.mainDataOffset()
+	if offset > len(frame) {
+		return errors.New("side info out of range")
+	}
+	sideStart := 4
+	if h.CRC {
+		sideStart += 2
+	}
+	side, err := parseMP3SideInfo(h, frame[sideStart:offset])
+	if err != nil {
+		return err
+	}
+
+	mainData := frame[offset:]
+	var data []byte
+	if side.MainDataBegin <= len(d.reservoir) {
+		data = append(data, d.reservoir[len(d.reservoir)-side.MainDataBegin:]...)
+		data = append(data, mainData...)
+	}
+	d.reservoir = append(d.reservoir, mainData...)
+	if len(d.reservoir) > mp3MaxReservoir {
+		d.reservoir = append(d.reservoir[:0], d.reservoir[len(d.reservoir)-mp3MaxReservoir:]...)
+	}
+
+	var spectrum [2][mp3Granule]float64
+	r := mp3BitReader{data: data}
+	for gr := 0; gr < h.Granules(); gr++ {
+		// Frames referring to the lost reservoir(e.g. the first ones of a cut stream) are silent
+		if data != nil {
+			for ch := 0; ch < d.channels; ch++ {
+				g := &side.Granules[gr][ch]
+				end := r.pos + g.Part23Length
+				if end > len(data)*8 {
+					return errors.New("main data out of range")
+				}
+				d.readScalefactors(&r, side, gr, ch)
+				err = d.readSpectrum(&r, g, &d.scalefacs[ch], end, &spectrum[ch])
+				if err != nil {
+					return errors.Wrapf(err, "granule %v, channel %v", gr, ch)
+				}
+				r.pos = end
+			}
+			if d.channels == 2 && h.Mode == mp3ModeJoint {
+				d.stereo(&side.Granules[gr][1], &spectrum)
+			}
+		}
+		for ch := 0; ch < d.channels; ch++ {
+			d.synthesize(&side.Granules[gr][ch], ch, &spectrum[ch])
+		}
+	}
+	return nil
+}
+
+func (d *mp3Decoder) readScalefactors(r *mp3BitReader, side mp3SideInfo, gr, ch int) {
+	g := &side.Granules[gr][ch]
+	sf := &d.scalefacs[ch]
+	if d.header.LSF {
+		d.readLSFScalefactors(r, g, ch)
+		return
+	}
+
+	slen := mp3ScalefacLengths[g.ScalefacCompress]
+	if g.BlockType == 2 {
+		first := 0
+		if g.Mixed {
+			for sfb := 0; sfb < 8; sfb++ {
+				sf.Long[sfb] = r.Read(slen[0])
+			}
+			first = 3
+		}
+		for sfb := first; sfb < 12; sfb++ {
+			n := slen[0]
+			if sfb >= 6 {
+				n = slen[1]
+			}
+			for w := range sf.Short[sfb] {
+				sf.Short[sfb][w] = r.Read(n)
+			}
+		}
+		sf.Short[12] = [3]int{}
+		return
+	}
+
+	// Groups of the bands marked by scfsi keep the factors of the first granule
+	groups := [5]int{0, 6, 11, 16, 21}
+	for i := 0; i < 4; i++ {
+		if gr == 1 && side.Scfsi[ch][i] {
+			continue
+		}
+		n := slen[0]
+		if i >= 2 {
+			n = slen[1]
+		}
+		for sfb := groups[i]; sfb < groups[i+1]; sfb++ {
+			sf.Long[sfb] = r.Read(n)
+		}
+	}
+	sf.Long[21] = 0
+}
+
+func (d *mp3Decoder) readLSFScalefactors(r *mp3BitReader, g *mp3GranuleInfo, ch int) {
+	var slen [4]int
+	var row int
+	sfc := g.ScalefacCompress
+	if ch == 1 && d.header.Mode == mp3ModeJoint && d.header.ModeExt&1 != 0 {
+		g.IntensityScale = sfc & 1
+		sfc >>= 1
+		switch {
+		case sfc < 180:
+			slen, row = [4]int{sfc / 36, sfc % 36 / 6, sfc % 36 % 6, 0}, 3
+		case sfc < 244:
+			sfc -= 180
+			slen, row = [4]int{sfc % 64 >> 4, sfc % 16 >> 2, sfc % 4, 0}, 4
+		default:
+			sfc -= 244
+			slen, row = [4]int{sfc / 3, sfc % 3, 0, 0}, 5
+		}
+	} else {
+		switch {
+		case sfc < 400:
+			slen, row = [4]int{(sfc >> 4) / 5, (sfc >> 4) % 5, sfc & 15 >> 2, sfc & 3}, 0
+		case sfc < 500:
+			sfc -= 400
+			slen, row = [4]int{(sfc >> 2) / 5, (sfc >> 2) % 5, sfc & 3, 0}, 1
+		default:
+			sfc -= 500
+			slen, row = [4]int{sfc / 3, sfc % 3, 0, 0}, 2
+			g.Preflag = true
+		}
+	}
+
+	block := 0
+	if g.BlockType == 2 {
+		block = 1
+		if g.Mixed {
+			block = 2
+		}
+	}
+
+	sf := &d.scalefacs[ch]
+	*sf = mp3Scalefactors{}
+	// Factors go in the band order: long ones, then short ones by band and window
+	slot := 0
+	for i, count := range mp3LSFScalefacCounts[row][block] {
+		for j := 0; j < count; j++ {
+			v := r.Read(slen[i])
+			switch {
+			case block == 0:
+				sf.Long[slot], sf.LongLen[slot] = v, slen[i]
+			case block == 2 && slot < 6:
+				sf.Long[slot], sf.LongLen[slot] = v, slen[i]
+			default:
+				k := slot
+				if block == 2 {
+					k += 3*3 - 6
+				}
+				sf.Short[k/3][k%3], sf.ShortLen[k/3] = v, slen[i]
+			}
+			slot++
+		}
+	}
+}
+
+// Decodes Huffman coded values of the granule and requantizes them.
+func (d *mp3Decoder) readSpectrum(r *mp3BitReader, g *mp3GranuleInfo, sf *mp3Scalefactors, end int, out *[mp3Granule]float64) error {
+	var values [mp3Granule]int
+	long, short := mp3LongBands[d.header.RateIndex], mp3ShortBands[d.header.RateIndex]
+	var region1, region2 int
+	if g.WindowSwitching {
+		if g.BlockType == 2 && !g.Mixed {
+			region1 = short[3] * 3
+		} else {
+			region1 = long[8]
+		}
+		region2 = mp3Granule
+	} else {
+		region1 = long[minInt(g.Region0Count+1, 22)]
+		region2 = long[minInt(g.Region0Count+g.Region1Count+2, 22)]
+	}
+
+	i := 0
+	for bigValues := g.BigValues * 2; i < bigValues; i += 2 {
+		selected := g.TableSelect[0]
+		switch {
+		case i >= region2:
+			selected = g.TableSelect[2]
+		case i >= region1:
+			selected = g.TableSelect[1]
+		}
+		if selected == 0 {
+			continue
+		}
+		table := mp3PairTables[selected]
+		if table == nil {
+			return errors.Errorf("invalid Huffman table %v", selected)
+		}
+
+		sym := table.tree.Decode(r)
+		for j, v := range [2]int{sym / table.size, sym % table.size} {
+			if table.linbits > 0 && v == 15 {
+				v += r.Read(int(table.linbits))
+			}
+			if v != 0 && r.Read(1) != 0 {
+				v = -v
+			}
+			values[i+j] = v
+		}
+	}
+
+	// Quadruples of -1..1 values up to the end of the part 3
+	for i+4 <= mp3Granule && r.pos < end {
+		var sym int
+		if g.Count1Table == 0 {
+			sym = mp3QuadTree.Decode(r)
+		} else {
+			sym = 15 - r.Read(4)
+		}
+		var quad [4]int
+		for j := range quad {
+			if sym>>uint(3-j)&1 != 0 {
+				quad[j] = 1
+				if r.Read(1) != 0 {
+					quad[j] = -1
+				}
+			}
+		}
+		// Encoders may stuff bits after the values, the code running past the end is one of them
+		if r.pos > end {
+			break
+		}
+		copy(values[i:], quad[:])
+		i += 4
+	}
+
+	// Requantization
+	mult := 0.5
+	if g.ScalefacScale {
+		mult = 1
+	}
+	gain := float64(g.GlobalGain-210) / 4
+	for _, b := range mp3Bands(d.header, g) {
+		var scale float64
+		if b.Window < 0 {
+			v := sf.Long[b.Sfb]
+			if g.Preflag {
+				v += mp3Pretab[b.Sfb]
+			}
+			scale = math.Exp2(gain - mult*float64(v))
+		} else {
+			scale = math.Exp2(gain - 2*float64(g.SubblockGain[b.Window]) - mult*float64(sf.Short[b.Sfb][b.Window]))
+		}
+		for i := b.Start; i < b.End; i++ {
+			v := values[i]
+			switch {
+			case v > 0:
+				out[i] = mp3Pow43[v] * scale
+			case v < 0:
+				out[i] = -mp3Pow43[-v] * scale
+			default:
+				out[i] = 0
+			}
+		}
+	}
+	return nil
+}
+
+// Restores left and right channels of the joint stereo in place.
+func (d *mp3Decoder) stereo(g *mp3GranuleInfo, spectrum *[2][mp3Granule]float64) {
+	h := d.header
+	ms := h.ModeExt&2 != 0
+	left, right := &spectrum[0], &spectrum[1]
+	midSide := func(start, end int) {
+		for i := start; i < end; i++ {
+			m, s := left[i], right[i]
+			left[i], right[i] = (m+s)/math.Sqrt2, (m-s)/math.Sqrt2
+		}
+	}
+	if h.ModeExt&1 == 0 {
+		if ms {
+			midSide(0, mp3Granule)
+		}
+		return
+	}
+
+	// Intensity stereo takes the bands above the last non-zero one of the right channel,
+	// short windows are checked separately
+	bands := mp3Bands(h, g)
+	intensity := make([]bool, len(bands))
+	var nonZero [4]bool
+	for i := len(bands) - 1; i >= 0; i-- {
+		b := bands[i]
+		window := b.Window
+		if window < 0 {
+			window = 3
+		}
+		zero := !nonZero[window]
+		for j := b.Start; zero && j < b.End; j++ {
+			zero = right[j] == 0
+		}
+		// Long bands of mixed blocks are below all the short ones
+		if window == 3 && (nonZero[0] || nonZero[1] || nonZero[2]) {
+			zero = false
+		}
+		intensity[i] = zero
+		nonZero[window] = !zero
+	}
+
+	sf := &d.scalefacs[1]
+	for i, b := range bands {
+		if !intensity[i] {
+			if ms {
+				midSide(b.Start, b.End)
+			}
+			continue
+		}
+
+		// The last band has no factor and takes the previous one
+		var pos, bits int
+		if b.Window < 0 {
+			sfb := minInt(b.Sfb, 20)
+			pos, bits = sf.Long[sfb], sf.LongLen[sfb]
+		} else {
+			sfb := minInt(b.Sfb, 11)
+			pos, bits = sf.Short[sfb][b.Window], sf.ShortLen[sfb]
+		}
+
+		var kl, kr float64
+		if !h.LSF {
+			if pos >= 7 {
+				if ms {
+					midSide(b.Start, b.End)
+				}
+				continue
+			}
+			sin, cos := math.Sincos(float64(pos) * math.Pi / 12)
+			kl, kr = sin/(sin+cos), cos/(sin+cos)
+		} else {
+			if pos == 1<<uint(bits)-1 {
+				if ms {
+					midSide(b.Start, b.End)
+				}
+				continue
+			}
+			io := math.Pow(2, -0.25*float64(g.IntensityScale+1))
+			kl, kr = 1, 1
+			if pos%2 == 1 {
+				kl = math.Pow(io, float64(pos+1)/2)
+			} else {
+				kr = math.Pow(io, float64(pos)/2)
+			}
+		}
+		for j := b.Start; j < b.End; j++ {
+			left[j], right[j] = left[j]*kl, left[j]*kr
+		}
+	}
+}
+
+// Butterfly coefficients of the alias reduction.
+var mp3AliasCs, mp3AliasCa = func() (cs, ca [8]float64) {
+	for i, c := range []float64{-0.6, -0.535, -0.33, -0.185, -0.095, -0.041, -0.0142, -0.0037} {
+		cs[i] = 1 / math.Sqrt(1+c*c)
+		ca[i] = c / math.Sqrt(1+c*c)
+	}
+	return
+}()
+
+// IMDCT windows by block type, the short one is applied to each of 3 short blocks.
+var mp3Windows = func() (windows [4][36]float64) {
+	for i := 0; i < 36; i++ {
+		windows[0][i] = math.Sin(math.Pi / 36 * (float64(i) + 0.5))
+	}
+	for i := 0; i < 18; i++ {
+		windows[1][i] = windows[0][i]
+		windows[3][i+18] = windows[0][i+18]
+	}
+	for i := 0; i < 6; i++ {
+		windows[1][18+i] = 1
+		windows[1][24+i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5 + 6))
+		windows[3][6+i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5))
+		windows[3][12+i] = 1
+	}
+	for i := 0; i < 12; i++ {
+		windows[2][i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5))
+	}
+	return
+}()
+
+var mp3LongIMDCT = func() (table [36][18]float64) {
+	for i := range table {
+		for k := range table[i] {
+			table[i][k] = math.Cos(math.Pi / 72 * float64((2*i+1+18)*(2*k+1)))
+		}
+	}
+	return
+}()
+
+var mp3ShortIMDCT = func() (table [12][6]float64) {
+	for i := range table {
+		for k := range table[i] {
+			table[i][k] = math.Cos(math.Pi / 24 * float64((2*i+1+6)*(2*k+1)))
+		}
+	}
+	return
+}()
+
+// Matrixing of the synthesis filter bank.
+var mp3SynthesisCos = func() (table [64][32]float64) {
+	for i := range table {
+		for k := range table[i] {
+			table[i][k] = math.Cos(math.Pi / 64 * float64((16+i)*(2*k+1)))
+		}
+	}
+	return
+}()
+
+// Synthesis window, blocks of 64 coefficients alternate signs of the prototype filter.
+var mp3SynthesisWindow = func() (window [512]float64) {
+	for i := range window {
+		j := i
+		if j > 256 {
+			j = 512 - i
+		}
+		window[i] = mp3SynthesisPrototype[j] / 65536
+		if i/64%2 == 1 {
+			window[i] = -window[i]
+		}
+	}
+	return
+}()
+
+// Turns the spectrum of a granule into samples: reordering, alias reduction, IMDCT and synthesis.
+func (d *mp3Decoder) synthesize(g *mp3GranuleInfo, ch int, xr *[mp3Granule]float64) {
+	if g.BlockType == 2 {
+		// Short blocks are decoded by band and window, IMDCT takes them by frequency
+		short := mp3ShortBands[d.header.RateIndex]
+		first := 0
+		if g.Mixed {
+			first = 3
+		}
+		var tmp [mp3Granule]float64
+		for sfb := first; sfb < 13; sfb++ {
+			start, width := short[sfb]*3, short[sfb+1]-short[sfb]
+			for w := 0; w < 3; w++ {
+				for j := 0; j < width; j++ {
+					tmp[start+3*j+w] = xr[start+w*width+j]
+				}
+			}
+		}
+		start := short[first] * 3
+		copy(xr[start:], tmp[start:])
+	}
+
+	aliased := mp3Subbands - 1
+	if g.BlockType == 2 {
+		aliased = 0
+		if g.Mixed {
+			aliased = 1
+		}
+	}
+	for sb := 0; sb < aliased; sb++ {
+		for i := 0; i < 8; i++ {
+			lo, hi := &xr[sb*mp3SubbandSize+17-i], &xr[(sb+1)*mp3SubbandSize+i]
+			*lo, *hi = *lo*mp3AliasCs[i]-*hi*mp3AliasCa[i], *hi*mp3AliasCs[i]+*lo*mp3AliasCa[i]
+		}
+	}
+
+	var subbands [mp3SubbandSize][mp3Subbands]float64
+	for sb := 0; sb < mp3Subbands; sb++ {
+		in := xr[sb*mp3SubbandSize : (sb+1)*mp3SubbandSize]
+		blockType := g.BlockType
+		if g.Mixed && sb < 2 {
+			blockType = 0
+		}
+
+		var out [36]float64
+		if blockType == 2 {
+			for w := 0; w < 3; w++ {
+				for i := 0; i < 12; i++ {
+					s := 0.0
+					for k := 0; k < 6; k++ {
+						s += in[3*k+w] * mp3ShortIMDCT[i][k]
+					}
+					out[6+6*w+i] += s * mp3Windows[2][i]
+				}
+			}
+		} else {
+			for i := 0; i < 36; i++ {
+				s := 0.0
+				for k, v := range in {
+					s += v * mp3LongIMDCT[i][k]
+				}
+				out[i] = s * mp3Windows[blockType][i]
+			}
+		}
+
+		overlap := &d.overlap[ch][sb]
+		for i := 0; i < mp3SubbandSize; i++ {
+			v := out[i] + overlap[i]
+			// Frequency inversion of the odd subbands
+			if sb%2 == 1 && i%2 == 1 {
+				v = -v
+			}
+			subbands[i][sb] = v
+			overlap[i] = out[i+mp3SubbandSize]
+		}
+	}
+
+	v := &d.v[ch]
+	for _, s := range subbands {
+		d.vPos[ch] = (d.vPos[ch] - 64) & 1023
+		pos := d.vPos[ch]
+		for i := 0; i < 64; i++ {
+			sum := 0.0
+			for k, x := range s {
+				sum += x * mp3SynthesisCos[i][k]
+			}
+			v[(pos+i)&1023] = sum
+		}
+		for j := 0; j < 32; j++ {
+			sum := 0.0
+			for m := 0; m < 8; m++ {
+				sum += v[(pos+128*m+j)&1023] * mp3SynthesisWindow[64*m+j]
+				sum += v[(pos+128*m+96+j)&1023] * mp3SynthesisWindow[64*m+32+j]
+			}
+			d.samples[ch] = append(d.samples[ch], sum)
+		}
+	}
+}
+
+// Returns the data after ID3v2 tag if there is one.
+func skipID3v2(data []byte) ([]byte, error) {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return data, nil
+	}
+	size := int(data[6])<<21 | int(data[7])<<14 | int(data[8])<<7 | int(data[9])
+	if 10+size > len(data) {
+		return nil, errors.New("ID3 tag out of range")
+	}
+	return data[10+size:], nil
+}
+
+// Returns encoder delay and padding stored in the LAME tag of Xing/Info frame, ok is false for other frames.
+func parseMP3Info(h mp3Header, frame []byte) (delay, padding int, ok bool) {
+	pos := h.mainDataOffset()
+	if pos+8 > len(frame) {
+		return 0, 0, false
+	}
+	if id := string(frame[pos : pos+4]); id != "Xing" && id != "Info" {
+		return 0, 0, false
+	}
+	flags := binary.BigEndian.Uint32(frame[pos+4:])
+	pos += 8
+	// Frames, bytes, TOC and quality fields
+	for i, size := range []int{4, 4, 100, 4} {
+		if flags&(1<<uint(i)) != 0 {
+			pos += size
+		}
+	}
+	if pos+24 <= len(frame) && (string(frame[pos:pos+4]) == "LAME" || string(frame[pos:pos+3]) == "Lav") {
+		delay = int(frame[pos+21])<<4 | int(frame[pos+22])>>4
+		padding = int(frame[pos+22]&15)<<8 | int(frame[pos+23])
+	}
+	return delay, padding, true
+}
+
+func ParseMP3(data []byte) (PCMAudio, error) {
+	data, err := skipID3v2(data)
+	if err != nil {
+		return PCMAudio{}, err
+	}
+	if len(data) >= 128 && string(data[len(data)-128:len(data)-125]) == "TAG" {
+		data = data[:len(data)-128]
+	}
+
+	var d mp3Decoder
+	var first *mp3Header
+	delay, padding := 0, 0
+	for pos, frame := 0, 0; pos+4 <= len(data); {
+		h, ok := parseMP3Header(data[pos:])
+		if ok && first != nil {
+			ok = h.LSF == first.LSF && h.RateIndex == first.RateIndex
+		}
+		// The first header is taken only when the next one follows it to skip junk looking like a header
+		if ok && first == nil && pos+h.FrameSize()+4 <= len(data) {
+			next, nextOk := parseMP3Header(data[pos+h.FrameSize():])
+			ok = nextOk && next.LSF == h.LSF && next.RateIndex == h.RateIndex
+		}
+		if !ok {
+			pos++
+			continue
+		}
+		size := h.FrameSize()
+		if pos+size > len(data) {
+			// Truncated last frame is dropped like players do
+			break
+		}
+
+		if first == nil {
+			first = &h
+			d.channels = h.Channels()
+			d.samples = make([][]float64, d.channels)
+			if tagDelay, tagPadding, ok := parseMP3Info(h, data[pos:pos+size]); ok {
+				delay, padding = tagDelay+mp3DecoderDelay, maxInt(tagPadding-mp3DecoderDelay, 0)
+				pos += size
+				continue
+			}
+		}
+		if h.Channels() != d.channels {
+			return PCMAudio{}, errors.Errorf("frame %v: %v channels, %v expected", frame, h.Channels(), d.channels)
+		}
+		err = d.decodeFrame(h, data[pos:pos+size])
+		if err != nil {
+			return PCMAudio{}, errors.Wrapf(err, "frame %v", frame)
+		}
+		pos += size
+		frame++
+	}
+	if first == nil {
+		return PCMAudio{}, errors.New("no MPEG layer III frames found")
+	}
+
+	for ch, s := range d.samples {
+		end := maxInt(len(s)-padding, 0)
+		d.samples[ch] = s[minInt(delay, end):end]
+	}
+	return NewPCMAudio16(d.samples, first.SampleRate()), nil
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Codes are complete and prefix free: every node has both children and each symbol has a leaf.
+func TestMP3HuffmanCodes(t *testing.T) {
+	check := func(name string, tree mp3HuffmanTree, symbols int) {
+		leaves := 0
+		for _, node := range tree {
+			for _, child := range node {
+				switch {
+				case child < 0:
+					leaves++
+				case child == 0:
+					t.Errorf("%v: incomplete code", name)
+					return
+				}
+			}
+		}
+		if leaves != symbols {
+			t.Errorf("%v: %v leaves, %v symbols", name, leaves, symbols)
+		}
+	}
+	for i, table := range mp3PairTables {
+		if table != nil {
+			check(fmt.Sprintf("table %v", i), table.tree, table.size*table.size)
+		}
+	}
+	check("count1 table", mp3QuadTree, 16)
+}
+
+// MPEG-1 44100Hz 128kbit/s stream, every granule of a channel has the same spectrum.
+type mp3TestStream struct {
+	mode, modeExt int
+	// Big values of each channel
+	spectra [][]int
+	frames  int
+	table   int
+	// LAME tag in the Info frame if any is set
+	delay, padding int
+}
+
+// 144 * 128000 / 44100
+const mp3TestFrameSize = 417
+
+func (s mp3TestStream) encode() []byte {
+	header := []byte{0xff, 0xfb, 0x90, byte(s.mode<<6 | s.modeExt<<4)}
+	h, _ := parseMP3Header(header)
+	var data []byte
+	if s.delay != 0 || s.padding != 0 {
+		frame := make([]byte, mp3TestFrameSize)
+		copy(frame, header)
+		tag := h.mainDataOffset()
+		copy(frame[tag:], "Info\x00\x00\x00\x00LAME3.100")
+		tag += 8
+		frame[tag+21] = byte(s.delay >> 4)
+		frame[tag+22] = byte(s.delay<<4 | s.padding>>8)
+		frame[tag+23] = byte(s.padding)
+		data = append(data, frame...)
+	}
+
+	table := s.table
+	if table == 0 {
+		table = 24
+	}
+	codes, linbits := mp3PairCodes[24], uint(4)
+	if t := mp3PairTables[table]; t != nil {
+		linbits = t.linbits
+	}
+	granules := make([]flacTestWriter, len(s.spectra))
+	for ch, spectrum := range s.spectra {
+		w := &granules[ch]
+		for i := 0; i < len(spectrum); i += 2 {
+			x, y := spectrum[i], spectrum[i+1]
+			ax, ay := minInt(abs(x), 15), minInt(abs(y), 15)
+			sym := ax*codes.size + ay
+			w.Write(uint64(codes.codes[sym]), uint(codes.lens[sym]))
+			for _, v := range []int{x, y} {
+				if abs(v) >= 15 {
+					w.Write(uint64(abs(v)-15), linbits)
+				}
+				if v != 0 {
+					w.Write(uint64(v)>>63, 1)
+				}
+			}
+		}
+	}
+
+	for f := 0; f < s.frames; f++ {
+		side := &flacTestWriter{}
+		side.Write(0, 9)
+		if len(s.spectra) == 1 {
+			side.Write(0, 5+4)
+		} else {
+			side.Write(0, 3+8)
+		}
+		main := &flacTestWriter{}
+		for gr := 0; gr < 2; gr++ {
+			for ch, spectrum := range s.spectra {
+				side.Write(uint64(granules[ch].pos), 12)
+				side.Write(uint64(len(spectrum)/2), 9)
+				// Global gain and no scale factors
+				side.Write(190, 8)
+				side.Write(0, 4+1)
+				for i := 0; i < 3; i++ {
+					side.Write(uint64(table), 5)
+				}
+				side.Write(15, 4)
+				side.Write(7, 3)
+				side.Write(0, 3)
+				for i, b := range granules[ch].data {
+					bits := minInt(8, int(granules[ch].pos)-i*8)
+					main.Write(uint64(b>>uint(8-bits)), uint(bits))
+				}
+			}
+		}
+
+		frame := make([]byte, mp3TestFrameSize)
+		copy(frame, header)
+		copy(frame[4:], side.data)
+		copy(frame[h.mainDataOffset():], main.data)
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Returns the spectrum line of the loudest tone in the samples.
+func mp3TestTone(samples []float64) int {
+	best, bestPower := 0, 0.0
+	for k := 0; k < mp3Granule; k++ {
+		// Goertzel filter, a line repeated in every granule sounds at k * rate / 1152
+		c := 2 * math.Cos(math.Pi*float64(k)/mp3Granule)
+		var s1, s2 float64
+		for _, x := range samples {
+			s1, s2 = x+c*s1-s2, s1
+		}
+		if power := s1*s1 + s2*s2 - c*s1*s2; power > bestPower {
+			best, bestPower = k, power
+		}
+	}
+	return best
+}
+
+func mp3TestSpectrum(lines map[int]int) []int {
+	ret := make([]int, 2*mp3Granule/4)
+	for i, v := range lines {
+		ret[i] = v
+	}
+	return ret
+}
+
+func TestParseMP3(t *testing.T) {
+	const frames = 12
+	cases := []struct {
+		name string
+		mp3TestStream
+		// Loudest lines of the channels, then of their sum and difference
+		tones []int
+	}{
+		{
+			name: "mono",
+			mp3TestStream: mp3TestStream{mode: mp3ModeMono, frames: frames,
+				spectra: [][]int{mp3TestSpectrum(map[int]int{40: 12})}},
+			tones: []int{40},
+		},
+		{
+			name: "linbits",
+			mp3TestStream: mp3TestStream{mode: mp3ModeMono, frames: frames, table: 26,
+				spectra: [][]int{mp3TestSpectrum(map[int]int{7: -3, 90: 40})}},
+			tones: []int{90},
+		},
+		{
+			name: "stereo",
+			mp3TestStream: mp3TestStream{mode: 0, frames: frames,
+				spectra: [][]int{mp3TestSpectrum(map[int]int{40: 12}), mp3TestSpectrum(map[int]int{100: 12})}},
+			tones: []int{40, 100},
+		},
+		{
+			name: "mid side",
+			mp3TestStream: mp3TestStream{mode: mp3ModeJoint, modeExt: 2, frames: frames,
+				spectra: [][]int{mp3TestSpectrum(map[int]int{40: 12}), mp3TestSpectrum(map[int]int{100: 6})}},
+			tones: []int{40, 40, 40, 100},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			audio, err := ParseMP3(c.encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audio.Channels != len(c.spectra) || audio.SampleRate != 44100 || audio.Frames() != frames*1152 {
+				t.Fatalf("%v channels, %v Hz, %v frames", audio.Channels, audio.SampleRate, audio.Frames())
+			}
+
+			samples, err := audio.Samples()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) == 2 {
+				sum, diff := make([]float64, len(samples[0])), make([]float64, len(samples[0]))
+				for i := range sum {
+					sum[i], diff[i] = samples[0][i]+samples[1][i], samples[0][i]-samples[1][i]
+				}
+				samples = append(samples, sum, diff)
+			}
+			for i, expected := range c.tones {
+				// Skip the filter bank delay
+				if tone := mp3TestTone(samples[i][1152:]); tone != expected {
+					t.Errorf("signal %v: tone at line %v, %v expected", i, tone, expected)
+				}
+			}
+		})
+	}
+}
+
+// Encoder delay and padding are trimmed, so the Info frame doesn't add silence.
+func TestParseMP3Gapless(t *testing.T) {
+	stream := mp3TestStream{mode: mp3ModeMono, frames: 10, delay: 576, padding: 1000,
+		spectra: [][]int{mp3TestSpectrum(map[int]int{40: 12})}}
+	data := stream.encode()
+
+	tag := append([]byte("ID3\x03\x00\x00\x00\x00\x00\x04"), "tags"...)
+	audio, err := ParseMP3(append(tag, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 10*1152 - (576 + mp3DecoderDelay) - (1000 - mp3DecoderDelay); audio.Frames() != expected {
+		t.Errorf("%v frames, %v expected", audio.Frames(), expected)
+	}
+}
+
+func TestParseMP3Errors(t *testing.T) {
+	mono := mp3TestStream{mode: mp3ModeMono, frames: 2, spectra: [][]int{mp3TestSpectrum(map[int]int{40: 12})}}
+	stereo := mono
+	stereo.mode = 0
+	stereo.spectra = append(stereo.spectra, stereo.spectra[0])
+	invalidTable := mono
+	invalidTable.table = 4
+
+	cases := map[string]struct {
+		data []byte
+		err  string
+	}{
+		"no frames":        {[]byte("RIFF....WAVEfmt "), "no MPEG layer III frames"},
+		"channels changed": {append(mono.encode(), stereo.encode()...), "frame 2: 2 channels, 1 expected"},
+		"invalid table":    {invalidTable.encode(), "invalid Huffman table 4"},
+	}
+	for name, c := range cases {
+		_, err := ParseMP3(c.data)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: %v, %q expected", name, err, c.err)
+		}
+	}
+}
+
+// Subbands of the analysis filter bank given by the standard.
+func mp3TestAnalysis(in []float64) [][mp3Subbands]float64 {
+	var x [512]float64
+	var ret [][mp3Subbands]float64
+	for pos := 0; pos+mp3Subbands <= len(in); pos += mp3Subbands {
+		copy(x[mp3Subbands:], x[:512-mp3Subbands])
+		for i := 0; i < mp3Subbands; i++ {
+			x[i] = in[pos+mp3Subbands-1-i]
+		}
+		var y [64]float64
+		for i := range y {
+			for j := 0; j < 8; j++ {
+				y[i] += mp3SynthesisWindow[i+64*j] / 32 * x[i+64*j]
+			}
+		}
+		var s [mp3Subbands]float64
+		for k := range s {
+			for i, v := range y {
+				s[k] += math.Cos(math.Pi/64*float64((2*k+1)*(i-16))) * v
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// The spectrum made by the analysis filter bank and MDCT is synthesized back to the input.
+func TestMP3Synthesis(t *testing.T) {
+	cases := []struct {
+		name       string
+		blockTypes []int
+		mixed      bool
+	}{
+		{"long", []int{0}, false},
+		{"short", []int{2}, false},
+		{"mixed", []int{2}, true},
+		{"switching", []int{0, 1, 2, 2, 3, 0, 1, 3}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			in := make([]float64, 40*mp3Granule)
+			for i := range in {
+				in[i] = rand.Float64() - 0.5
+			}
+			subbands := mp3TestAnalysis(in)
+			d := mp3Decoder{channels: 1, samples: make([][]float64, 1)}
+			short := mp3ShortBands[d.header.RateIndex]
+			for gr := 0; gr < len(in)/mp3Granule; gr++ {
+				g := mp3GranuleInfo{BlockType: c.blockTypes[gr%len(c.blockTypes)], Mixed: c.mixed}
+
+				var xr [mp3Granule]float64
+				for sb := 0; sb < mp3Subbands; sb++ {
+					// Two granules of the subband with the frequency inversion
+					var z [2 * mp3SubbandSize]float64
+					for i := range z {
+						if n := (gr-1)*mp3SubbandSize + i; n >= 0 {
+							z[i] = subbands[n][sb]
+							if sb%2 == 1 && n%2 == 1 {
+								z[i] = -z[i]
+							}
+						}
+					}
+
+					if g.BlockType != 2 || g.Mixed && sb < 2 {
+						blockType := g.BlockType
+						if g.Mixed {
+							blockType = 0
+						}
+						for k := 0; k < mp3SubbandSize; k++ {
+							for i, v := range z {
+								xr[sb*mp3SubbandSize+k] += v * mp3Windows[blockType][i] * mp3LongIMDCT[i][k] / 9
+							}
+						}
+						continue
+					}
+					// Short blocks are stored by band and window
+					for w := 0; w < 3; w++ {
+						for k := 0; k < 6; k++ {
+							line := sb*6 + k
+							sfb := 0
+							for short[sfb+1] <= line {
+								sfb++
+							}
+							width := short[sfb+1] - short[sfb]
+							pos := short[sfb]*3 + w*width + line - short[sfb]
+							for i := 0; i < 12; i++ {
+								xr[pos] += z[6+6*w+i] * mp3Windows[2][i] * mp3ShortIMDCT[i][k] / 3
+							}
+						}
+					}
+				}
+
+				aliased := mp3Subbands - 1
+				if g.BlockType == 2 {
+					aliased = 0
+					if g.Mixed {
+						aliased = 1
+					}
+				}
+				for sb := 0; sb < aliased; sb++ {
+					for i := 0; i < 8; i++ {
+						lo, hi := &xr[sb*mp3SubbandSize+17-i], &xr[(sb+1)*mp3SubbandSize+i]
+						*lo, *hi = *lo*mp3AliasCs[i]+*hi*mp3AliasCa[i], *hi*mp3AliasCs[i]-*lo*mp3AliasCa[i]
+					}
+				}
+				d.synthesize(&g, 0, &xr)
+			}
+
+			// Delays of the analysis and synthesis filter banks and of the MDCT
+			const delay = 481 + mp3Granule
+			out := d.samples[0]
+			var signal, noise float64
+			for i := 2 * mp3Granule; i < len(out); i++ {
+				signal += in[i-delay] * in[i-delay]
+				noise += (out[i] - in[i-delay]) * (out[i] - in[i-delay])
+			}
+			if snr := 10 * math.Log10(signal/noise); snr < 80 {
+				t.Errorf("SNR %.1f dB", snr)
+			}
+		})
+	}
+}
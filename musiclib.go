@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/betrok/shadowed/class"
+	"github.com/golang/protobuf/proto"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/* Editing of music.mlib.bytes, the list of music groups shown in the editor.
+Exported lib is JSON for .json files and txtpack(protobuf text format) otherwise:
+
+	groups {
+	  name: "Combat"
+	  tracks: "Combat-01"
+	}
+*/
+
+func MusicLibExport() error {
+	lib, err := parseMusicLib(os.Args[2])
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if isJSONFile(os.Args[3]) {
+		data, err = json.MarshalIndent(lib, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		data = musicLibText(lib)
+	}
+
+	return WriteOutput(os.Args[3], data)
+}
+
+func MusicLibImport() error {
+	data, err := ioutil.ReadFile(os.Args[2])
+	if err != nil {
+		return err
+	}
+
+	var lib class.MusicLib
+	if isJSONFile(os.Args[2]) {
+		err = json.Unmarshal(data, &lib)
+	} else {
+		err = proto.UnmarshalText(string(data), &lib)
+	}
+	if err != nil {
+		return errors.Wrap(err, os.Args[2])
+	}
+
+	checkMusicLib(lib)
+	return saveMusicLib(lib, os.Args[3])
+}
+
+func isJSONFile(file string) bool {
+	return strings.ToLower(path.Ext(file)) == ".json"
+}
+
+// Writes the lib in txtpack format, proto.MarshalText uses <> for messages which txtpack doesn't accept.
+func musicLibText(lib class.MusicLib) []byte {
+	var buf bytes.Buffer
+	for _, group := range lib.Groups {
+		fmt.Fprintf(&buf, "groups {\n  name: %v\n", strconv.Quote(group.Name))
+		for _, track := range group.Tracks {
+			fmt.Fprintf(&buf, "  tracks: %v\n", strconv.Quote(track))
+		}
+		buf.WriteString("}\n")
+	}
+	return buf.Bytes()
+}
+
+// Warns about duplicated groups and tracks, which the editor doesn't expect.
+func checkMusicLib(lib class.MusicLib) {
+	groups := make(map[string]bool)
+	for _, group := range lib.Groups {
+		if groups[strings.ToLower(group.Name)] {
+			log.Printf("[warn] duplicated group %v", group.Name)
+		}
+		groups[strings.ToLower(group.Name)] = true
+
+		tracks := make(map[string]bool)
+		for _, track := range group.Tracks {
+			if tracks[strings.ToLower(track)] {
+				log.Printf("[warn] duplicated track %v in group %v", track, group.Name)
+			}
+			tracks[strings.ToLower(track)] = true
+		}
+		if len(group.Tracks) == 0 {
+			log.Printf("[warn] group %v is empty", group.Name)
+		}
+	}
+}
+
+// mlib-group <add|remove|rename|move-track> <music.mlib.bytes> args...
+func MusicLibGroup() error {
+	command, file, args := os.Args[2], os.Args[3], os.Args[4:]
+
+	lib, err := parseMusicLib(file)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "add":
+		if len(args) < 1 {
+			return errors.New("group name is required")
+		}
+		err = addToGroup(&lib, args[0], args[1:])
+
+	case "remove":
+		if len(args) != 1 {
+			return errors.New("group name is required")
+		}
+		err = removeGroup(&lib, args[0])
+
+	case "rename":
+		if len(args) != 2 {
+			return errors.New("old and new group names are required")
+		}
+		err = renameGroup(&lib, args[0], args[1])
+
+	case "move-track":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("track and target group are required")
+		}
+		from := ""
+		if len(args) == 3 {
+			from = args[2]
+		}
+		err = moveTrack(&lib, args[0], args[1], from)
+
+	default:
+		return errors.Errorf("unknown mlib-group command %v", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	return saveMusicLib(lib, file)
+}
+
+// Creates the group if needed and appends the tracks missing in it.
+func addToGroup(lib *class.MusicLib, name string, tracks []string) error {
+	group := findGroup(lib, name)
+	if group == nil {
+		if len(tracks) == 0 {
+			return errors.New("new group needs at least one track")
+		}
+		group = &class.MusicGroup{Name: name}
+		lib.Groups = append(lib.Groups, group)
+		log.Printf("creating group %v", name)
+	}
+
+	for _, track := range tracks {
+		if hasTrack(group, track) {
+			log.Printf("%v is already in group %v", track, group.Name)
+			continue
+		}
+		group.Tracks = append(group.Tracks, track)
+		log.Printf("adding %v to group %v", track, group.Name)
+	}
+	return nil
+}
+
+func removeGroup(lib *class.MusicLib, name string) error {
+	group := findGroup(lib, name)
+	if group == nil {
+		return errors.Errorf("group %v not found", name)
+	}
+
+	groups := lib.Groups[:0]
+	for _, g := range lib.Groups {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	lib.Groups = groups
+
+	// Tracks without a group are not listed in the editor
+	for _, track := range group.Tracks {
+		if len(trackGroups(lib, track)) == 0 {
+			log.Printf("[warn] %v is not in any group now", track)
+		}
+	}
+	log.Printf("removing group %v", group.Name)
+	return nil
+}
+
+func renameGroup(lib *class.MusicLib, name, newName string) error {
+	group := findGroup(lib, name)
+	if group == nil {
+		return errors.Errorf("group %v not found", name)
+	}
+	if other := findGroup(lib, newName); other != nil && other != group {
+		return errors.Errorf("group %v already exists", other.Name)
+	}
+
+	log.Printf("renaming group %v to %v", group.Name, newName)
+	group.Name = newName
+	return nil
+}
+
+// Moves the track to the target group, from all the groups it is in if the source group is not given.
+func moveTrack(lib *class.MusicLib, track, to, from string) error {
+	target := findGroup(lib, to)
+	if target == nil {
+		return errors.Errorf("group %v not found, use mlib-group add to create it", to)
+	}
+
+	sources := trackGroups(lib, track)
+	if from != "" {
+		source := findGroup(lib, from)
+		if source == nil {
+			return errors.Errorf("group %v not found", from)
+		}
+		if !hasTrack(source, track) {
+			return errors.Errorf("%v is not in group %v", track, source.Name)
+		}
+		sources = []*class.MusicGroup{source}
+	}
+	if len(sources) == 0 {
+		return errors.Errorf("track %v not found", track)
+	}
+
+	for _, group := range sources {
+		if group == target {
+			continue
+		}
+		tracks := group.Tracks[:0]
+		for _, t := range group.Tracks {
+			if !strings.EqualFold(t, track) {
+				tracks = append(tracks, t)
+			}
+		}
+		group.Tracks = tracks
+		log.Printf("removing %v from group %v", track, group.Name)
+	}
+
+	if !hasTrack(target, track) {
+		target.Tracks = append(target.Tracks, track)
+		log.Printf("adding %v to group %v", track, target.Name)
+	}
+
+	// Same as music-pack does
+	groups := lib.Groups[:0]
+	for _, group := range lib.Groups {
+		if len(group.Tracks) == 0 {
+			log.Printf("removing empty group %v", group.Name)
+			continue
+		}
+		groups = append(groups, group)
+	}
+	lib.Groups = groups
+	return nil
+}
+
+func hasTrack(group *class.MusicGroup, track string) bool {
+	for _, t := range group.Tracks {
+		if strings.EqualFold(t, track) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups containing the track.
+func trackGroups(lib *class.MusicLib, track string) []*class.MusicGroup {
+	var ret []*class.MusicGroup
+	for _, group := range lib.Groups {
+		if hasTrack(group, track) {
+			ret = append(ret, group)
+		}
+	}
+	return ret
+}
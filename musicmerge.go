@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/betrok/shadowed/class"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Transplants music of other games into the target one.
+All the target tracks are kept, tracks of each source game are added to the target and listed
+in the music lib as "<game>: <group>" groups mirroring the source lib.
+Colliding names get the game name as a suffix or prefix, identical tracks are not duplicated.
+*/
+
+// Placeholder of the game name in the rename templates.
+const mergeGamePlaceholder = "{game}"
+
+// music-merge <target_data_root> <source_data_root>... <output_dir> [--prefix text|--suffix text] [--incremental]
+func MusicMerge() error {
+	prefix, suffix := "", "-"+mergeGamePlaceholder
+	incremental := false
+
+	var roots []string
+	for i := 2; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "--incremental":
+			incremental = true
+		case (arg == "--prefix" || arg == "--suffix") && i+1 < len(os.Args):
+			i++
+			prefix, suffix = "", ""
+			if arg == "--prefix" {
+				prefix = os.Args[i]
+			} else {
+				suffix = os.Args[i]
+			}
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix, suffix = strings.TrimPrefix(arg, "--prefix="), ""
+		case strings.HasPrefix(arg, "--suffix="):
+			prefix, suffix = "", strings.TrimPrefix(arg, "--suffix=")
+		case strings.HasPrefix(arg, "--"):
+			return errors.Errorf("unknown argument %v", arg)
+		default:
+			roots = append(roots, arg)
+		}
+	}
+	if len(roots) < 3 {
+		return errors.New("target, at least one source data root and output dir are required")
+	}
+	if prefix == "" && suffix == "" {
+		return errors.New("prefix or suffix must not be empty")
+	}
+	target, sourceRoots, outputDir := roots[0], roots[1:len(roots)-1], roots[len(roots)-1]
+
+	err := os.MkdirAll(outputDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	p, err := openMusicPacker(target)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// Tracks by lower case name
+	taken := make(map[string]musicSource)
+	var sources []musicSource
+	for i, c := range p.clips {
+		src := musicSource{Name: c.clip.Name, Clip: &p.clips[i].clip}
+		sources = append(sources, src)
+		taken[strings.ToLower(src.Name)] = src
+	}
+
+	type gameGroup struct {
+		name   string
+		tracks []string
+	}
+	var groups []gameGroup
+
+	for _, root := range sourceRoots {
+		game := gameName(root)
+		log.Printf("Importing music of %v...", game)
+
+		sp, err := openMusicPacker(root)
+		if err != nil {
+			return errors.Wrap(err, root)
+		}
+		defer sp.Close()
+
+		if sp.template.Legacy() != p.template.Legacy() {
+			return errors.Errorf("audio clips of %v and %v have different layouts", root, target)
+		}
+
+		// Source track name -> name in the target
+		imported := make(map[string]string)
+		for i, c := range sp.clips {
+			src := musicSource{Name: c.clip.Name, Clip: &sp.clips[i].clip, Assets: sp.assets}
+
+			if existing, ok := taken[strings.ToLower(src.Name)]; ok {
+				same, err := sameClips(existing, src, p.assets)
+				if err != nil {
+					return errors.Wrap(err, src.Name)
+				}
+				if same {
+					log.Printf("  %v is already in the target", src.Name)
+					imported[strings.ToLower(c.clip.Name)] = existing.Name
+					continue
+				}
+
+				src.Name = strings.Replace(prefix, mergeGamePlaceholder, game, -1) + src.Name +
+					strings.Replace(suffix, mergeGamePlaceholder, game, -1)
+				if _, ok := taken[strings.ToLower(src.Name)]; ok {
+					return errors.Errorf("%v of %v collides with another track even after renaming to %v", c.clip.Name, game, src.Name)
+				}
+				log.Printf("  %v is renamed to %v", c.clip.Name, src.Name)
+			}
+
+			sources = append(sources, src)
+			taken[strings.ToLower(src.Name)] = src
+			imported[strings.ToLower(c.clip.Name)] = src.Name
+		}
+
+		lib, err := parseMusicLib(path.Join(root, MusicLibPath, MusicLibName))
+		if err != nil {
+			log.Printf("[warn] music lib of %v is not available, its tracks are grouped together: %v", game, err)
+		}
+		grouped := make(map[string]bool)
+		for _, group := range lib.Groups {
+			g := gameGroup{name: game + ": " + group.Name}
+			for _, track := range group.Tracks {
+				if name, ok := imported[strings.ToLower(track)]; ok {
+					g.tracks = append(g.tracks, name)
+					grouped[strings.ToLower(track)] = true
+				}
+			}
+			if len(g.tracks) > 0 {
+				groups = append(groups, g)
+			}
+		}
+
+		rest := gameGroup{name: game}
+		for _, c := range sp.clips {
+			if !grouped[strings.ToLower(c.clip.Name)] {
+				rest.tracks = append(rest.tracks, imported[strings.ToLower(c.clip.Name)])
+			}
+		}
+		if len(rest.tracks) > 0 {
+			groups = append(groups, rest)
+		}
+	}
+
+	var base *musicBase
+	if incremental {
+		base = &musicBase{assets: p.assets, clips: make(map[string]AudioClip)}
+		for _, c := range p.clips {
+			base.clips[c.clip.Name] = c.clip
+		}
+	}
+
+	log.Printf("Preparing %v file...", p.streamFile)
+	stream, err := openMusicStream(outputDir, p.streamFile, base)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	newMap, err := prepareMusic(p.assets, sources, stream, p.template.Legacy(), defaultTranscodeOptions)
+	if err != nil {
+		return err
+	}
+
+	err = p.write(outputDir, newMap, func(lib *class.MusicLib, removed map[string]bool) {
+		for _, g := range groups {
+			// Groups of the previous merge are updated
+			addToGroup(lib, g.name, g.tracks)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return stream.Commit()
+}
+
+// Data root of the game, e.g. Dragonfall_Data -> Dragonfall.
+func gameName(root string) string {
+	return strings.TrimSuffix(path.Base(path.Clean(root)), "_Data")
+}
+
+// Compares data of the clips by size and hash.
+func sameClips(a, b musicSource, assets *AssetsReader) (bool, error) {
+	sizeA, sizeB := clipSize(*a.Clip), clipSize(*b.Clip)
+	if sizeA != sizeB {
+		return false, nil
+	}
+
+	var sums [2][]byte
+	for i, src := range []musicSource{a, b} {
+		clipAssets := assets
+		if src.Assets != nil {
+			clipAssets = src.Assets
+		}
+		r, err := src.Clip.Reader(clipAssets)
+		if err != nil {
+			return false, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		if err != nil {
+			return false, err
+		}
+		sums[i] = h.Sum(nil)
+	}
+	return bytes.Equal(sums[0], sums[1]), nil
+}
+
+func clipSize(clip AudioClip) uint64 {
+	if clip.Resource.Size > 0 {
+		return clip.Resource.Size
+	}
+	return uint64(len(clip.Data))
+}
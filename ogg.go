@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"time"
+)
+
+/* Ogg bitstream(RFC 3533) with Vorbis I audio.
+Page header(27 bytes):
+	"OggS", version(0), header type flags, granule position(int64), stream serial, page sequence, CRC32, segments count
+followed by the segment table and the data. Packets are split into 255 bytes segments, a shorter segment ends the packet.
+The first three packets of Vorbis stream are identification, comment and setup headers,
+granule position of the last page is the number of PCM samples per channel.
+See https://xiph.org/vorbis/doc/Vorbis_I_spec.html for details.
+*/
+
+const (
+	oggCapturePattern = "OggS"
+
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+
+	vorbisIdentification = 1
+	vorbisComment        = 3
+	vorbisSetup          = 5
+)
+
+type oggPageHeader struct {
+	Pattern  [4]byte
+	Version  uint8
+	Flags    uint8
+	Granule  int64
+	Serial   uint32
+	Sequence uint32
+	CRC      uint32
+	Segments uint8
+}
+
+type vorbisIdentificationHeader struct {
+	Version        uint32
+	Channels       uint8
+	SampleRate     uint32
+	MaxBitrate     int32
+	NominalBitrate int32
+	MinBitrate     int32
+	BlockSizes     uint8
+	Framing        uint8
+}
+
+type OggInfo struct {
+	SampleRate     int
+	Channels       int
+	NominalBitrate int
+	// Samples per channel
+	Samples uint64
+	// Problems which don't prevent playback, e.g. CRC mismatch or missing end of stream
+	Warnings []string `json:",omitempty"`
+}
+
+func (i OggInfo) Duration() time.Duration {
+	if i.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(i.Samples * uint64(time.Second) / uint64(i.SampleRate))
+}
+
+func (i OggInfo) String() string {
+	return audioSummary(i.SampleRate, i.Channels, i.Duration())
+}
+
+func audioSummary(rate, channels int, duration time.Duration) string {
+	return fmt.Sprintf("%v Hz, %v channels, %v", rate, channels, duration.Round(time.Millisecond))
+}
+
+// Validates Ogg/Vorbis stream and reads its properties.
+// Broken headers are reported as errors, damaged pages after them as warnings.
+func ParseOgg(r io.Reader) (OggInfo, error) {
+	var ret OggInfo
+	br := bufio.NewReader(r)
+
+	var serial uint32
+	var packets [][]byte
+	var packet []byte
+	lastFlags := uint8(0)
+
+	for page := 0; ; page++ {
+		header, data, err := readOggPage(br)
+		if err == io.EOF && page > 0 {
+			break
+		}
+		if err != nil {
+			if len(packets) < 3 {
+				return ret, errors.Wrapf(err, "page %v", page)
+			}
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf("page %v: %v, the rest of the file is ignored", page, err))
+			break
+		}
+
+		if page == 0 {
+			if header.Flags&oggBOS == 0 {
+				return ret, errors.New("first page is not the beginning of a stream")
+			}
+			serial = header.Serial
+		}
+		if header.Serial != serial {
+			if len(packets) < 3 {
+				return ret, errors.New("multiplexed streams are not supported")
+			}
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf("page %v belongs to another logical stream", page))
+			continue
+		}
+		if !oggCRCValid(header, data) {
+			if len(packets) < 3 {
+				return ret, errors.Errorf("page %v: CRC mismatch", page)
+			}
+			ret.Warnings = append(ret.Warnings, fmt.Sprintf("page %v: CRC mismatch", page))
+		}
+
+		// Only the headers are assembled, audio packets are not interesting
+		if len(packets) < 3 {
+			table, body := data[:header.Segments], data[header.Segments:]
+			if header.Flags&oggContinued == 0 && len(packet) > 0 {
+				return ret, errors.Errorf("page %v: unfinished packet", page)
+			}
+			for _, size := range table {
+				packet = append(packet, body[:size]...)
+				body = body[size:]
+				if size < 255 {
+					packets = append(packets, packet)
+					packet = nil
+				}
+			}
+		}
+
+		if header.Granule != -1 {
+			ret.Samples = uint64(header.Granule)
+		}
+		lastFlags = header.Flags
+		if header.Flags&oggEOS != 0 {
+			break
+		}
+	}
+
+	if len(packets) < 3 {
+		return ret, errors.New("vorbis headers are incomplete")
+	}
+	for i, typ := range []uint8{vorbisIdentification, vorbisComment, vorbisSetup} {
+		p := packets[i]
+		if len(p) < 7 || p[0] != typ || string(p[1:7]) != "vorbis" {
+			return ret, errors.Errorf("vorbis header %v expected", typ)
+		}
+	}
+
+	var id vorbisIdentificationHeader
+	err := binary.Read(bytes.NewReader(packets[0][7:]), binary.LittleEndian, &id)
+	if err != nil {
+		return ret, errors.Wrap(err, "failed to read vorbis identification header")
+	}
+	small, large := id.BlockSizes&0xf, id.BlockSizes>>4
+	switch {
+	case id.Version != 0:
+		return ret, errors.Errorf("unsupported vorbis version %v", id.Version)
+	case id.Channels == 0:
+		return ret, errors.New("zero channels count")
+	case id.SampleRate == 0:
+		return ret, errors.New("zero sample rate")
+	case small < 6 || large > 13 || small > large:
+		return ret, errors.Errorf("invalid block sizes %v, %v", 1<<small, 1<<large)
+	case id.Framing&1 == 0:
+		return ret, errors.New("framing bit of identification header is not set")
+	}
+
+	ret.SampleRate = int(id.SampleRate)
+	ret.Channels = int(id.Channels)
+	ret.NominalBitrate = int(id.NominalBitrate)
+
+	if lastFlags&oggEOS == 0 {
+		ret.Warnings = append(ret.Warnings, "end of stream is missing, the file may be truncated")
+	}
+	if ret.Samples == 0 {
+		ret.Warnings = append(ret.Warnings, "no audio data")
+	}
+
+	return ret, nil
+}
+
+// Returns io.EOF only if there is no data left at all.
+func readOggPage(r io.Reader) (oggPageHeader, []byte, error) {
+	var header oggPageHeader
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err == io.ErrUnexpectedEOF {
+		return header, nil, errors.New("truncated page header")
+	}
+	if err != nil {
+		return header, nil, err
+	}
+	if string(header.Pattern[:]) != oggCapturePattern {
+		return header, nil, errors.New("capture pattern not found")
+	}
+	if header.Version != 0 {
+		return header, nil, errors.Errorf("unsupported ogg version %v", header.Version)
+	}
+
+	data := make([]byte, header.Segments)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return header, nil, errors.New("truncated segment table")
+	}
+	size := 0
+	for _, s := range data {
+		size += int(s)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return header, nil, errors.New("truncated page")
+	}
+
+	return header, append(data, body...), nil
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+func oggCRCValid(header oggPageHeader, data []byte) bool {
+	return oggCRC(header, data) == header.CRC
+}
+
+// Ogg uses non-reflected CRC32 over the whole page with zero checksum field.
+func oggCRC(header oggPageHeader, data []byte) uint32 {
+	header.CRC = 0
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(data)
+
+	var crc uint32
+	for _, b := range buf.Bytes() {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// Writes packets of a single logical stream into Ogg pages.
+type oggWriter struct {
+	w        io.Writer
+	serial   uint32
+	sequence uint32
+}
+
+// Segment table of a page is limited to 255 entries.
+const oggMaxPageSegments = 255
+
+// Writes packets starting from a new page, granules are the granule positions of the packets.
+// Packets are split between pages if needed, a page gets the granule of the last packet completed on it, -1 if none.
+// The last page gets flags(BOS, EOS) if given.
+func (o *oggWriter) WritePackets(packets [][]byte, granules []int64, flags uint8) error {
+	if len(granules) != len(packets) {
+		return errors.Errorf("%v granules for %v packets", len(granules), len(packets))
+	}
+
+	type segment struct {
+		data []byte
+		// Granule of the packet if the segment ends it
+		end     bool
+		granule int64
+	}
+	var segments []segment
+	for i, p := range packets {
+		for len(p) >= 255 {
+			segments = append(segments, segment{p[:255], false, 0})
+			p = p[255:]
+		}
+		segments = append(segments, segment{p, true, granules[i]})
+	}
+
+	continued := false
+	for len(segments) > 0 {
+		count := minInt(len(segments), oggMaxPageSegments)
+		page := segments[:count]
+		segments = segments[count:]
+
+		header := oggPageHeader{
+			Flags:    flags &^ oggEOS,
+			Granule:  -1,
+			Serial:   o.serial,
+			Sequence: o.sequence,
+			Segments: uint8(count),
+		}
+		copy(header.Pattern[:], oggCapturePattern)
+		if continued {
+			header.Flags |= oggContinued
+		}
+		if o.sequence > 0 {
+			header.Flags &^= oggBOS
+		}
+		if len(segments) == 0 {
+			header.Flags |= flags & oggEOS
+		}
+		for _, s := range page {
+			if s.end {
+				header.Granule = s.granule
+			}
+		}
+
+		data := make([]byte, 0, count)
+		for _, s := range page {
+			data = append(data, uint8(len(s.data)))
+		}
+		for _, s := range page {
+			data = append(data, s.data...)
+		}
+		header.CRC = oggCRC(header, data)
+
+		err := binary.Write(o.w, binary.LittleEndian, header)
+		if err != nil {
+			return err
+		}
+		_, err = o.w.Write(data)
+		if err != nil {
+			return err
+		}
+
+		o.sequence++
+		continued = !page[count-1].end
+	}
+	return nil
+}
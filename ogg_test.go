@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type oggTestPage struct {
+	flags   uint8
+	granule int64
+	// Packets ended on the page
+	ends int
+}
+
+// Reads back the pages checking CRC and sequence numbers.
+func readOggTestPages(t *testing.T, data []byte) []oggTestPage {
+	var ret []oggTestPage
+	r := bytes.NewReader(data)
+	for {
+		header, page, err := readOggPage(r)
+		if err == io.EOF {
+			return ret
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !oggCRCValid(header, page) {
+			t.Errorf("page %v: CRC mismatch", len(ret))
+		}
+		if header.Sequence != uint32(len(ret)) {
+			t.Errorf("page %v: sequence %v", len(ret), header.Sequence)
+		}
+
+		p := oggTestPage{flags: header.Flags, granule: header.Granule}
+		for _, size := range page[:header.Segments] {
+			if size < 255 {
+				p.ends++
+			}
+		}
+		ret = append(ret, p)
+	}
+}
+
+func TestOggWriterGranules(t *testing.T) {
+	cases := []struct {
+		name     string
+		sizes    []int
+		granules []int64
+		flags    uint8
+		pages    []oggTestPage
+	}{
+		{
+			name:     "single page",
+			sizes:    []int{10, 300, 0},
+			granules: []int64{100, 200, 300},
+			flags:    oggBOS | oggEOS,
+			pages:    []oggTestPage{{oggBOS | oggEOS, 300, 3}},
+		},
+		{
+			// 255 segments per page, the second packet ends on the third page
+			name:     "packet over pages",
+			sizes:    []int{100, 255 * 600, 20},
+			granules: []int64{1024, 2048, 3072},
+			flags:    oggEOS,
+			pages: []oggTestPage{
+				{0, 1024, 1},
+				{oggContinued, -1, 0},
+				{oggContinued | oggEOS, 3072, 2},
+			},
+		},
+		{
+			name:     "packet ends exactly on page",
+			sizes:    []int{255*254 + 10, 255*100 + 5},
+			granules: []int64{500, 700},
+			pages: []oggTestPage{
+				{0, 500, 1},
+				{0, 700, 1},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var packets [][]byte
+			for _, size := range c.sizes {
+				packets = append(packets, make([]byte, size))
+			}
+
+			var buf bytes.Buffer
+			w := oggWriter{w: &buf, serial: 1}
+			err := w.WritePackets(packets, c.granules, c.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pages := readOggTestPages(t, buf.Bytes())
+			if !reflect.DeepEqual(pages, c.pages) {
+				t.Errorf("pages %+v\nexpected %+v", pages, c.pages)
+			}
+		})
+	}
+}
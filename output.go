@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* All the modified files are written through a temporary file next to the target,
+which is synced and renamed over the target only when the writing is complete,
+so failed or interrupted runs never leave partial files behind.
+Overwritten files are kept as <name>.<timestamp>.bak, see restore, up to maxBackups per file.
+Files of the unpacked dirs are regenerated on every run, so they are not backed up.
+Files appended in place(see appendFile) are not backed up either,
+their original size is recorded as <name>.<timestamp>.size instead.
+*/
+
+const backupTimeFormat = "20060102-150405"
+
+// <name>.<timestamp>[_N].bak, N is added to backups made within the same second.
+var backupFile = regexp.MustCompile(`^(.+)\.(\d{8}-\d{6}(_\d+)?)\.bak$`)
+
+// <name>.<timestamp>[_N].size holding the size of the file before it was appended, stamped as backups.
+var sizeRecordFile = regexp.MustCompile(`^(.+)\.(\d{8}-\d{6}(_\d+)?)\.size$`)
+
+type OutputFile struct {
+	*os.File
+	// Backup of the overwritten target made by Commit, empty if the target didn't exist
+	Backup string
+
+	target    string
+	committed bool
+	noBackup  bool
+}
+
+// Creates the temporary file for the target, see Commit.
+func CreateOutput(file string) (*OutputFile, error) {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file)+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &OutputFile{File: tmp, target: file}, nil
+}
+
+// Syncs the written data and replaces the target with it, the previous version is backed up.
+func (f *OutputFile) Commit() error {
+	if f.committed {
+		return nil
+	}
+
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(f.target); err == nil {
+		mode = stat.Mode().Perm()
+	}
+	err := f.File.Chmod(mode)
+	if err == nil {
+		err = f.File.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, f.target)
+	}
+	err = f.File.Close()
+	if err != nil {
+		os.Remove(f.File.Name())
+		return errors.Wrap(err, f.target)
+	}
+	f.committed = true
+
+	if !f.noBackup {
+		f.Backup, err = backup(f.target)
+		if err != nil {
+			os.Remove(f.File.Name())
+			return err
+		}
+	}
+	err = os.Rename(f.File.Name(), f.target)
+	if err != nil {
+		os.Remove(f.File.Name())
+		return err
+	}
+	syncDir(path.Dir(f.target))
+	return nil
+}
+
+// Discards the written data unless it is committed, so it is safe to defer.
+func (f *OutputFile) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.committed = true
+	f.File.Close()
+	return os.Remove(f.File.Name())
+}
+
+// Creates the output for a file of the dir regenerated by the unpack and export commands,
+// its previous version is not backed up.
+func CreateUnpacked(file string) (*OutputFile, error) {
+	out, err := CreateOutput(file)
+	if err != nil {
+		return nil, err
+	}
+	out.noBackup = true
+	return out, nil
+}
+
+func WriteOutput(file string, data []byte) error {
+	out, err := CreateOutput(file)
+	if err != nil {
+		return err
+	}
+	return out.writeAll(data)
+}
+
+// See CreateUnpacked.
+func WriteUnpacked(file string, data []byte) error {
+	out, err := CreateUnpacked(file)
+	if err != nil {
+		return err
+	}
+	return out.writeAll(data)
+}
+
+func (f *OutputFile) writeAll(data []byte) error {
+	defer f.Close()
+
+	_, err := f.Write(data)
+	if err != nil {
+		return err
+	}
+	return f.Commit()
+}
+
+// Keeps the current version of the file as a timestamped .bak and returns its path, missing files are ignored.
+func backup(file string) (string, error) {
+	stat, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", errors.Errorf("%v is not a regular file", file)
+	}
+
+	bak := stampedFile(file, ".bak")
+	log.Printf("  backing up %v to %v", path.Base(file), path.Base(bak))
+	// The link keeps the original data while the target is replaced by rename
+	if os.Link(file, bak) != nil {
+		_, err = copyFile(file, bak)
+		if err != nil {
+			return bak, err
+		}
+	}
+	return bak, pruneBackups(file)
+}
+
+// Returns <file>.<timestamp>[_N]<ext> for a new backup or size record.
+// Backups and records of the same second share the N sequence, so their order is kept.
+func stampedFile(file, ext string) string {
+	name := file + "." + time.Now().Format(backupTimeFormat)
+	_, errBak := os.Lstat(name + ".bak")
+	_, errSize := os.Lstat(name + ".size")
+	if errBak != nil && errSize != nil {
+		return name + ext
+	}
+
+	// Suffixes freed by pruneBackups are not reused to keep the order
+	n := 0
+	others, _ := filepath.Glob(name + "_*")
+	for _, other := range others {
+		var i int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(other, name), "_%d.", &i); err == nil && i > n {
+			n = i
+		}
+	}
+	return fmt.Sprintf("%v_%v%v", name, n+1, ext)
+}
+
+// Backups or size records of the file matching re, sorted from the oldest.
+func stampedFiles(file string, re *regexp.Regexp) ([]string, error) {
+	infos, err := ioutil.ReadDir(path.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, info := range infos {
+		if m := re.FindStringSubmatch(info.Name()); m != nil && m[1] == path.Base(file) {
+			ret = append(ret, path.Join(path.Dir(file), info.Name()))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return backupStamp(ret[i]) < backupStamp(ret[j])
+	})
+	return ret, nil
+}
+
+// Records the size of the file before it is appended in place, so restore can truncate it back.
+// Only the first record matters, the file is not recorded again until it is restored.
+func recordSize(file string, size int64) error {
+	records, err := stampedFiles(file, sizeRecordFile)
+	if err != nil || len(records) > 0 {
+		return err
+	}
+	record := stampedFile(file, ".size")
+	log.Printf("  recording size of %v to %v", path.Base(file), path.Base(record))
+	return WriteUnpacked(record, []byte(strconv.FormatInt(size, 10)))
+}
+
+// Backups kept per file: the oldest one, which restore takes as the original, and the most recent ones.
+const maxBackups = 5
+
+func pruneBackups(file string) error {
+	backups, err := stampedFiles(file, backupFile)
+	if err != nil || len(backups) <= maxBackups {
+		return err
+	}
+
+	for _, bak := range backups[1 : len(backups)-maxBackups+1] {
+		log.Printf("  removing old backup %v", path.Base(bak))
+		err = os.Remove(bak)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the file through the output layer, returns the backup of the overwritten target.
+func copyFile(from, to string) (string, error) {
+	src, err := os.Open(from)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	out, err := CreateOutput(to)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, src)
+	if err != nil {
+		return "", err
+	}
+	err = out.Commit()
+	return out.Backup, err
+}
+
+// Makes the rename durable, not every system can sync directories so errors are ignored.
+func syncDir(dir string) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fd.Sync()
+	fd.Close()
+}
+
+// restore <data_root> [backup_dir]
+// Without backup_dir every file of the data root with .bak versions is restored from the oldest one,
+// which is the vanilla file if the data root was modified by shadowed only.
+// Otherwise files from backup_dir replace the ones with the same relative path or, for a flat backup,
+// the same name among the files modified by the music commands.
+func Restore() error {
+	dataRoot := os.Args[2]
+
+	var restore, records map[string]string
+	var err error
+	if len(os.Args) > 3 {
+		restore, err = backupDirFiles(dataRoot, os.Args[3])
+	} else {
+		restore, err = backupFiles(dataRoot, backupFile)
+		if err == nil {
+			records, err = backupFiles(dataRoot, sizeRecordFile)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(restore) == 0 && len(records) == 0 {
+		log.Print("No backups found")
+		return nil
+	}
+
+	var targets []string
+	for target := range restore {
+		targets = append(targets, target)
+	}
+	for target := range records {
+		if _, ok := restore[target]; !ok {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		record, ok := records[target]
+		if ok && (restore[target] == "" || backupStamp(record) < backupStamp(restore[target])) {
+			err = truncateAppended(target, record)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.Printf("  restoring %v from %v", target, restore[target])
+		err = os.MkdirAll(path.Dir(target), 0777)
+		if err != nil {
+			return err
+		}
+		_, err = copyFile(restore[target], target)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// Made after the vanilla backup, it is of no use now
+			err = os.Remove(record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Restores the file appended in place since the size record was made.
+// The file is only appended until the next backup, which is restored first if there is one.
+func truncateAppended(target, record string) error {
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, record)
+	}
+
+	backups, err := stampedFiles(target, backupFile)
+	if err != nil {
+		return err
+	}
+	for _, bak := range backups {
+		if backupStamp(bak) > backupStamp(record) {
+			log.Printf("  restoring %v from %v", target, bak)
+			_, err = copyFile(bak, target)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	log.Printf("  truncating %v to %v bytes", target, size)
+	stat, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if stat.Size() < size {
+		return errors.Errorf("%v is smaller than its recorded size %v", target, size)
+	}
+	err = os.Truncate(target, size)
+	if err != nil {
+		return err
+	}
+	return os.Remove(record)
+}
+
+// Oldest .bak versions or size records(depending on re) of the data root files by target.
+func backupFiles(dataRoot string, re *regexp.Regexp) (map[string]string, error) {
+	ret := make(map[string]string)
+	err := filepath.Walk(dataRoot, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		m := re.FindStringSubmatch(file)
+		if m == nil {
+			return nil
+		}
+		if prev, ok := ret[m[1]]; !ok || backupStamp(file) < backupStamp(prev) {
+			ret[m[1]] = file
+		}
+		return nil
+	})
+	return ret, err
+}
+
+// Timestamp of the backup comparable as string, _N suffixes are padded to keep the order.
+func backupStamp(file string) string {
+	m := backupFile.FindStringSubmatch(file)
+	if m == nil {
+		m = sizeRecordFile.FindStringSubmatch(file)
+	}
+	stamp := strings.SplitN(m[2], "_", 2)
+	if len(stamp) == 1 {
+		return stamp[0] + "_0000"
+	}
+	return fmt.Sprintf("%v_%04v", stamp[0], stamp[1])
+}
+
+// Files of the hand made backup by target in the data root.
+func backupDirFiles(dataRoot, backupDir string) (map[string]string, error) {
+	// Files modified by music-pack, flat backups are matched by name
+	known := map[string]string{
+		strings.ToLower(MainData):       MainData,
+		strings.ToLower(AssetsFile):     AssetsFile,
+		strings.ToLower(AssetsDataFile): AssetsDataFile,
+		strings.ToLower(MusicLibName):   path.Join(MusicLibPath, MusicLibName),
+	}
+
+	ret := make(map[string]string)
+	err := filepath.Walk(backupDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(backupDir, file)
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(dataRoot, filepath.ToSlash(rel))
+		if _, err := os.Stat(target); err != nil {
+			name, ok := known[strings.ToLower(info.Name())]
+			if !ok {
+				log.Printf("[warn] skipping %v, it is missing in the data root", rel)
+				return nil
+			}
+			target = path.Join(dataRoot, name)
+		}
+		ret[target] = file
+		return nil
+	})
+	return ret, err
+}
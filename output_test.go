@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func testBackups(t *testing.T, dir string) map[string]string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make(map[string]string)
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".bak") {
+			data, err := ioutil.ReadFile(path.Join(dir, info.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret[info.Name()] = string(data)
+		}
+	}
+	return ret
+}
+
+// The oldest backup is kept as the original and the most recent ones up to maxBackups.
+func TestBackupPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadowed-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "data.assets")
+	versions := []string{"vanilla", "1", "2", "3", "4", "5", "6", "7"}
+	for _, v := range versions {
+		err = WriteOutput(file, []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups := testBackups(t, dir)
+	if len(backups) != maxBackups {
+		t.Fatalf("%v backups kept, %v expected", len(backups), maxBackups)
+	}
+	kept := make(map[string]bool)
+	for _, data := range backups {
+		kept[data] = true
+	}
+	// The last version is the target itself
+	for _, v := range append([]string{"vanilla"}, versions[len(versions)-maxBackups:len(versions)-1]...) {
+		if !kept[v] {
+			t.Errorf("backup of %q is pruned, kept %v", v, backups)
+		}
+	}
+
+	originals, err := backupFiles(dir, backupFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original, ok := originals[file]; !ok || backups[path.Base(original)] != "vanilla" {
+		t.Errorf("original backup is %v", originals)
+	}
+}
+
+func TestWriteUnpacked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadowed-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "texture.png")
+	for _, v := range []string{"first", "second"} {
+		err = WriteUnpacked(file, []byte(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil || string(data) != "second" {
+		t.Errorf("read %q, %v", data, err)
+	}
+	if backups := testBackups(t, dir); len(backups) != 0 {
+		t.Errorf("unexpected backups %v", backups)
+	}
+}
+
+func appendTestFile(t *testing.T, file, data string, commit bool) {
+	out, err := openAppendFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = out.WriteString(data)
+	if err == nil && commit {
+		err = out.Commit()
+	}
+	out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Files appended in place are truncated back to the recorded size by restore.
+func TestRestoreAppended(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadowed-output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{"shadowed", "restore", dir}
+
+	file := path.Join(dir, "resources.assets.resS")
+	check := func(expected string) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil || string(data) != expected {
+			t.Errorf("%q, %v, expected %q", data, err, expected)
+		}
+	}
+
+	cases := []struct {
+		name string
+		// Applied to the vanilla file
+		modify func()
+		result string
+	}{
+		{"discarded", func() { appendTestFile(t, file, "new", false) }, "vanilla"},
+		{"appended", func() {
+			appendTestFile(t, file, "new", true)
+			appendTestFile(t, file, "more", true)
+		}, "vanillanewmore"},
+		{"appended and replaced", func() {
+			appendTestFile(t, file, "new", true)
+			err := WriteOutput(file, []byte("replaced"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendTestFile(t, file, "new", true)
+		}, "replacednew"},
+		{"replaced and appended", func() {
+			err := WriteOutput(file, []byte("replaced"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendTestFile(t, file, "new", true)
+		}, "replacednew"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			os.RemoveAll(dir)
+			err := os.MkdirAll(dir, 0777)
+			if err == nil {
+				err = ioutil.WriteFile(file, []byte("vanilla"), 0666)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.modify()
+			check(c.result)
+
+			err = Restore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("vanilla")
+			records, err := stampedFiles(file, sizeRecordFile)
+			if err != nil || len(records) > 0 {
+				t.Errorf("records %v are left, %v", records, err)
+			}
+		})
+	}
+}
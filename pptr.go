@@ -0,0 +1,133 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Objects refer each other with (FileID, PathID) pairs(PPtr in the type trees, ObjectReference in the legacy structs).
+FileID is relative to the file the reference is stored in: 0 is the file itself, N is MetaData.Externals[N-1].
+Externals are searched in the same bundle or next to the assets file by FilePath,
+built-in files like "library/unity default resources" are searched in the Resources dir.
+*/
+
+const builtinLibraryPrefix = "library/"
+
+// Returns the assets file referred by fileID, external files are opened on the first use and closed along with r.
+func (r *AssetsReader) External(fileID uint32) (*AssetsReader, error) {
+	if fileID == 0 {
+		return r, nil
+	}
+	if int(fileID) > len(r.MetaData.Externals) {
+		return nil, errors.Errorf("file id %v is out of %v externals", fileID, len(r.MetaData.Externals))
+	}
+	if ret, ok := r.externals[fileID]; ok {
+		return ret, nil
+	}
+
+	ext := r.MetaData.Externals[fileID-1]
+	name := path.Base(strings.TrimPrefix(ext.FilePath, archivePrefix))
+
+	var ret *AssetsReader
+	var err error
+	if r.bundle != nil {
+		if _, ok := r.bundle.File(name); ok {
+			ret, err = r.bundle.Open(name)
+		}
+	}
+	if ret == nil && err == nil {
+		file, ok := r.findFile(ext.FilePath)
+		if !ok {
+			return nil, errors.Errorf("external file %v not found", ext.FilePath)
+		}
+		ret, err = NewAssetsReader(file)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, ext.FilePath)
+	}
+
+	if r.externals == nil {
+		r.externals = make(map[uint32]*AssetsReader)
+	}
+	r.externals[fileID] = ret
+	return ret, nil
+}
+
+// Looks for the file referred from the assets next to them, returns false if it doesn't exist.
+// Archive paths are resolved against the extracted bundle files.
+func (r *AssetsReader) findFile(file string) (string, bool) {
+	if r.Path == "" {
+		return "", false
+	}
+
+	var candidates []string
+	if !strings.HasPrefix(file, archivePrefix) {
+		candidates = append(candidates, path.Join(path.Dir(r.Path), file))
+	}
+	// Built-in files of the editor are shipped in the Resources dir of the player data
+	if strings.HasPrefix(file, builtinLibraryPrefix) {
+		candidates = append(candidates, path.Join(path.Dir(r.Path), "Resources", strings.TrimPrefix(file, builtinLibraryPrefix)))
+	}
+	candidates = append(candidates, path.Join(path.Dir(r.Path), path.Base(strings.TrimPrefix(file, archivePrefix))))
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+func (r *AssetsReader) FindObject(pathID uint64) (Object, bool) {
+	if r.objectIndex == nil {
+		r.objectIndex = make(map[uint64]int, len(r.MetaData.Objects))
+		for i, obj := range r.MetaData.Objects {
+			r.objectIndex[obj.ID] = i
+		}
+	}
+
+	i, ok := r.objectIndex[pathID]
+	if !ok {
+		return Object{}, false
+	}
+	return r.MetaData.Objects[i], true
+}
+
+func (r *AssetsReader) ObjectReader(obj Object) io.ReadSeeker {
+	return io.NewSectionReader(r.fd, int64(r.Header.DataOffset+obj.Shift), int64(obj.Size))
+}
+
+// Follows the reference stored in r to the object, returns the file the object is in as well.
+func (r *AssetsReader) Resolve(fileID uint32, pathID uint64) (*AssetsReader, Object, error) {
+	file, err := r.External(fileID)
+	if err != nil {
+		return nil, Object{}, err
+	}
+	obj, ok := file.FindObject(pathID)
+	if !ok {
+		return nil, Object{}, errors.Errorf("object %v not found in %v", pathID, file.Name())
+	}
+	return file, obj, nil
+}
+
+func (ref ObjectReference) Resolve(from *AssetsReader) (*AssetsReader, Object, error) {
+	return from.Resolve(ref.FileID, uint64(ref.PathID))
+}
+
+func (ptr PPtr) Resolve(from *AssetsReader) (*AssetsReader, Object, error) {
+	if ptr.FileID < 0 {
+		return nil, Object{}, errors.Errorf("invalid file id %v", ptr.FileID)
+	}
+	return from.Resolve(uint32(ptr.FileID), uint64(ptr.PathID))
+}
+
+// File name for messages.
+func (r *AssetsReader) Name() string {
+	if r.Path == "" {
+		return "<unnamed assets>"
+	}
+	return path.Base(r.Path)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/* ResourceManager of mainData maps names used by Resources.Load to objects
+and lists dependencies of the objects loaded this way.
+Editing commands write modified mainData to the output directory.
+References are given as <file>:<path_id>, where file is mainData or one of its externals, e.g. resources.assets:1234.
+*/
+
+type resourcesExport struct {
+	// File names by FileID, 0 is mainData itself
+	Files []string
+	ResourceManager
+}
+
+func ResourcesExport() error {
+	mainData, err := NewAssetsReader(path.Join(os.Args[2], MainData))
+	if err != nil {
+		return err
+	}
+	defer mainData.Close()
+
+	res, _, err := ReadResourceManager(mainData)
+	if err != nil {
+		return err
+	}
+	checkResources(mainData, res)
+
+	export := resourcesExport{Files: []string{MainData}, ResourceManager: res}
+	for _, ext := range mainData.MetaData.Externals {
+		export.Files = append(export.Files, ext.FilePath)
+	}
+
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteOutput(os.Args[3], data)
+}
+
+// resources-add <data_root> <output_dir> <name> <file:path_id> [dependency file:path_id...]
+func ResourcesAdd() error {
+	name := strings.ToLower(os.Args[4])
+	return editResources(func(mainData *AssetsReader, res *ResourceManager) error {
+		for _, r := range res.Resources {
+			if strings.ToLower(r.Name) == name {
+				return errors.Errorf("resource %v already exists", name)
+			}
+		}
+
+		var refs []ObjectReference
+		for _, arg := range os.Args[5:] {
+			ref, err := parseReference(mainData, arg)
+			if err != nil {
+				return err
+			}
+			refs = append(refs, ref)
+		}
+
+		log.Printf("  adding resource %v", name)
+		res.Resources = append(res.Resources, NamedReference{Name: name, Object: refs[0]})
+		if len(refs) > 1 {
+			addDependencies(res, refs[0], refs[1:])
+		}
+		return nil
+	})
+}
+
+// resources-remove <data_root> <output_dir> <name>...
+func ResourcesRemove() error {
+	names := listed(os.Args[4:])
+	return editResources(func(mainData *AssetsReader, res *ResourceManager) error {
+		var removed []ObjectReference
+		resources := res.Resources[:0]
+		for _, r := range res.Resources {
+			if names[strings.ToLower(r.Name)] {
+				log.Printf("  removing resource %v", r.Name)
+				delete(names, strings.ToLower(r.Name))
+				removed = append(removed, r.Object)
+				continue
+			}
+			resources = append(resources, r)
+		}
+		res.Resources = resources
+
+		for name := range names {
+			return errors.Errorf("resource %v not found", name)
+		}
+
+		// Dependencies are only needed for the objects still loaded by name
+		for _, obj := range removed {
+			if !isResource(*res, obj) {
+				dropDependencies(res, obj)
+			}
+		}
+		return nil
+	})
+}
+
+// resources-rename <data_root> <output_dir> <name> <new_name>
+func ResourcesRename() error {
+	name, newName := strings.ToLower(os.Args[4]), strings.ToLower(os.Args[5])
+	return editResources(func(mainData *AssetsReader, res *ResourceManager) error {
+		index := -1
+		for i, r := range res.Resources {
+			switch strings.ToLower(r.Name) {
+			case name:
+				index = i
+			case newName:
+				return errors.Errorf("resource %v already exists", newName)
+			}
+		}
+		if index < 0 {
+			return errors.Errorf("resource %v not found", name)
+		}
+
+		log.Printf("  renaming resource %v to %v", res.Resources[index].Name, newName)
+		res.Resources[index].Name = newName
+		return nil
+	})
+}
+
+// resource-ls <data_root> [prefix]
+func ResourcesList() error {
+	mainData, err := NewAssetsReader(path.Join(os.Args[2], MainData))
+	if err != nil {
+		return err
+	}
+	defer mainData.Close()
+
+	res, _, err := ReadResourceManager(mainData)
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if len(os.Args) > 3 {
+		prefix = strings.ToLower(os.Args[3])
+	}
+
+	for _, r := range res.Resources {
+		if !strings.HasPrefix(strings.ToLower(r.Name), prefix) {
+			continue
+		}
+		file, obj, err := r.Object.Resolve(mainData)
+		if err != nil {
+			log.Printf("%v\t%v:%v\t[broken: %v]", r.Name, r.Object.FileID, r.Object.PathID, err)
+			continue
+		}
+		log.Printf("%v\t%v:%v\ttype %v, %v bytes", r.Name, file.Name(), obj.ID, obj.TypeID, obj.Size)
+	}
+	return nil
+}
+
+// resource-get <data_root> <resource_path> <output>
+// Objects are saved as is or decoded with the type tree for .json output.
+func ResourceGet() error {
+	mainData, err := NewAssetsReader(path.Join(os.Args[2], MainData))
+	if err != nil {
+		return err
+	}
+	defer mainData.Close()
+
+	res, _, err := ReadResourceManager(mainData)
+	if err != nil {
+		return err
+	}
+
+	ref, ok := res.Find(os.Args[3])
+	if !ok {
+		return errors.Errorf("resource %v not found", os.Args[3])
+	}
+	file, obj, err := ref.Resolve(mainData)
+	if err != nil {
+		return errors.Wrap(err, os.Args[3])
+	}
+	log.Printf("%v is object %v of type %v in %v", os.Args[3], obj.ID, obj.TypeID, file.Name())
+
+	var data []byte
+	if isJSONFile(os.Args[4]) {
+		val, err := file.DecodeObject(obj, file.ObjectReader(obj))
+		if err != nil {
+			return err
+		}
+		data, err = json.MarshalIndent(val, "", "  ")
+		if err != nil {
+			return err
+		}
+	} else {
+		data, err = ioutil.ReadAll(file.ObjectReader(obj))
+		if err != nil {
+			return err
+		}
+	}
+
+	return WriteOutput(os.Args[4], data)
+}
+
+// Reads the resource manager from mainData of the data root, applies edit and writes modified mainData to the output dir.
+func editResources(edit func(mainData *AssetsReader, res *ResourceManager) error) error {
+	dataRoot, outputDir := os.Args[2], os.Args[3]
+
+	log.Printf("Parsing %v...", MainData)
+	mainData, err := NewAssetsReader(path.Join(dataRoot, MainData))
+	if err != nil {
+		return err
+	}
+	defer mainData.Close()
+
+	res, resObject, err := ReadResourceManager(mainData)
+	if err != nil {
+		return err
+	}
+
+	err = edit(mainData, &res)
+	if err != nil {
+		return err
+	}
+	checkResources(mainData, res)
+
+	resObject.Data, err = res.Bytes(mainData.Order, mainData.Header.Version)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outputDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Creating modified %v...", MainData)
+	_, err = CreateModifiedAssets(path.Join(outputDir, MainData), mainData, nil, []ReplacementObject{resObject}, nil)
+	return err
+}
+
+// Parses <file>:<path_id> reference and checks the object exists.
+func parseReference(mainData *AssetsReader, arg string) (ObjectReference, error) {
+	file, id, err := splitReference(arg)
+	if err != nil {
+		return ObjectReference{}, err
+	}
+	ref := ObjectReference{PathID: id}
+	if !strings.EqualFold(path.Base(file), MainData) {
+		var ok bool
+		ref.FileID, ok = mainData.ExternalFileID(file)
+		if !ok {
+			return ref, errors.Errorf("%v is not referenced by %v", file, MainData)
+		}
+	}
+
+	_, _, err = ref.Resolve(mainData)
+	return ref, errors.Wrap(err, arg)
+}
+
+// Splits <file>:<path_id> reference.
+func splitReference(arg string) (string, int64, error) {
+	sep := strings.LastIndex(arg, ":")
+	if sep < 0 {
+		return "", 0, errors.Errorf("reference %v is not in <file>:<path_id> form", arg)
+	}
+	id, err := strconv.ParseInt(arg[sep+1:], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid path id in %v", arg)
+	}
+	return arg[:sep], id, nil
+}
+
+func isResource(res ResourceManager, obj ObjectReference) bool {
+	for _, r := range res.Resources {
+		if r.Object == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds the dependencies of the object missing in its entry of the dependency graph.
+func addDependencies(res *ResourceManager, obj ObjectReference, deps []ObjectReference) {
+	index := -1
+	for i, d := range res.Dependent {
+		if d.Object == obj {
+			index = i
+		}
+	}
+	if index < 0 {
+		res.Dependent = append(res.Dependent, ResourceDependencies{Object: obj})
+		index = len(res.Dependent) - 1
+	}
+
+	entry := &res.Dependent[index]
+	for _, dep := range deps {
+		found := false
+		for _, d := range entry.Dependencies {
+			found = found || d == dep
+		}
+		if !found {
+			entry.Dependencies = append(entry.Dependencies, dep)
+		}
+	}
+}
+
+// Removes the object entry from the dependency graph, the object may still be a dependency of others.
+func dropDependencies(res *ResourceManager, obj ObjectReference) {
+	dependent := res.Dependent[:0]
+	for _, d := range res.Dependent {
+		if d.Object != obj {
+			dependent = append(dependent, d)
+		}
+	}
+	res.Dependent = dependent
+}
+
+// Follows all the references of the manager, broken ones are reported as warnings
+// since the original files may refer to the built-in resources which are not available.
+func checkResources(mainData *AssetsReader, res ResourceManager) {
+	// Missing files are reported once
+	missing := make(map[uint32]bool)
+	check := func(what string, ref ObjectReference) {
+		if missing[ref.FileID] {
+			return
+		}
+		if _, err := mainData.External(ref.FileID); err != nil {
+			log.Printf("[warn] references to file %v can't be checked: %v", ref.FileID, err)
+			missing[ref.FileID] = true
+			return
+		}
+		if _, _, err := ref.Resolve(mainData); err != nil {
+			log.Printf("[warn] %v: %v", what, err)
+		}
+	}
+
+	for _, r := range res.Resources {
+		check("resource "+r.Name, r.Object)
+	}
+	for _, d := range res.Dependent {
+		check(fmt.Sprintf("dependent object %v:%v", d.Object.FileID, d.Object.PathID), d.Object)
+		for _, dep := range d.Dependencies {
+			check(fmt.Sprintf("dependency %v:%v of %v:%v", dep.FileID, dep.PathID, d.Object.FileID, d.Object.PathID), dep)
+		}
+	}
+}
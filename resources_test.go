@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ref(fileID uint32, pathID int64) ObjectReference {
+	return ObjectReference{FileID: fileID, PathID: pathID}
+}
+
+func testResourceManager() ResourceManager {
+	return ResourceManager{
+		Resources: []NamedReference{
+			{"music/intro", ref(1, 10)},
+			{"music/boss", ref(1, 11)},
+			{"textures/logo", ref(2, 10)},
+		},
+		Dependent: []ResourceDependencies{
+			{ref(1, 10), []ObjectReference{ref(1, 11), ref(2, 10)}},
+			{ref(1, 11), []ObjectReference{ref(1, 12)}},
+			{ref(2, 10), []ObjectReference{ref(1, 10)}},
+		},
+	}
+}
+
+func TestRemoveResources(t *testing.T) {
+	cases := []struct {
+		name   string
+		fileID uint32
+		remove []uint64
+		res    ResourceManager
+	}{
+		{"nothing", 1, nil, testResourceManager()},
+		{
+			// Path ids are shared by the files, only the given file is affected
+			name:   "one file",
+			fileID: 1,
+			remove: []uint64{10, 12},
+			res: ResourceManager{
+				Resources: []NamedReference{{"music/boss", ref(1, 11)}, {"textures/logo", ref(2, 10)}},
+				Dependent: []ResourceDependencies{
+					{ref(1, 11), []ObjectReference{}},
+					{ref(2, 10), []ObjectReference{}},
+				},
+			},
+		},
+		{
+			name:   "dependency only",
+			fileID: 1,
+			remove: []uint64{12},
+			res: ResourceManager{
+				Resources: testResourceManager().Resources,
+				Dependent: []ResourceDependencies{
+					{ref(1, 10), []ObjectReference{ref(1, 11), ref(2, 10)}},
+					{ref(1, 11), []ObjectReference{}},
+					{ref(2, 10), []ObjectReference{ref(1, 10)}},
+				},
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := testResourceManager()
+			removeResources(&res, c.fileID, c.remove)
+			if !reflect.DeepEqual(res, c.res) {
+				t.Errorf("resources %+v\nexpected %+v", res, c.res)
+			}
+		})
+	}
+}
+
+func TestAddDependencies(t *testing.T) {
+	cases := []struct {
+		name string
+		obj  ObjectReference
+		deps []ObjectReference
+		// Expected dependencies of the object
+		result []ObjectReference
+	}{
+		{"new entry", ref(3, 1), []ObjectReference{ref(1, 10), ref(1, 10)}, []ObjectReference{ref(1, 10)}},
+		{"merged", ref(1, 11), []ObjectReference{ref(1, 12), ref(2, 10)}, []ObjectReference{ref(1, 12), ref(2, 10)}},
+		{"nothing new", ref(1, 10), []ObjectReference{ref(2, 10)}, []ObjectReference{ref(1, 11), ref(2, 10)}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := testResourceManager()
+			addDependencies(&res, c.obj, c.deps)
+
+			var entries []ResourceDependencies
+			for _, d := range res.Dependent {
+				if d.Object == c.obj {
+					entries = append(entries, d)
+				}
+			}
+			if len(entries) != 1 || !reflect.DeepEqual(entries[0].Dependencies, c.result) {
+				t.Errorf("entries %+v, expected dependencies %+v", entries, c.result)
+			}
+			// The other entries are kept as is
+			if len(res.Dependent) < len(testResourceManager().Dependent) {
+				t.Errorf("entries are lost: %+v", res.Dependent)
+			}
+		})
+	}
+}
+
+func TestDropDependencies(t *testing.T) {
+	res := testResourceManager()
+	dropDependencies(&res, ref(1, 10))
+	dropDependencies(&res, ref(5, 5))
+
+	expected := testResourceManager()
+	expected.Dependent = expected.Dependent[1:]
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("resources %+v\nexpected %+v", res, expected)
+	}
+	if !isResource(res, ref(1, 10)) || isResource(res, ref(1, 12)) {
+		t.Error("resources are not expected to change")
+	}
+}
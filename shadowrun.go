@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/betrok/shadowed/class"
 	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
@@ -12,8 +14,11 @@ import (
 	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -25,72 +30,150 @@ const (
 	MusicLibName = "music.mlib.bytes"
 )
 
-const (
-	// AudioClip type
-	MusicTypeID           = 83
-	ResourceManagerTypeID = 147
-)
+// AudioClip type
+const MusicTypeID = AudioClipTypeID
 
-// Unknown fields data. It's same in all versions that I have.
-var MagicNumbers = [4]uint32{2, 14, 0, 2}
+func MusicList() error {
+	// In theory some of objects can be in separate files, but it does not seem to be a thing for the shadowrun music.
+	assets, err := NewAssetsReader(path.Join(os.Args[2], AssetsFile))
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
 
-type MusicDescription struct {
-	Name string
+	existing := make(map[string]bool)
+	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID == MusicTypeID {
+			clip, err := DecodeAudioClip(assets, desc, r)
+			if err != nil {
+				return err
+			}
+			log.Printf("%+v", desc)
+			log.Printf("%+v: %v", desc.ID, dump(clip))
 
-	// These fields describe the file format and loading options,
-	// but I have no clue what exactly they mean.
-	// Gist below has related info("classID{83}").
-	// https://gist.githubusercontent.com/Mischanix/7db0145e809b692b63f2/raw/0ae1905171cc38dbfb68994c3cb679c3b8bf9e0c/structs.dump
-	// See MagicNumbers above.
-	Unknown [4]uint32
+			summary, err := describeClip(assets, clip)
+			if err != nil {
+				log.Printf("[warn] %v: %v", clip.Name, err)
+			} else {
+				log.Printf("  %v: %v", clip.Name, summary)
+			}
+			existing[clip.Name] = true
+		}
 
-	Size  uint32
-	Shift uint32
-}
+		return nil
+	})
+	if err != nil || len(os.Args) < 4 {
+		return err
+	}
 
-func ParseMusicDescription(r io.ReadSeeker, order binary.ByteOrder) (desc MusicDescription, err error) {
-	err = read(r, &desc, order, false)
+	musicDir := os.Args[3]
+	files, err := ioutil.ReadDir(musicDir)
 	if err != nil {
-		return
+		return err
 	}
 
-	// Any extra data will indicate an error
-	data, err := ioutil.ReadAll(r)
-	if len(data) > 0 {
-		err = errors.Errorf("unexpected data left:\n%v", hex.Dump(data))
+	log.Printf("Tracks in %v:", musicDir)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
+
+		summary, err := describeFile(path.Join(musicDir, f.Name()))
+		if err != nil {
+			log.Printf("[warn] %v: %v", f.Name(), err)
+			continue
+		}
+		if summary == "" {
+			continue
+		}
+
+		status := "new"
+		if existing[name] {
+			status = "replacement"
+		}
+		log.Printf("  %v(%v): %v", f.Name(), status, summary)
 	}
 
-	return
+	return nil
 }
 
-func (m MusicDescription) Bytes(order binary.ByteOrder) []byte {
-	var buf bytes.Buffer
-
-	write(&buf, m, order, false)
+// Describes audio properties of the clip, data of legacy clips is parsed for it.
+func describeClip(assets *AssetsReader, clip AudioClip) (string, error) {
+	if !clip.Legacy() {
+		duration := time.Duration(float64(clip.Length) * float64(time.Second))
+		return audioSummary(int(clip.Frequency), int(clip.Channels), duration), nil
+	}
+	if clip.Type != AudioTypeOGGVorbis {
+		return fmt.Sprintf("%v bytes of type %v", clip.Resource.Size+uint64(len(clip.Data)), clip.Type), nil
+	}
 
-	return buf.Bytes()
+	r, err := clip.Reader(assets)
+	if err != nil {
+		return "", err
+	}
+	info, err := ParseOgg(r)
+	if err != nil {
+		return "", err
+	}
+	return oggSummary(info), nil
 }
 
-func MusicList() error {
-	// In theory some of objects can be in separate files, but it does not seem to be a thing for the shadowrun music.
-	assets, err := NewAssetsReader(path.Join(os.Args[2], AssetsFile))
+// Describes audio properties of the file, returns empty string for unsupported files.
+func describeFile(file string) (string, error) {
+	ext := strings.ToLower(path.Ext(file))
+	if ext == ".ogg" {
+		info, err := parseOggFile(file)
+		if err != nil {
+			return "", err
+		}
+		return oggSummary(info), nil
+	}
+	if !isDecodableAudio(ext) && ext != ".fsb" {
+		return "", nil
+	}
+
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer assets.Close()
 
-	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
-		if desc.TypeID == MusicTypeID {
-			m, err := ParseMusicDescription(r, assets.Order)
-			if err != nil {
-				return err
-			}
-			log.Printf("%+v", desc)
-			log.Printf("%+v: %+v", desc.ID, m)
+	if audio, ok, err := decodeAudio(ext, data); ok {
+		if err != nil {
+			return "", err
 		}
+		duration := time.Duration(audio.Frames()) * time.Second / time.Duration(maxInt(audio.SampleRate, 1))
+		return audioSummary(audio.SampleRate, audio.Channels, duration), nil
+	}
 
-		return nil
-	})
+	fsb, err := ParseFSB5(data)
+	if err != nil {
+		return "", err
+	}
+	if len(fsb.Samples) == 0 {
+		return "", errors.New("FSB5 container has no samples")
+	}
+	sample := fsb.Samples[0]
+	duration := time.Duration(sample.Frames) * time.Second / time.Duration(maxInt(sample.Frequency, 1))
+	return fmt.Sprintf("%v, %v", fsb.Codec, audioSummary(sample.Frequency, sample.Channels, duration)), nil
+}
+
+func parseOggFile(file string) (OggInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return OggInfo{}, err
+	}
+	defer f.Close()
+
+	return ParseOgg(f)
+}
+
+func oggSummary(info OggInfo) string {
+	ret := info.String()
+	for _, w := range info.Warnings {
+		ret += "; [warn] " + w
+	}
+	return ret
 }
 
 func MusicUnpack() error {
@@ -105,39 +188,39 @@ func MusicUnpack() error {
 		return err
 	}
 
-	pack, err := os.Open(path.Join(os.Args[2], AssetsDataFile))
-	if err != nil {
-		return err
-	}
-	defer pack.Close()
-
 	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
 		if desc.TypeID == MusicTypeID {
-			m, err := ParseMusicDescription(r, assets.Order)
+			clip, err := DecodeAudioClip(assets, desc, r)
 			if err != nil {
 				return err
 			}
 
-			log.Printf("%+v", m)
+			log.Printf("%+v", dump(clip))
 
-			_, err = pack.Seek(int64(m.Shift), 0)
+			pack, err := clip.Reader(assets)
 			if err != nil {
 				return err
 			}
-
-			file := path.Join(os.Args[3], m.Name+".ogg")
-			out, err := os.Create(file)
+			data, err := ioutil.ReadAll(pack)
 			if err != nil {
 				return err
 			}
 
-			_, err = io.CopyN(out, pack, int64(m.Size))
-			if err != nil {
-				out.Close()
-				return err
+			ext := clip.Extension()
+			// Extract plain audio from FSB5 if possible, keep the container otherwise
+			if !clip.Legacy() {
+				fsb, err := ParseFSB5(data)
+				if err != nil {
+					return errors.Wrap(err, clip.Name)
+				}
+				if e, extracted, ok := fsb.Extract(); ok {
+					ext, data = e, extracted
+				} else {
+					log.Printf("[warn] %v: %v codec can't be extracted, the FSB5 container is saved as is", clip.Name, fsb.Codec)
+				}
 			}
 
-			return out.Close()
+			return WriteUnpacked(path.Join(os.Args[3], clip.Name+ext), data)
 		}
 
 		return nil
@@ -149,134 +232,347 @@ func MusicPack() error {
 	musicDir := os.Args[3]
 	outputDir := os.Args[4]
 
+	opts := defaultTranscodeOptions
+	incremental := false
+	manifestFile := ""
+	for i := 5; i < len(os.Args); i++ {
+		if os.Args[i] == "--incremental" {
+			incremental = true
+			continue
+		}
+
+		name, value := os.Args[i], ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		} else if i+1 < len(os.Args) {
+			i++
+			value = os.Args[i]
+		}
+
+		switch name {
+		case "--quality", "--rate":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return errors.Errorf("invalid %v value %q", name, value)
+			}
+			if name == "--quality" {
+				opts.Quality = n
+			} else {
+				opts.SampleRate = n
+			}
+		case "--manifest":
+			manifestFile = value
+		default:
+			return errors.Errorf("unknown argument %v", name)
+		}
+	}
+	if opts.Quality < 0 || opts.Quality > vorbisMaxQuality {
+		return errors.Errorf("quality must be in [0, %v]", vorbisMaxQuality)
+	}
+	if opts.SampleRate < 0 {
+		return errors.New("sample rate must be positive")
+	}
+
 	// Create output dir
 	err := os.MkdirAll(outputDir, 0777)
 	if err != nil {
 		return err
 	}
 
-	log.Print("Preparing .resS file...")
-	newMap, err := prepareMusic(musicDir, path.Join(outputDir, AssetsDataFile))
+	p, err := openMusicPacker(dataRoot)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	var manifest *MusicManifest
+	var sources []musicSource
+	if manifestFile != "" {
+		m, err := ReadMusicManifest(manifestFile)
+		if err != nil {
+			return err
+		}
+		manifest = &m
+
+		existing := make([]AudioClip, len(p.clips))
+		for i, c := range p.clips {
+			existing[i] = c.clip
+		}
+		sources = manifest.sources(musicDir, existing)
+	} else {
+		sources, err = dirSources(musicDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	var base *musicBase
+	if incremental {
+		base = &musicBase{assets: p.assets, clips: make(map[string]AudioClip)}
+		for _, c := range p.clips {
+			base.clips[c.clip.Name] = c.clip
+		}
+	}
+
+	log.Printf("Preparing %v file...", p.streamFile)
+	stream, err := openMusicStream(outputDir, p.streamFile, base)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	newMap, err := prepareMusic(p.assets, sources, stream, p.template.Legacy(), opts)
+	if err != nil {
+		return err
+	}
+	if manifest != nil {
+		for _, t := range manifest.Tracks {
+			if _, ok := newMap[t.Name]; !ok {
+				return errors.Errorf("%v: unsupported file %v", t.Name, t.File)
+			}
+		}
+	}
 
 	if len(newMap) == 0 {
 		return errors.Errorf("suitable tracks not found in %v", musicDir)
 	}
 
-	log.Print("Parsing assets file...")
-	assets, err := NewAssetsReader(path.Join(dataRoot, AssetsFile))
+	err = p.write(outputDir, newMap, func(lib *class.MusicLib, removed map[string]bool) {
+		inLib := make(map[string]bool)
+		for _, group := range lib.Groups {
+			for _, track := range group.Tracks {
+				inLib[strings.ToLower(track)] = true
+			}
+		}
+
+		// Tracks with groups in the manifest are placed later
+		grouped := make(map[string]bool)
+		if manifest != nil {
+			grouped = manifest.grouped()
+		}
+
+		for _, m := range newMap {
+			if grouped[strings.ToLower(m.Name)] {
+				continue
+			}
+			if !inLib[strings.ToLower(m.Name)] {
+				lib.Groups = append(lib.Groups, &class.MusicGroup{
+					Name:   m.Name,
+					Tracks: []string{m.Name},
+				})
+				log.Printf("  adding %v to lib", m.Name)
+			} else {
+				log.Printf("  %v already in lib", m.Name)
+			}
+		}
+
+		removeTracks(lib, removed)
+
+		for name := range inLib {
+			if removed[name] {
+				continue
+			}
+
+			found := false
+			for n := range newMap {
+				if strings.ToLower(n) == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				log.Printf("  %v found in lib, but missing in resources", name)
+			}
+		}
+
+		sort.Slice(lib.Groups, func(i, j int) bool {
+			return lib.Groups[i].Name < lib.Groups[j].Name
+		})
+		if manifest != nil {
+			manifest.applyGroups(lib)
+		}
+	})
 	if err != nil {
 		return err
 	}
-	defer assets.Close()
+	return stream.Commit()
+}
 
-	log.Print("Checking existing assets...")
-	var replace []ReplacementObject
-	var remove []uint32
+type existingClip struct {
+	desc Object
+	clip AudioClip
+}
 
-	used := make(map[string]bool)
+// Assets of the data root being modified, shared by music-pack and music-merge.
+type musicPacker struct {
+	dataRoot string
+	assets   *AssetsReader
+	clips    []existingClip
+	// New clips are created with the layout of the existing ones
+	template     AudioClip
+	templateDesc Object
+	streamFile   string
+}
+
+func openMusicPacker(dataRoot string) (*musicPacker, error) {
+	log.Print("Parsing assets file...")
+	assets, err := NewAssetsReader(path.Join(dataRoot, AssetsFile))
+	if err != nil {
+		return nil, err
+	}
+	p := &musicPacker{dataRoot: dataRoot, assets: assets}
 
+	log.Print("Checking existing assets...")
 	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
 		if desc.TypeID != MusicTypeID {
 			return nil
 		}
 
-		m, err := ParseMusicDescription(r, assets.Order)
+		clip, err := DecodeAudioClip(assets, desc, r)
 		if err != nil {
 			return err
 		}
-
-		if m, ok := newMap[m.Name]; ok {
-			replace = append(replace, ReplacementObject{
-				TargetID: desc.ID,
-				CustomObject: CustomObject{
-					ClassID: MusicTypeID,
-					TypeID:  MusicTypeID,
-					Data:    m.Bytes(assets.Order),
-				},
-			})
-			used[m.Name] = true
-			log.Printf("  replacing %v", m.Name)
-		} else {
-			remove = append(remove, desc.ID)
-			log.Printf("  removing %v", m.Name)
-		}
-
+		p.clips = append(p.clips, existingClip{desc, clip})
 		return nil
 	})
 	if err != nil {
-		return err
+		assets.Close()
+		return nil, err
+	}
+
+	p.template = defaultLegacyAudioClip
+	p.templateDesc = Object{TypeID: MusicTypeID, ClassID: MusicTypeID}
+	if len(p.clips) > 0 {
+		p.template, p.templateDesc = p.clips[0].clip, p.clips[0].desc
+	} else if assets.Header.Version >= 14 {
+		assets.Close()
+		return nil, errors.New("there are no audio clips in the assets to create new ones from")
+	}
+
+	p.streamFile = legacyStreamFile(assets)
+	if !p.template.Legacy() {
+		p.streamFile = p.template.Resource.Path
+		if p.streamFile == "" {
+			p.streamFile = strings.TrimSuffix(AssetsFile, path.Ext(AssetsFile)) + ".resource"
+		}
+	}
+
+	return p, nil
+}
+
+func (p *musicPacker) Close() error {
+	return p.assets.Close()
+}
+
+// Writes the modified assets, mainData and music lib to outputDir.
+// Existing clips missing in tracks are removed, updateLib gets their lower case names.
+func (p *musicPacker) write(outputDir string, tracks map[string]musicTrack, updateLib func(lib *class.MusicLib, removed map[string]bool)) error {
+	var replace []ReplacementObject
+	var remove []uint64
+
+	used := make(map[string]bool)
+	removed := make(map[string]bool)
+
+	for _, c := range p.clips {
+		track, ok := tracks[c.clip.Name]
+		if !ok {
+			remove = append(remove, c.desc.ID)
+			removed[strings.ToLower(c.clip.Name)] = true
+			log.Printf("  removing %v", c.clip.Name)
+			continue
+		}
+
+		clip := c.clip
+		err := track.apply(&clip)
+		if err != nil {
+			return errors.Wrap(err, track.Name)
+		}
+		data, err := clip.Encode(p.assets, c.desc)
+		if err != nil {
+			return errors.Wrap(err, track.Name)
+		}
+
+		replace = append(replace, ReplacementObject{
+			TargetID: c.desc.ID,
+			CustomObject: CustomObject{
+				ClassID: c.desc.ClassID,
+				TypeID:  c.desc.TypeID,
+				Data:    data,
+			},
+		})
+		used[track.Name] = true
+		log.Printf("  replacing %v", track.Name)
 	}
 
 	var add []CustomObject
 	addPos := make(map[string]int)
-	for _, m := range newMap {
-		if used[m.Name] {
+	for _, track := range tracks {
+		if used[track.Name] {
 			continue
 		}
+
+		clip := p.template.Clone()
+		err := track.apply(&clip)
+		if err != nil {
+			return errors.Wrap(err, track.Name)
+		}
+		data, err := clip.Encode(p.assets, p.templateDesc)
+		if err != nil {
+			return errors.Wrap(err, track.Name)
+		}
+
 		add = append(add, CustomObject{
-			ClassID: MusicTypeID,
-			TypeID:  MusicTypeID,
-			Data:    m.Bytes(assets.Order),
+			ClassID:   p.templateDesc.ClassID,
+			TypeID:    p.templateDesc.TypeID,
+			TypeIndex: p.templateDesc.TypeIndex,
+			Data:      data,
 		})
-		addPos[strings.ToLower(m.Name)] = len(add)
-		log.Printf("  adding %v", m.Name)
-	}
-
-	if len(remove) > 0 {
-		return errors.New("clean removing of music is not supported yet, make sure your directory contains replacements for all existing tracks")
+		addPos[strings.ToLower(track.Name)] = len(add)
+		log.Printf("  adding %v", track.Name)
 	}
 
 	log.Print("Creating modified assets...")
 	maxID, err := CreateModifiedAssets(
-		path.Join(outputDir, AssetsFile), assets, add, replace, remove,
+		path.Join(outputDir, AssetsFile), p.assets, add, replace, remove,
 	)
 	if err != nil {
 		return err
 	}
 
 	log.Printf("Parsing %v...", MainData)
-	mainData, err := NewAssetsReader(path.Join(dataRoot, MainData))
+	mainData, err := NewAssetsReader(path.Join(p.dataRoot, MainData))
 	if err != nil {
 		return err
 	}
 	defer mainData.Close()
 
-	var resources ResourceManager
-	var resObject ReplacementObject
-	err = mainData.RangeObjects(func(desc Object, r io.ReadSeeker) error {
-		if desc.TypeID != ResourceManagerTypeID {
-			return nil
-		}
-		resObject.TargetID = desc.ID
-		resObject.TypeID = desc.TypeID
-		resObject.ClassID = desc.ClassID
-		return read(r, &resources, mainData.Order, false)
-	})
+	resources, resObject, err := ReadResourceManager(mainData)
 	if err != nil {
 		return err
 	}
-	if len(resources.Resources) == 0 {
-		return errors.New("resources manager data not found")
+
+	fileID, err := musicFileID(mainData, resources)
+	if err != nil {
+		return err
 	}
 
 	log.Printf("Creating modified %v...", MainData)
+	removeResources(&resources, fileID, remove)
+
 	for name, pos := range addPos {
 		resources.Resources = append(resources.Resources, NamedReference{
 			Name: "music/" + name,
 			Object: ObjectReference{
-				// Little extra hardcode... @TODO Extract it from externals
-				FileID: 1,
-				PathID: maxID - uint32(len(add)-pos),
+				FileID: fileID,
+				PathID: int64(maxID) - int64(len(add)-pos),
 			},
 		})
 	}
 
-	var buf bytes.Buffer
-	err = write(&buf, resources, mainData.Order, false)
+	resObject.Data, err = resources.Bytes(mainData.Order, mainData.Header.Version)
 	if err != nil {
 		return err
 	}
-	resObject.Data = buf.Bytes()
 
 	_, err = CreateModifiedAssets(
 		path.Join(outputDir, MainData), mainData, nil, []ReplacementObject{resObject}, nil,
@@ -286,103 +582,517 @@ func MusicPack() error {
 	}
 
 	log.Printf("Parsing %v...", MusicLibName)
-	lib, err := parseMusicLib(path.Join(dataRoot, MusicLibPath, MusicLibName))
+	lib, err := parseMusicLib(path.Join(p.dataRoot, MusicLibPath, MusicLibName))
 	if err != nil {
 		return err
 	}
 
 	log.Print("Creating modified music lib...")
-	inLib := make(map[string]bool)
-	for _, group := range lib.Groups {
-		for _, track := range group.Tracks {
-			inLib[strings.ToLower(track)] = true
+	updateLib(&lib, removed)
+
+	mDir := path.Join(outputDir, MusicLibPath)
+	err = os.MkdirAll(mDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	return saveMusicLib(lib, path.Join(mDir, MusicLibName))
+}
+
+// Returns FileID of the resources.assets in mainData.
+// The existing music resources are followed to make sure they point to the audio clips in it.
+func musicFileID(mainData *AssetsReader, resources ResourceManager) (uint32, error) {
+	fileID, ok := mainData.ExternalFileID(AssetsFile)
+	if !ok {
+		return 0, errors.Errorf("%v is not referenced by %v", AssetsFile, MainData)
+	}
+
+	for _, res := range resources.Resources {
+		if !strings.HasPrefix(res.Name, "music/") {
+			continue
+		}
+		if res.Object.FileID != fileID {
+			log.Printf("[warn] resource %v refers to file %v, %v is expected", res.Name, res.Object.FileID, fileID)
+			continue
+		}
+		_, obj, err := res.Object.Resolve(mainData)
+		if err != nil {
+			log.Printf("[warn] resource %v: %v", res.Name, err)
+			continue
+		}
+		if obj.TypeID != MusicTypeID {
+			log.Printf("[warn] resource %v is not an audio clip", res.Name)
 		}
 	}
+	return fileID, nil
+}
 
-	for _, m := range newMap {
-		if !inLib[strings.ToLower(m.Name)] {
-			lib.Groups = append(lib.Groups, &class.MusicGroup{
-				Name:   m.Name,
-				Tracks: []string{m.Name},
-			})
-			log.Printf("  adding %v to lib", m.Name)
-		} else {
-			log.Printf("  %v already in lib", m.Name)
+// Drops resources pointing to the removed objects of file fileID along with their dependency links.
+func removeResources(res *ResourceManager, fileID uint32, remove []uint64) {
+	if len(remove) == 0 {
+		return
+	}
+
+	removed := make(map[ObjectReference]bool)
+	for _, id := range remove {
+		removed[ObjectReference{FileID: fileID, PathID: int64(id)}] = true
+	}
+
+	resources := res.Resources[:0]
+	for _, r := range res.Resources {
+		if removed[r.Object] {
+			log.Printf("  removing resource %v", r.Name)
+			continue
 		}
+		resources = append(resources, r)
 	}
+	res.Resources = resources
 
-	for name := range inLib {
-		found := false
-		for n := range newMap {
-			if strings.ToLower(n) == name {
-				found = true
-				break
-			}
+	dependent := res.Dependent[:0]
+	for _, d := range res.Dependent {
+		if removed[d.Object] {
+			continue
 		}
-		if !found {
-			log.Printf("  %v found in lib, but missing in resources", name)
+
+		deps := d.Dependencies[:0]
+		for _, dep := range d.Dependencies {
+			if !removed[dep] {
+				deps = append(deps, dep)
+			}
 		}
+		d.Dependencies = deps
+		dependent = append(dependent, d)
 	}
+	res.Dependent = dependent
+}
 
-	sort.Slice(lib.Groups, func(i, j int) bool {
-		return lib.Groups[i].Name < lib.Groups[j].Name
-	})
+// Drops tracks with the given (lower case) names from the lib.
+// Groups left without tracks are dropped as well.
+func removeTracks(lib *class.MusicLib, names map[string]bool) {
+	groups := lib.Groups[:0]
+	for _, group := range lib.Groups {
+		tracks := group.Tracks[:0]
+		for _, track := range group.Tracks {
+			if names[strings.ToLower(track)] {
+				log.Printf("  removing %v from lib", track)
+				continue
+			}
+			tracks = append(tracks, track)
+		}
+		group.Tracks = tracks
 
-	mDir := path.Join(outputDir, MusicLibPath)
-	err = os.MkdirAll(mDir, 0777)
-	if err != nil {
-		return err
+		if len(group.Tracks) == 0 {
+			log.Printf("  removing empty group %v from lib", group.Name)
+			continue
+		}
+		groups = append(groups, group)
 	}
+	lib.Groups = groups
+}
 
-	return saveMusicLib(lib, path.Join(mDir, MusicLibName))
+// Audio data prepared for packing.
+type musicTrack struct {
+	Name     string
+	Resource StreamInfo
+	// Legacy clips only
+	Type AudioType
+	// 5.0+ clips only
+	FSB *FSB5
 }
 
-// Packs music (all .ogg files) in dir into resS file
-// and returns map[track_name]->MusicDescription
-func prepareMusic(dir, resS string) (map[string]MusicDescription, error) {
-	tracks, err := ioutil.ReadDir(dir)
-	if err != nil {
-		return nil, err
+// Sets the prepared data to the clip.
+func (t musicTrack) apply(clip *AudioClip) error {
+	clip.Name = t.Name
+	clip.Data = nil
+	clip.Resource = t.Resource
+
+	if clip.Legacy() {
+		clip.Type = t.Type
+		// Data is in the stream file now
+		clip.LoadType = AudioStreaming
+		return nil
 	}
+	return clip.SetFSB(t.FSB)
+}
 
-	res, err := os.Create(resS)
+// Track to be packed, either an audio file or an existing clip which is kept as is.
+type musicSource struct {
+	Name string
+	File string
+	Clip *AudioClip
+	// Assets of the clip if it is not from the assets being modified
+	Assets *AssetsReader
+}
+
+// Lists music files in dir, tracks are named after the files.
+func dirSources(dir string) ([]musicSource, error) {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return nil, err
 	}
-	defer res.Close()
-
-	ret := make(map[string]MusicDescription)
 
-	for _, f := range tracks {
-		if f.IsDir() || !strings.HasSuffix(f.Name(), ".ogg") {
+	var ret []musicSource
+	for _, f := range files {
+		if f.IsDir() {
 			continue
 		}
+		ret = append(ret, musicSource{
+			Name: strings.TrimSuffix(f.Name(), path.Ext(f.Name())),
+			File: path.Join(dir, f.Name()),
+		})
+	}
+	return ret, nil
+}
 
-		track, err := os.Open(path.Join(dir, f.Name()))
+// Packs the tracks into the stream file in outputDir and returns map[track_name]->musicTrack.
+// Legacy clips take any audio type supported by unity 4(.ogg for the shadowrun music),
+// .wav and .flac files are encoded to ogg.
+// 5.0+ clips take FSB5 containers(.fsb), .wav and .flac files which are converted to PCM FSB5.
+// The stream file is committed by the caller once the assets referring to it are written.
+// Unsupported files are skipped.
+func prepareMusic(
+	assets *AssetsReader, sources []musicSource, stream *musicStream, legacy bool, opts transcodeOptions,
+) (map[string]musicTrack, error) {
+	streamFile, res, base := stream.file, stream.res, stream.base
+	ret := make(map[string]musicTrack)
+
+	for _, src := range sources {
+		track, data, ok, err := prepareTrack(assets, src, legacy, opts)
 		if err != nil {
 			return nil, err
 		}
+		if !ok {
+			continue
+		}
+
+		if base != nil {
+			if data == nil {
+				data, err = ioutil.ReadFile(src.File)
+				if err != nil {
+					return nil, err
+				}
+			}
+			track.Resource, err = base.store(streamFile, track.Name, data)
+			if err != nil {
+				return nil, errors.Wrap(err, track.Name)
+			}
+			ret[track.Name] = track
+			continue
+		}
 
 		offset, err := res.Seek(0, 1)
 		if err != nil {
 			return nil, err
 		}
 
-		size, err := io.Copy(res, track)
+		var size int64
+		if data != nil {
+			n, err := res.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			size = int64(n)
+		} else {
+			file, err := os.Open(src.File)
+			if err != nil {
+				return nil, err
+			}
+			size, err = io.Copy(res, file)
+			file.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		track.Resource = StreamInfo{
+			Path:   streamFile,
+			Offset: uint64(offset),
+			Size:   uint64(size),
+		}
+		ret[track.Name] = track
+	}
+
+	return ret, nil
+}
+
+// Stream file written by prepareMusic.
+// If base is given, the original stream file is kept and only new or changed tracks are appended to it,
+// in place if the output dir holds the original file.
+type musicStream struct {
+	file string
+	res  *OutputFile
+	base *musicBase
+}
+
+func openMusicStream(outputDir, streamFile string, base *musicBase) (*musicStream, error) {
+	if base != nil {
+		base.streams = newStreamWriter(base.assets, outputDir)
+		base.streams.inPlace = true
+		base.hashes = loadStreamHashes(base.assets, streamFile)
+		return &musicStream{file: streamFile, base: base}, nil
+	}
+
+	res, err := CreateOutput(path.Join(outputDir, path.Base(strings.TrimPrefix(streamFile, archivePrefix))))
+	if err != nil {
+		return nil, err
+	}
+	return &musicStream{file: streamFile, res: res}, nil
+}
+
+// Replaces or appends the stream file, must be called after the assets referring to the new data are written.
+func (s *musicStream) Commit() error {
+	if s.base == nil {
+		return s.res.Commit()
+	}
+	err := s.base.streams.Commit()
+	if err != nil {
+		return err
+	}
+	err = s.base.hashes.save()
+	if err != nil {
+		log.Printf("[warn] failed to cache stream hashes: %v", err)
+	}
+	return nil
+}
+
+// Discards the new data unless it is committed, the appended stream file is truncated back.
+func (s *musicStream) Close() error {
+	if s.base == nil {
+		return s.res.Close()
+	}
+	return s.base.streams.Close()
+}
+
+// Returns the track with its data, nil data means the file is packed as is.
+// ok is false for unsupported files.
+func prepareTrack(assets *AssetsReader, src musicSource, legacy bool, opts transcodeOptions) (track musicTrack, data []byte, ok bool, err error) {
+	track.Name = src.Name
+	if src.Clip != nil {
+		log.Printf("  keeping %v", src.Name)
+		if src.Assets != nil {
+			assets = src.Assets
+		}
+		r, err := src.Clip.Reader(assets)
 		if err != nil {
-			return nil, err
+			return track, nil, false, errors.Wrap(err, src.Name)
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return track, nil, false, errors.Wrap(err, src.Name)
+		}
+		if legacy {
+			track.Type = src.Clip.Type
+		} else {
+			track.FSB, err = ParseFSB5(data)
+		}
+		return track, data, err == nil, errors.Wrap(err, src.Name)
+	}
+
+	name := path.Base(src.File)
+	ext := path.Ext(src.File)
+	if !legacy {
+		data, err = prepareFSB(src.File, opts)
+		if err != nil || data == nil {
+			return track, nil, false, errors.Wrap(err, name)
 		}
+		track.FSB, err = ParseFSB5(data)
+		return track, data, err == nil, errors.Wrap(err, name)
+	}
 
-		name := strings.TrimSuffix(f.Name(), ".ogg")
-		ret[name] = MusicDescription{
-			Name:    name,
-			Unknown: MagicNumbers,
-			Size:    uint32(size),
-			Shift:   uint32(offset),
+	track.Type, ok = AudioTypeByExtension(ext)
+	switch {
+	case isDecodableAudio(ext):
+		data, err = transcodeOgg(src.File, opts)
+		if err != nil {
+			return track, nil, false, errors.Wrap(err, name)
 		}
+		track.Type = AudioTypeOGGVorbis
+
+	case !ok:
+		return track, nil, false, nil
 	}
 
-	return ret, res.Close()
+	if track.Type == AudioTypeOGGVorbis {
+		var info OggInfo
+		if data != nil {
+			info, err = ParseOgg(bytes.NewReader(data))
+		} else {
+			info, err = parseOggFile(src.File)
+		}
+		if err != nil {
+			return track, nil, false, errors.Wrapf(err, "invalid ogg file %v", name)
+		}
+		for _, w := range info.Warnings {
+			log.Printf("[warn] %v: %v", name, w)
+		}
+		log.Printf("  %v: %v", name, info)
+	}
+	return track, data, true, nil
+}
+
+// Existing clips for incremental packing.
+type musicBase struct {
+	assets *AssetsReader
+	// Clips by name
+	clips   map[string]AudioClip
+	streams *streamWriter
+	hashes  *streamHashes
+}
+
+// Returns the resource of the existing clip if its data is the same, appends the data to the stream file otherwise.
+func (b *musicBase) store(streamFile, name string, data []byte) (StreamInfo, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if clip, ok := b.clips[name]; ok && clip.Resource.Size > 0 && clip.Resource.Path == streamFile {
+		same, err := b.sameStreamData(clip.Resource, hash, len(data))
+		if err != nil {
+			return StreamInfo{}, err
+		}
+		if same {
+			log.Printf("  %v is unchanged", name)
+			return clip.Resource, nil
+		}
+	}
+
+	log.Printf("  appending %v", name)
+	info, err := b.streams.Append(streamFile, data)
+	if err == nil {
+		b.hashes.set(info, hash)
+	}
+	return info, err
+}
+
+// Compares the streamed data with the new one by size and hash, hashes of the stream file are cached.
+func (b *musicBase) sameStreamData(info StreamInfo, hash string, size int) (bool, error) {
+	if info.Size != uint64(size) {
+		return false, nil
+	}
+	if cached, ok := b.hashes.get(info); ok {
+		return cached == hash, nil
+	}
+
+	r, err := b.assets.StreamData(info)
+	if err != nil {
+		return false, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return false, err
+	}
+	current := hex.EncodeToString(h.Sum(nil))
+	b.hashes.set(info, current)
+	return current == hash, nil
+}
+
+// Hashes of the stream file data by offset and size, kept in the user cache dir between incremental runs,
+// so unchanged tracks are not read again. Incremental runs only append to the file,
+// the cache is dropped if the file was changed otherwise, e.g. by a game update.
+type streamHashes struct {
+	// Stream file state after the last run
+	Size    int64
+	ModTime time.Time
+	Hashes  map[string]string
+
+	// Local stream file and the cache file, empty if the cache is disabled
+	stream string
+	file   string
+}
+
+func loadStreamHashes(assets *AssetsReader, streamFile string) *streamHashes {
+	ret := &streamHashes{Hashes: make(map[string]string)}
+	local, ok := assets.findFile(streamFile)
+	if assets.bundle != nil || !ok {
+		return ret
+	}
+	local, err := filepath.Abs(local)
+	if err != nil {
+		return ret
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Printf("[warn] stream hash cache is disabled: %v", err)
+		return ret
+	}
+	sum := sha256.Sum256([]byte(local))
+	ret.stream, ret.file = local, path.Join(dir, "shadowed", "streams", hex.EncodeToString(sum[:])+".json")
+
+	stat, err := os.Stat(local)
+	if err != nil {
+		return ret
+	}
+	data, err := ioutil.ReadFile(ret.file)
+	if err != nil {
+		return ret
+	}
+	var cached streamHashes
+	if json.Unmarshal(data, &cached) != nil || cached.Size != stat.Size() || !cached.ModTime.Equal(stat.ModTime()) {
+		return ret
+	}
+	for k, v := range cached.Hashes {
+		ret.Hashes[k] = v
+	}
+	return ret
+}
+
+func streamHashKey(info StreamInfo) string {
+	return fmt.Sprintf("%v+%v", info.Offset, info.Size)
+}
+
+func (h *streamHashes) get(info StreamInfo) (string, bool) {
+	hash, ok := h.Hashes[streamHashKey(info)]
+	return hash, ok
+}
+
+func (h *streamHashes) set(info StreamInfo, hash string) {
+	h.Hashes[streamHashKey(info)] = hash
+}
+
+// Records the current state of the stream file along with the hashes.
+func (h *streamHashes) save() error {
+	if h.file == "" {
+		return nil
+	}
+	stat, err := os.Stat(h.stream)
+	if err != nil {
+		return err
+	}
+	h.Size, h.ModTime = stat.Size(), stat.ModTime()
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeCacheFile(h.file, data)
+}
+
+// Returns FSB5 data of the file, nil for unsupported files.
+func prepareFSB(file string, opts transcodeOptions) ([]byte, error) {
+	ext := strings.ToLower(path.Ext(file))
+	switch ext {
+	case ".fsb":
+		return ioutil.ReadFile(file)
+
+	case ".wav", ".flac", ".mp3":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		audio, _, err := decodeAudio(ext, data)
+		if err != nil {
+			return nil, err
+		}
+		audio, err = transcodePCM(audio, opts)
+		if err != nil {
+			return nil, err
+		}
+		return NewFSB5(audio)
+
+	case ".ogg":
+		log.Printf("[warn] skipping %v: ogg can't be packed into FSB5, use .wav, .flac, .mp3 or .fsb", file)
+	}
+	return nil, nil
 }
 
 func ParseMusicLib() error {
@@ -415,7 +1125,7 @@ func DumpResources() error {
 		if desc.TypeID == ResourceManagerTypeID {
 			log.Printf("%+v", desc)
 			var res ResourceManager
-			err := read(r, &res, assets.Order, false)
+			err := res.read(r, assets.Order, assets.Header.Version)
 			if err != nil {
 				return err
 			}
@@ -456,5 +1166,5 @@ func writeProtoFile(path string, pb proto.Message) error {
 		return err
 	}
 
-	return ioutil.WriteFile(path, data, 0666)
+	return WriteOutput(path, data)
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// Large binary data(textures, audio, meshes) may be stored out of the object in the .resS or .resource files.
+// Objects refer such data with a struct of path, offset and size, field names vary between the classes:
+//	Texture2D, Mesh: m_StreamData{offset, size, path}
+//	AudioClip(unity 5+): m_Resource{m_Source, m_Offset, m_Size}
+type StreamInfo struct {
+	Path   string
+	Offset uint64
+	Size   uint64
+}
+
+// Paths of the files stored in bundles start with it.
+const archivePrefix = "archive:/"
+
+// Extracts stream info from a decoded struct, see StreamInfo for supported layouts.
+func ParseStreamInfo(val interface{}) (StreamInfo, error) {
+	var (
+		ret StreamInfo
+		err error
+	)
+
+	pathVal, err := fieldValue(val, "path")
+	if err != nil {
+		pathVal, err = fieldValue(val, "m_Source")
+	}
+	if err != nil {
+		return ret, errors.Wrap(err, "invalid stream info")
+	}
+	switch p := pathVal.(type) {
+	case string:
+		ret.Path = p
+	case Bytes:
+		ret.Path = string(p)
+	default:
+		return ret, errors.Errorf("invalid stream info path type %T", pathVal)
+	}
+
+	for _, field := range []struct {
+		names []string
+		dst   *uint64
+	}{
+		{[]string{"offset", "m_Offset"}, &ret.Offset},
+		{[]string{"size", "m_Size"}, &ret.Size},
+	} {
+		var v interface{}
+		for _, name := range field.names {
+			v, err = fieldValue(val, name)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return ret, errors.Wrap(err, "invalid stream info")
+		}
+		*field.dst, err = uintValue(v)
+		if err != nil {
+			return ret, errors.Wrap(err, "invalid stream info")
+		}
+	}
+
+	return ret, nil
+}
+
+// Updates stream info fields of a decoded struct(see ParseStreamInfo).
+func (s StreamInfo) Store(val interface{}) error {
+	st, ok := val.(*Struct)
+	if !ok {
+		return errors.Errorf("invalid stream info type %T", val)
+	}
+
+	for _, field := range []struct {
+		names []string
+		val   interface{}
+	}{
+		{[]string{"path", "m_Source"}, s.Path},
+		{[]string{"offset", "m_Offset"}, s.Offset},
+		{[]string{"size", "m_Size"}, s.Size},
+	} {
+		if !st.Set(field.names[0], field.val) && !st.Set(field.names[1], field.val) {
+			return errors.Errorf("invalid stream info: field %v is missing", field.names[0])
+		}
+	}
+	return nil
+}
+
+// Decoded object with streamed data, see streamWriter.rewrite.
+type streamedObject struct {
+	desc Object
+	val  interface{}
+	info StreamInfo
+	// Replacement of the streamed data, nil if it is unchanged
+	data []byte
+}
+
+// Decodes the object if its type has stream info, ok is false for other objects.
+func decodeStreamedObject(assets *AssetsReader, desc Object, r io.Reader) (obj streamedObject, ok bool, err error) {
+	info, err := assets.TypeTree(desc)
+	if err != nil || !hasChild(info, "m_StreamData") && !hasChild(info, "m_Resource") {
+		return obj, false, nil
+	}
+
+	obj.desc = desc
+	obj.val, err = assets.DecodeObject(desc, r)
+	if err != nil {
+		return obj, false, err
+	}
+	stream, err := streamField(obj.val)
+	if err != nil {
+		return obj, false, errors.Wrapf(err, "object %v", desc.ID)
+	}
+	obj.info, err = ParseStreamInfo(stream)
+	return obj, err == nil, errors.Wrapf(err, "object %v", desc.ID)
+}
+
+func streamField(val interface{}) (interface{}, error) {
+	stream, err := fieldValue(val, "m_StreamData")
+	if err != nil {
+		stream, err = fieldValue(val, "m_Resource")
+	}
+	return stream, err
+}
+
+// Appends the data of the object to the stream file and encodes the object with the new location.
+func (o streamedObject) write(assets *AssetsReader, streams *streamWriter) (ReplacementObject, error) {
+	data := o.data
+	if data == nil {
+		r, err := assets.StreamData(o.info)
+		if err != nil {
+			return ReplacementObject{}, err
+		}
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return ReplacementObject{}, err
+		}
+	}
+
+	info, err := streams.Append(o.info.Path, data)
+	if err != nil {
+		return ReplacementObject{}, err
+	}
+	stream, err := streamField(o.val)
+	if err != nil {
+		return ReplacementObject{}, err
+	}
+	err = info.Store(stream)
+	if err != nil {
+		return ReplacementObject{}, err
+	}
+
+	encoded, err := assets.EncodeObject(o.desc, o.val)
+	if err != nil {
+		return ReplacementObject{}, err
+	}
+	return ReplacementObject{
+		TargetID: o.desc.ID,
+		CustomObject: CustomObject{
+			TypeID:  o.desc.TypeID,
+			ClassID: o.desc.ClassID,
+			Data:    encoded,
+		},
+	}, nil
+}
+
+// Returns reader of the streamed data.
+// Files are searched in the same bundle or next to the assets file,
+// opened files are kept until the assets reader is closed.
+func (r *AssetsReader) StreamData(info StreamInfo) (*io.SectionReader, error) {
+	if info.Path == "" {
+		return nil, errors.New("stream path is empty")
+	}
+
+	src, err := r.openStream(info.Path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(src, int64(info.Offset), int64(info.Size)), nil
+}
+
+func (r *AssetsReader) openStream(file string) (readSeekerAt, error) {
+	if src, ok := r.streams[file]; ok {
+		return src, nil
+	}
+
+	name := path.Base(strings.TrimPrefix(file, archivePrefix))
+
+	var src readSeekerAt
+	if r.bundle != nil {
+		if f, ok := r.bundle.File(name); ok {
+			src = f.Reader()
+		}
+	}
+
+	if src == nil {
+		if local, ok := r.findFile(file); ok {
+			fd, err := os.Open(local)
+			if err != nil {
+				return nil, err
+			}
+			src = fd
+		}
+	}
+
+	if src == nil {
+		return nil, errors.Errorf("streamed data file %v not found", file)
+	}
+
+	if r.streams == nil {
+		r.streams = make(map[string]readSeekerAt)
+	}
+	r.streams[file] = src
+	return src, nil
+}
+
+// Creates modified versions of the streamed data files in dir.
+// The original data is copied as is, since it may be referred by the objects which are not modified,
+// and the new data is appended to the end.
+type streamWriter struct {
+	src   *AssetsReader
+	dir   string
+	files map[string]streamOutput
+	// Files are written from scratch instead, every object referring them must be rewritten
+	rewrite bool
+	// Source files in dir are appended in place instead of being copied
+	inPlace bool
+}
+
+type streamOutput interface {
+	io.WriteSeeker
+	Commit() error
+	Close() error
+}
+
+// Stream file appended in place, the original data stays untouched.
+// Failed runs truncate the file back, the original size is recorded for restore
+// since the appended data stays if the run is interrupted.
+type appendFile struct {
+	*os.File
+	size      int64
+	committed bool
+}
+
+func openAppendFile(file string) (*appendFile, error) {
+	fd, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := fd.Seek(0, io.SeekEnd)
+	if err == nil {
+		err = recordSize(file, size)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &appendFile{File: fd, size: size}, nil
+}
+
+func (f *appendFile) Commit() error {
+	if f.committed {
+		return nil
+	}
+	f.committed = true
+	err := f.File.Sync()
+	if err != nil {
+		f.File.Truncate(f.size)
+		f.File.Close()
+		return errors.Wrap(err, f.Name())
+	}
+	return f.File.Close()
+}
+
+// Drops the appended data unless it is committed.
+func (f *appendFile) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.committed = true
+	err := f.File.Truncate(f.size)
+	f.File.Close()
+	return err
+}
+
+// Stream data offsets are aligned the same way as unity does.
+const streamAlign = 16
+
+func newStreamWriter(src *AssetsReader, dir string) *streamWriter {
+	return &streamWriter{
+		src:   src,
+		dir:   dir,
+		files: make(map[string]streamOutput),
+	}
+}
+
+// Appends data to the modified version of the file and returns the new stream info.
+func (w *streamWriter) Append(file string, data []byte) (StreamInfo, error) {
+	out, err := w.open(file)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+
+	end, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	err = writeAlign(out, int(end), streamAlign)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+
+	_, err = out.Write(data)
+	if err != nil {
+		return StreamInfo{}, err
+	}
+
+	return StreamInfo{
+		Path:   file,
+		Offset: align64(uint64(end), streamAlign),
+		Size:   uint64(len(data)),
+	}, nil
+}
+
+func (w *streamWriter) open(file string) (streamOutput, error) {
+	if out, ok := w.files[file]; ok {
+		return out, nil
+	}
+
+	src, err := w.src.openStream(file)
+	if err != nil {
+		return nil, err
+	}
+
+	outPath := path.Join(w.dir, path.Base(strings.TrimPrefix(file, archivePrefix)))
+	if srcFile, ok := src.(*os.File); ok {
+		srcStat, err := srcFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		outStat, err := os.Stat(outPath)
+		if err == nil && os.SameFile(srcStat, outStat) {
+			if !w.inPlace || w.rewrite {
+				return nil, errors.Errorf("can't overwrite the source file %v, use another output directory", outPath)
+			}
+			out, err := openAppendFile(outPath)
+			if err != nil {
+				return nil, err
+			}
+			w.files[file] = out
+			return out, nil
+		}
+	}
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := CreateOutput(outPath)
+	if err != nil {
+		return nil, err
+	}
+	w.files[file] = out
+	if w.rewrite {
+		return out, nil
+	}
+
+	if w.inPlace {
+		log.Printf("  copying %v, append in place by using its dir as the output dir", path.Base(outPath))
+	}
+	_, err = io.Copy(out, io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Replaces the output files with the written ones.
+func (w *streamWriter) Commit() error {
+	var ret error
+	for file, out := range w.files {
+		err := out.Commit()
+		if err != nil && ret == nil {
+			ret = err
+		}
+		delete(w.files, file)
+	}
+	return ret
+}
+
+// Discards the files which are not committed.
+func (w *streamWriter) Close() error {
+	var ret error
+	for file, out := range w.files {
+		err := out.Close()
+		if err != nil && ret == nil {
+			ret = err
+		}
+		delete(w.files, file)
+	}
+	return ret
+}
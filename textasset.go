@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+const TextAssetTypeID = 49
+
+// Despite the name, text assets may contain any binary data, e.g. serialized protobuf messages.
+type TextAsset struct {
+	Name   string
+	Script []byte
+}
+
+func ParseTextAsset(val interface{}) (TextAsset, error) {
+	var ret TextAsset
+
+	name, err := fieldValue(val, "m_Name")
+	if err != nil {
+		return ret, err
+	}
+	ret.Name, _ = name.(string)
+
+	script, err := fieldValue(val, "m_Script")
+	if err != nil {
+		return ret, err
+	}
+	ret.Script, err = bytesValue(script)
+	if err != nil {
+		return ret, errors.Wrap(err, "m_Script")
+	}
+
+	return ret, nil
+}
+
+// Updates the decoded text asset object, see ParseTextAsset.
+func (t TextAsset) Store(val interface{}) error {
+	st, ok := val.(*Struct)
+	if !ok {
+		return errors.Errorf("structure expected, got %T", val)
+	}
+
+	if !st.Set("m_Name", t.Name) {
+		return errors.New("field m_Name is missing")
+	}
+	if !st.Set("m_Script", Bytes(t.Script)) {
+		return errors.New("field m_Script is missing")
+	}
+	return nil
+}
+
+func TextUnpack() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	err = os.MkdirAll(os.Args[3], 0777)
+	if err != nil {
+		return err
+	}
+
+	names := make(fileNamer)
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != TextAssetTypeID {
+			return nil
+		}
+
+		text, err := decodeTextAsset(assets, desc, r)
+		if err != nil {
+			return err
+		}
+
+		file := path.Join(os.Args[3], names.name(text.Name, desc.ID, ""))
+		log.Printf("  %v: %v bytes", file, len(text.Script))
+		return WriteUnpacked(file, text.Script)
+	})
+}
+
+func TextPack() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	textDir := os.Args[3]
+	files, err := ioutil.ReadDir(textDir)
+	if err != nil {
+		return err
+	}
+
+	names := make(fileNamer)
+	var replace []ReplacementObject
+	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != TextAssetTypeID {
+			return nil
+		}
+
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			return err
+		}
+		text, err := ParseTextAsset(val)
+		if err != nil {
+			return errors.Wrapf(err, "text asset %v", desc.ID)
+		}
+
+		file := path.Join(textDir, names.name(text.Name, desc.ID, ""))
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(data, text.Script) {
+			return nil
+		}
+
+		text.Script = data
+		err = text.Store(val)
+		if err != nil {
+			return errors.Wrapf(err, "text asset %v", desc.ID)
+		}
+
+		encoded, err := assets.EncodeObject(desc, val)
+		if err != nil {
+			return errors.Wrapf(err, "text asset %v", desc.ID)
+		}
+
+		log.Printf("  replacing %v(%v): %v bytes", text.Name, desc.ID, len(data))
+		replace = append(replace, ReplacementObject{
+			TargetID: desc.ID,
+			CustomObject: CustomObject{
+				TypeID:  desc.TypeID,
+				ClassID: desc.ClassID,
+				Data:    encoded,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !f.IsDir() && !names[strings.ToLower(f.Name())] {
+			log.Printf("[warn] skipping %v, there is no text asset with this name", f.Name())
+		}
+	}
+
+	if len(replace) == 0 {
+		log.Print("No changes found")
+	}
+
+	_, err = CreateModifiedAssets(os.Args[4], assets, nil, replace, nil)
+	return err
+}
+
+func decodeTextAsset(assets *AssetsReader, desc Object, r io.Reader) (TextAsset, error) {
+	val, err := assets.DecodeObject(desc, r)
+	if err != nil {
+		return TextAsset{}, err
+	}
+
+	text, err := ParseTextAsset(val)
+	if err != nil {
+		return TextAsset{}, errors.Wrapf(err, "text asset %v", desc.ID)
+	}
+	return text, nil
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+)
+
+const TextureTypeID = 28
+
+// See UnityEngine.TextureFormat, only the formats handled here are listed.
+type TextureFormat int32
+
+const (
+	Alpha8   TextureFormat = 1
+	ARGB4444 TextureFormat = 2
+	RGB24    TextureFormat = 3
+	RGBA32   TextureFormat = 4
+	ARGB32   TextureFormat = 5
+	RGB565   TextureFormat = 7
+	DXT1     TextureFormat = 10
+	DXT5     TextureFormat = 12
+	RGBA4444 TextureFormat = 13
+	BGRA32   TextureFormat = 14
+)
+
+var textureFormatNames = map[TextureFormat]string{
+	Alpha8:   "Alpha8",
+	ARGB4444: "ARGB4444",
+	RGB24:    "RGB24",
+	RGBA32:   "RGBA32",
+	ARGB32:   "ARGB32",
+	RGB565:   "RGB565",
+	DXT1:     "DXT1",
+	DXT5:     "DXT5",
+	RGBA4444: "RGBA4444",
+	BGRA32:   "BGRA32",
+}
+
+func (f TextureFormat) String() string {
+	if name, ok := textureFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%v)", int32(f))
+}
+
+// Texture2D fields which matter for image conversion.
+// Field layout differs between unity versions, so they are taken from the decoded type tree value.
+type Texture struct {
+	Name       string
+	Width      int
+	Height     int
+	Format     TextureFormat
+	MipCount   int
+	ImageCount int
+	// Empty if the data is streamed
+	Data   []byte `json:"-"`
+	Stream StreamInfo
+}
+
+func ParseTexture(val interface{}) (Texture, error) {
+	var ret Texture
+
+	name, err := fieldValue(val, "m_Name")
+	if err != nil {
+		return ret, err
+	}
+	ret.Name, _ = name.(string)
+
+	for _, field := range []struct {
+		name string
+		dst  *int
+	}{
+		{"m_Width", &ret.Width},
+		{"m_Height", &ret.Height},
+		{"m_ImageCount", &ret.ImageCount},
+	} {
+		v, err := fieldValue(val, field.name)
+		if err != nil {
+			return ret, err
+		}
+		i, err := intValue(v)
+		if err != nil {
+			return ret, errors.Wrap(err, field.name)
+		}
+		*field.dst = int(i)
+	}
+
+	format, err := fieldValue(val, "m_TextureFormat")
+	if err != nil {
+		return ret, err
+	}
+	f, err := intValue(format)
+	if err != nil {
+		return ret, errors.Wrap(err, "m_TextureFormat")
+	}
+	ret.Format = TextureFormat(f)
+
+	// Unity 5.2+ stores mip count, older versions have a flag only
+	if count, err := fieldValue(val, "m_MipCount"); err == nil {
+		c, err := intValue(count)
+		if err != nil {
+			return ret, errors.Wrap(err, "m_MipCount")
+		}
+		ret.MipCount = int(c)
+	} else if flag, err := fieldValue(val, "m_MipMap"); err == nil && flag == true {
+		ret.MipCount = fullMipCount(ret.Width, ret.Height)
+	} else {
+		ret.MipCount = 1
+	}
+
+	data, err := fieldValue(val, "image data")
+	if err != nil {
+		return ret, err
+	}
+	ret.Data, err = bytesValue(data)
+	if err != nil {
+		return ret, errors.Wrap(err, "image data")
+	}
+
+	if stream, err := fieldValue(val, "m_StreamData"); err == nil {
+		ret.Stream, err = ParseStreamInfo(stream)
+		if err != nil {
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
+
+func fullMipCount(width, height int) int {
+	count := 1
+	for width > 1 || height > 1 {
+		width /= 2
+		height /= 2
+		count++
+	}
+	return count
+}
+
+// Reads streamed data if necessary.
+func (t *Texture) LoadData(assets *AssetsReader) error {
+	if len(t.Data) > 0 || t.Stream.Size == 0 {
+		return nil
+	}
+
+	r, err := assets.StreamData(t.Stream)
+	if err != nil {
+		return err
+	}
+	t.Data, err = ioutil.ReadAll(r)
+	return err
+}
+
+// Size of a single mip level in bytes.
+func (t Texture) LevelSize(width, height int) (int, error) {
+	switch t.Format {
+	case Alpha8:
+		return width * height, nil
+	case ARGB4444, RGBA4444, RGB565:
+		return width * height * 2, nil
+	case RGB24:
+		return width * height * 3, nil
+	case RGBA32, ARGB32, BGRA32:
+		return width * height * 4, nil
+	case DXT1:
+		return (width + 3) / 4 * ((height + 3) / 4) * 8, nil
+	case DXT5:
+		return (width + 3) / 4 * ((height + 3) / 4) * 16, nil
+	default:
+		return 0, errors.Errorf("unsupported texture format %v", t.Format)
+	}
+}
+
+// Decodes the main image(the first mip level of the first image).
+func (t Texture) Image() (*image.NRGBA, error) {
+	size, err := t.LevelSize(t.Width, t.Height)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Data) < size {
+		return nil, errors.Errorf("not enough image data: %v bytes, %v expected", len(t.Data), size)
+	}
+	data := t.Data[:size]
+
+	var img *image.NRGBA
+	switch t.Format {
+	case DXT1:
+		img = decodeDXT1(data, t.Width, t.Height)
+	case DXT5:
+		img = decodeDXT5(data, t.Width, t.Height)
+	default:
+		img = decodePixels(data, t.Width, t.Height, pixelFormats[t.Format])
+	}
+
+	// Unity stores images bottom up
+	flipImage(img)
+	return img, nil
+}
+
+// Replaces the texture data with the encoded image in the same format.
+// Mip levels are regenerated if the texture has them.
+func (t *Texture) SetImage(img image.Image) error {
+	if _, err := t.LevelSize(1, 1); err != nil {
+		return err
+	}
+	if t.ImageCount > 1 {
+		return errors.Errorf("textures with %v images are not supported", t.ImageCount)
+	}
+
+	level := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(level, level.Rect, img, img.Bounds().Min, draw.Src)
+	flipImage(level)
+
+	t.Width, t.Height = level.Rect.Dx(), level.Rect.Dy()
+	if t.MipCount > 1 {
+		t.MipCount = fullMipCount(t.Width, t.Height)
+	}
+
+	t.Data = nil
+	for i := 0; i < t.MipCount; i++ {
+		if i > 0 {
+			level = downscaleImage(level)
+		}
+		t.Data = append(t.Data, t.encodeLevel(level)...)
+	}
+	return nil
+}
+
+func (t Texture) encodeLevel(img *image.NRGBA) []byte {
+	switch t.Format {
+	case DXT1:
+		return encodeDXT1(img)
+	case DXT5:
+		return encodeDXT5(img)
+	default:
+		return encodePixels(img, pixelFormats[t.Format])
+	}
+}
+
+// Updates the decoded texture object, see ParseTexture.
+func (t Texture) Store(val interface{}) error {
+	st, ok := val.(*Struct)
+	if !ok {
+		return errors.Errorf("structure expected, got %T", val)
+	}
+
+	size := uint64(len(t.Data))
+	if size == 0 {
+		size = t.Stream.Size
+	}
+
+	for _, field := range []struct {
+		name     string
+		val      interface{}
+		optional bool
+	}{
+		{"m_Width", t.Width, false},
+		{"m_Height", t.Height, false},
+		{"m_CompleteImageSize", size, false},
+		{"m_MipCount", t.MipCount, true},
+		{"image data", Bytes(t.Data), false},
+	} {
+		if !st.Set(field.name, field.val) && !field.optional {
+			return errors.Errorf("field %v is missing", field.name)
+		}
+	}
+
+	if stream, ok := st.Get("m_StreamData"); ok {
+		return t.Stream.Store(stream)
+	}
+	return nil
+}
+
+// Uncompressed formats, pixels are stored row by row.
+type pixelFormat struct {
+	size   int
+	decode func(p []byte) color.NRGBA
+	encode func(c color.NRGBA, p []byte)
+}
+
+var pixelFormats = map[TextureFormat]pixelFormat{
+	Alpha8: {1, func(p []byte) color.NRGBA {
+		return color.NRGBA{R: 255, G: 255, B: 255, A: p[0]}
+	}, func(c color.NRGBA, p []byte) {
+		p[0] = c.A
+	}},
+	ARGB4444: {2, func(p []byte) color.NRGBA {
+		v := binary.LittleEndian.Uint16(p)
+		return color.NRGBA{R: nibble(v >> 8), G: nibble(v >> 4), B: nibble(v), A: nibble(v >> 12)}
+	}, func(c color.NRGBA, p []byte) {
+		binary.LittleEndian.PutUint16(p, toNibble(c.A)<<12|toNibble(c.R)<<8|toNibble(c.G)<<4|toNibble(c.B))
+	}},
+	RGBA4444: {2, func(p []byte) color.NRGBA {
+		v := binary.LittleEndian.Uint16(p)
+		return color.NRGBA{R: nibble(v >> 12), G: nibble(v >> 8), B: nibble(v >> 4), A: nibble(v)}
+	}, func(c color.NRGBA, p []byte) {
+		binary.LittleEndian.PutUint16(p, toNibble(c.R)<<12|toNibble(c.G)<<8|toNibble(c.B)<<4|toNibble(c.A))
+	}},
+	RGB565: {2, func(p []byte) color.NRGBA {
+		return rgb565(binary.LittleEndian.Uint16(p))
+	}, func(c color.NRGBA, p []byte) {
+		binary.LittleEndian.PutUint16(p, toRGB565(c))
+	}},
+	RGB24: {3, func(p []byte) color.NRGBA {
+		return color.NRGBA{R: p[0], G: p[1], B: p[2], A: 255}
+	}, func(c color.NRGBA, p []byte) {
+		p[0], p[1], p[2] = c.R, c.G, c.B
+	}},
+	RGBA32: {4, func(p []byte) color.NRGBA {
+		return color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]}
+	}, func(c color.NRGBA, p []byte) {
+		p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+	}},
+	ARGB32: {4, func(p []byte) color.NRGBA {
+		return color.NRGBA{R: p[1], G: p[2], B: p[3], A: p[0]}
+	}, func(c color.NRGBA, p []byte) {
+		p[0], p[1], p[2], p[3] = c.A, c.R, c.G, c.B
+	}},
+	BGRA32: {4, func(p []byte) color.NRGBA {
+		return color.NRGBA{R: p[2], G: p[1], B: p[0], A: p[3]}
+	}, func(c color.NRGBA, p []byte) {
+		p[0], p[1], p[2], p[3] = c.B, c.G, c.R, c.A
+	}},
+}
+
+func nibble(v uint16) uint8 {
+	return uint8(v&0xf) * 0x11
+}
+
+func toNibble(v uint8) uint16 {
+	return (uint16(v) + 8) / 0x11
+}
+
+func decodePixels(data []byte, width, height int, f pixelFormat) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pos := (y*width + x) * f.size
+			img.SetNRGBA(x, y, f.decode(data[pos:pos+f.size]))
+		}
+	}
+	return img
+}
+
+func encodePixels(img *image.NRGBA, f pixelFormat) []byte {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	ret := make([]byte, width*height*f.size)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pos := (y*width + x) * f.size
+			f.encode(img.NRGBAAt(x, y), ret[pos:pos+f.size])
+		}
+	}
+	return ret
+}
+
+// Halves the image with a box filter to produce the next mip level.
+func downscaleImage(img *image.NRGBA) *image.NRGBA {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	ret := image.NewNRGBA(image.Rect(0, 0, maxInt(width/2, 1), maxInt(height/2, 1)))
+
+	for y := 0; y < ret.Rect.Dy(); y++ {
+		for x := 0; x < ret.Rect.Dx(); x++ {
+			// Colors are weighted by alpha, so transparent pixels don't bleed into visible ones
+			var r, g, b, a int
+			for i := 0; i < 4; i++ {
+				c := img.NRGBAAt(minInt(x*2+i%2, width-1), minInt(y*2+i/2, height-1))
+				r += int(c.R) * int(c.A)
+				g += int(c.G) * int(c.A)
+				b += int(c.B) * int(c.A)
+				a += int(c.A)
+			}
+			if a == 0 {
+				continue
+			}
+			ret.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / a),
+				G: uint8(g / a),
+				B: uint8(b / a),
+				A: uint8(a / 4),
+			})
+		}
+	}
+	return ret
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func flipImage(img *image.NRGBA) {
+	height := img.Rect.Dy()
+	for y := 0; y < height/2; y++ {
+		top := img.Pix[y*img.Stride : y*img.Stride+img.Stride]
+		bottom := img.Pix[(height-1-y)*img.Stride : (height-y)*img.Stride]
+		for i := range top {
+			top[i], bottom[i] = bottom[i], top[i]
+		}
+	}
+}
+
+func TextureList() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != TextureTypeID {
+			return nil
+		}
+
+		tex, err := decodeTexture(assets, desc, r)
+		if err != nil {
+			return err
+		}
+		log.Printf("%v: %+v", desc.ID, tex)
+		return nil
+	})
+}
+
+func TextureUnpack() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	err = os.MkdirAll(os.Args[3], 0777)
+	if err != nil {
+		return err
+	}
+
+	names := make(fileNamer)
+	return assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != TextureTypeID {
+			return nil
+		}
+
+		tex, err := decodeTexture(assets, desc, r)
+		if err != nil {
+			return err
+		}
+		file := path.Join(os.Args[3], names.name(tex.Name, desc.ID, ".png"))
+
+		err = tex.LoadData(assets)
+		if err != nil {
+			return errors.Wrap(err, tex.Name)
+		}
+
+		img, err := tex.Image()
+		if err != nil {
+			log.Printf("[warn] skipping %v(%v): %v", tex.Name, desc.ID, err)
+			return nil
+		}
+
+		out, err := CreateUnpacked(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		err = png.Encode(out, img)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("  %v: %vx%v %v", file, tex.Width, tex.Height, tex.Format)
+		return out.Commit()
+	})
+}
+
+// Streamed data files with replaced textures are written from scratch, so the old data leaves no dead space.
+// Every object referring such files is rewritten with the new offsets, including the unchanged textures.
+func TexturePack() error {
+	assets, err := NewAssetsReader(os.Args[2])
+	if err != nil {
+		return err
+	}
+	defer assets.Close()
+
+	names := make(fileNamer)
+	var replace []ReplacementObject
+	var streamed []streamedObject
+	modified := make(map[string]bool)
+	err = assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != TextureTypeID {
+			obj, ok, err := decodeStreamedObject(assets, desc, r)
+			if ok {
+				streamed = append(streamed, obj)
+			}
+			return err
+		}
+
+		val, err := assets.DecodeObject(desc, r)
+		if err != nil {
+			return err
+		}
+		tex, err := ParseTexture(val)
+		if err != nil {
+			return errors.Wrapf(err, "texture %v", desc.ID)
+		}
+		obj := streamedObject{desc: desc, val: val, info: tex.Stream}
+
+		file := path.Join(os.Args[3], names.name(tex.Name, desc.ID, ".png"))
+		img, err := readPNG(file)
+		if os.IsNotExist(err) {
+			if tex.Stream.Path != "" {
+				streamed = append(streamed, obj)
+			}
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+
+		err = tex.SetImage(img)
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+		log.Printf("  replacing %v(%v): %vx%v %v, %v mips", tex.Name, desc.ID, tex.Width, tex.Height, tex.Format, tex.MipCount)
+
+		// Keep streamed textures streamed, the data is written with the rest of the file below.
+		// Store takes the image size from the stream then, the offset is set by streamedObject.write
+		if tex.Stream.Path != "" {
+			obj.data = tex.Data
+			tex.Stream.Size = uint64(len(tex.Data))
+			tex.Data = nil
+			modified[tex.Stream.Path] = true
+		}
+
+		err = tex.Store(val)
+		if err != nil {
+			return errors.Wrapf(err, "texture %v", desc.ID)
+		}
+		if tex.Stream.Path != "" {
+			streamed = append(streamed, obj)
+			return nil
+		}
+
+		data, err := assets.EncodeObject(desc, val)
+		if err != nil {
+			return errors.Wrapf(err, "texture %v", desc.ID)
+		}
+		replace = append(replace, ReplacementObject{
+			TargetID: desc.ID,
+			CustomObject: CustomObject{
+				TypeID:  desc.TypeID,
+				ClassID: desc.ClassID,
+				Data:    data,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	streams := newStreamWriter(assets, path.Dir(os.Args[4]))
+	streams.rewrite = true
+	defer streams.Close()
+
+	for _, obj := range streamed {
+		if !modified[obj.info.Path] {
+			continue
+		}
+		rep, err := obj.write(assets, streams)
+		if err != nil {
+			return errors.Wrapf(err, "object %v", obj.desc.ID)
+		}
+		replace = append(replace, rep)
+	}
+
+	if len(replace) == 0 {
+		log.Print("No changes found")
+	}
+
+	_, err = CreateModifiedAssets(os.Args[4], assets, nil, replace, nil)
+	if err != nil {
+		return err
+	}
+	return streams.Commit()
+}
+
+func readPNG(file string) (image.Image, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return png.Decode(fd)
+}
+
+func decodeTexture(assets *AssetsReader, desc Object, r io.Reader) (Texture, error) {
+	val, err := assets.DecodeObject(desc, r)
+	if err != nil {
+		return Texture{}, err
+	}
+
+	tex, err := ParseTexture(val)
+	if err != nil {
+		return Texture{}, errors.Wrapf(err, "texture %v", desc.ID)
+	}
+	return tex, nil
+}
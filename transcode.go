@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+/* Conversion of .wav, .flac and .mp3 audio into the formats the assets take:
+Ogg Vorbis for unity 4 clips and PCM FSB5 for 5.0+ ones.
+Encoded Ogg files are cached in the user cache dir keyed by the source content and the options,
+so repeated music-pack runs don't encode unchanged tracks again.
+*/
+
+type transcodeOptions struct {
+	// Vorbis quality, 0..10
+	Quality int
+	// Target sample rate, 0 keeps the original one
+	SampleRate int
+}
+
+var defaultTranscodeOptions = transcodeOptions{Quality: vorbisDefaultQuality}
+
+// Bumped whenever the encoder output changes to invalidate the cache.
+const transcodeVersion = 1
+
+// Decodes .wav, .flac or .mp3 audio, ok is false for other file types.
+func decodeAudio(ext string, data []byte) (audio PCMAudio, ok bool, err error) {
+	switch strings.ToLower(ext) {
+	case ".wav":
+		audio, err = ParseWAV(data)
+	case ".flac":
+		audio, err = ParseFLAC(data)
+	case ".mp3":
+		audio, err = ParseMP3(data)
+	default:
+		return audio, false, nil
+	}
+	return audio, true, err
+}
+
+// Files decodeAudio takes.
+func isDecodableAudio(ext string) bool {
+	ext = strings.ToLower(ext)
+	return ext == ".wav" || ext == ".flac" || ext == ".mp3"
+}
+
+// Returns samples of the audio at the target rate along with the rate itself.
+func transcodeSamples(audio PCMAudio, rate int) ([][]float64, int, error) {
+	samples, err := audio.Samples()
+	if err != nil {
+		return nil, 0, err
+	}
+	if rate == 0 || rate == audio.SampleRate {
+		return samples, audio.SampleRate, nil
+	}
+	for ch := range samples {
+		samples[ch] = Resample(samples[ch], audio.SampleRate, rate)
+	}
+	return samples, rate, nil
+}
+
+// Converts PCM into a form FSB5 can take: 24-bit samples are reduced to 16 and the rate is changed if requested.
+func transcodePCM(audio PCMAudio, opts transcodeOptions) (PCMAudio, error) {
+	resample := opts.SampleRate != 0 && opts.SampleRate != audio.SampleRate
+	if !resample && audio.BitsPerSample != 24 {
+		return audio, nil
+	}
+
+	samples, rate, err := transcodeSamples(audio, opts.SampleRate)
+	if err != nil {
+		return audio, err
+	}
+	return NewPCMAudio16(samples, rate), nil
+}
+
+// Encodes .wav, .flac or .mp3 file into Ogg Vorbis, the result is taken from the cache if possible.
+func transcodeOgg(file string, opts transcodeOptions) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := transcodeCachePath(data, opts)
+	if err != nil {
+		log.Printf("[warn] transcode cache is disabled: %v", err)
+	}
+	if cache != "" {
+		cached, err := ioutil.ReadFile(cache)
+		if err == nil {
+			// Broken entries(e.g. the disk was full) are just encoded again
+			if _, err = ParseOgg(bytes.NewReader(cached)); err == nil {
+				log.Printf("  %v: using cached %v", path.Base(file), cache)
+				return cached, nil
+			}
+		}
+	}
+
+	audio, ok, err := decodeAudio(path.Ext(file), data)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Errorf("%v can't be transcoded", file)
+	}
+
+	log.Printf("  %v: encoding to ogg with quality %v...", path.Base(file), opts.Quality)
+	samples, rate, err := transcodeSamples(audio, opts.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := NewVorbisEncoder(audio.Channels, rate, opts.Quality)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := enc.Encode(samples)
+	if err != nil {
+		return nil, err
+	}
+
+	if cache != "" {
+		err = writeCacheFile(cache, ret)
+		if err != nil {
+			log.Printf("[warn] failed to cache %v: %v", path.Base(file), err)
+		}
+	}
+	return ret, nil
+}
+
+// Returns path of the cached Ogg file for the given source and options.
+func transcodeCachePath(data []byte, opts transcodeOptions) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	name := fmt.Sprintf("%x-q%v-r%v-v%v.ogg", sum, opts.Quality, opts.SampleRate, transcodeVersion)
+	return path.Join(dir, "shadowed", "music", name), nil
+}
+
+// Writes the file through a temporary one, so interrupted runs don't leave partial entries.
+func writeCacheFile(file string, data []byte) error {
+	err := os.MkdirAll(path.Dir(file), 0777)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,800 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+/* Generic objects representation driven by the type trees from the metadata.
+
+Decoded values are
+	*Struct for the classes and structures, fields are kept in order of serialization
+	[]interface{} for arrays and maps(array of "pair" structs with "first" and "second" fields)
+	Bytes for byte arrays, TypelessData and strings with non UTF-8 content
+	PPtr for the references
+	string, bool and sized numeric types for everything else
+*/
+
+// Flag of TypeInfo.Flags, data is aligned to 4 bytes after the value.
+const AlignFlag = 0x4000
+
+type Struct struct {
+	Type   string
+	Fields []Field
+}
+
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+func (s *Struct) Get(name string) (interface{}, bool) {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Replaces value of an existing field, returns false if there is no such field.
+func (s *Struct) Set(name string, val interface{}) bool {
+	for i := range s.Fields {
+		if s.Fields[i].Name == name {
+			s.Fields[i].Value = val
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a copy of the struct which can be modified independently.
+// Nested structs are copied as well, arrays are shared.
+func (s *Struct) Clone() *Struct {
+	ret := &Struct{Type: s.Type, Fields: make([]Field, len(s.Fields))}
+	for i, f := range s.Fields {
+		if nested, ok := f.Value.(*Struct); ok {
+			f.Value = nested.Clone()
+		}
+		ret.Fields[i] = f
+	}
+	return ret
+}
+
+// Encodes the struct as JSON object with the original fields order.
+func (s *Struct) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range s.Fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		val, err := marshalValue(f.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, f.Name)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Non-finite floats are not valid JSON numbers, so they are written as "NaN", "+Inf" and "-Inf" strings.
+func marshalValue(val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case float32:
+		if f := float64(v); math.IsNaN(f) || math.IsInf(f, 0) {
+			return json.Marshal(strconv.FormatFloat(f, 'g', -1, 32))
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return json.Marshal(strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	case []interface{}:
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			data, err := marshalValue(item)
+			if err != nil {
+				return nil, errors.Wrapf(err, "[%v]", i)
+			}
+			buf.Write(data)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	}
+	return json.Marshal(val)
+}
+
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+type PPtr struct {
+	FileID int32 `json:"m_FileID"`
+	PathID int64 `json:"m_PathID"`
+}
+
+// Returns the type tree of the object's class.
+func (r *AssetsReader) TypeTree(obj Object) (TypeInfo, error) {
+	types := r.MetaData.TypeInfo
+	if !types.EnableTypeTree {
+		return TypeInfo{}, errors.New("type trees are stripped from the file")
+	}
+
+	idx, err := types.classIndex(obj)
+	if err != nil {
+		return TypeInfo{}, err
+	}
+	return types.Classes[idx].Info, nil
+}
+
+// Decodes object data(as provided by RangeObjects) with its type tree.
+func (r *AssetsReader) DecodeObject(obj Object, data io.Reader) (interface{}, error) {
+	info, err := r.TypeTree(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := decodeSized(data, int64(obj.Size), info, r.Order)
+	if err != nil {
+		return nil, errors.Wrapf(err, "object %v", obj.ID)
+	}
+	return ret, nil
+}
+
+func DecodeValue(r io.Reader, info TypeInfo, order binary.ByteOrder) (interface{}, error) {
+	d := typeDecoder{r: bufio.NewReader(r), order: order, size: -1}
+	return d.value(info)
+}
+
+// Decodes the value which must take exactly size bytes,
+// otherwise the type tree doesn't match the data and re-encoding would lose the rest.
+func decodeSized(r io.Reader, size int64, info TypeInfo, order binary.ByteOrder) (interface{}, error) {
+	d := typeDecoder{r: bufio.NewReader(r), order: order, size: size}
+	ret, err := d.value(info)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != size {
+		return nil, errors.Errorf("%v of %v bytes decoded, the type tree doesn't match the data", d.pos, size)
+	}
+	return ret, nil
+}
+
+type typeDecoder struct {
+	r     io.Reader
+	order binary.ByteOrder
+	// Offset from the beginning of the object, used for alignment
+	pos int64
+	// Size of the object, -1 if unknown
+	size int64
+}
+
+// Arrays of unknown data size are preallocated up to this length.
+const maxArrayPrealloc = 1024
+
+func (d *typeDecoder) read(val interface{}) error {
+	err := binary.Read(d.r, d.order, val)
+	if err != nil {
+		return err
+	}
+	d.pos += int64(binary.Size(val))
+	return nil
+}
+
+func (d *typeDecoder) bytes(size int32) ([]byte, error) {
+	if size < 0 {
+		return nil, errors.Errorf("invalid size %v", size)
+	}
+	if d.size >= 0 && d.pos+int64(size) > d.size {
+		return nil, errors.Errorf("size %v is past the end of the object", size)
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(d.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	d.pos += int64(size)
+	return buf, nil
+}
+
+func (d *typeDecoder) align() error {
+	if d.pos%4 == 0 {
+		return nil
+	}
+	_, err := d.bytes(int32(4 - d.pos%4))
+	return err
+}
+
+func (d *typeDecoder) value(info TypeInfo) (interface{}, error) {
+	ret, err := d.rawValue(info)
+	if err != nil {
+		return nil, errors.Wrap(err, info.Name)
+	}
+
+	if info.Flags&AlignFlag != 0 || alignedArray(info) {
+		err = d.align()
+	}
+	return ret, err
+}
+
+func (d *typeDecoder) rawValue(info TypeInfo) (interface{}, error) {
+	if len(info.Children) == 0 {
+		return d.primitive(info)
+	}
+
+	switch {
+	case info.Type == "string":
+		var size int32
+		err := d.read(&size)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(data) {
+			return Bytes(data), nil
+		}
+		return string(data), nil
+
+	case info.Type == "TypelessData":
+		var size int32
+		err := d.read(&size)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.bytes(size)
+		return Bytes(data), err
+
+	case isPPtr(info):
+		var ptr PPtr
+		err := d.read(&ptr.FileID)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Children) > 1 && info.Children[1].Size == 8 {
+			err = d.read(&ptr.PathID)
+		} else {
+			var id int32
+			err = d.read(&id)
+			ptr.PathID = int64(id)
+		}
+		return ptr, err
+
+	case isArray(info):
+		// maps are just arrays of pairs, it's fine to handle them in the same way
+		return d.array(info.Children[0])
+
+	case info.IsArray != 0:
+		return d.array(info)
+	}
+
+	ret := &Struct{Type: info.Type}
+	for _, child := range info.Children {
+		val, err := d.value(child)
+		if err != nil {
+			return nil, err
+		}
+		ret.Fields = append(ret.Fields, Field{Name: child.Name, Value: val})
+	}
+	return ret, nil
+}
+
+// Reads "Array" node with size and data children.
+func (d *typeDecoder) array(info TypeInfo) (interface{}, error) {
+	if len(info.Children) != 2 {
+		return nil, errors.Errorf("unexpected array layout of %v", info.Type)
+	}
+
+	var size int32
+	err := d.read(&size)
+	if err != nil {
+		return nil, err
+	}
+
+	elem := info.Children[1]
+	if isByte(elem) {
+		data, err := d.bytes(size)
+		return Bytes(data), err
+	}
+
+	if size < 0 {
+		return nil, errors.Errorf("invalid array size %v", size)
+	}
+
+	// The size comes from the file, don't trust it with the preallocation
+	capacity := int64(size)
+	if d.size >= 0 && capacity > d.size-d.pos {
+		capacity = d.size - d.pos
+	} else if d.size < 0 && capacity > maxArrayPrealloc {
+		capacity = maxArrayPrealloc
+	}
+	ret := make([]interface{}, 0, capacity)
+	for i := int32(0); i < size; i++ {
+		val, err := d.value(elem)
+		if err != nil {
+			return nil, errors.Wrapf(err, "[%v]", i)
+		}
+		ret = append(ret, val)
+	}
+	return ret, nil
+}
+
+func (d *typeDecoder) primitive(info TypeInfo) (interface{}, error) {
+	var ret interface{}
+	switch info.Type {
+	case "SInt8":
+		ret = new(int8)
+	case "UInt8", "char":
+		ret = new(uint8)
+	case "SInt16", "short":
+		ret = new(int16)
+	case "UInt16", "unsigned short":
+		ret = new(uint16)
+	case "SInt32", "int":
+		ret = new(int32)
+	case "UInt32", "unsigned int", "Type*":
+		ret = new(uint32)
+	case "SInt64", "long long":
+		ret = new(int64)
+	case "UInt64", "unsigned long long", "FileSize":
+		ret = new(uint64)
+	case "float":
+		ret = new(float32)
+	case "double":
+		ret = new(float64)
+	case "bool":
+		ret = new(bool)
+	default:
+		return nil, errors.Errorf("unsupported type %v", info.Type)
+	}
+
+	err := d.read(ret)
+	if err != nil {
+		return nil, err
+	}
+
+	return reflect.ValueOf(ret).Elem().Interface(), nil
+}
+
+// Node wrapping an "Array", e.g. vector, map, string.
+func isArray(info TypeInfo) bool {
+	return len(info.Children) == 1 && info.Children[0].IsArray != 0
+}
+
+// Alignment of arrays is defined by the inner "Array" node.
+func alignedArray(info TypeInfo) bool {
+	return isArray(info) && info.Children[0].Flags&AlignFlag != 0
+}
+
+func isPPtr(info TypeInfo) bool {
+	return strings.HasPrefix(info.Type, "PPtr<") && len(info.Children) == 2
+}
+
+func isByte(info TypeInfo) bool {
+	if len(info.Children) != 0 {
+		return false
+	}
+	switch info.Type {
+	case "UInt8", "SInt8", "char":
+		return true
+	}
+	return false
+}
+
+// Encodes the object value with the type tree of its class,
+// result can be used as CustomObject.Data as is.
+func (r *AssetsReader) EncodeObject(obj Object, val interface{}) ([]byte, error) {
+	info, err := r.TypeTree(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = EncodeValue(&buf, info, r.Order, val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "object %v", obj.ID)
+	}
+	return buf.Bytes(), nil
+}
+
+// Encodes either decoded value tree or generic JSON(see ParseJSONValue) according to the type tree.
+// Structures can be presented as *Struct or map[string]interface{},
+// byte arrays as Bytes, []byte or {"base64": "..."} object.
+func EncodeValue(w io.Writer, info TypeInfo, order binary.ByteOrder, val interface{}) error {
+	bw := bufio.NewWriter(w)
+	e := typeEncoder{w: bw, order: order}
+	err := e.value(info, val)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Parses JSON keeping numbers as is, so 64-bit values are not mangled by float conversion.
+func ParseJSONValue(data []byte) (interface{}, error) {
+	var ret interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&ret)
+	return ret, err
+}
+
+type typeEncoder struct {
+	w     io.Writer
+	order binary.ByteOrder
+	pos   int64
+}
+
+func (e *typeEncoder) write(val interface{}) error {
+	err := binary.Write(e.w, e.order, val)
+	if err != nil {
+		return err
+	}
+	e.pos += int64(binary.Size(val))
+	return nil
+}
+
+func (e *typeEncoder) bytes(data []byte) error {
+	err := e.write(int32(len(data)))
+	if err != nil {
+		return err
+	}
+	n, err := e.w.Write(data)
+	e.pos += int64(n)
+	return err
+}
+
+func (e *typeEncoder) align() error {
+	if e.pos%4 == 0 {
+		return nil
+	}
+	n, err := e.w.Write(make([]byte, 4-e.pos%4))
+	e.pos += int64(n)
+	return err
+}
+
+func (e *typeEncoder) value(info TypeInfo, val interface{}) error {
+	err := e.rawValue(info, val)
+	if err != nil {
+		return errors.Wrap(err, info.Name)
+	}
+
+	if info.Flags&AlignFlag != 0 || alignedArray(info) {
+		return e.align()
+	}
+	return nil
+}
+
+func (e *typeEncoder) rawValue(info TypeInfo, val interface{}) error {
+	if len(info.Children) == 0 {
+		return e.primitive(info, val)
+	}
+
+	switch {
+	case info.Type == "string":
+		if str, ok := val.(string); ok {
+			return e.bytes([]byte(str))
+		}
+		data, err := bytesValue(val)
+		if err != nil {
+			return err
+		}
+		return e.bytes(data)
+
+	case info.Type == "TypelessData":
+		data, err := bytesValue(val)
+		if err != nil {
+			return err
+		}
+		return e.bytes(data)
+
+	case isPPtr(info):
+		ptr, err := pptrValue(val)
+		if err != nil {
+			return err
+		}
+		err = e.write(ptr.FileID)
+		if err != nil {
+			return err
+		}
+		if info.Children[1].Size == 8 {
+			return e.write(ptr.PathID)
+		}
+		return e.write(int32(ptr.PathID))
+
+	case isArray(info):
+		return e.array(info.Children[0], val)
+
+	case info.IsArray != 0:
+		return e.array(info, val)
+	}
+
+	for _, child := range info.Children {
+		field, err := fieldValue(val, child.Name)
+		if err != nil {
+			return err
+		}
+		err = e.value(child, field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *typeEncoder) array(info TypeInfo, val interface{}) error {
+	if len(info.Children) != 2 {
+		return errors.Errorf("unexpected array layout of %v", info.Type)
+	}
+
+	elem := info.Children[1]
+	if isByte(elem) {
+		if _, ok := val.([]interface{}); !ok {
+			data, err := bytesValue(val)
+			if err != nil {
+				return err
+			}
+			return e.bytes(data)
+		}
+	}
+
+	list, ok := val.([]interface{})
+	if !ok {
+		return errors.Errorf("array expected, got %T", val)
+	}
+
+	err := e.write(int32(len(list)))
+	if err != nil {
+		return err
+	}
+	for i, item := range list {
+		err = e.value(elem, item)
+		if err != nil {
+			return errors.Wrapf(err, "[%v]", i)
+		}
+	}
+	return nil
+}
+
+func (e *typeEncoder) primitive(info TypeInfo, val interface{}) error {
+	var err error
+	var i int64
+	var u uint64
+	var f float64
+
+	switch info.Type {
+	case "SInt8", "SInt16", "short", "SInt32", "int", "SInt64", "long long":
+		i, err = intValue(val)
+	case "UInt8", "char", "UInt16", "unsigned short", "UInt32", "unsigned int", "Type*",
+		"UInt64", "unsigned long long", "FileSize":
+		u, err = uintValue(val)
+	case "float", "double":
+		f, err = floatValue(val)
+	case "bool":
+		b, ok := val.(bool)
+		if !ok {
+			return errors.Errorf("bool expected, got %T", val)
+		}
+		return e.write(b)
+	default:
+		return errors.Errorf("unsupported type %v", info.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	var out interface{}
+	switch info.Type {
+	case "SInt8":
+		out, err = int8(i), intInRange(i, 8)
+	case "SInt16", "short":
+		out, err = int16(i), intInRange(i, 16)
+	case "SInt32", "int":
+		out, err = int32(i), intInRange(i, 32)
+	case "SInt64", "long long":
+		out = i
+	case "UInt8", "char":
+		out, err = uint8(u), uintInRange(u, 8)
+	case "UInt16", "unsigned short":
+		out, err = uint16(u), uintInRange(u, 16)
+	case "UInt32", "unsigned int", "Type*":
+		out, err = uint32(u), uintInRange(u, 32)
+	case "float":
+		if !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32 {
+			err = errors.Errorf("%v is out of float range", f)
+		}
+		out = float32(f)
+	case "double":
+		out = f
+	default:
+		out = u
+	}
+	if err != nil {
+		return err
+	}
+	return e.write(out)
+}
+
+func intInRange(i int64, bits uint) error {
+	if i < -1<<(bits-1) || i >= 1<<(bits-1) {
+		return errors.Errorf("%v is out of %v-bit integer range", i, bits)
+	}
+	return nil
+}
+
+func uintInRange(u uint64, bits uint) error {
+	if u >= 1<<bits {
+		return errors.Errorf("%v is out of %v-bit unsigned range", u, bits)
+	}
+	return nil
+}
+
+func fieldValue(val interface{}, name string) (interface{}, error) {
+	var (
+		ret interface{}
+		ok  bool
+	)
+	switch v := val.(type) {
+	case *Struct:
+		ret, ok = v.Get(name)
+	case map[string]interface{}:
+		ret, ok = v[name]
+	default:
+		return nil, errors.Errorf("structure expected, got %T", val)
+	}
+	if !ok {
+		return nil, errors.Errorf("field %v is missing", name)
+	}
+	return ret, nil
+}
+
+func bytesValue(val interface{}) ([]byte, error) {
+	switch v := val.(type) {
+	case Bytes:
+		return v, nil
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case map[string]interface{}:
+		if str, ok := v["base64"].(string); ok {
+			return base64.StdEncoding.DecodeString(str)
+		}
+	case []interface{}:
+		ret := make([]byte, len(v))
+		for i, item := range v {
+			b, err := uintValue(item)
+			if err != nil {
+				return nil, err
+			}
+			ret[i] = byte(b)
+		}
+		return ret, nil
+	}
+	return nil, errors.Errorf("bytes expected, got %T", val)
+}
+
+func pptrValue(val interface{}) (PPtr, error) {
+	if ptr, ok := val.(PPtr); ok {
+		return ptr, nil
+	}
+
+	fileID, err := fieldValue(val, "m_FileID")
+	if err != nil {
+		return PPtr{}, err
+	}
+	pathID, err := fieldValue(val, "m_PathID")
+	if err != nil {
+		return PPtr{}, err
+	}
+
+	var ret PPtr
+	id, err := intValue(fileID)
+	if err != nil {
+		return PPtr{}, err
+	}
+	ret.FileID = int32(id)
+	ret.PathID, err = intValue(pathID)
+	return ret, err
+}
+
+func intValue(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case int8:
+		return int64(v), nil
+	case int16:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint8, uint16, uint32, uint64, uint:
+		u, err := uintValue(v)
+		if err == nil && u > math.MaxInt64 {
+			err = errors.Errorf("%v is out of integer range", u)
+		}
+		return int64(u), err
+	case json.Number:
+		return v.Int64()
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, errors.Errorf("integer expected, got %v", v)
+		}
+		return int64(v), nil
+	}
+	return 0, errors.Errorf("integer expected, got %T", val)
+}
+
+func uintValue(val interface{}) (uint64, error) {
+	switch v := val.(type) {
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case uint:
+		return uint64(v), nil
+	case json.Number:
+		if strings.HasPrefix(string(v), "-") {
+			return 0, errors.Errorf("unsigned integer expected, got %v", v)
+		}
+		return strconv.ParseUint(string(v), 10, 64)
+	default:
+		i, err := intValue(v)
+		if err == nil && i < 0 {
+			err = errors.Errorf("unsigned integer expected, got %v", i)
+		}
+		return uint64(i), err
+	}
+}
+
+func floatValue(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case json.Number:
+		return v.Float64()
+	case string:
+		// Non-finite values, see marshalValue
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return 0, errors.Errorf("number expected, got %q", v)
+		}
+		return f, nil
+	default:
+		i, err := intValue(v)
+		return float64(i), err
+	}
+}
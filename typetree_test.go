@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func leafType(typ, name string, size uint32) TypeInfo {
+	return TypeInfo{Type: typ, Name: name, Size: size}
+}
+
+func structType(typ, name string, children ...TypeInfo) TypeInfo {
+	return TypeInfo{Type: typ, Name: name, Children: children}
+}
+
+func alignedType(info TypeInfo) TypeInfo {
+	info.Flags |= AlignFlag
+	return info
+}
+
+func vectorType(name string, elem TypeInfo) TypeInfo {
+	elem.Name = "data"
+	array := TypeInfo{Type: "Array", Name: "Array", IsArray: 1, Flags: AlignFlag, Children: []TypeInfo{
+		leafType("int", "size", 4),
+		elem,
+	}}
+	return structType("vector", name, array)
+}
+
+func stringType(name string) TypeInfo {
+	info := vectorType(name, leafType("char", "data", 1))
+	info.Type = "string"
+	return info
+}
+
+func pptrType(name string, idSize uint32) TypeInfo {
+	id := leafType("SInt64", "m_PathID", 8)
+	if idSize == 4 {
+		id = leafType("int", "m_PathID", 4)
+	}
+	return structType("PPtr<Object>", name, leafType("int", "m_FileID", 4), id)
+}
+
+// Serializes the values one after another with the byte order.
+func packed(order binary.ByteOrder, vals ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, val := range vals {
+		if data, ok := val.([]byte); ok {
+			buf.Write(data)
+			continue
+		}
+		binary.Write(&buf, order, val)
+	}
+	return buf.Bytes()
+}
+
+var le = binary.LittleEndian
+
+var typeTreeCases = []struct {
+	name  string
+	info  TypeInfo
+	order binary.ByteOrder
+	data  []byte
+	value interface{}
+}{
+	{
+		name: "primitives",
+		info: structType("Test", "Base",
+			leafType("SInt8", "i8", 1),
+			leafType("UInt8", "u8", 1),
+			leafType("SInt16", "i16", 2),
+			leafType("unsigned int", "u32", 4),
+			leafType("SInt64", "i64", 8),
+			leafType("float", "f32", 4),
+			leafType("double", "f64", 8),
+			leafType("bool", "b", 1),
+		),
+		order: le,
+		data:  packed(le, int8(-2), uint8(200), int16(-300), uint32(70000), int64(-1<<40), float32(1.5), float64(-2.25), true),
+		value: &Struct{Type: "Test", Fields: []Field{
+			{"i8", int8(-2)},
+			{"u8", uint8(200)},
+			{"i16", int16(-300)},
+			{"u32", uint32(70000)},
+			{"i64", int64(-1 << 40)},
+			{"f32", float32(1.5)},
+			{"f64", float64(-2.25)},
+			{"b", true},
+		}},
+	},
+	{
+		name: "big endian",
+		info: structType("Test", "Base",
+			leafType("UInt16", "u16", 2),
+			leafType("int", "i32", 4),
+		),
+		order: binary.BigEndian,
+		data:  []byte{0x12, 0x34, 0xff, 0xff, 0xff, 0xfe},
+		value: &Struct{Type: "Test", Fields: []Field{{"u16", uint16(0x1234)}, {"i32", int32(-2)}}},
+	},
+	{
+		name: "alignment",
+		info: structType("Test", "Base",
+			alignedType(leafType("bool", "flag", 1)),
+			leafType("int", "after", 4),
+		),
+		order: le,
+		data:  packed(le, true, []byte{0, 0, 0}, int32(7)),
+		value: &Struct{Type: "Test", Fields: []Field{{"flag", true}, {"after", int32(7)}}},
+	},
+	{
+		name: "strings",
+		info: structType("Test", "Base",
+			stringType("m_Name"),
+			stringType("m_Raw"),
+			leafType("int", "after", 4),
+		),
+		order: le,
+		data:  packed(le, int32(3), []byte("abc\x00"), int32(2), []byte{0xff, 0xfe, 0, 0}, int32(1)),
+		value: &Struct{Type: "Test", Fields: []Field{
+			{"m_Name", "abc"},
+			{"m_Raw", Bytes{0xff, 0xfe}},
+			{"after", int32(1)},
+		}},
+	},
+	{
+		name: "arrays",
+		info: structType("Test", "Base",
+			vectorType("m_Bytes", leafType("UInt8", "data", 1)),
+			vectorType("m_Ints", leafType("int", "data", 4)),
+			vectorType("m_Empty", leafType("float", "data", 4)),
+		),
+		order: le,
+		data:  packed(le, int32(5), []byte{1, 2, 3, 4, 5, 0, 0, 0}, int32(2), int32(-1), int32(9), int32(0)),
+		value: &Struct{Type: "Test", Fields: []Field{
+			{"m_Bytes", Bytes{1, 2, 3, 4, 5}},
+			{"m_Ints", []interface{}{int32(-1), int32(9)}},
+			{"m_Empty", []interface{}{}},
+		}},
+	},
+	{
+		name: "map",
+		info: structType("Test", "Base",
+			vectorType("m_Container", structType("pair", "data",
+				stringType("first"),
+				leafType("int", "second", 4),
+			)),
+		),
+		order: le,
+		data:  packed(le, int32(2), int32(1), []byte("a\x00\x00\x00"), int32(10), int32(2), []byte("bc\x00\x00"), int32(20)),
+		value: &Struct{Type: "Test", Fields: []Field{
+			{"m_Container", []interface{}{
+				&Struct{Type: "pair", Fields: []Field{{"first", "a"}, {"second", int32(10)}}},
+				&Struct{Type: "pair", Fields: []Field{{"first", "bc"}, {"second", int32(20)}}},
+			}},
+		}},
+	},
+	{
+		name: "references",
+		info: structType("Test", "Base",
+			pptrType("m_Wide", 8),
+			pptrType("m_Narrow", 4),
+			vectorType("m_List", pptrType("data", 8)),
+		),
+		order: le,
+		data:  packed(le, int32(1), int64(-5), int32(0), int32(42), int32(1), int32(2), int64(1<<40)),
+		value: &Struct{Type: "Test", Fields: []Field{
+			{"m_Wide", PPtr{FileID: 1, PathID: -5}},
+			{"m_Narrow", PPtr{FileID: 0, PathID: 42}},
+			{"m_List", []interface{}{PPtr{FileID: 2, PathID: 1 << 40}}},
+		}},
+	},
+	{
+		name: "typeless data",
+		info: structType("Test", "Base",
+			structType("TypelessData", "image data", leafType("int", "size", 4), leafType("UInt8", "data", 1)),
+		),
+		order: le,
+		data:  packed(le, int32(3), []byte{7, 8, 9}),
+		value: &Struct{Type: "Test", Fields: []Field{{"image data", Bytes{7, 8, 9}}}},
+	},
+}
+
+func TestDecodeValue(t *testing.T) {
+	for _, c := range typeTreeCases {
+		t.Run(c.name, func(t *testing.T) {
+			val, err := DecodeValue(bytes.NewReader(c.data), c.info, c.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(val, c.value) {
+				t.Errorf("decoded %v\nexpected %v", dump(val), dump(c.value))
+			}
+		})
+	}
+}
+
+func TestDecodeValueErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		info TypeInfo
+		data []byte
+	}{
+		{"truncated", structType("Test", "Base", leafType("int", "a", 4)), []byte{1, 2}},
+		{"negative size", vectorType("m_Ints", leafType("int", "data", 4)), packed(le, int32(-1))},
+		{"string past the end", stringType("m_Name"), packed(le, int32(10), []byte("abc"))},
+		{"unknown type", structType("Test", "Base", leafType("half", "a", 2)), []byte{1, 2}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := DecodeValue(bytes.NewReader(c.data), c.info, le)
+			if err == nil {
+				t.Error("error expected")
+			}
+		})
+	}
+}
+
+func TestDecodeSized(t *testing.T) {
+	info := structType("Test", "Base", leafType("int", "a", 4), vectorType("m_Ints", leafType("int", "data", 4)))
+	data := packed(le, int32(1), int32(2), int32(3), int32(4))
+	val, err := decodeSized(bytes.NewReader(data), int64(len(data)), info, le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Struct{Type: "Test", Fields: []Field{{"a", int32(1)}, {"m_Ints", []interface{}{int32(3), int32(4)}}}}
+	if !reflect.DeepEqual(val, expected) {
+		t.Errorf("decoded %v\nexpected %v", dump(val), dump(expected))
+	}
+
+	named := structType("Test", "Base", leafType("int", "a", 4), stringType("m_Name"))
+	cases := []struct {
+		name string
+		info TypeInfo
+		data []byte
+	}{
+		// Field unknown to the type tree
+		{"trailing data", info, append(data, 5, 6, 7, 8)},
+		{"huge array", info, packed(le, int32(1), int32(math.MaxInt32), int32(3))},
+		{"huge string", named, packed(le, int32(1), int32(math.MaxInt32), []byte("abc"))},
+	}
+	for _, c := range cases {
+		_, err := decodeSized(bytes.NewReader(c.data), int64(len(c.data)), c.info, le)
+		if err == nil {
+			t.Errorf("%v: error expected", c.name)
+		}
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	for _, c := range typeTreeCases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := EncodeValue(&buf, c.info, c.order, c.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), c.data) {
+				t.Errorf("encoded % x\nexpected % x", buf.Bytes(), c.data)
+			}
+		})
+	}
+}
+
+// Values edited as JSON are encoded back to the same data.
+func TestEncodeJSONValue(t *testing.T) {
+	for _, c := range typeTreeCases {
+		t.Run(c.name, func(t *testing.T) {
+			data, err := json.Marshal(c.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			val, err := ParseJSONValue(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			err = EncodeValue(&buf, c.info, c.order, val)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), c.data) {
+				t.Errorf("encoded % x\nexpected % x\nfrom %s", buf.Bytes(), c.data, data)
+			}
+		})
+	}
+}
+
+func TestEncodeValueErrors(t *testing.T) {
+	cases := []struct {
+		name  string
+		info  TypeInfo
+		value interface{}
+	}{
+		{"missing field", structType("Test", "Base", leafType("int", "a", 4)), map[string]interface{}{"b": 1}},
+		{"not a number", structType("Test", "Base", leafType("int", "a", 4)), map[string]interface{}{"a": "x"}},
+		{"not an array", vectorType("m_Ints", leafType("int", "data", 4)), int32(1)},
+		{"not a bool", leafType("bool", "b", 1), 1},
+		{"UInt8 overflow", structType("Test", "Base", leafType("UInt8", "m_Flags", 1)), map[string]interface{}{"m_Flags": json.Number("300")}},
+		{"negative unsigned", structType("Test", "Base", leafType("unsigned int", "m_Flags", 4)), map[string]interface{}{"m_Flags": json.Number("-1")}},
+		{"negative Go unsigned", structType("Test", "Base", leafType("UInt16", "m_Flags", 2)), map[string]interface{}{"m_Flags": -1}},
+		{"SInt8 underflow", structType("Test", "Base", leafType("SInt8", "m_Flags", 1)), map[string]interface{}{"m_Flags": json.Number("-129")}},
+		{"int overflow", structType("Test", "Base", leafType("int", "m_Flags", 4)), map[string]interface{}{"m_Flags": int64(1 << 31)}},
+		{"SInt64 overflow", structType("Test", "Base", leafType("SInt64", "m_Flags", 8)), map[string]interface{}{"m_Flags": uint64(1 << 63)}},
+		{"float overflow", structType("Test", "Base", leafType("float", "m_Flags", 4)), map[string]interface{}{"m_Flags": 1e39}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := EncodeValue(ioutil.Discard, c.info, le, c.value)
+			if err == nil {
+				t.Fatal("error expected")
+			}
+			if c.info.Type == "Test" && !strings.Contains(err.Error(), c.info.Children[0].Name) {
+				t.Errorf("field name is missing in %q", err)
+			}
+		})
+	}
+}
+
+// NaN and infinities are not valid JSON numbers, but must survive export-json and import-json.
+func TestNonFiniteJSON(t *testing.T) {
+	info := structType("Test", "Base",
+		leafType("float", "nan32", 4),
+		leafType("double", "nan64", 8),
+		vectorType("m_Floats", leafType("float", "data", 4)),
+	)
+	data := packed(le, math.Float32frombits(0x7fc00000), math.NaN(), int32(3),
+		float32(math.Inf(1)), float32(math.Inf(-1)), float32(0.5))
+
+	val, err := DecodeValue(bytes.NewReader(data), info, le)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := json.Marshal(val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseJSONValue(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = EncodeValue(&buf, info, le, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("encoded % x\nexpected % x\nfrom %s", buf.Bytes(), data, text)
+	}
+}
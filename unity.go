@@ -7,16 +7,20 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"log"
+	"math"
 	"os"
+	"path"
 	"reflect"
+	"strconv"
 	"strings"
 )
 
 const (
-	// All the actual shadowrun builds seem to have version 9 of asset file.
-	// This implementation consider compatible versions only.
+	// All the actual shadowrun builds seem to have version 9 of asset file,
+	// later ones are supported for the sake of other unity games.
+	// Versions before 9 store metadata at the end of file and are not supported.
 	VersionMin = 9
-	VersionMax = 9
+	VersionMax = 22
 )
 
 /* See https://github.com/HearthSim/UnityPack/wiki/Format-Documentation for unity assets format specs.
@@ -31,48 +35,183 @@ struct {
 
 type Header struct {
 	MetaSize   uint32
-	FileSize   uint32
+	FileSize   uint64
 	Version    uint32
-	DataOffset uint32
+	DataOffset uint64
 	ByteOrder  uint8
 	// padding
 	Reserved [3]uint8 `json:"-"`
 }
 
+// Header is always big endian and starts with the same fields in all versions,
+// but version 22+ moves the sizes to 64-bit fields after the byte order flag.
+type legacyHeader struct {
+	MetaSize   uint32
+	FileSize   uint32
+	Version    uint32
+	DataOffset uint32
+}
+
+type largeHeader struct {
+	MetaSize   uint32
+	FileSize   uint64
+	DataOffset uint64
+	Unknown    uint64
+}
+
+func (h Header) Serialize(w io.Writer, order binary.ByteOrder, cString bool) error {
+	legacy := legacyHeader{Version: h.Version}
+	if h.Version < 22 {
+		legacy.MetaSize = h.MetaSize
+		legacy.FileSize = uint32(h.FileSize)
+		legacy.DataOffset = uint32(h.DataOffset)
+	}
+
+	err := write(w, legacy, order, cString)
+	if err != nil {
+		return err
+	}
+
+	err = write(w, h.ByteOrder, order, cString)
+	if err != nil {
+		return err
+	}
+	err = write(w, h.Reserved, order, cString)
+	if err != nil {
+		return err
+	}
+
+	if h.Version < 22 {
+		return nil
+	}
+
+	return write(w, largeHeader{
+		MetaSize:   h.MetaSize,
+		FileSize:   h.FileSize,
+		DataOffset: h.DataOffset,
+	}, order, cString)
+}
+
+func (h *Header) Deserialize(r io.ReadSeeker, order binary.ByteOrder, cString bool) error {
+	var legacy legacyHeader
+	err := read(r, &legacy, order, cString)
+	if err != nil {
+		return err
+	}
+
+	*h = Header{
+		MetaSize:   legacy.MetaSize,
+		FileSize:   uint64(legacy.FileSize),
+		Version:    legacy.Version,
+		DataOffset: uint64(legacy.DataOffset),
+	}
+
+	// Byte order is stored at the end of file for the older versions
+	if h.Version < 9 {
+		return nil
+	}
+
+	err = read(r, &h.ByteOrder, order, cString)
+	if err != nil {
+		return err
+	}
+	err = read(r, &h.Reserved, order, cString)
+	if err != nil {
+		return err
+	}
+
+	if h.Version < 22 {
+		return nil
+	}
+
+	var large largeHeader
+	err = read(r, &large, order, cString)
+	if err != nil {
+		return err
+	}
+	h.MetaSize = large.MetaSize
+	h.FileSize = large.FileSize
+	h.DataOffset = large.DataOffset
+
+	return nil
+}
+
+// Size of the serialized header
+func (h Header) Size() int64 {
+	if h.Version >= 22 {
+		return 48
+	}
+	return 20
+}
+
 type MetaData struct {
-	TypeInfo  TypesHeader
-	Objects   []Object
+	TypeInfo TypesHeader
+	Objects  []Object
+	// Version 11+
+	Scripts   []ScriptType `json:",omitempty"`
 	Externals []External
+	// Version 20+
+	RefTypes        []Class `json:",omitempty"`
+	UserInformation string  `json:",omitempty"`
 }
 
+// Actually it's unity version the file was built with, e.g. 4.5.5f1
 type Signature string
 
 func (s Signature) Serialize(w io.Writer, order binary.ByteOrder, cString bool) error {
-	var buf [8]byte
-	copy(buf[:], []byte(s))
-	return write(w, buf, order, cString)
+	return write(w, string(s), order, true)
 }
 
 func (s *Signature) Deserialize(r io.ReadSeeker, order binary.ByteOrder, cString bool) error {
-	var buf [8]byte
-	err := read(r, &buf, order, cString)
+	var str string
+	err := read(r, &str, order, true)
 	if err != nil {
 		return err
 	}
-	*s = Signature(strings.TrimRight(string(buf[:]), "\x00"))
+	*s = Signature(str)
 	return nil
 }
 
+// Returns major and minor parts of the version, zeros if the signature can't be parsed.
+func (s Signature) Version() (major, minor int) {
+	parts := strings.SplitN(string(s), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0
+	}
+	minor, _ = strconv.Atoi(parts[1])
+	return major, minor
+}
+
 type TypesHeader struct {
 	Signature Signature
 	Platform  uint32
-	Classes   []Class
-	Unknown   uint32
+	// Version 13+, type trees are always there before
+	EnableTypeTree bool
+	Classes        []Class
+	// Versions 7-13 only, 64-bit path IDs are always used after
+	BigIDEnabled uint32
 }
 
 type Class struct {
-	ID   uint32
-	Info TypeInfo
+	ID uint32
+	// Version 16+
+	IsStripped uint8 `json:",omitempty"`
+	// Version 17+, index in MetaData.Scripts
+	ScriptTypeIndex int16 `json:",omitempty"`
+	// Version 13+, ScriptID is presented for the script types only
+	ScriptID GUID `json:",omitempty"`
+	TypeHash GUID `json:",omitempty"`
+	Info     TypeInfo
+	// Version 21+
+	Dependencies []uint32 `json:",omitempty"`
+	// Version 21+, reference types only
+	ClassName string `json:",omitempty"`
+	NameSpace string `json:",omitempty"`
+	AsmName   string `json:",omitempty"`
 }
 
 type TypeInfo struct {
@@ -84,15 +223,30 @@ type TypeInfo struct {
 	Version  uint32
 	Flags    uint32
 	Children []TypeInfo
+	// Version 19+
+	RefTypeHash uint64 `json:",omitempty"`
 }
 
 type Object struct {
-	ID        uint32
-	Shift     uint32
+	ID        uint64
+	Shift     uint64
 	Size      uint32
 	TypeID    uint32
 	ClassID   uint16
 	Destroyed uint16
+	// Versions 11-16
+	ScriptTypeIndex int16 `json:",omitempty"`
+	// Versions 15-16
+	Stripped uint8 `json:",omitempty"`
+	// Version 16+ stores index in TypeInfo.Classes instead of TypeID,
+	// TypeID and ClassID are filled from the class on read.
+	TypeIndex uint32 `json:",omitempty"`
+}
+
+// Local reference to a MonoScript object.
+type ScriptType struct {
+	FileIndex uint32
+	ID        uint64
 }
 
 type GUID string
@@ -126,32 +280,67 @@ type External struct {
 	FilePath  string
 }
 
+// Returns FileID used by the objects of the assets file to refer objects of another file.
+// Externals are matched by the file name only.
+func (r *AssetsReader) ExternalFileID(file string) (uint32, bool) {
+	name := strings.ToLower(path.Base(file))
+	for i, ext := range r.MetaData.Externals {
+		if strings.ToLower(path.Base(strings.TrimPrefix(ext.FilePath, archivePrefix))) == name {
+			// Zero is the file itself
+			return uint32(i + 1), true
+		}
+	}
+	return 0, false
+}
+
 type AssetsReader struct {
-	fd *os.File
+	fd     readSeekerAt
+	closer io.Closer
+
+	// Location of the file, used to resolve external resources.
+	// Path is empty for readers created by NewAssetsReaderFrom.
+	Path   string
+	bundle *Bundle
+	// Opened .resS/.resource files, see StreamData
+	streams map[string]readSeekerAt
+	// Opened external assets by FileID, see External
+	externals map[uint32]*AssetsReader
+	// Index of MetaData.Objects by id, see FindObject
+	objectIndex map[uint64]int
 
 	Order    binary.ByteOrder
 	Header   Header
 	MetaData MetaData
 }
 
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
 func NewAssetsReader(file string) (*AssetsReader, error) {
-	var (
-		err error
-		ret AssetsReader
-	)
-	ret.fd, err = os.Open(file)
+	fd, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 
-	success := false
-	defer func() {
-		if !success {
-			ret.fd.Close()
-		}
-	}()
+	ret, err := NewAssetsReaderFrom(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	ret.closer = fd
+	ret.Path = file
+	return ret, nil
+}
+
+// Reads assets from an arbitrary source, e.g. a file inside a bundle.
+// Closing of the source is up to the caller.
+func NewAssetsReaderFrom(src readSeekerAt) (*AssetsReader, error) {
+	ret := AssetsReader{fd: src}
 
-	err = ret.read(&ret.Header, binary.BigEndian)
+	err := ret.read(&ret.Header, binary.BigEndian)
 	if err != nil {
 		return nil, err
 	}
@@ -166,19 +355,36 @@ func NewAssetsReader(file string) (*AssetsReader, error) {
 		ret.Order = binary.BigEndian
 	}
 
-	err = ret.read(&ret.MetaData, ret.Order)
+	err = ret.MetaData.read(ret.fd, ret.Order, ret.Header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read metadata")
+	}
 
-	success = true
 	return &ret, nil
 }
 
 func (r *AssetsReader) Close() error {
-	return r.fd.Close()
+	for _, s := range r.streams {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	r.streams = nil
+
+	for _, ext := range r.externals {
+		ext.Close()
+	}
+	r.externals = nil
+
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
 }
 
 func (r *AssetsReader) RangeObjects(f func(desc Object, r io.ReadSeeker) error) error {
 	for _, obj := range r.MetaData.Objects {
-		err := f(obj, io.NewSectionReader(r.fd, int64(r.Header.DataOffset+obj.Shift), int64(obj.Size)))
+		err := f(obj, r.ObjectReader(obj))
 		if err != nil {
 			return err
 		}
@@ -217,7 +423,9 @@ func readVal(r io.ReadSeeker, val reflect.Value, order binary.ByteOrder, cString
 	}
 
 	switch val.Kind() {
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
 		return binary.Read(r, order, val.Addr().Interface())
 
 	case reflect.Struct:
@@ -343,7 +551,9 @@ func writeVal(w io.Writer, val reflect.Value, order binary.ByteOrder, cString bo
 	}
 
 	switch val.Kind() {
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
 		return binary.Write(w, order, val.Interface())
 
 	case reflect.Struct:
@@ -417,24 +627,26 @@ func writeVal(w io.Writer, val reflect.Value, order binary.ByteOrder, cString bo
 type CustomObject struct {
 	TypeID  uint32
 	ClassID uint16
-	Data    []byte
+	// Version 16+, index in TypesHeader.Classes, see TypesHeader.classIndex
+	TypeIndex uint32
+	Data      []byte
 }
 
 type ReplacementObject struct {
 	CustomObject
-	TargetID uint32
+	TargetID uint64
 }
 
 func CreateModifiedAssets(
 	path string, src *AssetsReader,
-	add []CustomObject, replace []ReplacementObject, remove []uint32,
-) (maxID uint32, err error) {
-	deleteMap := make(map[uint32]struct{})
+	add []CustomObject, replace []ReplacementObject, remove []uint64,
+) (maxID uint64, err error) {
+	deleteMap := make(map[uint64]struct{})
 	for _, del := range remove {
 		deleteMap[del] = struct{}{}
 	}
 
-	replaceMap := make(map[uint32]CustomObject)
+	replaceMap := make(map[uint64]CustomObject)
 	for _, rep := range replace {
 		if _, ok := deleteMap[rep.TargetID]; ok {
 			return 0, errors.Errorf("targetID %v is presented in both replace and delete lists", rep.TargetID)
@@ -442,7 +654,7 @@ func CreateModifiedAssets(
 		replaceMap[rep.TargetID] = rep.CustomObject
 	}
 
-	fd, err := os.Create(path)
+	fd, err := CreateOutput(path)
 	if err != nil {
 		return 0, err
 	}
@@ -455,7 +667,15 @@ func CreateModifiedAssets(
 	meta := src.MetaData
 	meta.Objects = make([]Object, 0, len(meta.Objects)+len(add)-len(remove))
 
-	var dataSize uint32 = 0
+	// New objects get ids above all the original ones, including removed,
+	// so stale references from other files never point to them
+	for _, obj := range src.MetaData.Objects {
+		if obj.ID > maxID {
+			maxID = obj.ID
+		}
+	}
+
+	var dataSize uint64 = 0
 	for _, obj := range src.MetaData.Objects {
 		// ignore deleted object
 		if _, ok := deleteMap[obj.ID]; ok {
@@ -471,22 +691,20 @@ func CreateModifiedAssets(
 		// @TODO align?
 		obj.Shift = dataSize
 		meta.Objects = append(meta.Objects, obj)
-		dataSize += align(uint32(obj.Size), 8)
-		if obj.ID > maxID {
-			maxID = obj.ID
-		}
+		dataSize += align64(uint64(obj.Size), 8)
 	}
 
 	for _, obj := range add {
 		maxID++
 		meta.Objects = append(meta.Objects, Object{
-			ID:      maxID,
-			Shift:   dataSize,
-			Size:    uint32(len(obj.Data)),
-			TypeID:  obj.TypeID,
-			ClassID: obj.ClassID,
+			ID:        maxID,
+			Shift:     dataSize,
+			Size:      uint32(len(obj.Data)),
+			TypeID:    obj.TypeID,
+			ClassID:   obj.ClassID,
+			TypeIndex: obj.TypeIndex,
 		})
-		dataSize += align(uint32(len(obj.Data)), 8)
+		dataSize += align64(uint64(len(obj.Data)), 8)
 	}
 
 	// Just to reserve enough space, we will revisit it later
@@ -505,7 +723,7 @@ func CreateModifiedAssets(
 		order = binary.BigEndian
 	}
 
-	err = write(fd, meta, order, true)
+	err = meta.write(&alignWriter{w: fd, pos: metaOffset}, order, header)
 	if err != nil {
 		return 0, err
 	}
@@ -516,7 +734,7 @@ func CreateModifiedAssets(
 	}
 
 	header.MetaSize = uint32(dataOffset - metaOffset)
-	header.DataOffset = align(uint32(dataOffset), 8)
+	header.DataOffset = align64(uint64(dataOffset), 8)
 	header.FileSize = header.DataOffset + dataSize
 
 	_, err = fd.Seek(0, 0)
@@ -571,7 +789,7 @@ func CreateModifiedAssets(
 		}
 	}
 
-	return maxID, fd.Close()
+	return maxID, fd.Commit()
 }
 
 func writeAlign(w io.Writer, size, line int) error {
@@ -586,9 +804,44 @@ func align(raw, line uint32) uint32 {
 	return (raw + line - 1) / line * line
 }
 
+func align64(raw, line uint64) uint64 {
+	return (raw + line - 1) / line * line
+}
+
 type ObjectReference struct {
 	FileID uint32
-	PathID uint32
+	// 32-bit before version 14
+	PathID int64
+}
+
+func (ref *ObjectReference) read(r io.ReadSeeker, order binary.ByteOrder, version uint32) error {
+	err := read(r, &ref.FileID, order, false)
+	if err != nil {
+		return err
+	}
+
+	if version >= 14 {
+		return read(r, &ref.PathID, order, false)
+	}
+	var id int32
+	err = read(r, &id, order, false)
+	ref.PathID = int64(id)
+	return err
+}
+
+func (ref ObjectReference) write(w io.Writer, order binary.ByteOrder, version uint32) error {
+	err := write(w, ref.FileID, order, false)
+	if err != nil {
+		return err
+	}
+
+	if version >= 14 {
+		return write(w, ref.PathID, order, false)
+	}
+	if ref.PathID > math.MaxInt32 || ref.PathID < math.MinInt32 {
+		return errors.Errorf("path id %v doesn't fit version %v files", ref.PathID, version)
+	}
+	return write(w, int32(ref.PathID), order, false)
 }
 
 type NamedReference struct {
@@ -596,10 +849,140 @@ type NamedReference struct {
 	Object ObjectReference
 }
 
+const ResourceManagerTypeID = 147
+
 type ResourceManager struct {
 	Resources []NamedReference
-	Dependent []struct {
-		Object       ObjectReference
-		Dependencies []ObjectReference
+	Dependent []ResourceDependencies
+}
+
+type ResourceDependencies struct {
+	Object       ObjectReference
+	Dependencies []ObjectReference
+}
+
+// Reads the resource manager from the assets file(normally mainData).
+// Returned replacement object targets the manager and has no data, see ResourceManager.Bytes.
+func ReadResourceManager(assets *AssetsReader) (ResourceManager, ReplacementObject, error) {
+	var res ResourceManager
+	var obj ReplacementObject
+	found := false
+	err := assets.RangeObjects(func(desc Object, r io.ReadSeeker) error {
+		if desc.TypeID != ResourceManagerTypeID {
+			return nil
+		}
+		found = true
+		obj.TargetID = desc.ID
+		obj.TypeID = desc.TypeID
+		obj.ClassID = desc.ClassID
+		return res.read(r, assets.Order, assets.Header.Version)
+	})
+	if err != nil {
+		return res, obj, err
+	}
+	if !found {
+		return res, obj, errors.New("resources manager data not found")
+	}
+	return res, obj, nil
+}
+
+// Looks up the object loaded by Resources.Load(name), names are case insensitive.
+func (res ResourceManager) Find(name string) (ObjectReference, bool) {
+	for _, r := range res.Resources {
+		if strings.EqualFold(r.Name, name) {
+			return r.Object, true
+		}
+	}
+	return ObjectReference{}, false
+}
+
+// Serializes the manager for the assets file of the given version, see ReadResourceManager.
+func (res ResourceManager) Bytes(order binary.ByteOrder, version uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	err := res.write(&buf, order, version)
+	return buf.Bytes(), err
+}
+
+// Path ids of the references depend on the file version, so the reflection based read can't be used.
+func (res *ResourceManager) read(r io.ReadSeeker, order binary.ByteOrder, version uint32) error {
+	var count uint32
+	err := read(r, &count, order, false)
+	if err != nil {
+		return err
+	}
+	res.Resources = make([]NamedReference, count)
+	for i := range res.Resources {
+		err = read(r, &res.Resources[i].Name, order, false)
+		if err != nil {
+			return err
+		}
+		err = res.Resources[i].Object.read(r, order, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = read(r, &count, order, false)
+	if err != nil {
+		return err
+	}
+	res.Dependent = make([]ResourceDependencies, count)
+	for i := range res.Dependent {
+		d := &res.Dependent[i]
+		err = d.Object.read(r, order, version)
+		if err != nil {
+			return err
+		}
+		err = read(r, &count, order, false)
+		if err != nil {
+			return err
+		}
+		d.Dependencies = make([]ObjectReference, count)
+		for j := range d.Dependencies {
+			err = d.Dependencies[j].read(r, order, version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (res ResourceManager) write(w io.Writer, order binary.ByteOrder, version uint32) error {
+	err := write(w, uint32(len(res.Resources)), order, false)
+	if err != nil {
+		return err
 	}
+	for _, r := range res.Resources {
+		err = write(w, r.Name, order, false)
+		if err != nil {
+			return err
+		}
+		err = r.Object.write(w, order, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = write(w, uint32(len(res.Dependent)), order, false)
+	if err != nil {
+		return err
+	}
+	for _, d := range res.Dependent {
+		err = d.Object.write(w, order, version)
+		if err != nil {
+			return err
+		}
+		err = write(w, uint32(len(d.Dependencies)), order, false)
+		if err != nil {
+			return err
+		}
+		for _, dep := range d.Dependencies {
+			err = dep.write(w, order, version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
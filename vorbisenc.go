@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"sort"
+)
+
+/* Simple Vorbis I encoder.
+The setup is fixed and tiny compared to libvorbis:
+	* 2048 samples blocks only, so there is no block switching and pre-echo is not handled;
+	* floor 1 with 34 posts, the floor is the quantization step of the spectrum rather than its envelope;
+	* residue 1 with 16 values partitions and 7 classes by the max absolute value, large values are cascaded;
+	* stereo channels are coupled with the shared floor when it is cheaper, other layouts are not coupled.
+Quality sets the step relative to the energy of the spectrum around each post, which is a crude but working
+replacement of the psychoacoustic model: the noise follows the signal spectrum.
+See https://xiph.org/vorbis/doc/Vorbis_I_spec.html for the format.
+*/
+
+const (
+	vorbisBlockBits = 11
+	vorbisBlockSize = 1 << vorbisBlockBits
+	vorbisSpectrum  = vorbisBlockSize / 2
+
+	vorbisMaxQuality     = 10
+	vorbisDefaultQuality = 5
+
+	vorbisVendor = "shadowed"
+)
+
+// Floor posts, the first two are the implicit ends of the spectrum.
+// The order is used for prediction, so each post is placed between already known ones.
+var vorbisFloorX = []int{
+	0, 1024,
+	512, 256, 768, 128, 384, 640, 896, 64,
+	192, 320, 448, 576, 704, 832, 960, 32,
+	96, 160, 224, 16, 48, 80, 112, 8,
+	24, 40, 56, 4, 12, 20, 2, 6,
+}
+
+const (
+	vorbisFloorMultiplier = 2
+	vorbisFloorRange      = 128
+	vorbisFloorRangeBits  = 10
+	vorbisFloorClassDim   = 4
+
+	vorbisPartitionSize = 16
+	vorbisClasses       = 7
+	vorbisClassDim      = 2
+)
+
+// Residue classes by the max absolute value of the partition, the last class uses three passes.
+var vorbisClassMax = [vorbisClasses]int{0, 1, 2, 4, 8, 16, math.MaxInt32}
+
+// Codebooks, see newVorbisBooks.
+const (
+	vorbisFloorBook = iota
+	vorbisClassBook
+	vorbisBook1
+	vorbisBook2
+	vorbisBook4
+	vorbisBook8
+	vorbisBook16
+	vorbisBook33
+	vorbisBook1089
+)
+
+// Books of each residue class per pass, -1 for unused passes.
+var vorbisResidueBooks = [vorbisClasses][3]int{
+	{-1, -1, -1},
+	{vorbisBook1, -1, -1},
+	{vorbisBook2, -1, -1},
+	{vorbisBook4, -1, -1},
+	{vorbisBook8, -1, -1},
+	{vorbisBook16, -1, -1},
+	{vorbisBook1089, vorbisBook33, vorbisBook16},
+}
+
+// Max absolute value which can be coded by the cascade of the last class, coupling doubles the values.
+const vorbisMaxResidue = 15*1089 + 15*33 + 16
+
+type vorbisCodebook struct {
+	dimensions int
+	lengths    []uint8
+	codes      []uint32
+	// Lookup type 1 books are grids of values minimum + i*delta, i in [0, values)
+	values         int
+	minimum, delta int
+}
+
+// LSB first bit packer of Vorbis packets.
+type vorbisBitWriter struct {
+	buf []byte
+	pos uint
+}
+
+func (w *vorbisBitWriter) Write(val uint64, bits uint) {
+	for i := uint(0); i < bits; i++ {
+		if w.pos == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if val>>i&1 != 0 {
+			w.buf[len(w.buf)-1] |= 1 << w.pos
+		}
+		w.pos = (w.pos + 1) % 8
+	}
+}
+
+func (w *vorbisBitWriter) Bytes() []byte {
+	return w.buf
+}
+
+func newVorbisBooks() []*vorbisCodebook {
+	// Weights of the values are laplacian, steeper for the books of smaller values
+	laplace := func(scale float64) func(v int) float64 {
+		return func(v int) float64 {
+			return math.Exp(-math.Abs(float64(v)) / scale)
+		}
+	}
+
+	floorWeights := make([]float64, vorbisFloorRange)
+	for i := range floorWeights {
+		floorWeights[i] = math.Exp(-float64(i) / 6)
+	}
+
+	classProbs := [vorbisClasses]float64{0.3, 0.2, 0.15, 0.12, 0.1, 0.08, 0.05}
+	classWeights := make([]float64, vorbisClasses*vorbisClasses)
+	for i := range classWeights {
+		classWeights[i] = classProbs[i/vorbisClasses] * classProbs[i%vorbisClasses]
+	}
+
+	return []*vorbisCodebook{
+		vorbisFloorBook: newScalarBook(1, floorWeights),
+		// Entry of the class book is a number of vorbisClassDim classes
+		vorbisClassBook: newScalarBook(vorbisClassDim, classWeights),
+		vorbisBook1:     newGridBook(4, -1, 1, 1, laplace(0.7)),
+		vorbisBook2:     newGridBook(2, -2, 2, 1, laplace(1)),
+		vorbisBook4:     newGridBook(2, -4, 4, 1, laplace(2)),
+		vorbisBook8:     newGridBook(2, -8, 8, 1, laplace(3)),
+		vorbisBook16:    newGridBook(1, -16, 16, 1, laplace(6)),
+		vorbisBook33:    newGridBook(1, -15*33, 15*33, 33, laplace(3)),
+		vorbisBook1089:  newGridBook(1, -15*1089, 15*1089, 1089, laplace(0.5)),
+	}
+}
+
+func newScalarBook(dimensions int, weights []float64) *vorbisCodebook {
+	ret := &vorbisCodebook{dimensions: dimensions, lengths: huffmanLengths(weights)}
+	ret.codes = vorbisCodewords(ret.lengths)
+	return ret
+}
+
+// Creates a lookup type 1 book with values min, min+delta...max in each dimension.
+func newGridBook(dimensions, min, max, delta int, weight func(v int) float64) *vorbisCodebook {
+	values := (max-min)/delta + 1
+	entries := 1
+	for i := 0; i < dimensions; i++ {
+		entries *= values
+	}
+
+	weights := make([]float64, entries)
+	for i := range weights {
+		weights[i] = 1
+		for j, e := 0, i; j < dimensions; j, e = j+1, e/values {
+			weights[i] *= weight((min + e%values*delta) / delta)
+		}
+	}
+
+	ret := &vorbisCodebook{
+		dimensions: dimensions,
+		lengths:    huffmanLengths(weights),
+		values:     values,
+		minimum:    min,
+		delta:      delta,
+	}
+	ret.codes = vorbisCodewords(ret.lengths)
+	return ret
+}
+
+// Builds Huffman code lengths, weights are clamped to keep the lengths reasonable.
+func huffmanLengths(weights []float64) []uint8 {
+	type node struct {
+		weight float64
+		leaves []int
+	}
+
+	max := 0.0
+	for _, w := range weights {
+		max = math.Max(max, w)
+	}
+
+	nodes := make([]node, len(weights))
+	for i, w := range weights {
+		nodes[i] = node{math.Max(w, max/(1<<16)), []int{i}}
+	}
+
+	lengths := make([]uint8, len(weights))
+	for len(nodes) > 1 {
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].weight < nodes[j].weight
+		})
+		a, b := nodes[0], nodes[1]
+		leaves := make([]int, 0, len(a.leaves)+len(b.leaves))
+		leaves = append(append(leaves, a.leaves...), b.leaves...)
+		for _, l := range leaves {
+			lengths[l]++
+		}
+		nodes = append(nodes[2:], node{a.weight + b.weight, leaves})
+	}
+	return lengths
+}
+
+// Assigns codewords the same way decoders do: each entry takes the first free codeword of its length.
+// Codewords are returned MSB first.
+func vorbisCodewords(lengths []uint8) []uint32 {
+	var marker [33]uint32
+	codes := make([]uint32, len(lengths))
+
+	for i, length := range lengths {
+		entry := marker[length]
+		codes[i] = entry
+
+		for j := length; j > 0; j-- {
+			if marker[j]&1 != 0 {
+				if j == 1 {
+					marker[1]++
+				} else {
+					marker[j] = marker[j-1] << 1
+				}
+				break
+			}
+			marker[j]++
+		}
+
+		for j := length + 1; j < 33; j++ {
+			if marker[j]>>1 != entry {
+				break
+			}
+			entry = marker[j]
+			marker[j] = marker[j-1] << 1
+		}
+	}
+	return codes
+}
+
+func (b *vorbisCodebook) WriteHeader(w *vorbisBitWriter) {
+	w.Write(0x564342, 24)
+	w.Write(uint64(b.dimensions), 16)
+	w.Write(uint64(len(b.lengths)), 24)
+	// Not ordered, not sparse
+	w.Write(0, 1)
+	w.Write(0, 1)
+	for _, l := range b.lengths {
+		w.Write(uint64(l-1), 5)
+	}
+
+	if b.values == 0 {
+		w.Write(0, 4)
+		return
+	}
+
+	w.Write(1, 4)
+	w.Write(uint64(vorbisFloat(float64(b.minimum))), 32)
+	w.Write(uint64(vorbisFloat(float64(b.delta))), 32)
+	bits := ilog(uint32(b.values - 1))
+	w.Write(uint64(bits-1), 4)
+	// Sequence flag
+	w.Write(0, 1)
+	for i := 0; i < b.values; i++ {
+		w.Write(uint64(i), uint(bits))
+	}
+}
+
+func (b *vorbisCodebook) WriteEntry(w *vorbisBitWriter, entry int) {
+	code, length := b.codes[entry], uint(b.lengths[entry])
+	for i := length; i > 0; i-- {
+		w.Write(uint64(code>>(i-1)&1), 1)
+	}
+}
+
+// Writes the vector of grid values, the values must be on the grid.
+func (b *vorbisCodebook) WriteVector(w *vorbisBitWriter, vec []int) {
+	entry := 0
+	for i := len(vec) - 1; i >= 0; i-- {
+		entry = entry*b.values + (vec[i]-b.minimum)/b.delta
+	}
+	b.WriteEntry(w, entry)
+}
+
+// Number of bits needed to store the value.
+func ilog(v uint32) int {
+	ret := 0
+	for ; v > 0; v >>= 1 {
+		ret++
+	}
+	return ret
+}
+
+// Packs the value into 32-bit Vorbis float: 21 bits of mantissa, 10 bits of exponent and sign.
+func vorbisFloat(v float64) uint32 {
+	if v == 0 {
+		return 0
+	}
+	var sign uint32
+	if v < 0 {
+		sign = 0x80000000
+		v = -v
+	}
+	exp := int(math.Floor(math.Log2(v)))
+	mant := uint32(math.Round(math.Ldexp(v, 20-exp)))
+	if mant >= 1<<21 {
+		mant >>= 1
+		exp++
+	}
+	return sign | uint32(exp+768)<<21 | mant
+}
+
+type VorbisEncoder struct {
+	channels   int
+	sampleRate int
+	// Quantization step relative to the spectrum energy
+	stepRatio float64
+	// Level of the loudest band below which the others are masked
+	maskRange float64
+	// Spectrum above the cutoff is dropped, it is hardly audible but expensive
+	cutoff int
+
+	books  []*vorbisCodebook
+	window []float64
+	mdct   *mdct
+
+	lowNeighbor, highNeighbor []int
+	// Posts in the order of X
+	sortedPosts []int
+	// Inverse dB table of floor 1
+	floorTable [256]float64
+}
+
+func NewVorbisEncoder(channels, sampleRate, quality int) (*VorbisEncoder, error) {
+	if channels < 1 || channels > 255 {
+		return nil, errors.Errorf("unsupported channels count %v", channels)
+	}
+	if sampleRate < 1 {
+		return nil, errors.Errorf("invalid sample rate %v", sampleRate)
+	}
+	if quality < 0 || quality > vorbisMaxQuality {
+		return nil, errors.Errorf("quality must be in [0, %v], got %v", vorbisMaxQuality, quality)
+	}
+
+	e := &VorbisEncoder{
+		channels:   channels,
+		sampleRate: sampleRate,
+		stepRatio:  2 * math.Pow(0.72, float64(quality)),
+		maskRange:  math.Pow(10, -(25+2.5*float64(quality))/20),
+		cutoff:     minInt((12000+800*quality)*vorbisSpectrum*2/sampleRate, vorbisSpectrum),
+		books:      newVorbisBooks(),
+		window:     make([]float64, vorbisBlockSize),
+		mdct:       newMDCT(vorbisBlockSize),
+	}
+
+	for i := range e.window {
+		s := math.Sin((float64(i) + 0.5) / vorbisBlockSize * math.Pi)
+		e.window[i] = math.Sin(math.Pi / 2 * s * s)
+	}
+
+	posts := len(vorbisFloorX)
+	e.lowNeighbor = make([]int, posts)
+	e.highNeighbor = make([]int, posts)
+	for i := 2; i < posts; i++ {
+		low, high := 0, 1
+		for j := 0; j < i; j++ {
+			x := vorbisFloorX[j]
+			if x < vorbisFloorX[i] && x > vorbisFloorX[low] {
+				low = j
+			}
+			if x > vorbisFloorX[i] && x < vorbisFloorX[high] {
+				high = j
+			}
+		}
+		e.lowNeighbor[i], e.highNeighbor[i] = low, high
+	}
+
+	e.sortedPosts = make([]int, posts)
+	for i := range e.sortedPosts {
+		e.sortedPosts[i] = i
+	}
+	sort.Slice(e.sortedPosts, func(i, j int) bool {
+		return vorbisFloorX[e.sortedPosts[i]] < vorbisFloorX[e.sortedPosts[j]]
+	})
+
+	// The table of the spec is exponential from 1.0649863e-07 to 1
+	for i := range e.floorTable {
+		e.floorTable[i] = math.Exp(math.Log(vorbisFloorMin) * float64(255-i) / 255)
+	}
+
+	return e, nil
+}
+
+const vorbisFloorMin = 1.0649863e-07
+
+// Encodes the samples(one slice per channel, [-1, 1]) as Ogg Vorbis stream.
+func (e *VorbisEncoder) Encode(samples [][]float64) ([]byte, error) {
+	if len(samples) != e.channels {
+		return nil, errors.Errorf("%v channels expected, got %v", e.channels, len(samples))
+	}
+	length := len(samples[0])
+	if length == 0 {
+		return nil, errors.New("no audio data")
+	}
+
+	var buf bytes.Buffer
+	ogg := oggWriter{w: &buf, serial: rand.Uint32()}
+
+	err := ogg.WritePackets([][]byte{e.identificationHeader()}, []int64{0}, oggBOS)
+	if err != nil {
+		return nil, err
+	}
+	// Audio has to start from a new page
+	err = ogg.WritePackets([][]byte{e.commentHeader(), e.setupHeader()}, []int64{0, 0}, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Block j covers samples [(j-1)*n/2, (j+1)*n/2), decoder returns the first half of block j after decoding it.
+	blocks := (length+vorbisSpectrum-1)/vorbisSpectrum + 1
+	frame := make([]float64, vorbisBlockSize)
+	spectra := make([][]float64, e.channels)
+	for i := range spectra {
+		spectra[i] = make([]float64, vorbisSpectrum)
+	}
+
+	// About 8 KB pages
+	const packetsPerPage = 16
+	var packets [][]byte
+	var granules []int64
+	for j := 0; j < blocks; j++ {
+		start := (j - 1) * vorbisSpectrum
+		for ch, s := range samples {
+			for i := range frame {
+				frame[i] = 0
+				if pos := start + i; pos >= 0 && pos < length {
+					frame[i] = s[pos] * e.window[i]
+				}
+			}
+			e.mdct.Forward(frame, spectra[ch])
+			for i := e.cutoff; i < vorbisSpectrum; i++ {
+				spectra[ch][i] = 0
+			}
+		}
+		packets = append(packets, e.audioPacket(spectra))
+		granules = append(granules, int64(minInt(j*vorbisSpectrum, length)))
+
+		last := j == blocks-1
+		if len(packets) == packetsPerPage || last {
+			var flags uint8
+			if last {
+				flags = oggEOS
+			}
+			err = ogg.WritePackets(packets, granules, flags)
+			if err != nil {
+				return nil, err
+			}
+			packets, granules = packets[:0], granules[:0]
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *VorbisEncoder) identificationHeader() []byte {
+	var w vorbisBitWriter
+	w.Write(vorbisIdentification, 8)
+	for _, c := range []byte("vorbis") {
+		w.Write(uint64(c), 8)
+	}
+	// Version
+	w.Write(0, 32)
+	w.Write(uint64(e.channels), 8)
+	w.Write(uint64(e.sampleRate), 32)
+	// Max, nominal and min bitrates are unset
+	w.Write(0, 32)
+	w.Write(0, 32)
+	w.Write(0, 32)
+	// Both block sizes are the same
+	w.Write(vorbisBlockBits, 4)
+	w.Write(vorbisBlockBits, 4)
+	// Framing
+	w.Write(1, 1)
+	return w.Bytes()
+}
+
+func (e *VorbisEncoder) commentHeader() []byte {
+	var w vorbisBitWriter
+	w.Write(vorbisComment, 8)
+	for _, c := range []byte("vorbis") {
+		w.Write(uint64(c), 8)
+	}
+	w.Write(uint64(len(vorbisVendor)), 32)
+	for _, c := range []byte(vorbisVendor) {
+		w.Write(uint64(c), 8)
+	}
+	// No user comments
+	w.Write(0, 32)
+	w.Write(1, 1)
+	return w.Bytes()
+}
+
+func (e *VorbisEncoder) setupHeader() []byte {
+	var w vorbisBitWriter
+	w.Write(vorbisSetup, 8)
+	for _, c := range []byte("vorbis") {
+		w.Write(uint64(c), 8)
+	}
+
+	w.Write(uint64(len(e.books)-1), 8)
+	for _, b := range e.books {
+		b.WriteHeader(&w)
+	}
+
+	// Time domain transforms are placeholders
+	w.Write(0, 6)
+	w.Write(0, 16)
+
+	// Floor 1
+	w.Write(0, 6)
+	w.Write(1, 16)
+	partitions := (len(vorbisFloorX) - 2) / vorbisFloorClassDim
+	w.Write(uint64(partitions), 5)
+	for i := 0; i < partitions; i++ {
+		w.Write(0, 4)
+	}
+	// Single class without subclasses
+	w.Write(vorbisFloorClassDim-1, 3)
+	w.Write(0, 2)
+	w.Write(vorbisFloorBook+1, 8)
+	w.Write(vorbisFloorMultiplier-1, 2)
+	w.Write(vorbisFloorRangeBits, 4)
+	for _, x := range vorbisFloorX[2:] {
+		w.Write(uint64(x), vorbisFloorRangeBits)
+	}
+
+	// Residue 1
+	w.Write(0, 6)
+	w.Write(1, 16)
+	w.Write(0, 24)
+	w.Write(vorbisSpectrum, 24)
+	w.Write(vorbisPartitionSize-1, 24)
+	w.Write(vorbisClasses-1, 6)
+	w.Write(vorbisClassBook, 8)
+	for _, books := range vorbisResidueBooks {
+		cascade := 0
+		for pass, b := range books {
+			if b >= 0 {
+				cascade |= 1 << uint(pass)
+			}
+		}
+		w.Write(uint64(cascade), 3)
+		w.Write(0, 1)
+	}
+	for _, books := range vorbisResidueBooks {
+		for _, b := range books {
+			if b >= 0 {
+				w.Write(uint64(b), 8)
+			}
+		}
+	}
+
+	// Mapping 0 is plain, mapping 1 couples stereo channels. Both use the only floor and residue.
+	modes := e.modes()
+	w.Write(uint64(modes-1), 6)
+	for i := 0; i < modes; i++ {
+		w.Write(0, 16)
+		// Single submap
+		w.Write(0, 1)
+		if i == 1 {
+			// Single coupling step: magnitude 0, angle 1
+			w.Write(1, 1)
+			w.Write(0, 8)
+			w.Write(0, 1)
+			w.Write(1, 1)
+		} else {
+			w.Write(0, 1)
+		}
+		w.Write(0, 2)
+		w.Write(0, 8)
+		w.Write(0, 8)
+		w.Write(0, 8)
+	}
+
+	// Mode i uses mapping i
+	w.Write(uint64(modes-1), 6)
+	for i := 0; i < modes; i++ {
+		w.Write(0, 1)
+		w.Write(0, 16)
+		w.Write(0, 16)
+		w.Write(uint64(i), 8)
+	}
+
+	w.Write(1, 1)
+	return w.Bytes()
+}
+
+// Stereo is coupled only if it makes the packet smaller.
+func (e *VorbisEncoder) audioPacket(spectra [][]float64) []byte {
+	ret := e.encodePacket(spectra, false)
+	if e.modes() > 1 {
+		if coupled := e.encodePacket(spectra, true); len(coupled) < len(ret) {
+			ret = coupled
+		}
+	}
+	return ret
+}
+
+func (e *VorbisEncoder) modes() int {
+	if e.channels == 2 {
+		return 2
+	}
+	return 1
+}
+
+func (e *VorbisEncoder) encodePacket(spectra [][]float64, coupled bool) []byte {
+	var w vorbisBitWriter
+	// Audio packet
+	w.Write(0, 1)
+	mode := 0
+	if coupled {
+		mode = 1
+	}
+	w.Write(uint64(mode), uint(ilog(uint32(e.modes()-1))))
+
+	// Coupled channels share the floor, so their residues are comparable
+	groups := make([][][]float64, len(spectra))
+	for ch, spectrum := range spectra {
+		groups[ch] = [][]float64{spectrum}
+		if coupled {
+			groups[ch] = spectra
+		}
+	}
+
+	residues := make([][]int, len(spectra))
+	var coded []int
+	for ch, spectrum := range spectra {
+		desired := e.floorY(groups[ch])
+		if desired == nil {
+			w.Write(0, 1)
+			continue
+		}
+		floor := e.writeFloor(&w, desired)
+
+		residue := make([]int, vorbisSpectrum)
+		for i, v := range spectrum {
+			residue[i] = clampInt(int(math.Round(v/floor[i])), -vorbisMaxResidue/2, vorbisMaxResidue/2)
+		}
+		residues[ch] = residue
+		coded = append(coded, ch)
+	}
+
+	if coupled && len(coded) == 2 {
+		for i, l := range residues[0] {
+			residues[0][i], residues[1][i] = coupleResidue(l, residues[1][i])
+		}
+	}
+
+	e.writeResidue(&w, residues, coded)
+	return w.Bytes()
+}
+
+// Converts left and right values into magnitude and angle, the inverse of the decoder's square polar mapping.
+func coupleResidue(l, r int) (magnitude, angle int) {
+	switch {
+	case l > 0 && r < l:
+		return l, l - r
+	case r > 0 && l <= r:
+		return r, l - r
+	case r > l:
+		return l, r - l
+	default:
+		return r, r - l
+	}
+}
+
+// Computes floor posts for the spectra(the floor is shared by all of them), nil for silence.
+// Quantization step of each post follows the energy around it, with simple masking by the louder neighbours.
+func (e *VorbisEncoder) floorY(spectra [][]float64) []int {
+	// Quieter bands are below 16-bit noise
+	minStep := 2e-5 * e.stepRatio
+	// Masking spread per post
+	const spread = 0.18
+
+	posts := len(vorbisFloorX)
+	levels := make([]float64, posts)
+	for n, i := range e.sortedPosts {
+		from, to := 0, vorbisSpectrum
+		if n > 0 {
+			from = (vorbisFloorX[e.sortedPosts[n-1]] + vorbisFloorX[i]) / 2
+		}
+		if n+1 < posts {
+			to = minInt((vorbisFloorX[i]+vorbisFloorX[e.sortedPosts[n+1]]+1)/2, vorbisSpectrum)
+		}
+
+		energy := 0.0
+		for _, spectrum := range spectra {
+			for _, v := range spectrum[from:to] {
+				energy += v * v
+			}
+		}
+		levels[n] = math.Sqrt(energy / float64(maxInt(to-from, 1)*len(spectra)))
+	}
+
+	// Bands much quieter than the loudest one are masked as well, the range grows with the quality
+	loudest := 0.0
+	for _, l := range levels {
+		loudest = math.Max(loudest, l)
+	}
+	masked := loudest * e.maskRange
+
+	desired := make([]int, posts)
+	silent := true
+	for n, i := range e.sortedPosts {
+		level := math.Max(levels[n], masked)
+		for k, l := range levels {
+			d := n - k
+			if d < 0 {
+				d = -d
+			}
+			level = math.Max(level, l*math.Pow(spread, float64(d)))
+		}
+
+		step := level * e.stepRatio
+		if step >= minStep {
+			silent = false
+		}
+		step = math.Max(step, minStep)
+
+		y := int(math.Round(math.Log(step/vorbisFloorMin) / -math.Log(vorbisFloorMin) * 255 / vorbisFloorMultiplier))
+		desired[i] = clampInt(y, 0, vorbisFloorRange-1)
+	}
+
+	if silent {
+		return nil
+	}
+	return desired
+}
+
+// Writes the floor and returns the rendered curve.
+func (e *VorbisEncoder) writeFloor(w *vorbisBitWriter, desired []int) []float64 {
+	posts := len(vorbisFloorX)
+	w.Write(1, 1)
+
+	final := make([]int, posts)
+	used := make([]bool, posts)
+	final[0], final[1] = desired[0], desired[1]
+	used[0], used[1] = true, true
+	rangeBits := uint(ilog(vorbisFloorRange - 1))
+	w.Write(uint64(final[0]), rangeBits)
+	w.Write(uint64(final[1]), rangeBits)
+
+	for i := 2; i < posts; i++ {
+		low, high := e.lowNeighbor[i], e.highNeighbor[i]
+		predicted := renderPoint(vorbisFloorX[low], final[low], vorbisFloorX[high], final[high], vorbisFloorX[i])
+
+		// Small errors are cheaper to fix by the residue
+		val := 0
+		if diff := desired[i] - predicted; diff > 1 || diff < -1 {
+			val = floorValue(desired[i], predicted)
+		}
+		e.books[vorbisFloorBook].WriteEntry(w, val)
+
+		final[i] = predicted
+		if val != 0 {
+			used[low], used[high], used[i] = true, true, true
+			final[i] = floorFinalY(val, predicted)
+		}
+	}
+
+	// Rendering follows the spec exactly, so the encoder divides the spectrum by the same curve the decoder uses
+	curve := make([]int, vorbisSpectrum+1)
+	lx, ly := 0, final[0]*vorbisFloorMultiplier
+	for _, i := range e.sortedPosts[1:] {
+		if !used[i] {
+			continue
+		}
+		hx, hy := vorbisFloorX[i], final[i]*vorbisFloorMultiplier
+		renderLine(lx, ly, hx, hy, curve)
+		lx, ly = hx, hy
+	}
+	if lx < vorbisSpectrum {
+		renderLine(lx, ly, vorbisSpectrum, ly, curve)
+	}
+
+	ret := make([]float64, vorbisSpectrum)
+	for i := range ret {
+		ret[i] = e.floorTable[curve[i]]
+	}
+	return ret
+}
+
+// Encodes the floor value relative to the predicted one, the inverse of the decoder's step 2.
+func floorValue(y, predicted int) int {
+	highRoom, lowRoom := vorbisFloorRange-predicted, predicted
+	room := minInt(highRoom, lowRoom) * 2
+
+	diff := y - predicted
+	val := 2 * diff
+	if diff < 0 {
+		val = -2*diff - 1
+	}
+	if val < room {
+		return val
+	}
+	if highRoom > lowRoom {
+		return y - predicted + lowRoom
+	}
+	return predicted - y + highRoom - 1
+}
+
+func floorFinalY(val, predicted int) int {
+	highRoom, lowRoom := vorbisFloorRange-predicted, predicted
+	room := minInt(highRoom, lowRoom) * 2
+
+	switch {
+	case val >= room && highRoom > lowRoom:
+		return val - lowRoom + predicted
+	case val >= room:
+		return predicted - val + highRoom - 1
+	case val%2 == 1:
+		return predicted - (val+1)/2
+	default:
+		return predicted + val/2
+	}
+}
+
+func renderPoint(x0, y0, x1, y1, x int) int {
+	dy := y1 - y0
+	adx := x1 - x0
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+	off := ady * (x - x0) / adx
+	if dy < 0 {
+		return y0 - off
+	}
+	return y0 + off
+}
+
+func renderLine(x0, y0, x1, y1 int, v []int) {
+	dy := y1 - y0
+	adx := x1 - x0
+	ady := dy
+	if ady < 0 {
+		ady = -ady
+	}
+	base := dy / adx
+	sy := base + 1
+	if dy < 0 {
+		sy = base - 1
+	}
+	absBase := base
+	if absBase < 0 {
+		absBase = -absBase
+	}
+	ady -= absBase * adx
+
+	y, err := y0, 0
+	v[x0] = y
+	for x := x0 + 1; x < x1; x++ {
+		err += ady
+		if err >= adx {
+			err -= adx
+			y += sy
+		} else {
+			y += base
+		}
+		v[x] = y
+	}
+}
+
+func (e *VorbisEncoder) writeResidue(w *vorbisBitWriter, residues [][]int, coded []int) {
+	partitions := vorbisSpectrum / vorbisPartitionSize
+	classes := make([][]int, len(residues))
+	for _, ch := range coded {
+		classes[ch] = make([]int, partitions)
+		for p := range classes[ch] {
+			max := 0
+			for _, v := range residues[ch][p*vorbisPartitionSize : (p+1)*vorbisPartitionSize] {
+				if v < 0 {
+					v = -v
+				}
+				if v > max {
+					max = v
+				}
+			}
+			for max > vorbisClassMax[classes[ch][p]] {
+				classes[ch][p]++
+			}
+		}
+	}
+
+	vec := make([]int, vorbisPartitionSize)
+	for pass := 0; pass < len(vorbisResidueBooks[0]); pass++ {
+		for p := 0; p < partitions; {
+			if pass == 0 {
+				for _, ch := range coded {
+					entry := 0
+					for i := 0; i < vorbisClassDim; i++ {
+						entry = entry*vorbisClasses + classes[ch][p+i]
+					}
+					e.books[vorbisClassBook].WriteEntry(w, entry)
+				}
+			}
+
+			for i := 0; i < vorbisClassDim && p < partitions; i, p = i+1, p+1 {
+				for _, ch := range coded {
+					class := classes[ch][p]
+					book := vorbisResidueBooks[class][pass]
+					if book < 0 {
+						continue
+					}
+
+					for j, v := range residues[ch][p*vorbisPartitionSize : (p+1)*vorbisPartitionSize] {
+						vec[j] = residuePass(v, class, pass)
+					}
+					b := e.books[book]
+					for j := 0; j < vorbisPartitionSize; j += b.dimensions {
+						b.WriteVector(w, vec[j:j+b.dimensions])
+					}
+				}
+			}
+		}
+	}
+}
+
+// Part of the value coded by the pass, the last class splits values into 1089, 33 and 1 multiples.
+func residuePass(v, class, pass int) int {
+	if class < vorbisClasses-1 {
+		return v
+	}
+
+	coarse := clampInt(int(math.Round(float64(v)/1089)), -15, 15) * 1089
+	if pass == 0 {
+		return coarse
+	}
+	v -= coarse
+	mid := clampInt(int(math.Round(float64(v)/33)), -15, 15) * 33
+	if pass == 1 {
+		return mid
+	}
+	return v - mid
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// MDCT as defined by Vorbis, computed through FFT of n/4 size.
+type mdct struct {
+	n       int
+	twiddle []complex128
+	fft     *fft
+}
+
+func newMDCT(n int) *mdct {
+	m := n / 2
+	ret := &mdct{n: n, twiddle: make([]complex128, m/2), fft: newFFT(m / 2)}
+	for i := range ret.twiddle {
+		ret.twiddle[i] = cmplx.Exp(complex(0, -math.Pi*(float64(i)+0.25)/float64(m)))
+	}
+	return ret
+}
+
+// Computes n/2 coefficients of n windowed samples, the scale matches the inverse transform of decoders.
+func (t *mdct) Forward(in, out []float64) {
+	m := t.n / 2
+	h := m / 2
+
+	// Time domain aliasing reduces the transform to DCT-IV of (-c_r-d, a-b_r) for the input quarters (a, b, c, d)
+	u := make([]float64, m)
+	for i := 0; i < h; i++ {
+		u[i] = -in[3*h-1-i] - in[3*h+i]
+		u[h+i] = in[i] - in[m-1-i]
+	}
+
+	// DCT-IV through complex FFT of the half size
+	z := make([]complex128, h)
+	for i := range z {
+		z[i] = complex(u[2*i], u[m-1-2*i]) * t.twiddle[i]
+	}
+	t.fft.Transform(z)
+	scale := 2 / float64(m)
+	for k, c := range z {
+		c *= cmplx.Exp(complex(0, -math.Pi*float64(k)/float64(m)))
+		out[2*k] = real(c) * scale
+		out[m-1-2*k] = -imag(c) * scale
+	}
+}
+
+// Radix-2 forward FFT of power of two size.
+type fft struct {
+	n       int
+	twiddle []complex128
+	reverse []int
+}
+
+func newFFT(n int) *fft {
+	ret := &fft{n: n, twiddle: make([]complex128, n/2), reverse: make([]int, n)}
+	for i := range ret.twiddle {
+		ret.twiddle[i] = cmplx.Exp(complex(0, -2*math.Pi*float64(i)/float64(n)))
+	}
+	bits := ilog(uint32(n - 1))
+	for i := range ret.reverse {
+		r := 0
+		for b := 0; b < bits; b++ {
+			r |= (i >> uint(b) & 1) << uint(bits-1-b)
+		}
+		ret.reverse[i] = r
+	}
+	return ret
+}
+
+func (f *fft) Transform(data []complex128) {
+	for i, r := range f.reverse {
+		if i < r {
+			data[i], data[r] = data[r], data[i]
+		}
+	}
+	for size := 2; size <= f.n; size *= 2 {
+		half, step := size/2, f.n/size
+		for start := 0; start < f.n; start += size {
+			for i := 0; i < half; i++ {
+				t := f.twiddle[i*step] * data[start+i+half]
+				data[start+i+half] = data[start+i] - t
+				data[start+i] += t
+			}
+		}
+	}
+}
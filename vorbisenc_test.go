@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"github.com/jfreymuth/oggvorbis"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Chord with a slow envelope, the second channel is shifted in phase and level.
+func testSignal(channels, rate, length int) [][]float64 {
+	ret := make([][]float64, channels)
+	for ch := range ret {
+		ret[ch] = make([]float64, length)
+		for i := range ret[ch] {
+			t := float64(i) / float64(rate)
+			env := 0.6 + 0.4*math.Sin(2*math.Pi*0.7*t)
+			phase := float64(ch)
+			ret[ch][i] = env / float64(ch+2) * (math.Sin(2*math.Pi*220*t+phase) +
+				0.5*math.Sin(2*math.Pi*440*t+phase) + 0.25*math.Sin(2*math.Pi*1320*t))
+		}
+	}
+	return ret
+}
+
+func TestMDCT(t *testing.T) {
+	for _, n := range []int{64, 256, vorbisBlockSize} {
+		in := make([]float64, n)
+		for i := range in {
+			in[i] = rand.Float64()*2 - 1
+		}
+		out := make([]float64, n/2)
+		newMDCT(n).Forward(in, out)
+
+		// Direct definition, scaled by 4/n like the forward transform
+		m := float64(n / 2)
+		for k := range out {
+			sum := 0.0
+			for i, x := range in {
+				sum += x * math.Cos(math.Pi/m*(float64(i)+0.5+m/2)*(float64(k)+0.5))
+			}
+			sum *= 2 / m
+			if math.Abs(sum-out[k]) > 1e-9 {
+				t.Fatalf("n %v, coefficient %v: %v, expected %v", n, k, out[k], sum)
+			}
+		}
+	}
+}
+
+// Encoded streams are decoded back by an independent decoder.
+func TestVorbisEncode(t *testing.T) {
+	cases := []struct {
+		name     string
+		channels int
+		rate     int
+		quality  int
+		length   int
+		// Signal to noise ratio of the decoded samples, dB
+		minSNR float64
+	}{
+		{"mono q0", 1, 22050, 0, 22050, 8},
+		{"stereo q5", 2, 44100, 5, 44100*2 + 123, 18},
+		{"stereo q10", 2, 48000, 10, 48000, 30},
+		{"block multiple", 2, 44100, 3, vorbisSpectrum * 40, 14},
+		{"shorter than block", 1, 44100, 5, 100, 20},
+		{"multichannel", 3, 32000, 4, 32000, 16},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			in := testSignal(c.channels, c.rate, c.length)
+			enc, err := NewVorbisEncoder(c.channels, c.rate, c.quality)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := enc.Encode(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := ParseOgg(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(info.Warnings) > 0 || info.Channels != c.channels || info.SampleRate != c.rate || info.Samples != uint64(c.length) {
+				t.Errorf("unexpected stream info %+v", info)
+			}
+
+			pages := readOggTestPages(t, data)
+			if pages[0].flags != oggBOS || pages[0].ends != 1 || pages[len(pages)-1].flags&oggEOS == 0 {
+				t.Errorf("unexpected stream pages %+v", pages)
+			}
+			var granule int64
+			for i, p := range pages[2:] {
+				if p.granule < granule {
+					t.Errorf("page %v: granule %v after %v", i+2, p.granule, granule)
+				}
+				granule = p.granule
+			}
+
+			out, format, err := oggvorbis.ReadAll(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format.Channels != c.channels || format.SampleRate != c.rate {
+				t.Fatalf("decoded as %+v", format)
+			}
+			if len(out) != c.length*c.channels {
+				t.Fatalf("%v samples decoded, %v expected", len(out)/c.channels, c.length)
+			}
+
+			var signal, noise float64
+			for i := 0; i < c.length; i++ {
+				for ch := range in {
+					d := float64(out[i*c.channels+ch]) - in[ch][i]
+					signal += in[ch][i] * in[ch][i]
+					noise += d * d
+				}
+			}
+			if snr := 10 * math.Log10(signal/noise); snr < c.minSNR {
+				t.Errorf("SNR %.1f dB, %v expected at least", snr, c.minSNR)
+			}
+		})
+	}
+}
+
+func TestVorbisEncoderErrors(t *testing.T) {
+	for _, c := range []struct {
+		channels, rate, quality int
+	}{
+		{0, 44100, 5},
+		{256, 44100, 5},
+		{2, 0, 5},
+		{2, 44100, -1},
+		{2, 44100, vorbisMaxQuality + 1},
+	} {
+		_, err := NewVorbisEncoder(c.channels, c.rate, c.quality)
+		if err == nil {
+			t.Errorf("%+v: error expected", c)
+		}
+	}
+
+	enc, err := NewVorbisEncoder(2, 44100, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, samples := range map[string][][]float64{
+		"no samples":     {{}, {}},
+		"wrong channels": {make([]float64, 100)},
+	} {
+		_, err := enc.Encode(samples)
+		if err == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+}
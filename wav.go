@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"math"
+)
+
+// Uncompressed PCM audio as stored in RIFF WAVE files.
+type PCMAudio struct {
+	Channels      int
+	SampleRate    int
+	BitsPerSample int
+	// Interleaved samples, little endian
+	Data []byte
+}
+
+const wavFormatPCM = 1
+
+// Number of sample frames(samples per channel).
+func (a PCMAudio) Frames() int {
+	frameSize := a.Channels * a.BitsPerSample / 8
+	if frameSize == 0 {
+		return 0
+	}
+	return len(a.Data) / frameSize
+}
+
+func ParseWAV(data []byte) (PCMAudio, error) {
+	var ret PCMAudio
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return ret, errors.New("not a RIFF WAVE file")
+	}
+
+	gotFormat := false
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		pos += 8
+		if pos+size > len(data) {
+			// Some writers don't update data size of the streamed files
+			if id != "data" {
+				return ret, errors.Errorf("chunk %q out of range", id)
+			}
+			size = len(data) - pos
+		}
+		chunk := data[pos : pos+size]
+		// Chunks are padded to even size
+		pos += size + size%2
+
+		switch id {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return ret, errors.New("invalid fmt chunk")
+			}
+			format := binary.LittleEndian.Uint16(chunk)
+			// WAVE_FORMAT_EXTENSIBLE keeps the actual format in the sub format GUID
+			if format == 0xfffe && len(chunk) >= 26 {
+				format = binary.LittleEndian.Uint16(chunk[24:])
+			}
+			if format != wavFormatPCM {
+				return ret, errors.Errorf("unsupported wav format %#x, only PCM is supported", format)
+			}
+			ret.Channels = int(binary.LittleEndian.Uint16(chunk[2:]))
+			ret.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:]))
+			ret.BitsPerSample = int(binary.LittleEndian.Uint16(chunk[14:]))
+			gotFormat = true
+
+		case "data":
+			ret.Data = chunk
+		}
+	}
+
+	if !gotFormat {
+		return ret, errors.New("fmt chunk is missing")
+	}
+	if ret.Data == nil {
+		return ret, errors.New("data chunk is missing")
+	}
+	return ret, nil
+}
+
+func (a PCMAudio) WAV() []byte {
+	var buf bytes.Buffer
+	blockAlign := a.Channels * a.BitsPerSample / 8
+
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(a.Data)+len(a.Data)%2))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, struct {
+		Size          uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+	}{
+		16, wavFormatPCM, uint16(a.Channels), uint32(a.SampleRate),
+		uint32(a.SampleRate * blockAlign), uint16(blockAlign), uint16(a.BitsPerSample),
+	})
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(a.Data)))
+	buf.Write(a.Data)
+	if len(a.Data)%2 != 0 {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
+
+// Deinterleaved samples in [-1, 1) range.
+func (a PCMAudio) Samples() ([][]float64, error) {
+	switch a.BitsPerSample {
+	case 8, 16, 24, 32:
+	default:
+		return nil, errors.Errorf("unsupported sample size %v bits", a.BitsPerSample)
+	}
+	if a.Channels == 0 {
+		return nil, errors.New("zero channels count")
+	}
+
+	size := a.BitsPerSample / 8
+	frames := a.Frames()
+	scale := 1 / math.Exp2(float64(a.BitsPerSample-1))
+	ret := make([][]float64, a.Channels)
+	for ch := range ret {
+		ret[ch] = make([]float64, frames)
+	}
+
+	for i := 0; i < frames; i++ {
+		for ch := range ret {
+			b := a.Data[(i*a.Channels+ch)*size:]
+			var v int32
+			switch size {
+			case 1:
+				// 8-bit PCM is unsigned
+				v = int32(b[0]) - 128
+			case 2:
+				v = int32(int16(binary.LittleEndian.Uint16(b)))
+			case 3:
+				v = int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			case 4:
+				v = int32(binary.LittleEndian.Uint32(b))
+			}
+			ret[ch][i] = float64(v) * scale
+		}
+	}
+	return ret, nil
+}
+
+// Builds 16-bit PCM from deinterleaved samples, out of range values are clipped.
+func NewPCMAudio16(samples [][]float64, sampleRate int) PCMAudio {
+	ret := PCMAudio{
+		Channels:      len(samples),
+		SampleRate:    sampleRate,
+		BitsPerSample: 16,
+	}
+	if len(samples) == 0 {
+		return ret
+	}
+
+	frames := len(samples[0])
+	ret.Data = make([]byte, frames*len(samples)*2)
+	for i := 0; i < frames; i++ {
+		for ch, s := range samples {
+			v := math.Max(-32768, math.Min(32767, math.Floor(s[i]*32768+0.5)))
+			binary.LittleEndian.PutUint16(ret.Data[(i*len(samples)+ch)*2:], uint16(int16(v)))
+		}
+	}
+	return ret
+}
+
+// Number of sinc zero crossings on each side of the resampling kernel.
+const resampleZeroCrossings = 16
+
+// Kernel table resolution, steps per zero crossing.
+const resampleTableSteps = 512
+
+// Blackman windowed sinc, indexed by distance in zero crossings.
+var resampleTable = func() []float64 {
+	table := make([]float64, resampleZeroCrossings*resampleTableSteps+2)
+	for i := range table {
+		x := float64(i) / resampleTableSteps
+		if x >= resampleZeroCrossings {
+			continue
+		}
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		w := 0.5 + 0.5*x/resampleZeroCrossings
+		table[i] = sinc * (0.42 - 0.5*math.Cos(2*math.Pi*w) + 0.08*math.Cos(4*math.Pi*w))
+	}
+	return table
+}()
+
+// Band limited resampling of a single channel.
+func Resample(samples []float64, from, to int) []float64 {
+	if from == to || from <= 0 || to <= 0 {
+		return samples
+	}
+
+	ratio := float64(to) / float64(from)
+	// Cut a bit below Nyquist frequency of the lower rate to leave room for the transition band
+	cutoff := math.Min(1, ratio) * 0.95
+	half := resampleZeroCrossings / cutoff
+
+	ret := make([]float64, int(math.Floor(float64(len(samples))*ratio+0.5)))
+	for i := range ret {
+		t := float64(i) / ratio
+		start := int(math.Ceil(t - half))
+		end := int(math.Floor(t + half))
+
+		var sum, weights float64
+		for j := start; j <= end; j++ {
+			pos := math.Abs(t-float64(j)) * cutoff * resampleTableSteps
+			k := int(pos)
+			frac := pos - float64(k)
+			w := resampleTable[k]*(1-frac) + resampleTable[k+1]*frac
+			weights += w
+			if j >= 0 && j < len(samples) {
+				sum += samples[j] * w
+			}
+		}
+		if weights != 0 {
+			ret[i] = sum / weights
+		}
+	}
+	return ret
+}
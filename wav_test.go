@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// RIFF WAVE file with the given chunks after the header.
+func wavFile(chunks ...[]byte) []byte {
+	var body bytes.Buffer
+	for _, c := range chunks {
+		body.Write(c)
+	}
+	return packed(le, []byte("RIFF"), uint32(4+body.Len()), []byte("WAVE"), body.Bytes())
+}
+
+func wavChunk(id string, data []byte) []byte {
+	ret := packed(le, []byte(id), uint32(len(data)), data)
+	if len(data)%2 != 0 {
+		ret = append(ret, 0)
+	}
+	return ret
+}
+
+func wavFormat(format uint16, channels, rate, bits int) []byte {
+	align := channels * bits / 8
+	return wavChunk("fmt ", packed(le, format, uint16(channels), uint32(rate), uint32(rate*align), uint16(align), uint16(bits)))
+}
+
+func TestParseWAV(t *testing.T) {
+	extensible := packed(le, uint16(0xfffe), uint16(1), uint32(8000), uint32(16000), uint16(2), uint16(16),
+		uint16(22), uint16(16), uint32(3), uint16(wavFormatPCM), []byte("\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"))
+
+	cases := []struct {
+		name    string
+		data    []byte
+		audio   PCMAudio
+		samples [][]float64
+	}{
+		{
+			name:    "16 bits stereo",
+			data:    wavFile(wavFormat(1, 2, 44100, 16), wavChunk("data", packed(le, int16(16384), int16(-32768), int16(0), int16(8192)))),
+			audio:   PCMAudio{2, 44100, 16, packed(le, int16(16384), int16(-32768), int16(0), int16(8192))},
+			samples: [][]float64{{0.5, 0}, {-1, 0.25}},
+		},
+		{
+			name:    "8 bits with odd size and unknown chunks",
+			data:    wavFile(wavChunk("LIST", []byte("abc")), wavFormat(1, 1, 8000, 8), wavChunk("data", []byte{128, 192, 0}), wavChunk("cue ", nil)),
+			audio:   PCMAudio{1, 8000, 8, []byte{128, 192, 0}},
+			samples: [][]float64{{0, 0.5, -1}},
+		},
+		{
+			name:    "24 bits",
+			data:    wavFile(wavFormat(1, 1, 48000, 24), wavChunk("data", []byte{0, 0, 0x40, 0, 0, 0xe0})),
+			audio:   PCMAudio{1, 48000, 24, []byte{0, 0, 0x40, 0, 0, 0xe0}},
+			samples: [][]float64{{0.5, -0.25}},
+		},
+		{
+			name:    "32 bits",
+			data:    wavFile(wavFormat(1, 1, 96000, 32), wavChunk("data", packed(le, int32(-1<<30)))),
+			audio:   PCMAudio{1, 96000, 32, packed(le, int32(-1<<30))},
+			samples: [][]float64{{-0.5}},
+		},
+		{
+			name:    "extensible",
+			data:    wavFile(wavChunk("fmt ", extensible), wavChunk("data", packed(le, int16(-16384)))),
+			audio:   PCMAudio{1, 8000, 16, packed(le, int16(-16384))},
+			samples: [][]float64{{-0.5}},
+		},
+		{
+			// Size of the streamed data is not known in advance
+			name:    "unfinished data size",
+			data:    wavFile(wavFormat(1, 1, 8000, 16), packed(le, []byte("data"), uint32(0xffffffff), int16(16384))),
+			audio:   PCMAudio{1, 8000, 16, packed(le, int16(16384))},
+			samples: [][]float64{{0.5}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			audio, err := ParseWAV(c.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audio.Channels != c.audio.Channels || audio.SampleRate != c.audio.SampleRate ||
+				audio.BitsPerSample != c.audio.BitsPerSample || !bytes.Equal(audio.Data, c.audio.Data) {
+				t.Fatalf("parsed %+v\nexpected %+v", audio, c.audio)
+			}
+
+			samples, err := audio.Samples()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(samples) != len(c.samples) {
+				t.Fatalf("%v channels, %v expected", len(samples), len(c.samples))
+			}
+			for ch := range samples {
+				if len(samples[ch]) != len(c.samples[ch]) {
+					t.Fatalf("channel %v: %v samples, %v expected", ch, len(samples[ch]), len(c.samples[ch]))
+				}
+				for i, s := range samples[ch] {
+					if s != c.samples[ch][i] {
+						t.Errorf("channel %v: sample %v is %v, %v expected", ch, i, s, c.samples[ch][i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseWAVErrors(t *testing.T) {
+	data := wavChunk("data", []byte{0, 0})
+	cases := map[string][]byte{
+		"not wav":          []byte("fLaC"),
+		"not pcm":          wavFile(wavFormat(3, 1, 8000, 32), data),
+		"short fmt":        wavFile(wavChunk("fmt ", []byte{1, 0}), data),
+		"missing fmt":      wavFile(data),
+		"missing data":     wavFile(wavFormat(1, 1, 8000, 16)),
+		"chunk past end":   wavFile(wavFormat(1, 1, 8000, 16), packed(le, []byte("LIST"), uint32(100), []byte("ab")), data),
+		"fmt past the end": wavFile(packed(le, []byte("fmt "), uint32(100))),
+	}
+	for name, data := range cases {
+		_, err := ParseWAV(data)
+		if err == nil {
+			t.Errorf("%v: error expected", name)
+		}
+	}
+}
+
+// 16-bit PCM keeps the samples within the quantization step through WAV files.
+func TestWAVRoundTrip(t *testing.T) {
+	samples := [][]float64{make([]float64, 1000), make([]float64, 1000)}
+	for i := range samples[0] {
+		samples[0][i] = math.Sin(float64(i) * 0.01)
+		samples[1][i] = 1.5 * math.Cos(float64(i)*0.02)
+	}
+
+	audio, err := ParseWAV(NewPCMAudio16(samples, 22050).WAV())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.Channels != 2 || audio.SampleRate != 22050 || audio.BitsPerSample != 16 || audio.Frames() != 1000 {
+		t.Fatalf("unexpected audio %v channels, %v Hz, %v bits, %v frames", audio.Channels, audio.SampleRate, audio.BitsPerSample, audio.Frames())
+	}
+	decoded, err := audio.Samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ch := range samples {
+		for i, s := range samples[ch] {
+			// Out of range values are clipped
+			s = math.Max(-1, math.Min(32767.0/32768, s))
+			if math.Abs(decoded[ch][i]-s) > 0.5/32768 {
+				t.Fatalf("channel %v: sample %v is %v, %v expected", ch, i, decoded[ch][i], s)
+			}
+		}
+	}
+
+	if binary.LittleEndian.Uint32(NewPCMAudio16([][]float64{{0, 0, 0}}, 8000).WAV()[4:]) != 36+6 {
+		t.Error("invalid RIFF size")
+	}
+}
+
+func TestResample(t *testing.T) {
+	cases := []struct {
+		from, to int
+		// Frequency of the tone, Hz
+		freq float64
+		// Expected amplitude of the resampled tone
+		amp float64
+	}{
+		{48000, 44100, 1000, 0.5},
+		{22050, 44100, 3000, 0.5},
+		{44100, 32000, 2000, 0.5},
+		// Above Nyquist frequency of the target rate, must be filtered out
+		{44100, 22050, 15000, 0},
+	}
+	for _, c := range cases {
+		in := make([]float64, c.from)
+		for i := range in {
+			in[i] = 0.5 * math.Sin(2*math.Pi*c.freq*float64(i)/float64(c.from))
+		}
+		out := Resample(in, c.from, c.to)
+		if len(out) != c.to {
+			t.Errorf("%v -> %v: %v samples, %v expected", c.from, c.to, len(out), c.to)
+			continue
+		}
+
+		// Edges are skipped, the signal is cut there
+		var maxErr float64
+		for i := 100; i < len(out)-100; i++ {
+			expected := 0.0
+			if c.amp > 0 {
+				expected = c.amp * math.Sin(2*math.Pi*c.freq*float64(i)/float64(c.to))
+			}
+			maxErr = math.Max(maxErr, math.Abs(out[i]-expected))
+		}
+		if maxErr > 0.01 {
+			t.Errorf("%v -> %v, %v Hz: max error %v", c.from, c.to, c.freq, maxErr)
+		}
+	}
+}